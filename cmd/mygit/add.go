@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Usage: mygit add [-f] [-A] [-v] [--] <pathspec>...
+func addCmd(args []string) error {
+	force, all, verbose := false, false, false
+	var paths []string
+	for i, arg := range args {
+		if arg == "--" {
+			paths = append(paths, args[i+1:]...)
+			break
+		}
+		switch arg {
+		case "-f", "--force":
+			force = true
+		case "-A", "--all":
+			all = true
+		case "-v", "--verbose":
+			verbose = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				return fmt.Errorf("unknown option: %s", arg)
+			}
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 {
+		if !all {
+			return errors.New("nothing specified, nothing added")
+		}
+		paths = []string{"."}
+	}
+	return Add(".", paths, force, verbose)
+}
+
+// Stage the files matching the pathspecs. Untracked ignored files are only
+// added with force, and tracked files that were deleted get removed.
+func Add(localDir string, pathspecs []string, force, verbose bool) error {
+	index, err := readIndex(localDir)
+	if err != nil {
+		return err
+	}
+	ignore := newIgnoreMatcher(localDir)
+
+	candidates := make(map[string]bool)
+	var ignoredPaths []string
+	for _, spec := range pathspecs {
+		prefix := filepath.ToSlash(filepath.Clean(spec))
+		if prefix == "." {
+			prefix = ""
+		}
+		matched := false
+		for _, entry := range index.Entries {
+			if pathMatchesPrefix(entry.Name, prefix) {
+				candidates[entry.Name], matched = true, true
+			}
+		}
+
+		info, err := os.Lstat(filepath.Join(localDir, filepath.FromSlash(prefix)))
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return err
+		case !info.IsDir():
+			if index.entry(prefix) == nil && !force && ignore.ignored(prefix, false) {
+				ignoredPaths = append(ignoredPaths, prefix)
+			} else {
+				candidates[prefix] = true
+			}
+			matched = true
+		default:
+			if prefix != "" && !force && index.entry(prefix) == nil && ignore.ignored(prefix, true) {
+				ignoredPaths = append(ignoredPaths, prefix)
+				matched = true
+				break
+			}
+			err := walkWorkTree(localDir, prefix, func(name string, isDir bool) (bool, error) {
+				if !force && ignore.ignored(name, isDir) {
+					return false, nil
+				}
+				if !isDir {
+					candidates[name], matched = true, true
+				}
+				return true, nil
+			})
+			if err != nil {
+				return err
+			}
+			matched = true
+		}
+		if !matched {
+			return fmt.Errorf("pathspec '%s' did not match any files", spec)
+		}
+	}
+
+	names := make([]string, 0, len(candidates))
+	for name := range candidates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		file, err := writeWorkBlob(localDir, name)
+		if os.IsNotExist(err) {
+			if index.entry(name) != nil {
+				index.set(name, nil)
+				if verbose {
+					fmt.Printf("remove '%s'\n", name)
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		current := index.entry(name)
+		entry, err := newIndexEntry(name, file)
+		if err != nil {
+			return err
+		}
+		entry.updateStat(localDir)
+		index.set(name, entry)
+		if verbose && (current == nil || current.File() != file) {
+			fmt.Printf("add '%s'\n", name)
+		}
+	}
+	if err := index.write(localDir); err != nil {
+		return err
+	}
+	if len(ignoredPaths) > 0 {
+		return fmt.Errorf("the following paths are ignored by one of your .gitignore files:\n%s\nUse -f if you really want to add them.",
+			strings.Join(ignoredPaths, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Attribute states besides plain string values.
+// ref: https://git-scm.com/docs/gitattributes
+const (
+	attrSet         = "\x00set"
+	attrUnset       = "\x00unset"
+	attrUnspecified = "\x00unspecified"
+)
+
+// Macros every repository knows about.
+var builtinAttrMacros = map[string]string{
+	"binary": "-diff -merge -text",
+}
+
+type attrAssignment struct {
+	Name  string
+	Value string
+}
+
+// One line of a .gitattributes file.
+type attrRule struct {
+	Pattern *pathPattern
+	Attrs   []attrAssignment
+}
+
+func parseAttrAssignments(fields []string) []attrAssignment {
+	attrs := make([]attrAssignment, 0, len(fields))
+	for _, field := range fields {
+		switch {
+		case strings.HasPrefix(field, "-"):
+			attrs = append(attrs, attrAssignment{field[1:], attrUnset})
+		case strings.HasPrefix(field, "!"):
+			attrs = append(attrs, attrAssignment{field[1:], attrUnspecified})
+		case strings.Contains(field, "="):
+			name, value, _ := strings.Cut(field, "=")
+			attrs = append(attrs, attrAssignment{name, value})
+		default:
+			attrs = append(attrs, attrAssignment{field, attrSet})
+		}
+	}
+	return attrs
+}
+
+// Resolves gitattributes for paths from core.attributesFile, every
+// .gitattributes on the way to a path and .git/info/attributes.
+type attrMatcher struct {
+	root   string
+	global []*attrRule
+	info   []*attrRule
+	perDir map[string][]*attrRule
+	macros map[string][]attrAssignment
+	order  map[string]int // attributes in the order they were first seen
+}
+
+// Matchers are cached per repository since conversions ask for attributes
+// file by file.
+var attrMatchers = make(map[string]*attrMatcher)
+
+func loadAttrMatcher(root string) *attrMatcher {
+	if m, ok := attrMatchers[root]; ok {
+		return m
+	}
+	m := &attrMatcher{
+		root:   root,
+		perDir: make(map[string][]*attrRule),
+		macros: make(map[string][]attrAssignment),
+		order:  make(map[string]int),
+	}
+	for name, definition := range builtinAttrMacros {
+		m.register(name)
+		m.macros[name] = m.parseAssignments(strings.Fields(definition))
+	}
+	globalFile, ok := configPath(root, "core.attributesFile")
+	if !ok {
+		if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+			globalFile = filepath.Join(xdg, "git", "attributes")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			globalFile = filepath.Join(home, ".config", "git", "attributes")
+		}
+	}
+	m.global = m.readRules(globalFile, "", true)
+	m.dirRules("")
+	m.info = m.readRules(filepath.Join(gitDir(root), "info", "attributes"), "", true)
+	attrMatchers[root] = m
+	return m
+}
+
+// Forget cached rules, e.g. after a .gitattributes file was rewritten.
+func invalidateAttrMatcher(root string) {
+	delete(attrMatchers, root)
+}
+
+func (m *attrMatcher) readRules(file, base string, allowMacros bool) []*attrRule {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	source := displayPath(m.root, file)
+	var rules []*attrRule
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "[attr]") {
+			if allowMacros {
+				name := strings.TrimPrefix(fields[0], "[attr]")
+				m.register(name)
+				m.macros[name] = m.parseAssignments(fields[1:])
+			}
+			continue
+		}
+		// Negative patterns are forbidden and directory patterns match
+		// nothing in attribute files.
+		if strings.HasPrefix(fields[0], "!") || strings.HasSuffix(fields[0], "/") {
+			continue
+		}
+		rules = append(rules, &attrRule{
+			Pattern: parsePathPattern(fields[0], base, source, i+1, false),
+			Attrs:   m.parseAssignments(fields[1:]),
+		})
+	}
+	return rules
+}
+
+func (m *attrMatcher) parseAssignments(fields []string) []attrAssignment {
+	attrs := parseAttrAssignments(fields)
+	for _, a := range attrs {
+		m.register(a.Name)
+	}
+	return attrs
+}
+
+func (m *attrMatcher) register(name string) {
+	if _, ok := m.order[name]; !ok {
+		m.order[name] = len(m.order)
+	}
+}
+
+func (m *attrMatcher) dirRules(dir string) []*attrRule {
+	if rules, ok := m.perDir[dir]; ok {
+		return rules
+	}
+	file := filepath.Join(m.root, filepath.FromSlash(path.Join(dir, ".gitattributes")))
+	rules := m.readRules(file, dir, dir == "")
+	m.perDir[dir] = rules
+	return rules
+}
+
+// Resolve the attributes of a path. Unspecified attributes are left out.
+func (m *attrMatcher) attributes(name string) map[string]string {
+	// Highest precedence first: info/attributes, then the .gitattributes
+	// files from the deepest directory up, then the global file. The first
+	// source to mention an attribute decides it.
+	sources := [][]*attrRule{m.info}
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if dir == "." {
+			dir = ""
+		}
+		sources = append(sources, m.dirRules(dir))
+		if dir == "" {
+			break
+		}
+	}
+	sources = append(sources, m.global)
+
+	attrs := make(map[string]string)
+	var assign func(a attrAssignment)
+	assign = func(a attrAssignment) {
+		if _, decided := attrs[a.Name]; decided {
+			return
+		}
+		attrs[a.Name] = a.Value
+		if macro, ok := m.macros[a.Name]; ok && a.Value == attrSet {
+			for i := len(macro) - 1; i >= 0; i-- {
+				assign(macro[i])
+			}
+		}
+	}
+	for _, rules := range sources {
+		for i := len(rules) - 1; i >= 0; i-- {
+			if !rules[i].Pattern.matches(name, false) {
+				continue
+			}
+			for j := len(rules[i].Attrs) - 1; j >= 0; j-- {
+				assign(rules[i].Attrs[j])
+			}
+		}
+	}
+	for name, value := range attrs {
+		if value == attrUnspecified {
+			delete(attrs, name)
+		}
+	}
+	return attrs
+}
+
+// Attributes of a working tree path, or none for paths outside the repository.
+func attributesFor(localDir, name string) map[string]string {
+	name = filepath.ToSlash(filepath.Clean(name))
+	if strings.HasPrefix(name, "../") || filepath.IsAbs(name) {
+		return map[string]string{}
+	}
+	return loadAttrMatcher(localDir).attributes(name)
+}
+
+// How line endings of a path are converted between blob and working tree.
+type eolConversion struct {
+	Text bool // normalize CRLF to LF when storing
+	Auto bool // only when the content does not look binary
+	CRLF bool // write CRLF line endings to the working tree
+}
+
+func eolConversionFor(localDir, name string) eolConversion {
+	attrs := attributesFor(localDir, name)
+	autocrlf, _ := configValue(localDir, "core.autocrlf")
+	conv := eolConversion{}
+	text, ok := attrs["text"]
+	switch {
+	case ok && text == attrSet:
+		conv.Text = true
+	case ok && text == "auto":
+		conv.Text, conv.Auto = true, true
+	case ok:
+		// -text disables conversion.
+		return conv
+	case attrs["eol"] != "":
+		conv.Text = true
+	case autocrlf == "true" || autocrlf == "input":
+		conv.Text, conv.Auto = true, true
+	}
+	switch eol := attrs["eol"]; {
+	case eol == "crlf":
+		conv.CRLF = true
+	case eol == "lf":
+	case autocrlf == "true":
+		conv.CRLF = true
+	case autocrlf == "":
+		coreEOL, _ := configValue(localDir, "core.eol")
+		conv.CRLF = coreEOL == "crlf"
+	}
+	return conv
+}
+
+// Convert working tree content into what gets stored in a blob: the filter
+// driver runs first, then line endings are normalized.
+func cleanContent(localDir, name string, content []byte) ([]byte, error) {
+	content, err := applyFilter(localDir, name, "clean", content)
+	if err != nil {
+		return nil, err
+	}
+	conv := eolConversionFor(localDir, name)
+	if !conv.Text || (conv.Auto && isBinary(content)) {
+		return content, nil
+	}
+	return bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n")), nil
+}
+
+// Convert blob content into what gets written to the working tree, the
+// reverse of cleanContent.
+func smudgeContent(localDir, name string, content []byte) ([]byte, error) {
+	conv := eolConversionFor(localDir, name)
+	if conv.Text && conv.CRLF && !(conv.Auto && isBinary(content)) {
+		normalized := bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+		content = bytes.ReplaceAll(normalized, []byte("\n"), []byte("\r\n"))
+	}
+	return applyFilter(localDir, name, "smudge", content)
+}
+
+// Decide whether a path is shown as binary in diffs: the diff attribute wins
+// over looking at the content.
+func isBinaryForDiff(localDir, name string, contents ...[]byte) bool {
+	switch attributesFor(localDir, name)["diff"] {
+	case attrUnset:
+		return true
+	case "":
+		for _, content := range contents {
+			if isBinary(content) {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// Usage:
+//
+//	mygit check-attr [-a | --all] [--] <pathname>...
+//	mygit check-attr <attr>... -- <pathname>...
+//	mygit check-attr <attr> <pathname>...
+func checkAttrCmd(args []string) error {
+	all := false
+	var attrs, paths []string
+	dashes := -1
+	for i, arg := range args {
+		if arg == "--" {
+			dashes = i
+			break
+		}
+	}
+	rest := args
+	if dashes >= 0 {
+		rest, paths = args[:dashes], args[dashes+1:]
+	}
+	for _, arg := range rest {
+		if arg == "-a" || arg == "--all" {
+			all = true
+			continue
+		}
+		attrs = append(attrs, arg)
+	}
+	if dashes < 0 {
+		if all {
+			attrs, paths = nil, attrs
+		} else if len(attrs) > 0 {
+			attrs, paths = attrs[:1], attrs[1:]
+		}
+	}
+	if !all && len(attrs) == 0 {
+		return errors.New("no attribute specified")
+	}
+	if len(paths) == 0 {
+		return errors.New("no path specified")
+	}
+	return CheckAttr(".", attrs, paths, all)
+}
+
+func CheckAttr(localDir string, names, paths []string, all bool) error {
+	for _, name := range paths {
+		attrs := attributesFor(localDir, name)
+		if all {
+			order := loadAttrMatcher(localDir).order
+			names = names[:0]
+			for attr := range attrs {
+				names = append(names, attr)
+			}
+			sort.Slice(names, func(i, j int) bool { return order[names[i]] < order[names[j]] })
+		}
+		for _, attr := range names {
+			value, ok := attrs[attr]
+			if !ok {
+				value = attrUnspecified
+			}
+			fmt.Printf("%s: %s: %s\n", name, attr, strings.TrimPrefix(value, "\x00"))
+		}
+	}
+	return nil
+}
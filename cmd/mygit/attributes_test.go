@@ -0,0 +1,195 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Attributes the way git check-attr -a lists them.
+func formatAttributes(name string, attrs map[string]string) string {
+	var lines []string
+	for attr, value := range attrs {
+		switch value {
+		case attrSet:
+			value = "set"
+		case attrUnset:
+			value = "unset"
+		}
+		lines = append(lines, name+": "+attr+": "+value)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestAttributesPrecedence(t *testing.T) {
+	dir := newTestRepo(t)
+	global := filepath.Join(t.TempDir(), "attributes")
+	if err := os.WriteFile(global, []byte("*.txt diff=global foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setConfigValue(dir, "core.attributesFile", global); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		".gitattributes": "[attr]mymacro text -diff\n" +
+			"*.txt diff=root\n" +
+			"late.txt diff=later\n" +
+			"x.txt !foo\n" +
+			"*.bin binary\n" +
+			"*.m mymacro\n" +
+			"sub/*.txt eol=crlf\n" +
+			"!negated.txt diff=never\n" +
+			"dir/ diff=never\n",
+		"sub/.gitattributes":   "*.txt diff=sub\n[attr]ignored -text\n*.ig ignored\n",
+		".git/info/attributes": "special.txt diff=info\n",
+	} {
+		writeTestFile(t, dir, name, content)
+	}
+
+	want := map[string]string{
+		"a.txt":       "diff=root foo",
+		"late.txt":    "diff=later foo",
+		"x.txt":       "diff=root",
+		"negated.txt": "diff=root foo",
+		"special.txt": "diff=info foo",
+		"sub/b.txt":   "diff=sub eol=crlf foo",
+		"f.bin":       "binary -diff -merge -text",
+		"f.m":         "mymacro text -diff",
+		"sub/f.ig":    "ignored",
+		"dir/file":    "",
+	}
+	for name, attrs := range want {
+		expected := make(map[string]string)
+		for _, field := range strings.Fields(attrs) {
+			for _, a := range parseAttrAssignments([]string{field}) {
+				expected[a.Name] = a.Value
+			}
+		}
+		got := attributesFor(dir, name)
+		if formatAttributes(name, got) != formatAttributes(name, expected) {
+			t.Errorf("attributes of %s:\n%s\nwant\n%s", name, formatAttributes(name, got), formatAttributes(name, expected))
+		}
+	}
+
+	// git resolves the same files the same way, if in another order.
+	for name := range want {
+		lines := strings.Split(strings.TrimSpace(runGit(t, dir, "check-attr", "-a", name)), "\n")
+		sort.Strings(lines)
+		output := strings.Join(lines, "\n")
+		if got := formatAttributes(name, attributesFor(dir, name)); output != got {
+			t.Errorf("git check-attr -a %s:\n%s\nmygit:\n%s", name, output, got)
+		}
+	}
+}
+
+func TestEOLConversion(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes string
+		config     map[string]string
+		content    string
+		clean      string // stored in the blob
+		smudge     string // written back for the cleaned content
+	}{
+		{name: "no conversion", content: "a\r\nb\n", clean: "a\r\nb\n", smudge: "a\r\nb\n"},
+		{name: "text", attributes: "* text", content: "a\r\nb\n", clean: "a\nb\n", smudge: "a\nb\n"},
+		{name: "text eol=crlf", attributes: "* text eol=crlf", content: "a\r\nb\n", clean: "a\nb\n", smudge: "a\r\nb\r\n"},
+		{name: "eol alone", attributes: "* eol=crlf", content: "a\nb\n", clean: "a\nb\n", smudge: "a\r\nb\r\n"},
+		{name: "text=auto with text", attributes: "* text=auto", content: "a\r\n", clean: "a\n", smudge: "a\n"},
+		{name: "text=auto with binary", attributes: "* text=auto eol=crlf", content: "\x00\r\n\n", clean: "\x00\r\n\n", smudge: "\x00\r\n\n"},
+		{name: "text with core.eol", attributes: "* text", config: map[string]string{"core.eol": "crlf"}, content: "a\n", clean: "a\n", smudge: "a\r\n"},
+		{name: "core.autocrlf=true", config: map[string]string{"core.autocrlf": "true"}, content: "a\r\nb\n", clean: "a\nb\n", smudge: "a\r\nb\r\n"},
+		{name: "core.autocrlf=input", config: map[string]string{"core.autocrlf": "input"}, content: "a\r\nb\n", clean: "a\nb\n", smudge: "a\nb\n"},
+		{name: "-text beats core.autocrlf", attributes: "* -text", config: map[string]string{"core.autocrlf": "true"}, content: "a\r\nb\n", clean: "a\r\nb\n", smudge: "a\r\nb\n"},
+		{name: "eol=lf beats core.autocrlf", attributes: "* eol=lf", config: map[string]string{"core.autocrlf": "true"}, content: "a\r\n", clean: "a\n", smudge: "a\n"},
+	}
+	for _, tt := range tests {
+		dir := newTestRepo(t)
+		if tt.attributes != "" {
+			writeTestFile(t, dir, ".gitattributes", tt.attributes+"\n")
+		}
+		for name, value := range tt.config {
+			if err := setConfigValue(dir, name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		clean, err := cleanContent(dir, "file", []byte(tt.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		smudge, err := smudgeContent(dir, "file", clean)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(clean) != tt.clean || string(smudge) != tt.smudge {
+			t.Errorf("%s: cleaned to %q and smudged to %q, want %q and %q", tt.name, clean, smudge, tt.clean, tt.smudge)
+		}
+	}
+}
+
+func TestDiffAttribute(t *testing.T) {
+	dir := newTestRepo(t)
+	writeTestFile(t, dir, ".gitattributes", "*.dat -diff\n*.txt diff\n")
+	if !isBinaryForDiff(dir, "a.dat", []byte("text\n")) {
+		t.Error("-diff did not make a file binary")
+	}
+	if isBinaryForDiff(dir, "a.txt", []byte("\x00")) {
+		t.Error("diff did not make a file text")
+	}
+	if !isBinaryForDiff(dir, "a.other", []byte("\x00")) || isBinaryForDiff(dir, "a.other", []byte("text\n")) {
+		t.Error("without the attribute the content did not decide")
+	}
+}
+
+func TestCheckoutWithAttributes(t *testing.T) {
+	src := newTestRepo(t)
+	tip := commitFiles(t, src, "", "attributes", map[string]string{
+		".gitattributes":     "*.txt text eol=crlf\n",
+		"w.txt":              "a\nb\n",
+		"sub/.gitattributes": "*.dat -text\n*.txt -text\n",
+		"sub/x.txt":          "x\n",
+		"z.bin":              "a\nb\n",
+	})
+	if err := writeRef(src, "refs/heads/master", tip); err != nil {
+		t.Fatal(err)
+	}
+
+	// A clone converts by the attributes it checks out, as git clone does.
+	ours := filepath.Join(t.TempDir(), "ours")
+	if err := Clone("file://"+src, ours, cloneOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	theirs := filepath.Join(t.TempDir(), "theirs")
+	runGit(t, "", "clone", "-q", src, theirs)
+	for name, want := range map[string]string{".gitattributes": "*.txt text eol=crlf\n", "w.txt": "a\r\nb\r\n", "sub/x.txt": "x\n", "z.bin": "a\nb\n"} {
+		if got := readTestFile(t, ours, name); got != want {
+			t.Errorf("cloned %s as %q, want %q", name, got, want)
+		}
+		if got := readTestFile(t, theirs, name); got != want {
+			t.Errorf("git cloned %s as %q, want %q", name, got, want)
+		}
+	}
+
+	// A hard reset smudges by the committed attributes, not by a local edit
+	// of them.
+	dir := newTestRepo(t)
+	if err := setConfigValue(dir, "filter.up.smudge", "tr A-Z a-z"); err != nil {
+		t.Fatal(err)
+	}
+	tip = commitFiles(t, dir, "", "filtered", map[string]string{".gitattributes": "*.up filter=up\n", "f.up": "HELLO\n"})
+	resetHard(t, dir, tip)
+	if got := readTestFile(t, dir, "f.up"); got != "hello\n" {
+		t.Errorf("checked out %q", got)
+	}
+	writeTestFile(t, dir, ".gitattributes", "# nothing\n")
+	writeTestFile(t, dir, "f.up", "changed\n")
+	// As a new process would, start from the edited file.
+	invalidateAttrMatcher(dir)
+	resetHard(t, dir, tip)
+	if got := readTestFile(t, dir, "f.up"); got != "hello\n" {
+		t.Errorf("reset --hard wrote %q", got)
+	}
+}
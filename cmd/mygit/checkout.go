@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Update the working tree from one tree to another: files only in fromTree are
+// removed and files that are new or changed in toTree are written.
+func checkoutTree(localDir, fromTree, toTree string) error {
+	from, err := flattenTree(localDir, fromTree)
+	if err != nil {
+		return err
+	}
+	to, err := flattenTree(localDir, toTree)
+	if err != nil {
+		return err
+	}
+	return checkoutFiles(localDir, from, to)
+}
+
+func checkoutFiles(localDir string, from, to map[string]treeFile) error {
+	changed := make(map[string]treeFile)
+	for name, file := range to {
+		if old, ok := from[name]; !ok || old != file {
+			changed[name] = file
+		}
+	}
+	if err := prefetchFiles(localDir, changed); err != nil {
+		return err
+	}
+	for name := range from {
+		if _, ok := to[name]; !ok {
+			if err := removeWorkFile(localDir, name); err != nil {
+				return err
+			}
+		}
+	}
+	// Attributes have to be in place before the files they apply to.
+	names := make([]string, 0, len(to))
+	for name := range to {
+		names = append(names, name)
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return path.Base(names[i]) == ".gitattributes" && path.Base(names[j]) != ".gitattributes"
+	})
+	for _, name := range names {
+		file := to[name]
+		if old, ok := from[name]; ok && old == file {
+			continue
+		}
+		if err := writeWorkFile(localDir, name, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a blob to the working tree with the permissions its mode asks for.
+func writeWorkFile(localDir, name string, file treeFile) error {
+	if file.Mode == "160000" {
+		// Submodules are not checked out.
+		return os.MkdirAll(filepath.Join(localDir, filepath.FromSlash(name)), 0755)
+	}
+	content, err := CatFile(localDir, file.Sha)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(localDir, filepath.FromSlash(name))
+	if err := os.RemoveAll(filename); err != nil {
+		return err
+	}
+	if file.Mode == "120000" {
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return err
+		}
+		return os.Symlink(string(content), filename)
+	}
+	// An attributes file is written as it is, and the files after it are
+	// converted by the rules it now holds.
+	isAttributes := path.Base(name) == ".gitattributes"
+	if !isAttributes {
+		if content, err = smudgeContent(localDir, name, content); err != nil {
+			return err
+		}
+	}
+	if err := writeFile(filename, content); err != nil {
+		return err
+	}
+	if isAttributes {
+		invalidateAttrMatcher(localDir)
+	}
+	if file.Mode == "100755" {
+		return os.Chmod(filename, 0755)
+	}
+	return os.Chmod(filename, 0644)
+}
+
+// Remove a file from the working tree along with any directories it leaves
+// empty.
+func removeWorkFile(localDir, name string) error {
+	filename := filepath.Join(localDir, filepath.FromSlash(name))
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(filename); dir != filepath.Clean(localDir) && dir != "."; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Whether a path is a directory in the working tree, not following symlinks.
+func isWorkDir(localDir, name string) bool {
+	info, err := os.Lstat(filepath.Join(localDir, filepath.FromSlash(name)))
+	return err == nil && info.IsDir()
+}
+
+// Read a working tree file as blob content together with its git mode.
+func readWorkFile(localDir, name string) (string, []byte, error) {
+	filename := filepath.Join(localDir, filepath.FromSlash(name))
+	info, err := os.Lstat(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filename)
+		return "120000", []byte(target), err
+	}
+	if info.IsDir() {
+		return "", nil, fmt.Errorf("%s is a directory", name)
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	content, err = cleanContent(localDir, name, content)
+	return gitFileMode(info.Mode()), content, err
+}
+
+// Hash a working tree file the way it would be stored, without writing it.
+func hashWorkFile(localDir, name string) (treeFile, error) {
+	mode, content, err := readWorkFile(localDir, name)
+	if err != nil {
+		return treeFile{}, err
+	}
+	blob := &GitBlob{Content: content}
+	sha, err := calcSHA1(blob.Serialize())
+	if err != nil {
+		return treeFile{}, err
+	}
+	return treeFile{Mode: mode, Sha: sha}, nil
+}
+
+// Store a working tree file as a blob.
+func writeWorkBlob(localDir, name string) (treeFile, error) {
+	mode, content, err := readWorkFile(localDir, name)
+	if err != nil {
+		return treeFile{}, err
+	}
+	blob := &GitBlob{Content: content}
+	sha, err := writeGitObject(localDir, blob.Serialize())
+	if err != nil {
+		return treeFile{}, err
+	}
+	return treeFile{Mode: mode, Sha: sha}, nil
+}
+
+// Snapshot the given paths from the working tree, skipping missing files and
+// directories standing where a file might be. Blobs are only written to the
+// object store when write is set.
+func snapshotWorkFiles(localDir string, paths map[string]bool, write bool) (map[string]treeFile, error) {
+	files := make(map[string]treeFile)
+	for name := range paths {
+		if isWorkDir(localDir, name) {
+			continue
+		}
+		hash := hashWorkFile
+		if write {
+			hash = writeWorkBlob
+		}
+		file, err := hash(localDir, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[name] = file
+	}
+	return files, nil
+}
+
+// Collect the paths of several trees.
+func treePaths(localDir string, trees ...string) (map[string]bool, error) {
+	paths := make(map[string]bool)
+	for _, tree := range trees {
+		files, err := flattenTree(localDir, tree)
+		if err != nil {
+			return nil, err
+		}
+		for name := range files {
+			paths[name] = true
+		}
+	}
+	return paths, nil
+}
+
+// List tracked files whose working tree content differs from treeSha.
+func dirtyPaths(localDir, treeSha string) ([]string, error) {
+	files, err := flattenTree(localDir, treeSha)
+	if err != nil {
+		return nil, err
+	}
+	var dirty []string
+	for name, file := range files {
+		if file.Mode == "160000" {
+			continue
+		}
+		if isWorkDir(localDir, name) {
+			dirty = append(dirty, name)
+			continue
+		}
+		current, err := hashWorkFile(localDir, name)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err != nil || current != file {
+			dirty = append(dirty, name)
+		}
+	}
+	sort.Strings(dirty)
+	return dirty, nil
+}
+
+// Refuse to continue when tracked files have local modifications.
+func requireCleanWorkTree(localDir, treeSha, action string) error {
+	dirty, err := dirtyPaths(localDir, treeSha)
+	if err != nil {
+		return err
+	}
+	if len(dirty) > 0 {
+		for _, name := range dirty {
+			fmt.Fprintf(os.Stderr, "\t%s\n", name)
+		}
+		return fmt.Errorf("cannot %s: you have unstaged changes", action)
+	}
+	return nil
+}
+
+// Tree of the commit HEAD points at, or the empty tree on an unborn branch.
+func headTree(localDir string) (string, error) {
+	_, sha, err := readHead(localDir)
+	if err != nil || sha == "" {
+		return emptyTreeSha, err
+	}
+	commit, err := readCommit(localDir, sha)
+	if err != nil {
+		return "", err
+	}
+	return commit.Tree, nil
+}
+
+// Walk the working tree below dir in name order, calling visit for every file
+// and directory except .git. Directories are only descended into when visit
+// returns true for them.
+func walkWorkTree(localDir, dir string, visit func(name string, isDir bool) (bool, error)) error {
+	entries, err := os.ReadDir(filepath.Join(localDir, filepath.FromSlash(dir)))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == ".git" {
+			continue
+		}
+		name := path.Join(dir, entry.Name())
+		descend, err := visit(name, entry.IsDir())
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && descend {
+			if err := walkWorkTree(localDir, name, visit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// An upstream whose HEAD points at its topic branch rather than master, with
+// a tag on master, served over smart HTTP.
+func cloneUpstream(t *testing.T) (upstream, url string, refs map[string]string) {
+	t.Helper()
+	root, upstream := bareRepo(t)
+	first := commitFiles(t, upstream, "", "first", map[string]string{"a": "a\n"})
+	master := commitFiles(t, upstream, first, "second", map[string]string{"b": "b\n"})
+	topic := commitFiles(t, upstream, first, "topic", map[string]string{"dir/c": "c\n"})
+	refs = map[string]string{"refs/heads/master": master, "refs/heads/topic": topic, "refs/tags/v1": first}
+	for ref, sha := range refs {
+		if err := writeRef(upstream, ref, sha); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeSymref(upstream, "HEAD", "refs/heads/topic"); err != nil {
+		t.Fatal(err)
+	}
+	base, _ := serveRepos(t, root)
+	return upstream, base + "/upstream.git", refs
+}
+
+// The refs git show-ref lists, as a set.
+func showRefs(t *testing.T, dir string) map[string]bool {
+	t.Helper()
+	refs := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(runGit(t, dir, "show-ref")), "\n") {
+		if _, name, ok := strings.Cut(line, " "); ok {
+			refs[name] = true
+		}
+	}
+	return refs
+}
+
+func TestCloneOptions(t *testing.T) {
+	_, url, refs := cloneUpstream(t)
+	tests := []struct {
+		name     string
+		options  cloneOptions
+		head     string // the ref HEAD points at, "" when detached
+		sha      string
+		files    string // the checked out files, "" for none
+		fetch    string // remote.origin.fetch
+		mirror   bool
+		wantRefs []string
+	}{
+		{
+			name:     "remote HEAD",
+			head:     "refs/heads/topic",
+			sha:      refs["refs/heads/topic"],
+			files:    "a dir/c",
+			fetch:    "+refs/heads/*:refs/remotes/origin/*",
+			wantRefs: []string{"refs/heads/topic", "refs/remotes/origin/HEAD", "refs/remotes/origin/master", "refs/remotes/origin/topic", "refs/tags/v1"},
+		},
+		{
+			name:     "branch",
+			options:  cloneOptions{Branch: "master"},
+			head:     "refs/heads/master",
+			sha:      refs["refs/heads/master"],
+			files:    "a b",
+			fetch:    "+refs/heads/*:refs/remotes/origin/*",
+			wantRefs: []string{"refs/heads/master", "refs/remotes/origin/HEAD", "refs/remotes/origin/master", "refs/remotes/origin/topic", "refs/tags/v1"},
+		},
+		{
+			name:     "tag",
+			options:  cloneOptions{Branch: "v1"},
+			sha:      refs["refs/tags/v1"],
+			files:    "a",
+			fetch:    "+refs/heads/*:refs/remotes/origin/*",
+			wantRefs: []string{"refs/remotes/origin/HEAD", "refs/remotes/origin/master", "refs/remotes/origin/topic", "refs/tags/v1"},
+		},
+		{
+			name:     "single branch",
+			options:  cloneOptions{Branch: "master", SingleBranch: true},
+			head:     "refs/heads/master",
+			sha:      refs["refs/heads/master"],
+			files:    "a b",
+			fetch:    "+refs/heads/master:refs/remotes/origin/master",
+			wantRefs: []string{"refs/heads/master", "refs/remotes/origin/master", "refs/tags/v1"},
+		},
+		{
+			name:     "no checkout",
+			options:  cloneOptions{NoCheckout: true},
+			head:     "refs/heads/topic",
+			sha:      refs["refs/heads/topic"],
+			fetch:    "+refs/heads/*:refs/remotes/origin/*",
+			wantRefs: []string{"refs/heads/topic", "refs/remotes/origin/HEAD", "refs/remotes/origin/master", "refs/remotes/origin/topic", "refs/tags/v1"},
+		},
+		{
+			name:     "bare",
+			options:  cloneOptions{Bare: true},
+			head:     "refs/heads/topic",
+			sha:      refs["refs/heads/topic"],
+			wantRefs: []string{"refs/heads/master", "refs/heads/topic", "refs/tags/v1"},
+		},
+		{
+			name:     "mirror",
+			options:  cloneOptions{Bare: true, Mirror: true},
+			head:     "refs/heads/topic",
+			sha:      refs["refs/heads/topic"],
+			fetch:    "+refs/*:refs/*",
+			mirror:   true,
+			wantRefs: []string{"refs/heads/master", "refs/heads/topic", "refs/tags/v1"},
+		},
+	}
+	for _, tt := range tests {
+		dir := filepath.Join(t.TempDir(), "clone")
+		if err := Clone(url, dir, tt.options); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		head, sha, err := readHead(dir)
+		if err != nil || head != tt.head || sha != tt.sha {
+			t.Errorf("%s: HEAD is %q at %s, want %q at %s: %v", tt.name, head, sha, tt.head, tt.sha, err)
+		}
+
+		_, err = os.Stat(filepath.Join(dir, ".git"))
+		if tt.options.Bare != os.IsNotExist(err) {
+			t.Errorf("%s: .git exists is %v", tt.name, err == nil)
+		}
+		var files []string
+		if !tt.options.Bare {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if entry.Name() != ".git" {
+					files = append(files, entry.Name())
+				}
+			}
+		}
+		want := strings.Fields(tt.files)
+		for i, name := range want {
+			want[i], _, _ = strings.Cut(name, "/")
+		}
+		if strings.Join(files, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: checked out %q, want %q", tt.name, files, want)
+		}
+
+		if got := strings.Join(configValues(dir, "remote.origin.fetch"), " "); got != tt.fetch {
+			t.Errorf("%s: remote.origin.fetch is %q, want %q", tt.name, got, tt.fetch)
+		}
+		if mirror, _ := configValue(dir, "remote.origin.mirror"); (mirror == "true") != tt.mirror {
+			t.Errorf("%s: remote.origin.mirror is %q", tt.name, mirror)
+		}
+
+		got := showRefs(t, dir)
+		if len(got) != len(tt.wantRefs) {
+			t.Errorf("%s: cloned refs %v, want %v", tt.name, got, tt.wantRefs)
+		}
+		for _, ref := range tt.wantRefs {
+			if !got[ref] {
+				t.Errorf("%s: %s is missing", tt.name, ref)
+			}
+		}
+		if ok, output := runFsck(t, dir, false); !ok {
+			t.Errorf("%s: git fsck failed:\n%s", tt.name, output)
+		}
+	}
+}
+
+func TestCloneDestination(t *testing.T) {
+	_, url, _ := cloneUpstream(t)
+
+	// A directory with anything in it is refused and left as it was.
+	full := t.TempDir()
+	writeTestFile(t, full, "keep", "k\n")
+	if err := Clone(url, full, cloneOptions{}); err == nil || !strings.Contains(err.Error(), "already exists and is not an empty directory") {
+		t.Errorf("cloning into a non-empty directory gave %v", err)
+	}
+	if entries, _ := os.ReadDir(full); len(entries) != 1 || readTestFile(t, full, "keep") != "k\n" {
+		t.Errorf("the refused destination was changed: %d entries", len(entries))
+	}
+	file := filepath.Join(t.TempDir(), "file")
+	writeTestFile(t, filepath.Dir(file), "file", "f\n")
+	if err := Clone(url, file, cloneOptions{}); err == nil {
+		t.Error("cloned over a file")
+	}
+
+	// An empty directory is fine.
+	empty := t.TempDir()
+	if err := Clone(url, empty, cloneOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, empty, "dir/c"); got != "c\n" {
+		t.Errorf("checked out dir/c as %q", got)
+	}
+
+	// A failed clone removes the directory it made, and empties one that
+	// was there.
+	missing := strings.TrimSuffix(url, "upstream.git") + "missing.git"
+	made := filepath.Join(t.TempDir(), "made")
+	if err := Clone(missing, made, cloneOptions{}); err == nil {
+		t.Fatal("cloned a missing repository")
+	}
+	if _, err := os.Stat(made); !os.IsNotExist(err) {
+		t.Errorf("the failed clone left %s behind: %v", made, err)
+	}
+	existing := t.TempDir()
+	if err := Clone(missing, existing, cloneOptions{Bare: true}); err == nil {
+		t.Fatal("cloned a missing repository")
+	}
+	if entries, err := os.ReadDir(existing); err != nil || len(entries) != 0 {
+		t.Errorf("the failed clone left %d entries in the existing directory: %v", len(entries), err)
+	}
+}
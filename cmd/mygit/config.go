@@ -0,0 +1,1420 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	neturl "net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Usage: mygit config [--system | --global | --local | --worktree | -f <file>]
+// [--type=(bool|int|bool-or-int|path) | --bool | --int | --bool-or-int | --path]
+// [--show-origin] [--show-scope] <action>, the action one of
+//
+//	<name> [<value> [<value-pattern>]]
+//	--get <name> [<value-pattern>]
+//	--get-all <name> [<value-pattern>]
+//	--get-regexp <name-regex> [<value-pattern>]
+//	--add <name> <value>
+//	--replace-all <name> <value> [<value-pattern>]
+//	--unset <name> [<value-pattern>]
+//	--unset-all <name> [<value-pattern>]
+//	-l | --list
+//
+// A value pattern is a regular expression, or one starting with "!" for
+// values not matching it. The result is false when there was nothing to
+// get. As with git, the exit status is 5 when there is nothing to unset or
+// one value is set or unset where there are several, and 6 for an invalid
+// pattern.
+// ref: https://git-scm.com/docs/git-config
+func configCmd(args []string) (bool, error) {
+	c := configCommand{localDir: "."}
+	action := ""
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--system", "--global", "--local", "--worktree":
+			c.scope = strings.TrimPrefix(arg, "--")
+		case "-f", "--file":
+			if i+1 == len(args) {
+				return false, fmt.Errorf("switch `%s' requires a value", strings.TrimLeft(arg, "-"))
+			}
+			i++
+			c.scope, c.file = "file", args[i]
+		case "--bool", "--int", "--bool-or-int", "--path":
+			c.valueType = strings.TrimPrefix(arg, "--")
+		case "--show-origin":
+			c.showOrigin = true
+		case "--show-scope":
+			c.showScope = true
+		case "--get", "--get-all", "--get-regexp", "--add", "--replace-all", "--unset", "--unset-all", "-l", "--list":
+			if action != "" {
+				return false, errors.New("only one action at a time")
+			}
+			action = arg
+		default:
+			if file, ok := cutPrefix(arg, "--file="); ok {
+				c.scope, c.file = "file", file
+				continue
+			}
+			if valueType, ok := cutPrefix(arg, "--type="); ok {
+				switch valueType {
+				case "bool", "int", "bool-or-int", "path":
+				default:
+					return false, fmt.Errorf("unrecognized --type argument, %s", valueType)
+				}
+				c.valueType = valueType
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
+				return false, fmt.Errorf("unknown option: %s", arg)
+			}
+			positional = append(positional, arg)
+		}
+	}
+	if action == "-l" {
+		action = "--list"
+	}
+	if action == "" {
+		// Like git, one argument gets and more set.
+		switch len(positional) {
+		case 0:
+			return false, errors.New("usage: mygit config [<options>] <name> [<value> [<value-pattern>]]")
+		case 1:
+			action = "--get"
+		default:
+			action = "--set"
+		}
+	}
+
+	arity := map[string][2]int{
+		"--get": {1, 2}, "--get-all": {1, 2}, "--get-regexp": {1, 2}, "--list": {0, 0},
+		"--set": {2, 3}, "--add": {2, 2}, "--replace-all": {2, 3}, "--unset": {1, 2}, "--unset-all": {1, 2},
+	}[action]
+	if len(positional) < arity[0] || len(positional) > arity[1] {
+		return false, fmt.Errorf("wrong number of arguments, should be from %d to %d", arity[0], arity[1])
+	}
+	arg := func(i int) string {
+		if i < len(positional) {
+			return positional[i]
+		}
+		return ""
+	}
+	switch action {
+	case "--get", "--get-all", "--get-regexp", "--list":
+		return c.get(action, arg(0), arg(1))
+	case "--set", "--add", "--replace-all":
+		value, err := c.canonical(arg(0), arg(1))
+		if err != nil {
+			return false, err
+		}
+		return true, c.set(action, arg(0), value, arg(2))
+	}
+	return c.unset(action == "--unset-all", arg(0), arg(1))
+}
+
+// The options of one config command.
+type configCommand struct {
+	localDir   string
+	scope      string // "" for every scope when reading and local when writing
+	file       string // with scope "file"
+	valueType  string // "" to show values as they are
+	showOrigin bool
+	showScope  bool
+}
+
+// The file a scope reads and writes.
+func (c *configCommand) path() (string, error) {
+	switch c.scope {
+	case "system":
+		return systemConfigPath(), nil
+	case "global":
+		return globalConfigPath()
+	case "file":
+		return c.file, nil
+	}
+	if !isRepository(c.localDir) {
+		return "", errors.New("not in a git directory")
+	}
+	if c.scope == "worktree" && worktreeConfigEnabled(repositoryConfigPath(c.localDir)) {
+		return worktreeConfigPath(c.localDir), nil
+	}
+	return repositoryConfigPath(c.localDir), nil
+}
+
+// The variables to read: those of every scope with includes followed, or
+// those of the one file asked for.
+func (c *configCommand) vars() ([]configVar, error) {
+	if c.scope == "" {
+		return allConfigVars(c.localDir), nil
+	}
+	path, err := c.path()
+	if err != nil {
+		return nil, err
+	}
+	f, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	scope := map[string]configScope{"system": systemScope, "global": globalScope, "worktree": worktreeScope}[c.scope]
+	if c.scope == "local" || c.scope == "file" || c.scope == "worktree" && path == repositoryConfigPath(c.localDir) {
+		scope = localScope
+	}
+	vars := f.Vars
+	for i := range vars {
+		vars[i].Scope = scope
+	}
+	return vars, nil
+}
+
+func (c *configCommand) get(action, name, valuePattern string) (bool, error) {
+	vars, err := c.vars()
+	if err != nil {
+		return false, err
+	}
+	matchName := func(v configVar) bool { return true }
+	switch action {
+	case "--get", "--get-all":
+		section, subsection, key, err := splitConfigName(name)
+		if err != nil {
+			return false, err
+		}
+		matchName = func(v configVar) bool { return v.is(section, subsection, key) }
+	case "--get-regexp":
+		re, err := regexp.Compile(name)
+		if err != nil {
+			return false, &exitError{6, fmt.Errorf("invalid key pattern: %s", name)}
+		}
+		matchName = func(v configVar) bool { return re.MatchString(v.Name()) }
+	}
+	matchValue, err := compileValuePattern(valuePattern)
+	if err != nil {
+		return false, err
+	}
+	var matched []configVar
+	for _, v := range vars {
+		if matchName(v) && matchValue(v) {
+			matched = append(matched, v)
+		}
+	}
+	if action == "--get" && len(matched) > 0 {
+		matched = matched[len(matched)-1:]
+	}
+	for _, v := range matched {
+		var line strings.Builder
+		if c.showScope {
+			line.WriteString(v.Scope.String() + "\t")
+		}
+		if c.showOrigin {
+			if v.File == "" {
+				line.WriteString("command line:\t")
+			} else {
+				line.WriteString("file:" + v.File + "\t")
+			}
+		}
+		value, err := c.format(v)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case action == "--list" && v.NoValue && c.valueType == "":
+			line.WriteString(v.Name())
+		case action == "--list":
+			line.WriteString(v.Name() + "=" + value)
+		case action == "--get-regexp" && v.NoValue && c.valueType == "":
+			line.WriteString(v.Name())
+		case action == "--get-regexp":
+			line.WriteString(v.Name() + " " + value)
+		default:
+			line.WriteString(value)
+		}
+		fmt.Println(line.String())
+	}
+	return len(matched) > 0 || action == "--list", nil
+}
+
+// A value as the type asked for shows it.
+func (c *configCommand) format(v configVar) (string, error) {
+	switch c.valueType {
+	case "bool":
+		b, err := v.bool()
+		if err != nil {
+			return "", fmt.Errorf("%v for '%s'", err, v.Name())
+		}
+		return strconv.FormatBool(b), nil
+	case "int":
+		n, err := parseConfigInt(v.Value)
+		if err != nil {
+			return "", fmt.Errorf("%v for '%s'", err, v.Name())
+		}
+		return strconv.FormatInt(n, 10), nil
+	case "bool-or-int":
+		if n, err := parseConfigInt(v.Value); err == nil && !v.NoValue {
+			return strconv.FormatInt(n, 10), nil
+		}
+		b, err := v.bool()
+		if err != nil {
+			return "", fmt.Errorf("%v for '%s'", err, v.Name())
+		}
+		return strconv.FormatBool(b), nil
+	case "path":
+		if v.NoValue {
+			return "", fmt.Errorf("missing value for '%s'", v.Name())
+		}
+		return expandHome(v.Value), nil
+	}
+	return v.Value, nil
+}
+
+// A value to write, normalized as git does for its type.
+func (c *configCommand) canonical(name, value string) (string, error) {
+	section, subsection, key, err := splitConfigName(name)
+	if err != nil || c.valueType == "path" {
+		return value, err
+	}
+	return c.format(configVar{Section: section, Subsection: subsection, Key: key, Value: value})
+}
+
+// Match values against a regular expression, or with a leading "!" against
+// its negation. An empty pattern matches everything.
+func compileValuePattern(pattern string) (func(v configVar) bool, error) {
+	if pattern == "" {
+		return func(v configVar) bool { return true }, nil
+	}
+	negate := strings.HasPrefix(pattern, "!")
+	re, err := regexp.Compile(strings.TrimPrefix(pattern, "!"))
+	if err != nil {
+		return nil, &exitError{6, fmt.Errorf("invalid pattern: %s", pattern)}
+	}
+	return func(v configVar) bool { return re.MatchString(v.Value) != negate }, nil
+}
+
+// Set a variable: replace its one value, or the one matching the pattern,
+// adding it when there is none; add a value; or replace every matching
+// value with one.
+func (c *configCommand) set(action, name, value, valuePattern string) error {
+	path, err := c.path()
+	if err != nil {
+		return err
+	}
+	matchValue, err := compileValuePattern(valuePattern)
+	if err != nil {
+		return err
+	}
+	return editConfigFile(path, func(f *configFile) error {
+		if action == "--add" {
+			return f.add(name, value)
+		}
+		vars, err := f.matching(name)
+		if err != nil {
+			return err
+		}
+		var matched []configVar
+		for _, v := range vars {
+			if matchValue(v) {
+				matched = append(matched, v)
+			}
+		}
+		switch {
+		case len(matched) == 0:
+			return f.add(name, value)
+		case action == "--replace-all":
+			for i := len(matched) - 1; i > 0; i-- {
+				f.remove(matched[i])
+			}
+		case len(matched) > 1:
+			return &exitError{5, fmt.Errorf("warning: %s has multiple values\n"+
+				"error: cannot overwrite multiple values with a single value\n"+
+				"       Use a regexp, --add or --replace-all to change %s.", name, name)}
+		}
+		f.replace(matched[0], writtenKey(name), value)
+		return nil
+	})
+}
+
+// Remove the one value of a variable, or the one matching the pattern, or
+// with all every matching value.
+func (c *configCommand) unset(all bool, name, valuePattern string) (bool, error) {
+	path, err := c.path()
+	if err != nil {
+		return false, err
+	}
+	matchValue, err := compileValuePattern(valuePattern)
+	if err != nil {
+		return false, err
+	}
+	found := false
+	err = editConfigFile(path, func(f *configFile) error {
+		vars, err := f.matching(name)
+		if err != nil {
+			return err
+		}
+		var matched []configVar
+		for _, v := range vars {
+			if matchValue(v) {
+				matched = append(matched, v)
+			}
+		}
+		if len(matched) > 1 && !all {
+			return &exitError{5, fmt.Errorf("warning: %s has multiple values", name)}
+		}
+		for i := len(matched) - 1; i >= 0; i-- {
+			f.remove(matched[i])
+		}
+		found = len(matched) > 0
+		return nil
+	})
+	if err == nil && !found {
+		// Like git, there being nothing to unset exits with 5, not 1.
+		err = &exitError{Status: 5}
+	}
+	return found, err
+}
+
+// Where configuration comes from, lowest precedence first. Variables set
+// with GIT_CONFIG_COUNT come last, in the command scope.
+// ref: https://git-scm.com/docs/git-config#SCOPES
+type configScope int
+
+const (
+	systemScope configScope = iota
+	globalScope
+	localScope
+	worktreeScope
+	commandScope
+)
+
+var configScopeNames = []string{"system", "global", "local", "worktree", "command"}
+
+func (s configScope) String() string {
+	return configScopeNames[s]
+}
+
+// A config file and the scope it sets variables in.
+type configSource struct {
+	Scope configScope
+	Path  string
+}
+
+// Files consulted for configuration, lowest precedence first.
+func configSources(localDir string) []configSource {
+	var sources []configSource
+	if !envBool("GIT_CONFIG_NOSYSTEM") {
+		sources = append(sources, configSource{systemScope, systemConfigPath()})
+	}
+	for _, path := range globalConfigPaths() {
+		sources = append(sources, configSource{globalScope, path})
+	}
+	local := repositoryConfigPath(localDir)
+	sources = append(sources, configSource{localScope, local})
+	if worktreeConfigEnabled(local) {
+		sources = append(sources, configSource{worktreeScope, worktreeConfigPath(localDir)})
+	}
+	return sources
+}
+
+func systemConfigPath() string {
+	if path := os.Getenv("GIT_CONFIG_SYSTEM"); path != "" {
+		return path
+	}
+	return "/etc/gitconfig"
+}
+
+// $XDG_CONFIG_HOME/git/config and ~/.gitconfig, or GIT_CONFIG_GLOBAL.
+func globalConfigPaths() []string {
+	if path := os.Getenv("GIT_CONFIG_GLOBAL"); path != "" {
+		return []string{path}
+	}
+	var paths []string
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	home, _ := os.UserHomeDir()
+	if xdg == "" && home != "" {
+		xdg = filepath.Join(home, ".config")
+	}
+	if xdg != "" {
+		paths = append(paths, filepath.Join(xdg, "git", "config"))
+	}
+	if home != "" {
+		paths = append(paths, filepath.Join(home, ".gitconfig"))
+	}
+	return paths
+}
+
+// The global file written to: ~/.gitconfig, unless only the XDG one exists.
+func globalConfigPath() (string, error) {
+	paths := globalConfigPaths()
+	if len(paths) == 0 {
+		return "", errors.New("$HOME not set")
+	}
+	if _, err := os.Stat(paths[len(paths)-1]); err != nil && len(paths) > 1 {
+		if _, err := os.Stat(paths[0]); err == nil {
+			return paths[0], nil
+		}
+	}
+	return paths[len(paths)-1], nil
+}
+
+func repositoryConfigPath(localDir string) string {
+	return filepath.Join(gitDir(localDir), "config")
+}
+
+func worktreeConfigPath(localDir string) string {
+	return filepath.Join(gitDir(localDir), "config.worktree")
+}
+
+// Whether extensions.worktreeConfig is set in the repository's own file,
+// which is all that can set it.
+func worktreeConfigEnabled(localPath string) bool {
+	f, err := readConfigFile(localPath)
+	if err != nil {
+		return false
+	}
+	enabled := false
+	for _, v := range f.Vars {
+		if v.is("extensions", "", "worktreeconfig") {
+			enabled, _ = v.bool()
+		}
+	}
+	return enabled
+}
+
+// Variables given as GIT_CONFIG_KEY_<n> and GIT_CONFIG_VALUE_<n>.
+func environmentConfigVars() ([]configVar, error) {
+	count := os.Getenv("GIT_CONFIG_COUNT")
+	if count == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, errors.New("bogus count in GIT_CONFIG_COUNT")
+	}
+	var vars []configVar
+	for i := 0; i < n; i++ {
+		name, ok := os.LookupEnv(fmt.Sprintf("GIT_CONFIG_KEY_%d", i))
+		if !ok {
+			return nil, fmt.Errorf("missing config key GIT_CONFIG_KEY_%d", i)
+		}
+		value, ok := os.LookupEnv(fmt.Sprintf("GIT_CONFIG_VALUE_%d", i))
+		if !ok {
+			return nil, fmt.Errorf("missing config value GIT_CONFIG_VALUE_%d", i)
+		}
+		section, subsection, key, err := splitConfigName(name)
+		if err != nil {
+			return nil, err
+		}
+		vars = append(vars, configVar{Section: section, Subsection: subsection, Key: key, Value: value, Scope: commandScope})
+	}
+	return vars, nil
+}
+
+// Look up a "section.key" or "section.subsection.key" value, the last
+// definition winning.
+func configValue(localDir, name string) (string, bool) {
+	values := configValues(localDir, name)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// Look up every value of a multi-valued key, in the order they are defined.
+// A key given without "=" reads as "true".
+func configValues(localDir, name string) []string {
+	var values []string
+	for _, v := range configVars(localDir, name) {
+		if v.NoValue {
+			values = append(values, "true")
+		} else {
+			values = append(values, v.Value)
+		}
+	}
+	return values
+}
+
+// Every definition of a variable across the config files, included files
+// read in place. Like git, a config file that cannot be parsed is fatal.
+func configVars(localDir, name string) []configVar {
+	section, subsection, key, err := splitConfigName(name)
+	if err != nil {
+		return nil
+	}
+	var vars []configVar
+	for _, v := range allConfigVars(localDir) {
+		if v.is(section, subsection, key) {
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
+
+// Every variable set in any scope, lowest precedence first.
+func allConfigVars(localDir string) []configVar {
+	var vars []configVar
+	for _, source := range configSources(localDir) {
+		all, err := readConfigVars(localDir, source.Path, 0)
+		must(err)
+		for _, v := range all {
+			v.Scope = source.Scope
+			vars = append(vars, v)
+		}
+	}
+	more, err := environmentConfigVars()
+	must(err)
+	return append(vars, more...)
+}
+
+// One variable set in a config file: its section and subsection, its key
+// and value, and the lines it takes up.
+// ref: https://git-scm.com/docs/git-config#_configuration_file
+type configVar struct {
+	Section    string // lower case
+	Subsection string // case-sensitive, "" for none
+	Key        string // lower case
+	Value      string
+	NoValue    bool   // the key stands alone, which booleans read as true
+	File       string // "" when set from the environment
+	Scope      configScope
+
+	key        string // the key as written
+	header     int    // index of the section header in configFile.sections
+	start, end int    // lines [start, end) of the file
+}
+
+func (v configVar) is(section, subsection, key string) bool {
+	return v.Section == section && v.Subsection == subsection && v.Key == key
+}
+
+func (v configVar) Name() string {
+	if v.Subsection == "" {
+		return v.Section + "." + v.Key
+	}
+	return v.Section + "." + v.Subsection + "." + v.Key
+}
+
+type configSection struct {
+	Section    string
+	Subsection string
+	line       int
+	text       string // the header as written, "[...]"
+}
+
+// A config file kept line by line, so that an edit leaves comments,
+// layout and every other variable as they were.
+type configFile struct {
+	Path     string
+	lines    []string // each with its newline, but for maybe the last
+	Vars     []configVar
+	sections []configSection
+}
+
+// Read and parse a config file; one that does not exist is empty.
+func readConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f := &configFile{Path: path}
+	return f, f.parse(string(data))
+}
+
+// Split a name into its lower-cased section and key and the subsection
+// between them, which keeps its case.
+func splitConfigName(name string) (string, string, string, error) {
+	first, last := strings.Index(name, "."), strings.LastIndex(name, ".")
+	if first <= 0 {
+		return "", "", "", fmt.Errorf("key does not contain a section: %s", name)
+	}
+	if last == len(name)-1 {
+		return "", "", "", fmt.Errorf("key does not contain variable name: %s", name)
+	}
+	section, key := strings.ToLower(name[:first]), strings.ToLower(name[last+1:])
+	subsection := ""
+	if first < last {
+		subsection = name[first+1 : last]
+	}
+	if !isConfigSectionName(section) || !isConfigKey(key) {
+		return "", "", "", fmt.Errorf("invalid key: %s", name)
+	}
+	return section, subsection, key, nil
+}
+
+func isConfigSectionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !isAlnum(c) && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// A key starts with a letter and has only letters, digits and "-".
+func isConfigKey(key string) bool {
+	if key == "" || !isAlnum(rune(key[0])) || key[0] >= '0' && key[0] <= '9' {
+		return false
+	}
+	for _, c := range key {
+		if !isAlnum(c) && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAlnum(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (f *configFile) parse(data string) error {
+	f.lines = strings.SplitAfter(data, "\n")
+	if f.lines[len(f.lines)-1] == "" {
+		f.lines = f.lines[:len(f.lines)-1]
+	}
+	f.Vars, f.sections = nil, nil
+	p := configParser{data: data, file: f.Path}
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return nil
+		}
+		switch c := p.data[p.pos]; {
+		case c == '#' || c == ';':
+			p.skipLine()
+		case c == '[':
+			start, line := p.pos, p.line
+			section, subsection, err := p.header()
+			if err != nil {
+				return err
+			}
+			f.sections = append(f.sections, configSection{section, subsection, line, p.data[start:p.pos]})
+		default:
+			if len(f.sections) == 0 {
+				return p.error()
+			}
+			v, err := p.variable()
+			if err != nil {
+				return err
+			}
+			current := f.sections[len(f.sections)-1]
+			v.Section, v.Subsection, v.File = current.Section, current.Subsection, f.Path
+			v.header = len(f.sections) - 1
+			f.Vars = append(f.Vars, v)
+		}
+	}
+}
+
+type configParser struct {
+	data string
+	pos  int
+	line int
+	file string
+}
+
+func (p *configParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *configParser) error() error {
+	return fmt.Errorf("bad config line %d in file %s", p.line+1, p.file)
+}
+
+func (p *configParser) skipSpace(newlines bool) {
+	for !p.eof() {
+		switch p.data[p.pos] {
+		case '\n':
+			if !newlines {
+				return
+			}
+			p.line++
+		case ' ', '\t', '\r':
+		default:
+			return
+		}
+		p.pos++
+	}
+}
+
+func (p *configParser) skipLine() {
+	for !p.eof() && p.data[p.pos] != '\n' {
+		p.pos++
+	}
+}
+
+// Parse "[section]", "[section "subsection"]" or the old "[section.subsection]",
+// where the subsection is lower-cased.
+func (p *configParser) header() (string, string, error) {
+	p.pos++
+	start := p.pos
+	for !p.eof() && p.data[p.pos] != ']' && p.data[p.pos] != ' ' && p.data[p.pos] != '\t' && p.data[p.pos] != '\n' {
+		p.pos++
+	}
+	name := p.data[start:p.pos]
+	if !isConfigSectionName(name) {
+		return "", "", p.error()
+	}
+	section, subsection := strings.ToLower(name), ""
+	if dot := strings.Index(section, "."); dot >= 0 {
+		section, subsection = section[:dot], section[dot+1:]
+	}
+	p.skipSpace(false)
+	if !p.eof() && p.data[p.pos] == '"' {
+		if strings.Contains(name, ".") {
+			return "", "", p.error()
+		}
+		var sub strings.Builder
+		for p.pos++; ; p.pos++ {
+			if p.eof() || p.data[p.pos] == '\n' {
+				return "", "", p.error()
+			}
+			c := p.data[p.pos]
+			if c == '"' {
+				break
+			}
+			if c == '\\' && p.pos+1 < len(p.data) && p.data[p.pos+1] != '\n' {
+				p.pos++
+				c = p.data[p.pos]
+			}
+			sub.WriteByte(c)
+		}
+		p.pos++
+		subsection = sub.String()
+	}
+	if p.eof() || p.data[p.pos] != ']' {
+		return "", "", p.error()
+	}
+	p.pos++
+	return section, subsection, nil
+}
+
+// Parse "key = value" or a lone "key", the value possibly quoted, escaped
+// and continued over lines ending in a backslash.
+func (p *configParser) variable() (configVar, error) {
+	v := configVar{start: p.line}
+	start := p.pos
+	for !p.eof() && (isAlnum(rune(p.data[p.pos])) || p.data[p.pos] == '-') {
+		p.pos++
+	}
+	v.key = p.data[start:p.pos]
+	v.Key = strings.ToLower(v.key)
+	if !isConfigKey(v.Key) {
+		return v, p.error()
+	}
+	p.skipSpace(false)
+	switch {
+	case p.eof() || p.data[p.pos] == '\n' || p.data[p.pos] == '#' || p.data[p.pos] == ';':
+		v.NoValue = true
+		p.skipLine()
+	case p.data[p.pos] == '=':
+		p.pos++
+		value, err := p.value()
+		if err != nil {
+			return v, err
+		}
+		v.Value = value
+	default:
+		return v, p.error()
+	}
+	v.end = p.line + 1
+	return v, nil
+}
+
+func (p *configParser) value() (string, error) {
+	var b strings.Builder
+	quoted, spaces := false, 0
+	for ; !p.eof(); p.pos++ {
+		c := p.data[p.pos]
+		if c == '\n' {
+			if quoted {
+				return "", p.error()
+			}
+			break
+		}
+		if !quoted && (c == '#' || c == ';') {
+			p.skipLine()
+			break
+		}
+		if !quoted && (c == ' ' || c == '\t' || c == '\r') {
+			// Spaces are kept between words but not around the value.
+			if b.Len() > 0 {
+				spaces++
+			}
+			continue
+		}
+		for ; spaces > 0; spaces-- {
+			b.WriteByte(' ')
+		}
+		switch c {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			p.pos++
+			if p.eof() {
+				return "", p.error()
+			}
+			switch p.data[p.pos] {
+			case '\n':
+				p.line++
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'b':
+				b.WriteByte('\b')
+			case '\\', '"':
+				b.WriteByte(p.data[p.pos])
+			default:
+				return "", p.error()
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quoted {
+		return "", p.error()
+	}
+	return b.String(), nil
+}
+
+// Quote and escape a value so that it reads back as written.
+func formatConfigValue(value string) string {
+	var b strings.Builder
+	quote := value != strings.TrimSpace(value) || strings.ContainsAny(value, "#;")
+	if quote {
+		b.WriteByte('"')
+	}
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quote {
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func formatConfigHeader(section, subsection string) string {
+	if subsection == "" {
+		return "[" + section + "]"
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(subsection)
+	return fmt.Sprintf("[%s \"%s\"]", section, escaped)
+}
+
+// The key of a name as the caller spelled it, which is how it is written.
+func writtenKey(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+func formatConfigVar(key, value string) string {
+	return fmt.Sprintf("\t%s = %s\n", key, formatConfigValue(value))
+}
+
+// Replace lines [start, end) and parse the file again.
+func (f *configFile) splice(start, end int, lines ...string) {
+	edited := append(append(append([]string{}, f.lines[:start]...), lines...), f.lines[end:]...)
+	// The file was valid before and stays so.
+	must(f.parse(strings.Join(edited, "")))
+}
+
+// Give a variable a new value, written with the key as given.
+func (f *configFile) replace(v configVar, key, value string) {
+	f.splice(v.start, v.end, formatConfigVar(key, value))
+}
+
+// Remove a variable's lines, keeping a section header written on the same
+// line. Like git, a section left with nothing in it goes too.
+func (f *configFile) remove(v configVar) {
+	var keep []string
+	if header := f.sections[v.header]; header.line == v.start {
+		keep = append(keep, header.text+"\n")
+	}
+	f.splice(v.start, v.end, keep...)
+	for _, other := range f.Vars {
+		if other.header == v.header {
+			return
+		}
+	}
+	start, end := f.sectionLines(v.header)
+	for _, line := range f.lines[start+1 : end] {
+		if strings.TrimSpace(line) != "" {
+			return
+		}
+	}
+	f.splice(start, end)
+}
+
+// Lines [start, end) of a section block, from its header to the next.
+func (f *configFile) sectionLines(header int) (int, int) {
+	end := len(f.lines)
+	if header+1 < len(f.sections) {
+		end = f.sections[header+1].line
+	}
+	return f.sections[header].line, end
+}
+
+func (f *configFile) matching(name string) ([]configVar, error) {
+	section, subsection, key, err := splitConfigName(name)
+	if err != nil {
+		return nil, err
+	}
+	var vars []configVar
+	for _, v := range f.Vars {
+		if v.is(section, subsection, key) {
+			vars = append(vars, v)
+		}
+	}
+	return vars, nil
+}
+
+// Set a variable, replacing its one value or adding it. A multi-valued
+// variable is not replaced.
+func (f *configFile) set(name, value string) error {
+	vars, err := f.matching(name)
+	switch {
+	case err != nil:
+		return err
+	case len(vars) > 1:
+		return fmt.Errorf("warning: %s has multiple values", name)
+	case len(vars) == 1:
+		f.replace(vars[0], writtenKey(name), value)
+		return nil
+	}
+	return f.add(name, value)
+}
+
+// Add a value to a variable after the last variable of the last section it
+// belongs in, appending the section if there is none.
+func (f *configFile) add(name, value string) error {
+	section, subsection, _, err := splitConfigName(name)
+	if err != nil {
+		return err
+	}
+	key := writtenKey(name)
+	header := -1
+	for i, s := range f.sections {
+		if s.Section == section && s.Subsection == subsection {
+			header = i
+		}
+	}
+	if header < 0 {
+		lines := []string{formatConfigHeader(section, subsection) + "\n", formatConfigVar(key, value)}
+		if n := len(f.lines); n > 0 && !strings.HasSuffix(f.lines[n-1], "\n") {
+			lines = append([]string{"\n"}, lines...)
+		}
+		f.splice(len(f.lines), len(f.lines), lines...)
+		return nil
+	}
+	at := f.sections[header].line + 1
+	for _, v := range f.Vars {
+		if v.header == header {
+			at = v.end
+		}
+	}
+	f.splice(at, at, formatConfigVar(key, value))
+	return nil
+}
+
+// Remove every value of a variable, reporting how many there were.
+func (f *configFile) unset(name string) (int, error) {
+	vars, err := f.matching(name)
+	if err != nil {
+		return 0, err
+	}
+	for i := len(vars) - 1; i >= 0; i-- {
+		f.remove(vars[i])
+	}
+	return len(vars), nil
+}
+
+// Remove every block of a section with all it holds, reporting whether
+// there was one.
+func (f *configFile) removeSection(section, subsection string) bool {
+	found := false
+	for i := len(f.sections) - 1; i >= 0; i-- {
+		s := f.sections[i]
+		if s.Section != section || s.Subsection != subsection {
+			continue
+		}
+		start, end := f.sectionLines(i)
+		f.splice(start, end)
+		found = true
+	}
+	return found
+}
+
+// Give a section a new subsection, reporting whether there was one.
+func (f *configFile) renameSection(section, oldSubsection, newSubsection string) bool {
+	found := false
+	for _, s := range f.sections {
+		if s.Section != section || s.Subsection != oldSubsection {
+			continue
+		}
+		line := strings.Replace(f.lines[s.line], s.text, formatConfigHeader(section, newSubsection), 1)
+		f.splice(s.line, s.line+1, line)
+		found = true
+	}
+	return found
+}
+
+func (f *configFile) save() error {
+	return writeFile(f.Path, []byte(strings.Join(f.lines, "")))
+}
+
+// Read a config file, edit it and write it back.
+func editConfigFile(path string, edit func(f *configFile) error) error {
+	f, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if err := edit(f); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+// Set a variable in the repository's config file.
+func setConfigValue(localDir, name, value string) error {
+	return editConfigFile(repositoryConfigPath(localDir), func(f *configFile) error {
+		return f.set(name, value)
+	})
+}
+
+func unsetConfigValue(localDir, name string) error {
+	return editConfigFile(repositoryConfigPath(localDir), func(f *configFile) error {
+		_, err := f.unset(name)
+		return err
+	})
+}
+
+type configEntry struct {
+	Key   string
+	Value string
+}
+
+// Add variables to a section of the repository's config file, appending
+// the section if it is not there yet.
+func appendConfigSection(localDir, section, subsection string, entries ...configEntry) error {
+	return editConfigSection(localDir, section, subsection, entries, (*configFile).add)
+}
+
+// Set variables of a section of the repository's config file, replacing
+// any values they already have.
+func setConfigSection(localDir, section, subsection string, entries ...configEntry) error {
+	return editConfigSection(localDir, section, subsection, entries, (*configFile).set)
+}
+
+func editConfigSection(localDir, section, subsection string, entries []configEntry, edit func(f *configFile, name, value string) error) error {
+	prefix := section + "."
+	if subsection != "" {
+		prefix += subsection + "."
+	}
+	return editConfigFile(repositoryConfigPath(localDir), func(f *configFile) error {
+		for _, entry := range entries {
+			if err := edit(f, prefix+entry.Key, entry.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The variables a config file sets, with the files it includes read where
+// they are included.
+// ref: https://git-scm.com/docs/git-config#_includes
+func readConfigVars(localDir, path string, depth int) ([]configVar, error) {
+	if depth > 10 {
+		return nil, fmt.Errorf("exceeded maximum include depth (10) while including %s", path)
+	}
+	f, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var vars []configVar
+	for _, v := range f.Vars {
+		vars = append(vars, v)
+		if v.Key != "path" || v.NoValue || !(v.Section == "include" && v.Subsection == "" ||
+			v.Section == "includeif" && includeConditionHolds(localDir, path, v.Subsection)) {
+			continue
+		}
+		included := expandHome(v.Value)
+		if !filepath.IsAbs(included) {
+			included = filepath.Join(filepath.Dir(path), included)
+		}
+		more, err := readConfigVars(localDir, included, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		vars = append(vars, more...)
+	}
+	return vars, nil
+}
+
+// Whether an includeIf condition holds: gitdir:, gitdir/i: or onbranch:.
+func includeConditionHolds(localDir, path, condition string) bool {
+	if pattern, ok := cutPrefix(condition, "onbranch:"); ok {
+		ref, _, err := readHead(localDir)
+		if err != nil || ref == "" {
+			return false
+		}
+		if strings.HasSuffix(pattern, "/") {
+			pattern += "**"
+		}
+		return wildmatch(pattern, branchName(ref))
+	}
+	pattern, ok := cutPrefix(condition, "gitdir:")
+	foldCase := false
+	if !ok {
+		if pattern, ok = cutPrefix(condition, "gitdir/i:"); !ok {
+			return false
+		}
+		foldCase = true
+	}
+	dir, err := filepath.Abs(gitDir(localDir))
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(pattern, "~/"):
+		pattern = expandHome(pattern)
+	case strings.HasPrefix(pattern, "./"):
+		pattern = filepath.Join(filepath.Dir(path), pattern[2:])
+	case !filepath.IsAbs(pattern):
+		pattern = "**/" + pattern
+	}
+	if strings.HasSuffix(condition, "/") {
+		pattern = strings.TrimSuffix(pattern, "/") + "/**"
+	}
+	if foldCase {
+		pattern, dir = strings.ToLower(pattern), strings.ToLower(dir)
+	}
+	return wildmatch(filepath.ToSlash(pattern), filepath.ToSlash(dir))
+}
+
+// The value of section.key for a URL: that of section.<url>.key with the
+// <url> matching it most closely, else section.key, the last one set
+// winning among equals.
+// ref: https://git-scm.com/docs/git-config#Documentation/git-config.txt-httplturlgt
+func urlConfigValue(localDir, section, key, target string) (string, bool) {
+	best, value, found := -1, "", false
+	for _, v := range urlConfigVars(localDir, section, key, target) {
+		score, _ := urlMatchScore(v.Subsection, target)
+		if score >= best {
+			best, value, found = score, v.Value, true
+			if v.NoValue {
+				value = "true"
+			}
+		}
+	}
+	return value, found
+}
+
+// Every definition of section.key and of the section.<url>.key matching a
+// URL, in the order they are set.
+func urlConfigVars(localDir, section, key, target string) []configVar {
+	var vars []configVar
+	for _, v := range allConfigVars(localDir) {
+		if v.Section != section || v.Key != key {
+			continue
+		}
+		if _, ok := urlMatchScore(v.Subsection, target); ok {
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
+
+// Whether a config URL matches a URL and how closely: an exact host beats
+// a "*." wildcard, then a longer path prefix wins, then having a user name.
+// An empty pattern matches everything, least closely.
+func urlMatchScore(pattern, target string) (int, bool) {
+	if pattern == "" {
+		return 0, true
+	}
+	p, err := neturl.Parse(pattern)
+	if err != nil || p.Host == "" {
+		return 0, false
+	}
+	u, err := neturl.Parse(target)
+	if err != nil || !strings.EqualFold(p.Scheme, u.Scheme) || urlPort(p) != urlPort(u) {
+		return 0, false
+	}
+	exactHost, ok := matchHost(strings.ToLower(p.Hostname()), strings.ToLower(u.Hostname()))
+	if !ok {
+		return 0, false
+	}
+	score := 1
+	if exactHost {
+		score += 1 << 20
+	}
+	if p.User != nil {
+		if u.User == nil || p.User.Username() != u.User.Username() {
+			return 0, false
+		}
+		score++
+	}
+	path := strings.TrimSuffix(p.Path, "/")
+	if path != "" && u.Path != path && !strings.HasPrefix(u.Path, path+"/") {
+		return 0, false
+	}
+	return score + 2*len(path), true
+}
+
+// Match a host against one whose labels may be "*", reporting whether the
+// match was exact.
+func matchHost(pattern, host string) (bool, bool) {
+	if pattern == host {
+		return true, true
+	}
+	patternLabels, hostLabels := strings.Split(pattern, "."), strings.Split(host, ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false, false
+	}
+	for i, label := range patternLabels {
+		if label != "*" && label != hostLabels[i] {
+			return false, false
+		}
+	}
+	return false, true
+}
+
+// A URL's port, the scheme's default when not given.
+func urlPort(u *neturl.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
+
+// Interpret a boolean value; unset or unparsable values are false.
+func configBool(localDir, name string) bool {
+	vars := configVars(localDir, name)
+	if len(vars) == 0 {
+		return false
+	}
+	value, _ := vars[len(vars)-1].bool()
+	return value
+}
+
+// An integer value, which may end in k, m or g; unset or unparsable values
+// are the fallback.
+func configInt(localDir, name string, fallback int64) int64 {
+	value, ok := configValue(localDir, name)
+	if !ok {
+		return fallback
+	}
+	n, err := parseConfigInt(value)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// A path value with a leading ~ or ~user expanded.
+func configPath(localDir, name string) (string, bool) {
+	value, ok := configValue(localDir, name)
+	if !ok || value == "" {
+		return "", false
+	}
+	return expandHome(value), true
+}
+
+// A key standing alone is true; other values are read as git reads them.
+func (v configVar) bool() (bool, error) {
+	if v.NoValue {
+		return true, nil
+	}
+	return parseConfigBool(v.Value)
+}
+
+// Read true, yes, on or a non-zero number as true, and false, no, off, 0
+// or an empty value as false.
+func parseConfigBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off", "":
+		return false, nil
+	}
+	if n, err := parseConfigInt(value); err == nil {
+		return n != 0, nil
+	}
+	return false, fmt.Errorf("bad boolean config value '%s'", value)
+}
+
+// Read an integer with an optional k, m or g suffix scaling it by 1024,
+// 1024^2 or 1024^3.
+func parseConfigInt(value string) (int64, error) {
+	scale := int64(1)
+	number := value
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'k', 'K':
+			scale = 1 << 10
+		case 'm', 'M':
+			scale = 1 << 20
+		case 'g', 'G':
+			scale = 1 << 30
+		}
+		if scale > 1 {
+			number = value[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(number, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad numeric config value '%s': invalid unit", value)
+	}
+	if n > math.MaxInt64/scale || n < math.MinInt64/scale {
+		return 0, fmt.Errorf("bad numeric config value '%s': out of range", value)
+	}
+	return n * scale, nil
+}
+
+// Whether an environment variable is set to a true value.
+func envBool(name string) bool {
+	value, _ := parseConfigBool(os.Getenv(name))
+	return value
+}
+
+// Expand a leading ~/ to the home directory, or ~user/ to that user's.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~") {
+		return path
+	}
+	name, rest, _ := strings.Cut(path[1:], "/")
+	home := ""
+	if name == "" {
+		home, _ = os.UserHomeDir()
+	} else if u, err := user.Lookup(name); err == nil {
+		home = u.HomeDir
+	}
+	if home == "" {
+		return path
+	}
+	return filepath.Join(home, rest)
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The variables of a config file as git config --list shows them.
+func listConfigVars(vars []configVar) string {
+	var b strings.Builder
+	for _, v := range vars {
+		if v.NoValue {
+			fmt.Fprintln(&b, v.Name())
+		} else {
+			fmt.Fprintf(&b, "%s=%s\n", v.Name(), v.Value)
+		}
+	}
+	return b.String()
+}
+
+func TestConfigParse(t *testing.T) {
+	isolateConfig(t)
+	path := filepath.Join(t.TempDir(), "config")
+	data := "# a comment\n" +
+		"; another\n" +
+		"[Core]\n" +
+		"\tBare = false ; trailing\n" +
+		"\tflag\n" +
+		"\tspaced =   several   words   here  \n" +
+		"[Section \"Sub Sec\"]\n" +
+		"\tquoted = \" kept # and ; kept \"\n" +
+		"\tescaped = a\\tb\\\\c\\\"d\\n\n" +
+		"\tcontinued = one \\\n   two\n" +
+		"\tmixed = a\"b c\"d\n" +
+		"[old.Sub]\n" +
+		"\tkey=value\n" +
+		"[esc \"a\\\"b\\\\c\"] key = on the header line\n" +
+		"[empty]\n" +
+		"\tvalue =\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// git reads the file the same.
+	if got, want := listConfigVars(f.Vars), runGit(t, "", "config", "--file", path, "--list"); got != want {
+		t.Errorf("read:\n%s\ngit reads:\n%s", got, want)
+	}
+
+	for _, bad := range []string{
+		"key = before a section\n",
+		"[unterminated\n",
+		"[a \"sub\n",
+		"[a.b \"sub\"]\n",
+		"[a]\n\tk = \"open\n",
+		"[a]\n\tk = bad\\q\n",
+		"[a]\n\t1k = v\n",
+		"[a]\n\tk v\n",
+		"[a]\n\tk = trailing\\",
+	} {
+		if err := (&configFile{Path: path}).parse(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func TestConfigEdit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	original := "# a comment at the top\n" +
+		"[core]\n" +
+		"\tbare = false ; changed\n" +
+		"\t# a comment in core\n" +
+		"[user]\n" +
+		"\tname = A U Thor\n" +
+		"[remote \"origin\"]\n" +
+		"\turl = https://example.com/repo.git\n" +
+		"\tfetch = +refs/heads/*:refs/remotes/origin/*\n"
+	if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := editConfigFile(path, func(f *configFile) error {
+		if err := f.set("core.bare", "true"); err != nil {
+			return err
+		}
+		if err := f.add("remote.origin.fetch", "+refs/tags/*:refs/tags/*"); err != nil {
+			return err
+		}
+		if err := f.set("remote.origin.fetch", "x"); err == nil {
+			return fmt.Errorf("set a multi-valued variable")
+		}
+		if err := f.set("new.Sub.Key", "x"); err != nil {
+			return err
+		}
+		if n, err := f.unset("user.name"); n != 1 || err != nil {
+			return fmt.Errorf("unset %d: %v", n, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# a comment at the top\n" +
+		"[core]\n" +
+		"\tbare = true\n" +
+		"\t# a comment in core\n" +
+		"[remote \"origin\"]\n" +
+		"\turl = https://example.com/repo.git\n" +
+		"\tfetch = +refs/heads/*:refs/remotes/origin/*\n" +
+		"\tfetch = +refs/tags/*:refs/tags/*\n" +
+		"[new \"Sub\"]\n" +
+		"\tKey = x\n"
+	if got, _ := os.ReadFile(path); string(got) != want {
+		t.Errorf("edited into:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Sections are renamed and removed whole.
+	err = editConfigFile(path, func(f *configFile) error {
+		if !f.renameSection("remote", "origin", "up\"stream") || f.renameSection("remote", "none", "x") {
+			return fmt.Errorf("renamed the wrong sections")
+		}
+		if !f.removeSection("core", "") || f.removeSection("core", "") {
+			return fmt.Errorf("removed the wrong sections")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runGit(t, "", "config", "--file", path, "--get-all", "remote.up\"stream.fetch"); got != "+refs/heads/*:refs/remotes/origin/*\n+refs/tags/*:refs/tags/*\n" {
+		t.Errorf("git reads the renamed section as:\n%s", got)
+	}
+	if got, _ := os.ReadFile(path); !strings.HasPrefix(string(got), "# a comment at the top\n[remote \"up\\\"stream\"]\n") {
+		t.Errorf("after removing a section:\n%s", got)
+	}
+}
+
+func TestConfigValueRoundTrip(t *testing.T) {
+	isolateConfig(t)
+	path := filepath.Join(t.TempDir(), "config")
+	values := []string{
+		"plain",
+		"",
+		" leading space",
+		"trailing space ",
+		"several  inner  spaces",
+		"a # hash",
+		"a ; semicolon",
+		`say "hi"`,
+		`back\slash`,
+		"new\nline",
+		"tab\there",
+		"C:\\path\\to\\file",
+	}
+	for _, value := range values {
+		err := editConfigFile(path, func(f *configFile) error {
+			return f.set("test.value", value)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := readConfigFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(f.Vars) != 1 || f.Vars[0].Value != value {
+			t.Errorf("%q reads back as %+v", value, f.Vars)
+		}
+		if got := runGit(t, "", "config", "--file", path, "--get", "test.value"); got != value+"\n" {
+			t.Errorf("git reads %q as %q", value, got)
+		}
+	}
+}
+
+func TestConfigIncludes(t *testing.T) {
+	dir := newTestRepo(t)
+	git := filepath.Join(dir, ".git")
+	writeTestFile(t, git, "relative.inc", "[test]\n\torder = included\n\trelative = yes\n")
+	writeTestFile(t, git, "nested.inc", "[include]\n\tpath = relative.inc\n")
+	writeTestFile(t, git, "gitdir.inc", "[test]\n\tgitdir = yes\n")
+	writeTestFile(t, git, "branch.inc", "[test]\n\tbranch = yes\n")
+	writeTestFile(t, git, "never.inc", "[test]\n\tnever = yes\n")
+	writeTestFile(t, os.Getenv("HOME"), "home.inc", "[test]\n\thome = yes\n")
+	config, err := os.OpenFile(repositoryConfigPath(dir), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(config, "[test]\n\torder = before\n"+
+		"[include]\n\tpath = nested.inc\n\tpath = ~/home.inc\n\tpath = missing.inc\n"+
+		"[includeIf \"gitdir:%s/\"]\n\tpath = gitdir.inc\n"+
+		"[includeIf \"gitdir:/nowhere/\"]\n\tpath = never.inc\n"+
+		"[includeIf \"onbranch:mast*\"]\n\tpath = branch.inc\n"+
+		"[includeIf \"onbranch:other\"]\n\tpath = never.inc\n"+
+		"[test]\n\tlast = yes\n", dir)
+	config.Close()
+
+	tests := []struct{ name, want string }{
+		{"test.order", "included"},
+		{"test.relative", "yes"},
+		{"test.home", "yes"},
+		{"test.gitdir", "yes"},
+		{"test.branch", "yes"},
+		{"test.never", ""},
+		{"test.last", "yes"},
+	}
+	for _, tt := range tests {
+		got, _ := configValue(dir, tt.name)
+		if got != tt.want {
+			t.Errorf("%s is %q, want %q", tt.name, got, tt.want)
+		}
+		if theirs := strings.TrimSpace(runGit(t, dir, "config", "--default", "", tt.name)); theirs != got {
+			t.Errorf("%s: git reads %q, we read %q", tt.name, theirs, got)
+		}
+	}
+
+	// Files including each other without end are an error.
+	writeTestFile(t, git, "loop.inc", "[include]\n\tpath = loop.inc\n")
+	if _, err := readConfigVars(dir, filepath.Join(git, "loop.inc"), 0); err == nil || !strings.Contains(err.Error(), "maximum include depth") {
+		t.Errorf("an include loop: %v", err)
+	}
+}
+
+func TestRemoteConfig(t *testing.T) {
+	dir := newTestRepo(t)
+	config := repositoryConfigPath(dir)
+	if err := editConfigFile(config, func(f *configFile) error {
+		f.splice(len(f.lines), len(f.lines), "# kept through every edit\n")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRemote(dir, "origin", "https://example.com/a.git", remoteAddOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRemote(dir, "other", "https://example.com/b.git", remoteAddOptions{Branches: []string{"main", "dev"}, TagOpt: "--no-tags"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRemote(dir, "origin", "https://example.com/c.git", remoteAddOptions{}); err == nil {
+		t.Error("added a remote twice")
+	}
+	for _, bad := range []string{"", "-x", "a..b", "a b"} {
+		if err := AddRemote(dir, bad, "https://example.com/c.git", remoteAddOptions{}); err == nil {
+			t.Errorf("added a remote named %q", bad)
+		}
+	}
+	want := "remote.origin.url https://example.com/a.git\n" +
+		"remote.origin.fetch +refs/heads/*:refs/remotes/origin/*\n" +
+		"remote.other.url https://example.com/b.git\n" +
+		"remote.other.fetch +refs/heads/main:refs/remotes/other/main\n" +
+		"remote.other.fetch +refs/heads/dev:refs/remotes/other/dev\n" +
+		"remote.other.tagopt --no-tags\n"
+	if got := runGit(t, dir, "config", "--get-regexp", `^remote\.`); got != want {
+		t.Errorf("git reads the remotes as:\n%s", got)
+	}
+
+	// Renaming moves the tracking refs and whatever names the remote.
+	tip := commitFiles(t, dir, "", "first", map[string]string{"a": "a\n"})
+	if err := writeRef(dir, "refs/remotes/origin/master", tip); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSymref(dir, "refs/remotes/origin/HEAD", "refs/remotes/origin/master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setConfigSection(dir, "branch", "master", configEntry{"remote", "origin"}, configEntry{"merge", "refs/heads/master"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RenameRemote(dir, "origin", "upstream"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RenameRemote(dir, "origin", "again"); err == nil {
+		t.Error("renamed a remote that is gone")
+	}
+	if err := RenameRemote(dir, "upstream", "other"); err == nil {
+		t.Error("renamed a remote over another")
+	}
+	want = "remote.upstream.url https://example.com/a.git\n" +
+		"remote.upstream.fetch +refs/heads/*:refs/remotes/upstream/*\n"
+	if got := runGit(t, dir, "config", "--get-regexp", `^remote\.upstream\.`); got != want {
+		t.Errorf("git reads the renamed remote as:\n%s", got)
+	}
+	if got, _ := configValue(dir, "branch.master.remote"); got != "upstream" {
+		t.Errorf("branch.master.remote is %q", got)
+	}
+	checkRef(t, dir, "refs/remotes/upstream/master", tip)
+	if target, ok := readSymref(dir, "refs/remotes/upstream/HEAD"); !ok || target != "refs/remotes/upstream/master" {
+		t.Errorf("refs/remotes/upstream/HEAD points at %q", target)
+	}
+	if _, err := readRef(dir, "refs/remotes/origin/master"); err == nil {
+		t.Error("the old tracking ref is still there")
+	}
+
+	// URLs are added, replaced by pattern and deleted.
+	if err := SetRemoteURL(dir, "upstream", "https://mirror.example.com/a.git", "", false, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetRemoteURL(dir, "upstream", "https://new.example.com/a.git", "^https://example", false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := configValues(dir, "remote.upstream.url"); strings.Join(got, " ") != "https://new.example.com/a.git https://mirror.example.com/a.git" {
+		t.Errorf("URLs are %v", got)
+	}
+	if err := SetRemoteURL(dir, "upstream", "example", "", false, false, true); err == nil {
+		t.Error("deleted every URL")
+	}
+	if err := SetRemoteURL(dir, "upstream", "mirror", "", false, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := configValues(dir, "remote.upstream.url"); len(got) != 1 || got[0] != "https://new.example.com/a.git" {
+		t.Errorf("URLs after a delete are %v", got)
+	}
+
+	// Removing takes the tracking refs and the branch settings with it.
+	if err := RemoveRemote(dir, "upstream"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveRemote(dir, "upstream"); err == nil {
+		t.Error("removed a remote twice")
+	}
+	if _, err := readRef(dir, "refs/remotes/upstream/master"); err == nil {
+		t.Error("the tracking ref is still there")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git", "refs", "remotes", "upstream")); !os.IsNotExist(err) {
+		t.Error("the tracking ref directory is still there")
+	}
+	for _, name := range []string{"branch.master.remote", "branch.master.merge", "remote.upstream.url"} {
+		if value, ok := configValue(dir, name); ok {
+			t.Errorf("%s is still %q", name, value)
+		}
+	}
+	if names := remoteNames(dir); len(names) != 1 || names[0] != "other" {
+		t.Errorf("remotes left: %v", names)
+	}
+	if data, _ := os.ReadFile(config); !strings.Contains(string(data), "# kept through every edit\n") {
+		t.Errorf("the comment was lost:\n%s", data)
+	}
+}
+
+// Run the config command in the current repository.
+func runConfig(t *testing.T, args ...string) (string, bool, error) {
+	t.Helper()
+	var ok bool
+	var err error
+	output := captureOutput(t, func() { ok, err = configCmd(args) })
+	return output, ok, err
+}
+
+// The exit status git config has for the same arguments.
+func gitConfigStatus(t *testing.T, dir string, args ...string) int {
+	t.Helper()
+	runGit(t, dir, "version")
+	cmd := exec.Command("git", append([]string{"config"}, args...)...)
+	cmd.Dir = dir
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+func TestConfigCmdTypes(t *testing.T) {
+	dir := newTestRepo(t)
+	writeTestFile(t, dir, ".git/config", "[test]\n"+
+		"\tflag\n\tyes = yes\n\toff = off\n\tzero = 0\n\tkilo = 1k\n\thex = 0x10\n"+
+		"\thome = ~/file\n\tmaybe = maybe\n\tempty =\n")
+	tests := []struct {
+		args []string
+		want string
+		fail bool
+	}{
+		{[]string{"test.flag"}, "\n", false},
+		{[]string{"--type=bool", "test.flag"}, "true\n", false},
+		{[]string{"--bool", "test.yes"}, "true\n", false},
+		{[]string{"--bool", "test.off"}, "false\n", false},
+		{[]string{"--bool", "test.zero"}, "false\n", false},
+		{[]string{"--bool", "test.empty"}, "false\n", false},
+		{[]string{"--bool", "test.maybe"}, "", true},
+		{[]string{"--type=int", "test.kilo"}, "1024\n", false},
+		{[]string{"--int", "test.hex"}, "16\n", false},
+		{[]string{"--int", "test.yes"}, "", true},
+		{[]string{"--type=bool-or-int", "test.kilo"}, "1024\n", false},
+		{[]string{"--bool-or-int", "test.yes"}, "true\n", false},
+		{[]string{"--bool-or-int", "test.flag"}, "true\n", false},
+		{[]string{"--bool-or-int", "test.maybe"}, "", true},
+		{[]string{"--type=path", "test.home"}, filepath.Join(os.Getenv("HOME"), "file") + "\n", false},
+		{[]string{"--path", "test.flag"}, "", true},
+		{[]string{"--get-regexp", "^test\\.(flag|yes)$"}, "test.flag\ntest.yes yes\n", false},
+		{[]string{"--bool", "--get-regexp", "^test\\.(flag|yes)$"}, "test.flag true\ntest.yes true\n", false},
+	}
+	for _, tt := range tests {
+		output, ok, err := runConfig(t, tt.args...)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("config %v gave %q", tt.args, output)
+			}
+			continue
+		}
+		if err != nil || !ok || output != tt.want {
+			t.Errorf("config %v = %q, %v, %v; want %q", tt.args, output, ok, err, tt.want)
+		}
+		// git agrees.
+		if theirs := runGit(t, dir, append([]string{"config"}, tt.args...)...); theirs != tt.want {
+			t.Errorf("git config %v = %q", tt.args, theirs)
+		}
+	}
+	if _, _, err := runConfig(t, "--type=nope", "test.yes"); err == nil {
+		t.Error("took an unknown --type")
+	}
+
+	// Values are written in their canonical form, but paths as given.
+	for _, set := range [][]string{{"--bool", "set.bool", "yes"}, {"--int", "set.int", "2k"}, {"--bool-or-int", "set.either", "on"}, {"--path", "set.path", "~/x"}} {
+		if _, _, err := runConfig(t, set...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := runConfig(t, "--int", "set.bad", "lots"); err == nil {
+		t.Error("set a bad --int")
+	}
+	if got := runGit(t, dir, "config", "--get-regexp", "^set\\."); got != "set.bool true\nset.int 2048\nset.either true\nset.path ~/x\n" {
+		t.Errorf("wrote:\n%s", got)
+	}
+
+	// Nothing found is not an error, but a false result.
+	if output, ok, err := runConfig(t, "--get", "test.none"); ok || err != nil || output != "" {
+		t.Errorf("--get of nothing: %q, %v, %v", output, ok, err)
+	}
+}
+
+func TestConfigCmdExitStatus(t *testing.T) {
+	dir := newTestRepo(t)
+	original := "[test]\n\tmulti = a\n\tmulti = b\n\tone = 1\n"
+	tests := []struct {
+		args   []string
+		status int
+	}{
+		{[]string{"test.multi", "c"}, 5},
+		{[]string{"--unset", "test.multi"}, 5},
+		{[]string{"--unset", "test.none"}, 5},
+		{[]string{"--unset-all", "test.none"}, 5},
+		{[]string{"--unset", "test.multi", "^z"}, 5},
+		{[]string{"--get", "test.one", "("}, 6},
+		{[]string{"--get-all", "test.multi", "!["}, 6},
+		{[]string{"--get-regexp", "("}, 6},
+		{[]string{"test.one", "2", "("}, 6},
+		{[]string{"--unset", "test.one", "["}, 6},
+	}
+	for _, tt := range tests {
+		writeTestFile(t, dir, ".git/config", original)
+		_, _, err := runConfig(t, tt.args...)
+		var exit *exitError
+		if !errors.As(err, &exit) || exit.Status != tt.status {
+			t.Errorf("config %v: %v, want exit status %d", tt.args, err, tt.status)
+		}
+		if got := readTestFile(t, dir, ".git/config"); got != original {
+			t.Errorf("config %v changed the file:\n%s", tt.args, got)
+		}
+		if status := gitConfigStatus(t, dir, tt.args...); status != tt.status {
+			t.Errorf("git config %v exits with %d", tt.args, status)
+		}
+	}
+
+	// A value pattern picks out one value of several.
+	writeTestFile(t, dir, ".git/config", original)
+	steps := [][]string{
+		{"test.multi", "c", "^a$"},
+		{"--add", "test.multi", "d"},
+		{"--unset", "test.multi", "^b$"},
+		{"--replace-all", "test.multi", "e", "!^d$"},
+		{"--unset-all", "test.multi", "^d$"},
+	}
+	for _, args := range steps {
+		if _, _, err := runConfig(t, args...); err != nil {
+			t.Fatalf("config %v: %v", args, err)
+		}
+	}
+	if got := runGit(t, dir, "config", "--get-all", "test.multi"); got != "e\n" {
+		t.Errorf("values left:\n%s", got)
+	}
+	if output, ok, err := runConfig(t, "--get-all", "test.multi", "!e"); ok || err != nil || output != "" {
+		t.Errorf("a negated pattern matched: %q, %v, %v", output, ok, err)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// What a credential helper is told and tells back: where the credential is
+// for, and the user name and password, or with authtype a credential such
+// as a bearer token to send as it is.
+// ref: https://git-scm.com/docs/git-credential#IOFMT
+type credential struct {
+	Protocol   string
+	Host       string // with the port, if any
+	Path       string // only with credential.useHttpPath
+	Username   string
+	Password   string
+	AuthType   string   // "Bearer" and the like, sent with Credential
+	Credential string   // a pre-encoded credential for AuthType
+	WWWAuth    []string // WWW-Authenticate headers of the server's 401
+	Quit       bool     // a helper said to stop asking
+}
+
+// Where credentials for a URL are looked for and stored; its user name and
+// password, if it has them, are taken out of it.
+func newCredential(localDir, rawURL string) (*credential, error) {
+	u, err := neturl.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &credential{Protocol: u.Scheme, Host: u.Host}
+	if u.User != nil {
+		c.Username = u.User.Username()
+		c.Password, _ = u.User.Password()
+	}
+	if useHTTPPath, ok := urlConfigValue(localDir, "credential", "usehttppath", rawURL); ok {
+		if b, _ := parseConfigBool(useHTTPPath); b {
+			c.Path = strings.TrimPrefix(u.Path, "/")
+		}
+	}
+	if c.Username == "" {
+		c.Username, _ = urlConfigValue(localDir, "credential", "username", rawURL)
+	}
+	return c, nil
+}
+
+// The URL a credential is for, as prompts show it.
+func (c *credential) url(withUser bool) string {
+	user := ""
+	if withUser && c.Username != "" {
+		user = neturl.PathEscape(c.Username) + "@"
+	}
+	return c.Protocol + "://" + user + c.Host
+}
+
+func (c *credential) complete() bool {
+	return c.Username != "" && c.Password != "" || c.AuthType != "" && c.Credential != ""
+}
+
+// Write the credential in the helper protocol, up to a blank line.
+func (c *credential) write(w io.Writer) error {
+	var b strings.Builder
+	field := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s=%s\n", key, value)
+		}
+	}
+	b.WriteString("capability[]=authtype\n")
+	field("authtype", c.AuthType)
+	field("credential", c.Credential)
+	field("protocol", c.Protocol)
+	field("host", c.Host)
+	field("path", c.Path)
+	field("username", c.Username)
+	field("password", c.Password)
+	for _, header := range c.WWWAuth {
+		field("wwwauth[]", header)
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Read key=value lines up to a blank line or the end, taking what a helper
+// fills in. Empty values clear a field.
+func (c *credential) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("invalid credential line: %s", line)
+		}
+		switch key {
+		case "protocol":
+			c.Protocol = value
+		case "host":
+			c.Host = value
+		case "path":
+			c.Path = value
+		case "username":
+			c.Username = value
+		case "password":
+			c.Password = value
+		case "authtype":
+			c.AuthType = value
+		case "credential":
+			c.Credential = value
+		case "wwwauth[]":
+			c.WWWAuth = append(c.WWWAuth, value)
+		case "url":
+			u, err := neturl.Parse(value)
+			if err != nil {
+				return err
+			}
+			*c = credential{Protocol: u.Scheme, Host: u.Host, Path: strings.TrimPrefix(u.Path, "/"), WWWAuth: c.WWWAuth}
+			if u.User != nil {
+				c.Username = u.User.Username()
+				c.Password, _ = u.User.Password()
+			}
+		case "quit":
+			c.Quit, _ = parseConfigBool(value)
+		}
+	}
+	return scanner.Err()
+}
+
+// The helpers credential.helper names for a URL, in order; an empty value
+// clears the list so far.
+func credentialHelpers(localDir, rawURL string) []string {
+	var helpers []string
+	for _, v := range urlConfigVars(localDir, "credential", "helper", rawURL) {
+		if v.Value == "" {
+			helpers = nil
+		} else {
+			helpers = append(helpers, v.Value)
+		}
+	}
+	return helpers
+}
+
+// Run a helper with fill, store or erase. Like git, "!" starts a shell
+// command, a path is run as it is and any other name is the git
+// credential-<name> helper.
+// ref: https://git-scm.com/docs/gitcredentials#_custom_helpers
+func runCredentialHelper(helper, action string, c *credential) error {
+	command := "git credential-" + helper
+	switch {
+	case strings.HasPrefix(helper, "!"):
+		command = helper[1:]
+	case filepath.IsAbs(helper):
+		command = helper
+	}
+	cmd := exec.Command("sh", "-c", command+" "+action)
+	var input strings.Builder
+	if err := c.write(&input); err != nil {
+		return err
+	}
+	cmd.Stdin = strings.NewReader(input.String())
+	cmd.Stderr = os.Stderr
+	if action != "get" {
+		return cmd.Run()
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+	return c.read(strings.NewReader(string(output)))
+}
+
+// Fill in the user name and password: from the helpers in turn, then from
+// an askpass program or the terminal.
+// ref: https://git-scm.com/docs/gitcredentials
+func (c *credential) fill(localDir, rawURL string) error {
+	for _, helper := range credentialHelpers(localDir, rawURL) {
+		if err := runCredentialHelper(helper, "get", c); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: credential helper '%s' failed: %v\n", helper, err)
+		}
+		if c.Quit {
+			return fmt.Errorf("credential helper '%s' told us to quit", helper)
+		}
+		if c.complete() {
+			return nil
+		}
+	}
+	if c.Username == "" {
+		username, err := credentialPrompt(localDir, fmt.Sprintf("Username for '%s': ", c.url(false)), true)
+		if err != nil {
+			return err
+		}
+		c.Username = username
+	}
+	if c.Password == "" {
+		password, err := credentialPrompt(localDir, fmt.Sprintf("Password for '%s': ", c.url(true)), false)
+		if err != nil {
+			return err
+		}
+		c.Password = password
+	}
+	return nil
+}
+
+// Tell every helper to store a credential that worked.
+func (c *credential) approve(localDir, rawURL string) {
+	if !c.complete() {
+		return
+	}
+	for _, helper := range credentialHelpers(localDir, rawURL) {
+		runCredentialHelper(helper, "store", c)
+	}
+}
+
+// Tell every helper to forget a credential that was turned down.
+func (c *credential) reject(localDir, rawURL string) {
+	for _, helper := range credentialHelpers(localDir, rawURL) {
+		runCredentialHelper(helper, "erase", c)
+	}
+	c.Password, c.AuthType, c.Credential = "", "", ""
+}
+
+// Ask for a user name or password through GIT_ASKPASS, core.askPass or
+// SSH_ASKPASS, or else on the terminal unless GIT_TERMINAL_PROMPT is 0.
+func credentialPrompt(localDir, prompt string, echo bool) (string, error) {
+	askpass := os.Getenv("GIT_ASKPASS")
+	if askpass == "" {
+		askpass, _ = configValue(localDir, "core.askPass")
+	}
+	if askpass == "" {
+		askpass = os.Getenv("SSH_ASKPASS")
+	}
+	what := strings.SplitN(prompt, " ", 2)[0]
+	if askpass != "" {
+		cmd := exec.Command(askpass, prompt)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("could not read %s: %v", strings.TrimSuffix(prompt, ": "), err)
+		}
+		line, _, _ := strings.Cut(string(output), "\n")
+		return strings.TrimSuffix(line, "\r"), nil
+	}
+	if value, ok := os.LookupEnv("GIT_TERMINAL_PROMPT"); ok {
+		if enabled, _ := parseConfigBool(value); !enabled {
+			return "", fmt.Errorf("could not read %s: terminal prompts disabled", strings.TrimSuffix(prompt, ": "))
+		}
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: No such device or address", strings.TrimSuffix(prompt, ": "))
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, prompt)
+	if !echo {
+		// Passwords are typed unseen, as far as stty allows.
+		if stty(tty, "-echo") == nil {
+			defer func() {
+				stty(tty, "echo")
+				fmt.Fprintln(tty)
+			}()
+		}
+	}
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("could not read %s", what)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func stty(tty *os.File, setting string) error {
+	cmd := exec.Command("stty", setting)
+	cmd.Stdin = tty
+	return cmd.Run()
+}
+
+// Credentials for a host from ~/.netrc, or $NETRC: the machine entry for
+// the host, else the default one, whose login must match any user name
+// already known.
+// ref: https://www.gnu.org/software/inetutils/manual/html_node/The-_002enetrc-file.html
+func netrcCredential(host, username string) (string, string, bool) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", false
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", false
+	}
+	type entry struct{ machine, login, password string }
+	var entries []entry
+	var current *entry
+	tokens := strings.Fields(string(data))
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+			return ""
+		}
+		switch tokens[i] {
+		case "machine":
+			entries = append(entries, entry{machine: next()})
+			current = &entries[len(entries)-1]
+		case "default":
+			entries = append(entries, entry{machine: ""})
+			current = &entries[len(entries)-1]
+		case "login":
+			if value := next(); current != nil {
+				current.login = value
+			}
+		case "password":
+			if value := next(); current != nil {
+				current.password = value
+			}
+		case "account":
+			next()
+		case "macdef":
+			// A macro runs to the next blank line, which Fields cannot see;
+			// nothing else follows a macro in practice.
+			i = len(tokens)
+		}
+	}
+	for _, machine := range []string{host, ""} {
+		for _, e := range entries {
+			if e.machine == machine && e.password != "" && (username == "" || e.login == username) {
+				return e.login, e.password, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// Usage: mygit credential (fill | approve | reject)
+// Read a credential from stdin and fill it in from the helpers, or have them
+// store or erase it, as git credential does.
+// ref: https://git-scm.com/docs/git-credential
+func credentialCmd(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: mygit credential (fill | approve | reject)")
+	}
+	c := &credential{}
+	if err := c.read(os.Stdin); err != nil {
+		return err
+	}
+	rawURL := c.url(false) + "/" + c.Path
+	switch args[0] {
+	case "fill":
+		if err := c.fill(".", rawURL); err != nil {
+			return err
+		}
+		c.WWWAuth = nil
+		var out strings.Builder
+		if err := c.write(&out); err != nil {
+			return err
+		}
+		// Only the fields, without the capability line or the blank line.
+		fields := strings.TrimPrefix(out.String(), "capability[]=authtype\n")
+		fmt.Print(strings.TrimSuffix(fields, "\n"))
+	case "approve":
+		c.approve(".", rawURL)
+	case "reject":
+		c.reject(".", rawURL)
+	default:
+		return fmt.Errorf("unknown action: %s", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A server taking one user name and password with Basic auth, recording the
+// Authorization header of each request.
+func authServer(t *testing.T, username, password string) (server *httptest.Server, host string, sent func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var headers []string
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Get("Authorization"))
+		mu.Unlock()
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	t.Cleanup(server.Close)
+	return server, strings.TrimPrefix(server.URL, "http://"), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, headers...)
+	}
+}
+
+func basicAuth(username, password string) string {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.SetBasicAuth(username, password)
+	return req.Header.Get("Authorization")
+}
+
+// Configure credential helpers in the global config, replacing any before.
+func setCredentialHelpers(t *testing.T, helpers ...string) {
+	t.Helper()
+	var config strings.Builder
+	config.WriteString("[credential]\n")
+	for _, helper := range helpers {
+		config.WriteString(formatConfigVar("helper", helper))
+	}
+	if err := os.WriteFile(filepath.Join(os.Getenv("HOME"), ".gitconfig"), []byte(config.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A "!" helper logging its action and what it is told, and answering get
+// with the lines given.
+func scriptHelper(t *testing.T, answer string) (helper string, log func() string) {
+	t.Helper()
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "log")
+	script := fmt.Sprintf("echo \"$1\" >>'%s'\ncat >>'%s'\nif [ \"$1\" = get ]; then printf '%%s' '%s'; fi\n", logPath, logPath, answer)
+	writeTestFile(t, dir, "helper.sh", script)
+	return "!sh '" + filepath.Join(dir, "helper.sh") + "'", func() string {
+		data, _ := os.ReadFile(logPath)
+		return string(data)
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	isolateHTTPConfig(t)
+	unsetenv(t, "NETRC")
+	helper, log := scriptHelper(t, "username=alice\npassword=secret\n")
+	setCredentialHelpers(t, helper)
+	server, host, sent := authServer(t, "alice", "secret")
+
+	if body, err := getWith(t, server.URL); err != nil || body != "ok" {
+		t.Fatalf("got %q: %v", body, err)
+	}
+	// Nothing is sent before the server asks.
+	if got := sent(); len(got) != 2 || got[0] != "" || got[1] != basicAuth("alice", "secret") {
+		t.Errorf("sent %q", got)
+	}
+	challenge := "wwwauth[]=Basic realm=\"test\"\n"
+	want := "get\ncapability[]=authtype\nprotocol=http\nhost=" + host + "\n" + challenge + "\n" +
+		"store\ncapability[]=authtype\nprotocol=http\nhost=" + host + "\nusername=alice\npassword=secret\n" + challenge + "\n"
+	if got := log(); got != want {
+		t.Errorf("the helper was told:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Credentials turned down a second time are erased, and not tried again.
+	helper, log = scriptHelper(t, "username=alice\npassword=wrong\n")
+	setCredentialHelpers(t, helper)
+	_, err := getWith(t, server.URL)
+	if err == nil || !strings.Contains(err.Error(), "Authentication failed") {
+		t.Errorf("wrong credentials: %v", err)
+	}
+	want = "get\ncapability[]=authtype\nprotocol=http\nhost=" + host + "\n" + challenge + "\n" +
+		"erase\ncapability[]=authtype\nprotocol=http\nhost=" + host + "\nusername=alice\npassword=wrong\n" + challenge + "\n"
+	if got := log(); got != want {
+		t.Errorf("the helper was told:\n%s\nwant:\n%s", got, want)
+	}
+	if got := sent(); len(got) != 4 {
+		t.Errorf("%d requests in all, want 4", len(got))
+	}
+}
+
+func TestCredentialHelperOrder(t *testing.T) {
+	isolateHTTPConfig(t)
+	unsetenv(t, "NETRC")
+	server, _, _ := authServer(t, "alice", "secret")
+	partial, partialLog := scriptHelper(t, "username=alice\n")
+	full, fullLog := scriptHelper(t, "password=secret\n")
+	unused, unusedLog := scriptHelper(t, "username=mallory\npassword=x\n")
+
+	// Helpers are asked in turn until the credential is complete, and an
+	// empty helper clears those before it.
+	setCredentialHelpers(t, unused, "", partial, full, unused)
+	if body, err := getWith(t, server.URL); err != nil || body != "ok" {
+		t.Fatalf("got %q: %v", body, err)
+	}
+	if !strings.HasPrefix(partialLog(), "get\n") || !strings.HasPrefix(fullLog(), "get\n") {
+		t.Errorf("the helpers were not asked:\n%s\n%s", partialLog(), fullLog())
+	}
+	if got := unusedLog(); !strings.HasPrefix(got, "store\n") || strings.Count(got, "store\n") != 1 || strings.Contains(got, "get\n") || !strings.Contains(got, "username=alice\npassword=secret\n") {
+		t.Errorf("the last helper should only be told to store:\n%s", got)
+	}
+
+	// quit=1 stops at once.
+	quitting, _ := scriptHelper(t, "quit=1\n")
+	later, laterLog := scriptHelper(t, "username=alice\npassword=secret\n")
+	setCredentialHelpers(t, quitting, later)
+	if _, err := getWith(t, server.URL); err == nil || !strings.Contains(err.Error(), "told us to quit") {
+		t.Errorf("quit=1: %v", err)
+	}
+	if got := laterLog(); got != "" {
+		t.Errorf("a helper was asked after quit=1:\n%s", got)
+	}
+}
+
+func TestCredentialFromURL(t *testing.T) {
+	isolateHTTPConfig(t)
+	unsetenv(t, "NETRC")
+	helper, log := scriptHelper(t, "")
+	setCredentialHelpers(t, helper)
+	server, host, sent := authServer(t, "alice", "p@ss")
+	url := "http://alice:p%40ss@" + host
+
+	tr, err := newHTTPTransport(t.TempDir(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.URL != server.URL {
+		t.Errorf("the transport keeps the URL %s", tr.URL)
+	}
+	if body, err := getWith(t, url); err != nil || body != "ok" {
+		t.Fatalf("got %q: %v", body, err)
+	}
+	if got := sent(); len(got) != 2 || got[1] != basicAuth("alice", "p@ss") {
+		t.Errorf("sent %q", got)
+	}
+	if got := log(); !strings.HasPrefix(got, "store\n") || strings.Contains(got, "get\n") {
+		t.Errorf("helpers were asked for what the URL had:\n%s", got)
+	}
+
+	// A wrong password in the URL is turned down, and erased.
+	if _, err := getWith(t, "http://alice:wrong@"+host); err == nil || !strings.Contains(err.Error(), "Authentication failed") {
+		t.Errorf("a wrong password: %v", err)
+	}
+	if got := log(); !strings.Contains(got, "erase\n") || !strings.Contains(got, "password=wrong\n") {
+		t.Errorf("the wrong password was not erased:\n%s", got)
+	}
+}
+
+func TestNetrcCredential(t *testing.T) {
+	isolateHTTPConfig(t)
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	t.Setenv("NETRC", netrc)
+	writeTestFile(t, filepath.Dir(netrc), "netrc", "machine example.com login alice password one\n"+
+		"machine example.com\n\tlogin bob\n\taccount ignored\n\tpassword two\n"+
+		"machine 127.0.0.1 login carol password three\n"+
+		"default login dave password four\n")
+	tests := []struct {
+		host, username  string
+		login, password string
+		found           bool
+	}{
+		{"example.com", "", "alice", "one", true},
+		{"example.com", "bob", "bob", "two", true},
+		{"example.com", "dave", "dave", "four", true},
+		{"other.org", "", "dave", "four", true},
+		{"other.org", "erin", "", "", false},
+	}
+	for _, tt := range tests {
+		login, password, found := netrcCredential(tt.host, tt.username)
+		if login != tt.login || password != tt.password || found != tt.found {
+			t.Errorf("netrcCredential(%q, %q) = %q, %q, %v", tt.host, tt.username, login, password, found)
+		}
+	}
+
+	// A matching machine, and the default entry for a user name in the URL.
+	server, host, sent := authServer(t, "carol", "three")
+	if body, err := getWith(t, server.URL); err != nil || body != "ok" {
+		t.Errorf("from the machine entry: %q, %v", body, err)
+	}
+	if got := sent(); len(got) != 2 || got[1] != basicAuth("carol", "three") {
+		t.Errorf("sent %q", got)
+	}
+	server, host, _ = authServer(t, "dave", "four")
+	if body, err := getWith(t, "http://dave@"+host); err != nil || body != "ok" {
+		t.Errorf("from the default entry: %q, %v", body, err)
+	}
+
+	// A wrong netrc password fails without prompting.
+	server, _, sent = authServer(t, "carol", "changed")
+	if _, err := getWith(t, server.URL); err == nil {
+		t.Error("authenticated with a stale netrc password")
+	}
+	if got := sent(); len(got) != 2 {
+		t.Errorf("%d requests with a stale netrc password", len(got))
+	}
+}
+
+func TestCredentialRead(t *testing.T) {
+	c := &credential{Username: "old", WWWAuth: []string{"Basic"}}
+	input := "protocol=https\nhost=example.com\nusername=\npassword=secret\nquit=true\n\nignored=after the blank line\n"
+	if err := c.read(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Protocol != "https" || c.Host != "example.com" || c.Username != "" || c.Password != "secret" || !c.Quit {
+		t.Errorf("read %+v", *c)
+	}
+	// A url line sets every field it has, and clears the others.
+	if err := c.read(strings.NewReader("url=http://bob:pw@host:8080/repo.git\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := credential{Protocol: "http", Host: "host:8080", Path: "repo.git", Username: "bob", Password: "pw", WWWAuth: []string{"Basic"}}
+	if fmt.Sprint(*c) != fmt.Sprint(want) {
+		t.Errorf("read %+v, want %+v", *c, want)
+	}
+	if err := c.read(strings.NewReader("no equals sign\n")); err == nil {
+		t.Error("read a line without a value")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Deltas are found by indexing the base in blocks of this size and looking
+// each position of the target up in that index.
+const deltaBlockSize = 16
+
+// Copies are limited to what a size of zero stands for, as in git.
+const maxCopySize = 0x10000
+
+// Polynomial rolling hash over deltaBlockSize bytes.
+const deltaHashPrime = 0x01000193
+
+var deltaHashTop = func() uint32 {
+	h := uint32(1)
+	for i := 1; i < deltaBlockSize; i++ {
+		h *= deltaHashPrime
+	}
+	return h
+}()
+
+// Keep buckets short so repetitive content does not make matching quadratic.
+const maxDeltaBucket = 64
+
+// Offsets of the blocks of a delta base, by block hash.
+type deltaIndex struct {
+	base   []byte
+	blocks map[uint32][]int
+}
+
+func hashBlock(block []byte) uint32 {
+	h := uint32(0)
+	for _, c := range block {
+		h = h*deltaHashPrime + uint32(c)
+	}
+	return h
+}
+
+func newDeltaIndex(base []byte) *deltaIndex {
+	index := &deltaIndex{base: base, blocks: make(map[uint32][]int)}
+	for i := 0; i+deltaBlockSize <= len(base); i += deltaBlockSize {
+		h := hashBlock(base[i : i+deltaBlockSize])
+		if len(index.blocks[h]) < maxDeltaBucket {
+			index.blocks[h] = append(index.blocks[h], i)
+		}
+	}
+	return index
+}
+
+// Encode target as copy and insert instructions against the indexed base,
+// the inverse of readDeltified. Returns nil if the delta would be larger
+// than maxSize.
+// ref: https://git-scm.com/docs/gitformat-pack#_deltified_representation
+func (index *deltaIndex) createDelta(target []byte, maxSize int) []byte {
+	base := index.base
+	var out bytes.Buffer
+	var varint [binary.MaxVarintLen64]byte
+	out.Write(varint[:binary.PutUvarint(varint[:], uint64(len(base)))])
+	out.Write(varint[:binary.PutUvarint(varint[:], uint64(len(target)))])
+
+	literalStart := 0
+	h, hashed := uint32(0), false
+	for j := 0; j+deltaBlockSize <= len(target); {
+		if !hashed {
+			h, hashed = hashBlock(target[j:j+deltaBlockSize]), true
+		}
+		bestOffset, bestLen := 0, 0
+		for _, offset := range index.blocks[h] {
+			if !bytes.Equal(base[offset:offset+deltaBlockSize], target[j:j+deltaBlockSize]) {
+				continue
+			}
+			n := deltaBlockSize
+			for offset+n < len(base) && j+n < len(target) && base[offset+n] == target[j+n] {
+				n++
+			}
+			if n > bestLen {
+				bestOffset, bestLen = offset, n
+			}
+		}
+		if bestLen == 0 {
+			if j+deltaBlockSize < len(target) {
+				h = (h-uint32(target[j])*deltaHashTop)*deltaHashPrime + uint32(target[j+deltaBlockSize])
+			}
+			j++
+			continue
+		}
+		// Grow the match backwards over bytes not yet emitted.
+		for bestOffset > 0 && j > literalStart && base[bestOffset-1] == target[j-1] {
+			bestOffset, j, bestLen = bestOffset-1, j-1, bestLen+1
+		}
+		writeDeltaInsert(&out, target[literalStart:j])
+		writeDeltaCopy(&out, bestOffset, bestLen)
+		j += bestLen
+		literalStart, hashed = j, false
+		if out.Len() > maxSize {
+			return nil
+		}
+	}
+	writeDeltaInsert(&out, target[literalStart:])
+	if out.Len() > maxSize {
+		return nil
+	}
+	return out.Bytes()
+}
+
+// Insert instructions carry at most 127 bytes each.
+func writeDeltaInsert(out *bytes.Buffer, data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > 0x7f {
+			n = 0x7f
+		}
+		out.WriteByte(byte(n))
+		out.Write(data[:n])
+		data = data[n:]
+	}
+}
+
+// A copy instruction sets a bit for each non-zero byte of the offset and
+// size that follows.
+func writeDeltaCopy(out *bytes.Buffer, offset, length int) {
+	for length > 0 {
+		n := length
+		if n > maxCopySize {
+			n = maxCopySize
+		}
+		cmd, args := msbMask, make([]byte, 0, 7)
+		for i := 0; i < 4; i++ {
+			if b := byte(offset >> (8 * i)); b != 0 {
+				cmd |= 1 << i
+				args = append(args, b)
+			}
+		}
+		if n != maxCopySize {
+			for i := 0; i < 3; i++ {
+				if b := byte(n >> (8 * i)); b != 0 {
+					cmd |= 1 << (4 + i)
+					args = append(args, b)
+				}
+			}
+		}
+		out.WriteByte(cmd)
+		out.Write(args)
+		offset += n
+		length -= n
+	}
+}
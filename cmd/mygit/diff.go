@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Split data into lines, keeping the trailing newline on each line so the
+// content can be reassembled byte for byte.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			lines = append(lines, string(data))
+			break
+		}
+		lines = append(lines, string(data[:i+1]))
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// Git treats content with a NUL byte in the first 8000 bytes as binary.
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// Compute a longest common subsequence of a and b with Myers' O(ND)
+// algorithm, in its linear space form: find the middle snake of an optimal
+// edit script and recurse on either side of it. The result maps every index
+// of a to its matching index in b, or -1 when the line was deleted.
+// ref: http://www.xmailserver.org/diff2.pdf (section 4b)
+func matchLines(a, b []string) []int {
+	// Compare lines by number rather than by content.
+	ids := make(map[string]int)
+	intern := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+	d := &lineDiff{a: intern(a), b: intern(b), matches: make([]int, len(a))}
+	for i := range d.matches {
+		d.matches[i] = -1
+	}
+	size := 2*(len(a)+len(b)) + 3
+	d.forward, d.backward = make([]int, size), make([]int, size)
+	d.compare(0, len(a), 0, len(b))
+	return d.matches
+}
+
+// State of a linear space diff: the lines, the matches found so far and the
+// furthest reaching x on every diagonal, searching from either end. The
+// diagonal arrays are shared by every step of the recursion.
+type lineDiff struct {
+	a, b              []int
+	matches           []int
+	forward, backward []int
+}
+
+// Match a[aLo:aHi] against b[bLo:bHi].
+func (d *lineDiff) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		d.matches[aLo] = bLo
+		aLo, bLo = aLo+1, bLo+1
+	}
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi, bHi = aHi-1, bHi-1
+		d.matches[aHi] = bHi
+	}
+	if aLo == aHi || bLo == bHi {
+		return
+	}
+	x, y, u, v := d.middleSnake(aLo, aHi, bLo, bHi)
+	d.compare(aLo, x, bLo, y)
+	for ; x < u; x, y = x+1, y+1 {
+		d.matches[x] = y
+	}
+	d.compare(u, aHi, v, bHi)
+}
+
+// Find the snake in the middle of an optimal edit script turning
+// a[aLo:aHi] into b[bLo:bHi], from (x, y) to (u, v), by searching forwards
+// from the start and backwards from the end until the two meet. Both
+// ranges must be non-empty and differ at either end.
+//
+// Like git's xdiff, a search that runs past maxDiffCost steps gives up on
+// the best split and cuts at the forward point furthest along, so that
+// very different inputs cost O((N+M) * maxDiffCost) rather than O((N+M)^2).
+func (d *lineDiff) middleSnake(aLo, aHi, bLo, bHi int) (x, y, u, v int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta&1 != 0
+	offset := n + m + 1
+	vf, vb := d.forward, d.backward
+	vf[offset+1], vb[offset+1] = 0, 0
+	for step := 0; ; step++ {
+		if step > maxDiffCost {
+			return d.furthestSplit(aLo, bLo, n, m, step-1)
+		}
+		for k := -step; k <= step; k += 2 {
+			fx := vf[offset+k+1]
+			if k != -step && (k == step || vf[offset+k-1] >= vf[offset+k+1]) {
+				fx = vf[offset+k-1] + 1
+			}
+			fy := fx - k
+			startX, startY := fx, fy
+			for fx < n && fy < m && d.a[aLo+fx] == d.b[bLo+fy] {
+				fx, fy = fx+1, fy+1
+			}
+			vf[offset+k] = fx
+			// The backward search has only reached step-1 here.
+			if kb := delta - k; odd && kb >= -(step-1) && kb <= step-1 && fx+vb[offset+kb] >= n {
+				return aLo + startX, bLo + startY, aLo + fx, bLo + fy
+			}
+		}
+		// Backwards, x and y count from the end of either range.
+		for kb := -step; kb <= step; kb += 2 {
+			bx := vb[offset+kb+1]
+			if kb != -step && (kb == step || vb[offset+kb-1] >= vb[offset+kb+1]) {
+				bx = vb[offset+kb-1] + 1
+			}
+			by := bx - kb
+			startX, startY := bx, by
+			for bx < n && by < m && d.a[aHi-1-bx] == d.b[bHi-1-by] {
+				bx, by = bx+1, by+1
+			}
+			vb[offset+kb] = bx
+			if k := delta - kb; !odd && k >= -step && k <= step && vf[offset+k]+bx >= n {
+				return aHi - bx, bHi - by, aHi - startX, bHi - startY
+			}
+		}
+	}
+}
+
+// How many steps the middle snake search takes before settling for a split
+// that may not be optimal.
+const maxDiffCost = 1024
+
+// The point furthest from the start that the forward search reached within
+// the ranges, taken as an empty snake.
+func (d *lineDiff) furthestSplit(aLo, bLo, n, m, step int) (x, y, u, v int) {
+	offset := n + m + 1
+	bestX, bestY := 0, 0
+	for k := -step; k <= step; k += 2 {
+		fx := d.forward[offset+k]
+		if fy := fx - k; fx <= n && fy >= 0 && fy <= m && fx+fy > bestX+bestY && (fx < n || fy < m) {
+			bestX, bestY = fx, fy
+		}
+	}
+	return aLo + bestX, bLo + bestY, aLo + bestX, bLo + bestY
+}
+
+// Result of a three-way line merge.
+type mergeResult struct {
+	Content   []byte
+	Conflicts int
+}
+
+// Merge ours and theirs against their common base with the diff3 algorithm,
+// wrapping conflicting hunks in conflict markers.
+func mergeLines(base, ours, theirs []byte, oursLabel, theirsLabel string) mergeResult {
+	baseLines, ourLines, theirLines := splitLines(base), splitLines(ours), splitLines(theirs)
+	ourMatch := matchLines(baseLines, ourLines)
+	theirMatch := matchLines(baseLines, theirLines)
+
+	var out bytes.Buffer
+	result := mergeResult{}
+	writeLines := func(lines []string) {
+		for _, line := range lines {
+			out.WriteString(line)
+		}
+	}
+	emitChunk := func(b, o, t []string) {
+		switch {
+		case equalLines(o, b):
+			writeLines(t)
+		case equalLines(t, b), equalLines(o, t):
+			writeLines(o)
+		default:
+			result.Conflicts++
+			out.WriteString("<<<<<<< " + oursLabel + "\n")
+			writeConflictSide(&out, o)
+			out.WriteString("=======\n")
+			writeConflictSide(&out, t)
+			out.WriteString(">>>>>>> " + theirsLabel + "\n")
+		}
+	}
+
+	i, a, b := 0, 0, 0
+	for i < len(baseLines) {
+		if ourMatch[i] == a && theirMatch[i] == b {
+			out.WriteString(baseLines[i])
+			i, a, b = i+1, a+1, b+1
+			continue
+		}
+		// Find the next base line that is stable in both sides.
+		k := i
+		for k < len(baseLines) && (ourMatch[k] < a || theirMatch[k] < b) {
+			k++
+		}
+		if k == len(baseLines) {
+			break
+		}
+		emitChunk(baseLines[i:k], ourLines[a:ourMatch[k]], theirLines[b:theirMatch[k]])
+		i, a, b = k, ourMatch[k], theirMatch[k]
+	}
+	emitChunk(baseLines[i:], ourLines[a:], theirLines[b:])
+	result.Content = out.Bytes()
+	return result
+}
+
+func writeConflictSide(out *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		out.WriteString(line)
+	}
+	if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+		out.WriteString("\n")
+	}
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// A path whose content differs between two trees. Old or New is the zero
+// value when the file was added or deleted.
+type fileChange struct {
+	Name string
+	Old  treeFile
+	New  treeFile
+}
+
+// Compare two flattened trees and return the changed paths in sorted order.
+func diffFiles(old, new map[string]treeFile) []fileChange {
+	var changes []fileChange
+	for name, file := range old {
+		if newFile, ok := new[name]; !ok || newFile != file {
+			changes = append(changes, fileChange{Name: name, Old: file, New: newFile})
+		}
+	}
+	for name, file := range new {
+		if _, ok := old[name]; !ok {
+			changes = append(changes, fileChange{Name: name, New: file})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+func diffTrees(localDir, oldTree, newTree string) ([]fileChange, error) {
+	old, err := flattenTree(localDir, oldTree)
+	if err != nil {
+		return nil, err
+	}
+	new, err := flattenTree(localDir, newTree)
+	if err != nil {
+		return nil, err
+	}
+	return diffFiles(old, new), nil
+}
+
+func blobContent(localDir string, file treeFile) ([]byte, error) {
+	if file.Sha == "" {
+		return nil, nil
+	}
+	return CatFile(localDir, file.Sha)
+}
+
+// Count added and deleted lines of a change. Binary files report ok=false.
+func changeLineCounts(localDir string, change fileChange) (added, deleted int, ok bool, err error) {
+	oldContent, err := blobContent(localDir, change.Old)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	newContent, err := blobContent(localDir, change.New)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if isBinaryForDiff(localDir, change.Name, oldContent, newContent) {
+		return 0, 0, false, nil
+	}
+	oldLines, newLines := splitLines(oldContent), splitLines(newContent)
+	matches := matchLines(oldLines, newLines)
+	common := 0
+	for _, m := range matches {
+		if m >= 0 {
+			common++
+		}
+	}
+	return len(newLines) - common, len(oldLines) - common, true, nil
+}
+
+// Write a "git diff --stat" style summary.
+func writeDiffStat(w io.Writer, localDir string, changes []fileChange) error {
+	type stat struct {
+		name           string
+		added, deleted int
+		binary         bool
+	}
+	stats := make([]stat, 0, len(changes))
+	width, maxChanged := 0, 0
+	for _, change := range changes {
+		added, deleted, ok, err := changeLineCounts(localDir, change)
+		if err != nil {
+			return err
+		}
+		stats = append(stats, stat{change.Name, added, deleted, !ok})
+		if len(change.Name) > width {
+			width = len(change.Name)
+		}
+		if added+deleted > maxChanged {
+			maxChanged = added + deleted
+		}
+	}
+	totalAdded, totalDeleted := 0, 0
+	for _, s := range stats {
+		if s.binary {
+			fmt.Fprintf(w, " %-*s | Bin\n", width, s.name)
+			continue
+		}
+		plus, minus := s.added, s.deleted
+		// Scale the graph so the largest change fits in 50 columns.
+		if maxChanged > 50 {
+			plus, minus = plus*50/maxChanged, minus*50/maxChanged
+		}
+		fmt.Fprintf(w, " %-*s | %d %s%s\n", width, s.name, s.added+s.deleted,
+			strings.Repeat("+", plus), strings.Repeat("-", minus))
+		totalAdded += s.added
+		totalDeleted += s.deleted
+	}
+	summary := fmt.Sprintf(" %d file%s changed", len(stats), plural(len(stats)))
+	if totalAdded > 0 {
+		summary += fmt.Sprintf(", %d insertion%s(+)", totalAdded, plural(totalAdded))
+	}
+	if totalDeleted > 0 {
+		summary += fmt.Sprintf(", %d deletion%s(-)", totalDeleted, plural(totalDeleted))
+	}
+	fmt.Fprintln(w, summary)
+	return nil
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+// Write changes as a git-style unified diff.
+func writePatch(w io.Writer, localDir string, changes []fileChange) error {
+	for _, change := range changes {
+		oldContent, err := blobContent(localDir, change.Old)
+		if err != nil {
+			return err
+		}
+		newContent, err := blobContent(localDir, change.New)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "diff --git a/%s b/%s\n", change.Name, change.Name)
+		oldName, newName := "a/"+change.Name, "b/"+change.Name
+		switch {
+		case change.Old.Sha == "":
+			fmt.Fprintf(w, "new file mode %s\n", change.New.Mode)
+			fmt.Fprintf(w, "index %s..%s\n", shortSha(zeroSha), shortSha(change.New.Sha))
+			oldName = "/dev/null"
+		case change.New.Sha == "":
+			fmt.Fprintf(w, "deleted file mode %s\n", change.Old.Mode)
+			fmt.Fprintf(w, "index %s..%s\n", shortSha(change.Old.Sha), shortSha(zeroSha))
+			newName = "/dev/null"
+		case change.Old.Mode != change.New.Mode:
+			fmt.Fprintf(w, "old mode %s\nnew mode %s\n", change.Old.Mode, change.New.Mode)
+			fmt.Fprintf(w, "index %s..%s\n", shortSha(change.Old.Sha), shortSha(change.New.Sha))
+		default:
+			fmt.Fprintf(w, "index %s..%s %s\n", shortSha(change.Old.Sha), shortSha(change.New.Sha), change.New.Mode)
+		}
+		if change.Old.Sha == change.New.Sha {
+			continue
+		}
+		if isBinaryForDiff(localDir, change.Name, oldContent, newContent) {
+			fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+			continue
+		}
+		fmt.Fprintf(w, "--- %s\n+++ %s\n", oldName, newName)
+		writeHunks(w, splitLines(oldContent), splitLines(newContent), 3)
+	}
+	return nil
+}
+
+// Write the unified diff hunks turning a into b.
+func writeHunks(w io.Writer, a, b []string, context int) {
+	type edit struct {
+		op   byte
+		line string
+		i, j int // position in a and b before this edit
+	}
+	var edits []edit
+	matches := matchLines(a, b)
+	j := 0
+	for i, m := range matches {
+		if m < 0 {
+			edits = append(edits, edit{'-', a[i], i, j})
+			continue
+		}
+		for ; j < m; j++ {
+			edits = append(edits, edit{'+', b[j], i, j})
+		}
+		edits = append(edits, edit{' ', a[i], i, j})
+		j++
+	}
+	for ; j < len(b); j++ {
+		edits = append(edits, edit{'+', b[j], len(a), j})
+	}
+
+	for start := 0; start < len(edits); {
+		// Find the next change and extend the hunk while changes are close.
+		first := start
+		for first < len(edits) && edits[first].op == ' ' {
+			first++
+		}
+		if first == len(edits) {
+			break
+		}
+		last := first
+		for k := first; k < len(edits); k++ {
+			if edits[k].op != ' ' {
+				if k-last-1 > 2*context {
+					break
+				}
+				last = k
+			}
+		}
+		from := first - context
+		if from < start {
+			from = start
+		}
+		if from < 0 {
+			from = 0
+		}
+		to := last + context + 1
+		if to > len(edits) {
+			to = len(edits)
+		}
+		oldCount, newCount := 0, 0
+		for _, e := range edits[from:to] {
+			if e.op != '+' {
+				oldCount++
+			}
+			if e.op != '-' {
+				newCount++
+			}
+		}
+		oldStart, newStart := edits[from].i+1, edits[from].j+1
+		if oldCount == 0 {
+			oldStart--
+		}
+		if newCount == 0 {
+			newStart--
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(oldStart, oldCount), hunkRange(newStart, newCount))
+		for _, e := range edits[from:to] {
+			fmt.Fprintf(w, "%c%s", e.op, e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+		start = to
+	}
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return strconv.Itoa(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
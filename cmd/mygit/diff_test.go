@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMergeLines(t *testing.T) {
+	tests := []struct {
+		name               string
+		base, ours, theirs string
+		want               string
+		conflicts          int
+	}{
+		{
+			name: "changes on one side",
+			base: "a\nb\nc\n", ours: "a\nb\nc\n", theirs: "a\nB\nc\n",
+			want: "a\nB\nc\n",
+		},
+		{
+			name: "changes apart on both sides",
+			base: "a\nb\nc\nd\ne\n", ours: "A\nb\nc\nd\ne\n", theirs: "a\nb\nc\nd\nE\n",
+			want: "A\nb\nc\nd\nE\n",
+		},
+		{
+			name: "the same change on both sides",
+			base: "a\nb\nc\n", ours: "a\nB\nc\n", theirs: "a\nB\nc\n",
+			want: "a\nB\nc\n",
+		},
+		{
+			name: "deletion and change apart",
+			base: "a\nb\nc\nd\ne\n", ours: "a\nc\nd\ne\n", theirs: "a\nb\nc\nd\nE\n",
+			want: "a\nc\nd\nE\n",
+		},
+		{
+			name: "insertions at either end",
+			base: "b\n", ours: "a\nb\n", theirs: "b\nc\n",
+			want: "a\nb\nc\n",
+		},
+		{
+			name: "overlapping changes",
+			base: "a\nb\nc\n", ours: "a\nours\nc\n", theirs: "a\ntheirs\nc\n",
+			want:      "a\n<<<<<<< HEAD\nours\n=======\ntheirs\n>>>>>>> topic\nc\n",
+			conflicts: 1,
+		},
+		{
+			name: "change against deletion",
+			base: "a\nb\nc\n", ours: "a\nc\n", theirs: "a\nB\nc\n",
+			want:      "a\n<<<<<<< HEAD\n=======\nB\n>>>>>>> topic\nc\n",
+			conflicts: 1,
+		},
+		{
+			name: "two overlapping hunks",
+			base: "1\n2\n3\n4\n5\n", ours: "1\nx\n3\ny\n5\n", theirs: "1\nX\n3\nY\n5\n",
+			want:      "1\n<<<<<<< HEAD\nx\n=======\nX\n>>>>>>> topic\n3\n<<<<<<< HEAD\ny\n=======\nY\n>>>>>>> topic\n5\n",
+			conflicts: 2,
+		},
+		{
+			name: "add/add",
+			base: "", ours: "one\n", theirs: "two\n",
+			want:      "<<<<<<< HEAD\none\n=======\ntwo\n>>>>>>> topic\n",
+			conflicts: 1,
+		},
+		{
+			name: "add/add of the same content",
+			base: "", ours: "same\n", theirs: "same\n",
+			want: "same\n",
+		},
+		{
+			name: "conflict without a final newline",
+			base: "a\n", ours: "a\nb", theirs: "a\nc",
+			want:      "a\n<<<<<<< HEAD\nb\n=======\nc\n>>>>>>> topic\n",
+			conflicts: 1,
+		},
+	}
+	for _, tt := range tests {
+		got := mergeLines([]byte(tt.base), []byte(tt.ours), []byte(tt.theirs), "HEAD", "topic")
+		if string(got.Content) != tt.want || got.Conflicts != tt.conflicts {
+			t.Errorf("%s: got %d conflicts in\n%s\nwant %d in\n%s", tt.name, got.Conflicts, got.Content, tt.conflicts, tt.want)
+		}
+	}
+}
+
+// Check that matches pair equal lines in order.
+func checkMatches(t *testing.T, a, b []string, matches []int) int {
+	t.Helper()
+	if len(matches) != len(a) {
+		t.Fatalf("got %d matches for %d lines", len(matches), len(a))
+	}
+	count, last := 0, -1
+	for i, j := range matches {
+		if j < 0 {
+			continue
+		}
+		if j <= last || j >= len(b) || a[i] != b[j] {
+			t.Fatalf("line %d matched to line %d after %d", i, j, last)
+		}
+		count, last = count+1, j
+	}
+	return count
+}
+
+// Length of a longest common subsequence, by dynamic programming.
+func lcsLength(a, b []string) int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func randomLines(r *rand.Rand, n, alphabet int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%d\n", r.Intn(alphabet))
+	}
+	return lines
+}
+
+func TestMatchLinesIsOptimal(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 300; i++ {
+		a, b := randomLines(r, r.Intn(40), 4), randomLines(r, r.Intn(40), 4)
+		if got, want := checkMatches(t, a, b, matchLines(a, b)), lcsLength(a, b); got != want {
+			t.Fatalf("matched %d lines of\n%q\n%q\nwant %d", got, a, b, want)
+		}
+	}
+}
+
+func TestMatchLinesLargeInputs(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	// Completely different inputs are cut short by the cost limit rather
+	// than taking quadratic time and memory.
+	a, b := randomLines(r, 20000, 1000000), randomLines(r, 20000, 1000000)
+	checkMatches(t, a, b, matchLines(a, b))
+
+	// A few edits in a long file still match everything else.
+	a = randomLines(r, 50000, 1000000)
+	b = append([]string(nil), a...)
+	for _, i := range []int{10, 20000, 49999} {
+		b[i] = "changed\n"
+	}
+	if got := checkMatches(t, a, b, matchLines(a, b)); got != len(a)-3 {
+		t.Errorf("matched %d of %d lines", got, len(a)-3)
+	}
+}
+
+func TestMergeTreesFileAgainstDirectory(t *testing.T) {
+	dir := newTestRepo(t)
+	tree := func(files map[string]string) string {
+		commit, err := readCommit(dir, commitFiles(t, dir, "", "tree", files))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return commit.Tree
+	}
+	base := tree(map[string]string{"keep": "k\n"})
+	ours := tree(map[string]string{"keep": "k\n", "a/b": "nested\n"})
+	theirs := tree(map[string]string{"keep": "k\n", "a": "file\n"})
+
+	merge, err := mergeTrees(dir, base, ours, theirs, "HEAD", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range merge.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, " "); got != "a/b a~topic keep" {
+		t.Errorf("merged files: %s", got)
+	}
+	if got := strings.Join(merge.Conflicts, " "); got != "a~topic" {
+		t.Errorf("conflicts: %s", got)
+	}
+	if _, err := writeTreeFromFiles(dir, merge.Files); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := writeTreeFromFiles(dir, map[string]treeFile{"a": {}, "a/b": {}}); err == nil {
+		t.Error("wrote a tree with a file and a directory of the same name")
+	}
+}
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Usage: mygit fetch [--depth=<n>|--deepen=<n>|--unshallow] [--shallow-since=<date>]
+// [--shallow-exclude=<ref>] [<remote> [<refspec>...]]
+func fetchCmd(args []string) error {
+	var options fetchOptions
+	var positional []string
+	for _, arg := range args {
+		if ok, err := parseDeepenOption(arg, &options.Deepen); ok || err != nil {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		switch {
+		case arg == "--unshallow":
+			if !isShallowRepository(".") {
+				return errors.New("--unshallow on a complete repository does not make sense")
+			}
+			options.Deepen.Depth, options.Deepen.Relative = infiniteDepth, false
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option: %s", arg)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	remote := ""
+	if len(positional) > 0 {
+		remote, positional = positional[0], positional[1:]
+	}
+	return Fetch(".", remote, positional, options)
+}
+
+// How a fetch goes beyond updating refs.
+type fetchOptions struct {
+	Deepen deepenOptions // how to change the history of a shallow repository
+}
+
+// Fetch from a remote, updating refs as the refspecs say. Without refspecs
+// the remote's configured ones are used.
+func Fetch(localDir, remoteName string, specs []string, options fetchOptions) error {
+	// Like git, the reflog records the arguments as given.
+	reflogMessage := strings.TrimSpace("fetch " + strings.Join(append([]string{anonymizeURL(remoteName)}, specs...), " "))
+	if remoteName == "" {
+		remoteName = defaultRemote(localDir)
+	}
+	url, named, err := remoteURL(localDir, remoteName)
+	if err != nil {
+		return err
+	}
+	configured, err := configuredRefspecs(localDir, remoteName)
+	if err != nil {
+		return err
+	}
+	refspecs := configured
+	fromCommandLine := len(specs) > 0
+	if fromCommandLine {
+		refspecs = nil
+		for _, spec := range specs {
+			refspec, err := parseRefspec(spec)
+			if err != nil {
+				return err
+			}
+			refspecs = append(refspecs, refspec)
+		}
+	}
+	if len(refspecs) == 0 {
+		// Like git, fetch the remote's HEAD into FETCH_HEAD only.
+		refspecs = []refspec{{Src: "HEAD"}}
+		fromCommandLine = true
+	}
+
+	remote, err := connectRemote(localDir, url)
+	if err != nil {
+		return err
+	}
+	defer remote.close()
+	refs, err := remote.listRefs(refspecPrefixes(refspecs))
+	if err != nil {
+		return err
+	}
+	updates, err := matchRefspecs(refs, refspecs)
+	if err != nil {
+		return err
+	}
+	if fromCommandLine && named {
+		// Remote-tracking refs are updated opportunistically along with
+		// explicitly requested ones.
+		for _, update := range updates {
+			for _, spec := range configured {
+				if dst, ok := spec.match(update.Remote.Name); ok {
+					updates = append(updates, refUpdate{Remote: update.Remote, Local: dst, Force: spec.Force})
+					break
+				}
+			}
+		}
+	}
+
+	remote.Shallow = sortedKeys(shallowCommits(localDir))
+	remote.Deepen = options.Deepen
+	// A promisor remote keeps sending what the partial clone asked for.
+	if remote.Filter, err = remoteFilter(localDir, remoteName); err != nil {
+		return err
+	}
+	if remote.Filter.Spec != "" && !remote.fetchSupports("filter") {
+		fmt.Fprintln(os.Stderr, "warning: filtering not recognized by server, ignoring")
+		remote.Filter = objectFilter{}
+	}
+	if err := remote.checkShallowSupport(); err != nil {
+		return err
+	}
+	// When deepening, tips we already have are wanted too, since the
+	// history below them changes.
+	var wants []string
+	wanted := make(map[string]bool)
+	for _, update := range updates {
+		if sha := update.Remote.Sha; !wanted[sha] && (options.Deepen.requested() || !hasObject(localDir, sha)) {
+			wanted[sha] = true
+			wants = append(wants, sha)
+		}
+	}
+	if len(wants) > 0 {
+		walker, err := newHaveWalker(localDir)
+		if err != nil {
+			return err
+		}
+		common, err := remote.negotiate(wants, walker)
+		if err != nil {
+			return err
+		}
+		pack, err := remote.fetchPack(wants, common)
+		if err != nil {
+			return err
+		}
+		promisor := configBool(localDir, "remote."+remoteName+".promisor")
+		_, err = indexPack(localDir, pack, indexPackOptions{UnpackLimit: unpackLimit(localDir, "fetch"), Promisor: promisor, Progress: progressEnabled()})
+		pack.Close()
+		if err != nil {
+			return err
+		}
+		if err := updateShallow(localDir, remote.NewShallow, remote.Unshallow); err != nil {
+			return err
+		}
+	}
+
+	// Refs given on the command line, or else the current branch's upstream,
+	// are the ones to merge; git lists them first.
+	mergeRef := upstreamRef(localDir, remoteName)
+	for i := range updates {
+		updates[i].ForMerge = fromCommandLine || updates[i].Remote.Name == mergeRef
+	}
+	sort.SliceStable(updates, func(i, j int) bool { return updates[i].ForMerge && !updates[j].ForMerge })
+
+	displayURL := shortRemoteURL(url)
+	if err := writeFetchHead(localDir, displayURL, updates); err != nil {
+		return err
+	}
+	return applyRefUpdates(localDir, displayURL, updates, reflogMessage)
+}
+
+// The remote branch the current branch merges from, if it tracks remoteName.
+func upstreamRef(localDir, remoteName string) string {
+	ref, _, err := readHead(localDir)
+	if err != nil || ref == "" {
+		return ""
+	}
+	if remote, _ := configValue(localDir, "branch."+branchName(ref)+".remote"); remote != remoteName {
+		return ""
+	}
+	merge, _ := configValue(localDir, "branch."+branchName(ref)+".merge")
+	return merge
+}
+
+// Look up a configured remote's URL. A name that looks like a URL is used as
+// one, which named reports.
+func remoteURL(localDir, remoteName string) (url string, named bool, err error) {
+	if url, ok := configValue(localDir, "remote."+remoteName+".url"); ok {
+		return url, true, nil
+	}
+	if !strings.Contains(remoteName, "/") {
+		return "", false, fmt.Errorf("'%s' does not appear to be a git repository", remoteName)
+	}
+	return remoteName, false, nil
+}
+
+// A URL as git fetch shows it, without trailing slashes or ".git".
+func shortRemoteURL(url string) string {
+	url = strings.TrimRight(anonymizeURL(url), "/")
+	if len(url) > 8 && strings.HasSuffix(url, ".git") {
+		url = strings.TrimSuffix(url, ".git")
+	}
+	return url
+}
+
+// The remote of the current branch, or origin.
+func defaultRemote(localDir string) string {
+	if ref, _, err := readHead(localDir); err == nil && ref != "" {
+		if remote, ok := configValue(localDir, "branch."+branchName(ref)+".remote"); ok {
+			return remote
+		}
+	}
+	return "origin"
+}
+
+// A refspec such as "+refs/heads/*:refs/remotes/origin/*".
+// ref: https://git-scm.com/book/en/v2/Git-Internals-The-Refspec
+type refspec struct {
+	Src   string
+	Dst   string // "" to only record the ref in FETCH_HEAD
+	Force bool
+}
+
+func parseRefspec(spec string) (refspec, error) {
+	r := refspec{}
+	if strings.HasPrefix(spec, "+") {
+		r.Force, spec = true, spec[1:]
+	}
+	r.Src, r.Dst, _ = strings.Cut(spec, ":")
+	if r.Src == "" || strings.Count(r.Src, "*") > 1 || strings.Count(r.Src, "*") != strings.Count(r.Dst, "*") && r.Dst != "" {
+		return refspec{}, fmt.Errorf("invalid refspec '%s'", spec)
+	}
+	return r, nil
+}
+
+// Fetch refspecs configured as remote.<name>.fetch, in order.
+func configuredRefspecs(localDir, remoteName string) ([]refspec, error) {
+	var specs []refspec
+	for _, value := range configValues(localDir, "remote."+remoteName+".fetch") {
+		spec, err := parseRefspec(value)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// Map a remote ref name through the refspec, reporting whether it matches.
+func (r refspec) match(name string) (string, bool) {
+	prefix, suffix, glob := strings.Cut(r.Src, "*")
+	if !glob {
+		return r.Dst, name == r.Src
+	}
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) || len(name) < len(prefix)+len(suffix) {
+		return "", false
+	}
+	return strings.Replace(r.Dst, "*", name[len(prefix):len(name)-len(suffix)], 1), true
+}
+
+// Names a short refspec source could stand for, in git's lookup order.
+func expandRefspecSource(src string) []string {
+	if strings.HasPrefix(src, "refs/") || src == "HEAD" {
+		return []string{src}
+	}
+	return []string{"refs/" + src, "refs/tags/" + src, "refs/heads/" + src, "refs/remotes/" + src}
+}
+
+// Ref prefixes worth asking the server about, or nil for all refs.
+func refspecPrefixes(specs []refspec) []string {
+	var prefixes []string
+	for _, spec := range specs {
+		if prefix, _, glob := strings.Cut(spec.Src, "*"); glob {
+			prefixes = append(prefixes, prefix)
+		} else {
+			prefixes = append(prefixes, expandRefspecSource(spec.Src)...)
+		}
+	}
+	return prefixes
+}
+
+// A remote ref and the local ref it should update, if any.
+type refUpdate struct {
+	Remote   remoteRef
+	Local    string
+	Force    bool
+	ForMerge bool
+}
+
+func matchRefspecs(refs []remoteRef, specs []refspec) ([]refUpdate, error) {
+	byName := make(map[string]remoteRef)
+	for _, ref := range refs {
+		byName[ref.Name] = ref
+	}
+	var updates []refUpdate
+	for _, spec := range specs {
+		if strings.Contains(spec.Src, "*") {
+			for _, ref := range refs {
+				if dst, ok := spec.match(ref.Name); ok {
+					updates = append(updates, refUpdate{Remote: ref, Local: dst, Force: spec.Force})
+				}
+			}
+			continue
+		}
+		found := false
+		for _, name := range expandRefspecSource(spec.Src) {
+			if ref, ok := byName[name]; ok {
+				updates = append(updates, refUpdate{Remote: ref, Local: spec.Dst, Force: spec.Force})
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("couldn't find remote ref %s", spec.Src)
+		}
+	}
+	return updates, nil
+}
+
+// Strip the well-known prefixes from a ref name for display.
+func prettyRefName(name string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		if strings.HasPrefix(name, prefix) {
+			return name[len(prefix):]
+		}
+	}
+	return name
+}
+
+// Record what was fetched in FETCH_HEAD, marking refs not to be merged.
+func writeFetchHead(localDir, url string, updates []refUpdate) error {
+	var content strings.Builder
+	seen := make(map[string]bool)
+	for _, update := range updates {
+		name := update.Remote.Name
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		description := fmt.Sprintf("'%s' of %s", name, url)
+		switch {
+		case name == "HEAD":
+			description = url
+		case strings.HasPrefix(name, "refs/heads/"):
+			description = fmt.Sprintf("branch '%s' of %s", prettyRefName(name), url)
+		case strings.HasPrefix(name, "refs/tags/"):
+			description = fmt.Sprintf("tag '%s' of %s", prettyRefName(name), url)
+		}
+		mark := "not-for-merge"
+		if update.ForMerge {
+			mark = ""
+		}
+		fmt.Fprintf(&content, "%s\t%s\t%s\n", update.Remote.Sha, mark, description)
+	}
+	return writeFile(filepath.Join(gitDir(localDir), "FETCH_HEAD"), []byte(content.String()))
+}
+
+// Move local refs to what was fetched, reporting each change the way git
+// fetch does. Non-fast-forward updates need a forcing refspec.
+func applyRefUpdates(localDir, url string, updates []refUpdate, reflogMessage string) error {
+	width := 10
+	for _, update := range updates {
+		if n := len(prettyRefName(update.Remote.Name)); n > width {
+			width = n
+		}
+	}
+	printedHeader, rejected := false, false
+	report := func(code byte, summary, remoteName, localName, note string) {
+		if !printedHeader {
+			fmt.Fprintf(os.Stderr, "From %s\n", url)
+			printedHeader = true
+		}
+		fmt.Fprintf(os.Stderr, " %c %-17s %-*s -> %s%s\n", code, summary, width, prettyRefName(remoteName), localName, note)
+	}
+
+	done := make(map[string]bool)
+	for _, update := range updates {
+		remoteName, newSha := update.Remote.Name, update.Remote.Sha
+		if update.Local == "" {
+			kind := "branch"
+			if strings.HasPrefix(remoteName, "refs/tags/") {
+				kind = "tag"
+			}
+			report('*', kind, remoteName, "FETCH_HEAD", "")
+			continue
+		}
+		if done[update.Local] {
+			continue
+		}
+		done[update.Local] = true
+		localName := prettyRefName(update.Local)
+		oldSha, err := readRef(localDir, update.Local)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if oldSha == newSha {
+			continue
+		}
+
+		code, summary, note, message := byte(' '), "", "", reflogMessage
+		switch {
+		case oldSha == "":
+			code, message = '*', reflogMessage+": storing head"
+			switch {
+			case strings.HasPrefix(remoteName, "refs/tags/"):
+				summary, message = "[new tag]", reflogMessage+": storing tag"
+			case strings.HasPrefix(remoteName, "refs/heads/"):
+				summary = "[new branch]"
+			default:
+				summary = "[new ref]"
+			}
+		case strings.HasPrefix(update.Local, "refs/tags/"):
+			if !update.Force {
+				report('!', "[rejected]", remoteName, localName, "  (would clobber existing tag)")
+				rejected = true
+				continue
+			}
+			code, summary, note, message = 't', "[tag update]", "", reflogMessage+": updating tag"
+		default:
+			fastForward, err := isFastForward(localDir, oldSha, newSha)
+			if err != nil {
+				return err
+			}
+			switch {
+			case fastForward:
+				summary, message = shortSha(oldSha)+".."+shortSha(newSha), reflogMessage+": fast-forward"
+			case update.Force:
+				code, summary, note = '+', shortSha(oldSha)+"..."+shortSha(newSha), "  (forced update)"
+				message = reflogMessage + ": forced-update"
+			default:
+				report('!', "[rejected]", remoteName, localName, "  (non-fast-forward)")
+				rejected = true
+				continue
+			}
+		}
+		if err := writeRef(localDir, update.Local, newSha); err != nil {
+			return err
+		}
+		if err := appendReflog(localDir, update.Local, oldSha, newSha, message); err != nil {
+			return err
+		}
+		report(code, summary, remoteName, localName, note)
+	}
+	if rejected {
+		return errors.New("some refs were not updated")
+	}
+	return nil
+}
+
+// Report whether moving a ref from oldSha to newSha keeps all of its history.
+func isFastForward(localDir, oldSha, newSha string) (bool, error) {
+	oldCommit, err := peelToCommit(localDir, oldSha)
+	if err != nil {
+		return false, nil
+	}
+	newCommit, err := peelToCommit(localDir, newSha)
+	if err != nil {
+		return false, nil
+	}
+	return isAncestor(localDir, oldCommit, newCommit)
+}
+
+// Walks local history newest first to offer commits as haves, skipping the
+// ancestors of commits the server turned out to have.
+type haveWalker struct {
+	localDir string
+	queue    commitQueue
+	seen     map[string]bool
+	common   map[string]bool
+}
+
+func newHaveWalker(localDir string) (*haveWalker, error) {
+	w := &haveWalker{localDir: localDir, seen: make(map[string]bool), common: make(map[string]bool)}
+	refs, err := localRefs(localDir, "refs/")
+	if err != nil {
+		return nil, err
+	}
+	tips := make([]string, 0, len(refs)+1)
+	for _, sha := range refs {
+		tips = append(tips, sha)
+	}
+	if _, head, err := readHead(localDir); err == nil && head != "" {
+		tips = append(tips, head)
+	}
+	sort.Strings(tips)
+	for _, sha := range tips {
+		if commit, err := peelToCommit(localDir, sha); err == nil {
+			w.push(commit)
+		}
+	}
+	return w, nil
+}
+
+func (w *haveWalker) push(sha string) {
+	if w.seen[sha] {
+		return
+	}
+	commit, err := readCommit(w.localDir, sha)
+	if err != nil {
+		// Objects missing locally cannot be offered.
+		return
+	}
+	w.seen[sha] = true
+	heap.Push(&w.queue, queuedCommit{Sha: sha, When: commit.Committer.When, Parents: commit.Parents})
+}
+
+// Return the next commit to offer.
+func (w *haveWalker) next() (string, bool) {
+	for w.queue.Len() > 0 {
+		c := heap.Pop(&w.queue).(queuedCommit)
+		if w.common[c.Sha] {
+			for _, parent := range c.Parents {
+				w.common[parent] = true
+			}
+			continue
+		}
+		for _, parent := range c.Parents {
+			w.push(parent)
+		}
+		return c.Sha, true
+	}
+	return "", false
+}
+
+func (w *haveWalker) isCommon(sha string) bool {
+	return w.common[sha]
+}
+
+// Remember that the server has a commit, and therefore all of its history.
+func (w *haveWalker) markCommon(sha string) {
+	w.common[sha] = true
+	if commit, err := readCommit(w.localDir, sha); err == nil {
+		for _, parent := range commit.Parents {
+			w.common[parent] = true
+		}
+	}
+}
+
+type queuedCommit struct {
+	Sha     string
+	When    time.Time
+	Parents []string
+}
+
+// A max-heap of commits by committer date.
+type commitQueue []queuedCommit
+
+func (q commitQueue) Len() int            { return len(q) }
+func (q commitQueue) Less(i, j int) bool  { return q[i].When.After(q[j].When) }
+func (q commitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(queuedCommit)) }
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A bare repository named upstream.git in a directory of its own, which
+// serveRepos can serve.
+func bareRepo(t *testing.T) (root, dir string) {
+	t.Helper()
+	isolateConfig(t)
+	root = t.TempDir()
+	dir = filepath.Join(root, "upstream.git")
+	if err := initBare(dir); err != nil {
+		t.Fatal(err)
+	}
+	return root, dir
+}
+
+// Serve the repositories under root over smart HTTP, returning the base URL
+// and the Git-Protocol header of every request.
+func serveRepos(t *testing.T, root string) (string, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var protocols []string
+	handler := &gitHTTPHandler{Root: root, ErrorLog: testLog{t}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		protocols = append(protocols, r.Header.Get("Git-Protocol"))
+		mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), protocols...)
+	}
+}
+
+// Report what a server logs through the test, rather than on stderr where
+// captureOutput may be reading.
+type testLog struct{ t *testing.T }
+
+func (l testLog) Write(p []byte) (int, error) {
+	l.t.Helper()
+	l.t.Log(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// An upstream with master and topic branches, and a clone-to-be with it
+// configured as origin.
+func fetchRepos(t *testing.T) (upstream, local, url string, protocols func() []string) {
+	t.Helper()
+	root, upstream := bareRepo(t)
+	first := commitFiles(t, upstream, "", "first", map[string]string{"a": "a\n"})
+	master := commitFiles(t, upstream, first, "second", map[string]string{"b": "b\n"})
+	topic := commitFiles(t, upstream, first, "topic", map[string]string{"dir/c": "c\n"})
+	for ref, sha := range map[string]string{"refs/heads/master": master, "refs/heads/topic": topic} {
+		if err := writeRef(upstream, ref, sha); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base, protocols := serveRepos(t, root)
+	url = base + "/upstream.git"
+	local = newTestRepo(t)
+	if err := AddRemote(local, "origin", url, remoteAddOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return upstream, local, url, protocols
+}
+
+func checkRef(t *testing.T, dir, ref, want string) {
+	t.Helper()
+	if got, err := readRef(dir, ref); err != nil || got != want {
+		t.Errorf("%s is %s, want %s: %v", ref, got, want, err)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	for _, version := range []string{"2", "0"} {
+		upstream, local, _, protocols := fetchRepos(t)
+		if err := setConfigValue(local, "protocol.version", version); err != nil {
+			t.Fatal(err)
+		}
+		if err := Fetch(local, "origin", nil, fetchOptions{}); err != nil {
+			t.Fatalf("protocol %s: %v", version, err)
+		}
+		for _, branch := range []string{"master", "topic"} {
+			checkRef(t, local, "refs/remotes/origin/"+branch, mustRevParse(t, upstream, branch))
+		}
+		if !equalContents(commitContents(t, local, "origin/topic"), map[string]string{"a": "a\n", "dir/c": "c\n"}) {
+			t.Errorf("protocol %s: fetched the wrong files", version)
+		}
+		for _, protocol := range protocols() {
+			if asked := protocol == "version=2"; asked != (version == "2") {
+				t.Errorf("protocol.version=%s sent Git-Protocol %q", version, protocol)
+			}
+		}
+		runGit(t, local, "fsck", "--strict")
+
+		// Nothing new is nothing to do.
+		before, _ := os.ReadFile(filepath.Join(local, ".git", "FETCH_HEAD"))
+		if err := Fetch(local, "origin", nil, fetchOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if after, _ := os.ReadFile(filepath.Join(local, ".git", "FETCH_HEAD")); string(after) != string(before) {
+			t.Errorf("a second fetch changed FETCH_HEAD to:\n%s", after)
+		}
+	}
+}
+
+func TestFetchRefspecs(t *testing.T) {
+	upstream, local, url, _ := fetchRepos(t)
+	master, topic := mustRevParse(t, upstream, "master"), mustRevParse(t, upstream, "topic")
+
+	// A refspec on the command line updates its destination and, along the
+	// way, the remote-tracking ref.
+	if err := Fetch(local, "origin", []string{"topic:refs/heads/mytopic"}, fetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkRef(t, local, "refs/heads/mytopic", topic)
+	checkRef(t, local, "refs/remotes/origin/topic", topic)
+	if _, err := readRef(local, "refs/remotes/origin/master"); err == nil {
+		t.Error("fetched master too")
+	}
+	// As in git, FETCH_HEAD shows the URL without ".git".
+	display := strings.TrimSuffix(url, ".git")
+	fetchHead := readTestFile(t, local, ".git/FETCH_HEAD")
+	if want := topic + "\t\tbranch 'topic' of " + display + "\n"; fetchHead != want {
+		t.Errorf("FETCH_HEAD is %q, want %q", fetchHead, want)
+	}
+
+	// A URL rather than a remote fetches HEAD into FETCH_HEAD only.
+	if err := Fetch(local, url, nil, fetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if fetchHead := readTestFile(t, local, ".git/FETCH_HEAD"); fetchHead != master+"\t\t"+display+"\n" {
+		t.Errorf("FETCH_HEAD is %q", fetchHead)
+	}
+
+	// A rewritten branch needs a forcing refspec.
+	if err := Fetch(local, "origin", []string{"refs/heads/master:refs/heads/m"}, fetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	rewritten := commitFiles(t, upstream, topic, "rewritten", map[string]string{"b": "other\n"})
+	if err := writeRef(upstream, "refs/heads/master", rewritten); err != nil {
+		t.Fatal(err)
+	}
+	err := Fetch(local, "origin", []string{"refs/heads/master:refs/heads/m"}, fetchOptions{})
+	if err == nil || !strings.Contains(err.Error(), "not updated") {
+		t.Errorf("a non-fast-forward fetch gave %v", err)
+	}
+	checkRef(t, local, "refs/heads/m", master)
+	// The configured refspec forces the remote-tracking ref along anyway.
+	checkRef(t, local, "refs/remotes/origin/master", rewritten)
+	if err := Fetch(local, "origin", []string{"+refs/heads/master:refs/heads/m"}, fetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkRef(t, local, "refs/heads/m", rewritten)
+
+	if err := Fetch(local, "origin", []string{"refs/heads/missing"}, fetchOptions{}); err == nil {
+		t.Error("fetched a missing ref")
+	}
+}
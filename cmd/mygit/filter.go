@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// A filter driver configured as filter.<name>.clean, .smudge and .process.
+// ref: https://git-scm.com/docs/gitattributes#_filter
+type filterDriver struct {
+	Name     string
+	Clean    string
+	Smudge   string
+	Process  string
+	Required bool
+}
+
+// Look up the driver named by a path's filter attribute, if any.
+func filterDriverFor(localDir, name string) *filterDriver {
+	filterName := attributesFor(localDir, name)["filter"]
+	if filterName == "" || strings.HasPrefix(filterName, "\x00") {
+		return nil
+	}
+	driver := &filterDriver{Name: filterName}
+	driver.Clean, _ = configValue(localDir, "filter."+filterName+".clean")
+	driver.Smudge, _ = configValue(localDir, "filter."+filterName+".smudge")
+	driver.Process, _ = configValue(localDir, "filter."+filterName+".process")
+	driver.Required = configBool(localDir, "filter."+filterName+".required")
+	return driver
+}
+
+// Run the clean or smudge side of a path's filter driver. Content passes
+// through unchanged when no driver is configured.
+func applyFilter(localDir, name, command string, content []byte) ([]byte, error) {
+	driver := filterDriverFor(localDir, name)
+	if driver == nil {
+		return content, nil
+	}
+	external := driver.Clean
+	if command == "smudge" {
+		external = driver.Smudge
+	}
+	var out []byte
+	var err error
+	switch {
+	case driver.Process != "":
+		external = driver.Process
+		out, err = runFilterProcess(localDir, driver.Process, command, name, content)
+	case external != "":
+		out, err = runFilterCommand(localDir, external, name, content)
+	case driver.Name == "lfs":
+		// Without git-lfs installed, pointers are resolved against the local
+		// LFS object store.
+		if command == "clean" {
+			return lfsClean(localDir, content)
+		}
+		return lfsSmudge(localDir, name, content), nil
+	default:
+		if driver.Required {
+			return nil, fmt.Errorf("%s: %s filter '%s' failed", name, command, driver.Name)
+		}
+		return content, nil
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: external filter '%s' failed: %v\n", external, err)
+		if driver.Required {
+			return nil, fmt.Errorf("%s: %s filter '%s' failed", name, command, driver.Name)
+		}
+		return content, nil
+	}
+	return out, nil
+}
+
+// Run a one-shot filter command with the content on stdin. %f in the command
+// is replaced by the quoted path.
+func runFilterCommand(localDir, command, name string, content []byte) ([]byte, error) {
+	command = strings.ReplaceAll(command, "%f", shellQuote(name))
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = localDir
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// A long-running filter speaking the pkt-line filter protocol.
+// ref: https://git-scm.com/docs/gitattributes#_long_running_filter_process
+type filterProcess struct {
+	cmd          *exec.Cmd
+	in           io.WriteCloser
+	out          *bufio.Reader
+	capabilities map[string]bool
+}
+
+// Processes are started once and reused for every file.
+var filterProcesses = make(map[string]*filterProcess)
+
+func startFilterProcess(localDir, command string) (*filterProcess, error) {
+	key := localDir + "\x00" + command
+	if p, ok := filterProcesses[key]; ok {
+		return p, nil
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = localDir
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &filterProcess{cmd: cmd, in: in, out: bufio.NewReader(out), capabilities: make(map[string]bool)}
+	if err := p.handshake(); err != nil {
+		in.Close()
+		cmd.Wait()
+		return nil, fmt.Errorf("initialization for subprocess '%s' failed: %v", command, err)
+	}
+	filterProcesses[key] = p
+	return p, nil
+}
+
+func (p *filterProcess) handshake() error {
+	if err := writePktLines(p.in, "git-filter-client", "version=2"); err != nil {
+		return err
+	}
+	lines, err := readPktLines(p.out)
+	if err != nil {
+		return err
+	}
+	if len(lines) < 2 || lines[0] != "git-filter-server" || lines[1] != "version=2" {
+		return fmt.Errorf("unexpected handshake %q", lines)
+	}
+	if err := writePktLines(p.in, "capability=clean", "capability=smudge"); err != nil {
+		return err
+	}
+	if lines, err = readPktLines(p.out); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if capability, ok := cutPrefix(line, "capability="); ok {
+			p.capabilities[capability] = true
+		}
+	}
+	return nil
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// Read a status list and report its final status; an empty list keeps the
+// previous one.
+func readFilterStatus(r io.Reader, previous string) (string, error) {
+	lines, err := readPktLines(r)
+	if err != nil {
+		return "", err
+	}
+	status := previous
+	for _, line := range lines {
+		if s, ok := cutPrefix(line, "status="); ok {
+			status = s
+		}
+	}
+	return status, nil
+}
+
+func runFilterProcess(localDir, command, filter, name string, content []byte) ([]byte, error) {
+	p, err := startFilterProcess(localDir, command)
+	if err != nil {
+		return nil, err
+	}
+	if !p.capabilities[filter] {
+		// The process does not handle this direction, so there is nothing to do.
+		return content, nil
+	}
+	if err := writePktLines(p.in, "command="+filter, "pathname="+name); err != nil {
+		return nil, err
+	}
+	if err := writePktData(p.in, content); err != nil {
+		return nil, err
+	}
+	status, err := readFilterStatus(p.out, "")
+	if err != nil {
+		return nil, err
+	}
+	if status != "success" {
+		if status == "abort" {
+			p.capabilities[filter] = false
+		}
+		return nil, fmt.Errorf("filter process reported %s for %s", status, name)
+	}
+	out, err := readPktData(p.out)
+	if err != nil {
+		return nil, err
+	}
+	if status, err = readFilterStatus(p.out, status); err != nil {
+		return nil, err
+	}
+	if status != "success" {
+		return nil, fmt.Errorf("filter process reported %s for %s", status, name)
+	}
+	return out, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A long-running filter that upper-cases on clean and lower-cases on smudge.
+// It fails error.txt, aborts on abort.txt, and notes every start in
+// $MYGIT_TEST_FILTER_LOG.
+func filterProcessHelper() int {
+	if log := os.Getenv("MYGIT_TEST_FILTER_LOG"); log != "" {
+		f, err := os.OpenFile(log, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintln(f, "started")
+			f.Close()
+		}
+	}
+	in, out := bufio.NewReader(os.Stdin), os.Stdout
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, "filter:", err)
+		return 1
+	}
+	lines, err := readPktLines(in)
+	if err != nil {
+		return fail(err)
+	}
+	if strings.Join(lines, " ") != "git-filter-client version=2" {
+		return fail(fmt.Errorf("unexpected greeting %q", lines))
+	}
+	if err := writePktLines(out, "git-filter-server", "version=2"); err != nil {
+		return fail(err)
+	}
+	if lines, err = readPktLines(in); err != nil {
+		return fail(err)
+	}
+	if strings.Join(lines, " ") != "capability=clean capability=smudge" {
+		return fail(fmt.Errorf("unexpected capabilities %q", lines))
+	}
+	if err := writePktLines(out, "capability=clean", "capability=smudge"); err != nil {
+		return fail(err)
+	}
+	for {
+		lines, err := readPktLines(in)
+		if err != nil {
+			// git closes the pipe when it is done.
+			return 0
+		}
+		request := make(map[string]string)
+		for _, line := range lines {
+			key, value, _ := strings.Cut(line, "=")
+			request[key] = value
+		}
+		content, err := readPktData(in)
+		if err != nil {
+			return fail(err)
+		}
+		switch request["pathname"] {
+		case "error.txt":
+			err = writePktLines(out, "status=error")
+		case "abort.txt":
+			err = writePktLines(out, "status=abort")
+		default:
+			if request["command"] == "clean" {
+				content = bytes.ToUpper(content)
+			} else {
+				content = bytes.ToLower(content)
+			}
+			if err = writePktLines(out, "status=success"); err == nil {
+				if err = writePktData(out, content); err == nil {
+					// An empty list keeps the status.
+					err = writePktLines(out)
+				}
+			}
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+}
+
+func filterRepo(t *testing.T, attributes string, config map[string]string) string {
+	t.Helper()
+	dir := newTestRepo(t)
+	writeTestFile(t, dir, ".gitattributes", attributes)
+	for name, value := range config {
+		if err := setConfigValue(dir, name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFilterProcess(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "log")
+	t.Setenv("MYGIT_TEST_FILTER_LOG", log)
+	dir := filterRepo(t, "*.txt filter=case\n", map[string]string{
+		"filter.case.process":  helperCommand(t, "filter-process"),
+		"filter.case.required": "true",
+	})
+
+	// Big enough to take several pkt-lines.
+	big := strings.Repeat("abcdefgh", 3*maxPktPayload/8)
+	for _, content := range []string{"hello\n", "", big} {
+		clean, err := cleanContent(dir, "a.txt", []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(clean) != strings.ToUpper(content) {
+			t.Errorf("cleaned %d bytes to %.20q", len(content), clean)
+		}
+		smudge, err := smudgeContent(dir, "b.txt", clean)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(smudge) != content {
+			t.Errorf("smudged %d bytes to %.20q", len(clean), smudge)
+		}
+	}
+	if other, err := cleanContent(dir, "other.dat", []byte("kept")); err != nil || string(other) != "kept" {
+		t.Errorf("a file without the filter became %q: %v", other, err)
+	}
+	if data, _ := os.ReadFile(log); string(data) != "started\n" {
+		t.Errorf("the process was started %d times", strings.Count(string(data), "started"))
+	}
+
+	// A required filter's failure fails the file.
+	if _, err := cleanContent(dir, "error.txt", []byte("x")); err == nil {
+		t.Error("a filter error went unnoticed")
+	}
+	if clean, err := cleanContent(dir, "c.txt", []byte("still\n")); err != nil || string(clean) != "STILL\n" {
+		t.Errorf("the process stopped working after an error: %q, %v", clean, err)
+	}
+	// An abort stops the process being asked to clean at all.
+	if _, err := cleanContent(dir, "abort.txt", []byte("x")); err == nil {
+		t.Error("an abort went unnoticed")
+	}
+	if clean, err := cleanContent(dir, "d.txt", []byte("as is\n")); err != nil || string(clean) != "as is\n" {
+		t.Errorf("cleaned %q after an abort: %v", clean, err)
+	}
+	if smudge, err := smudgeContent(dir, "d.txt", []byte("STILL\n")); err != nil || string(smudge) != "still\n" {
+		t.Errorf("the abort of clean stopped smudge too: %q, %v", smudge, err)
+	}
+}
+
+func TestFilterProcessHandshakeFailure(t *testing.T) {
+	dir := filterRepo(t, "*.txt filter=bad\n*.opt filter=optional\n", map[string]string{
+		"filter.bad.process":      "printf 0010nonsense0000",
+		"filter.bad.required":     "true",
+		"filter.optional.process": "printf 0010nonsense0000",
+	})
+	if _, err := cleanContent(dir, "a.txt", []byte("x")); err == nil {
+		t.Error("a required filter failed its handshake unnoticed")
+	}
+	if clean, err := cleanContent(dir, "a.opt", []byte("x")); err != nil || string(clean) != "x" {
+		t.Errorf("an optional filter failing its handshake gave %q, %v", clean, err)
+	}
+}
+
+func TestFilterCommands(t *testing.T) {
+	dir := filterRepo(t, "*.txt filter=tr\n*.name filter=name\n*.fail filter=fail\n*.soft filter=soft\n", map[string]string{
+		"filter.tr.clean":      "tr a-z A-Z",
+		"filter.tr.smudge":     "tr A-Z a-z",
+		"filter.name.clean":    "printf '%s' %f",
+		"filter.fail.clean":    "false",
+		"filter.fail.required": "true",
+		"filter.soft.clean":    "false",
+	})
+	if clean, err := cleanContent(dir, "a.txt", []byte("abc\n")); err != nil || string(clean) != "ABC\n" {
+		t.Errorf("clean gave %q, %v", clean, err)
+	}
+	if smudge, err := smudgeContent(dir, "a.txt", []byte("ABC\n")); err != nil || string(smudge) != "abc\n" {
+		t.Errorf("smudge gave %q, %v", smudge, err)
+	}
+	// %f is the path, quoted for the shell.
+	if clean, err := cleanContent(dir, "it's $HOME.name", nil); err != nil || string(clean) != "it's $HOME.name" {
+		t.Errorf("%%f gave %q, %v", clean, err)
+	}
+	if _, err := cleanContent(dir, "a.fail", []byte("x")); err == nil {
+		t.Error("a required filter failed unnoticed")
+	}
+	if clean, err := cleanContent(dir, "a.soft", []byte("x")); err != nil || string(clean) != "x" {
+		t.Errorf("an optional failing filter gave %q, %v", clean, err)
+	}
+}
+
+func TestLFSFilter(t *testing.T) {
+	dir := filterRepo(t, "*.bin filter=lfs -text\n", nil)
+	content := []byte("large\x00content")
+	pointer, err := cleanContent(dir, "a.bin", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := parseLFSPointer(pointer)
+	if p == nil || p.Size != int64(len(content)) {
+		t.Fatalf("cleaned to %q", pointer)
+	}
+	if again, err := cleanContent(dir, "b.bin", pointer); err != nil || !bytes.Equal(again, pointer) {
+		t.Errorf("a pointer was not kept as it is: %q", again)
+	}
+	if smudge, err := smudgeContent(dir, "a.bin", pointer); err != nil || !bytes.Equal(smudge, content) {
+		t.Errorf("smudged to %q, %v", smudge, err)
+	}
+
+	// Without the object the pointer stays.
+	if err := os.Remove(lfsObjectPath(dir, p.Oid)); err != nil {
+		t.Fatal(err)
+	}
+	if smudge, err := smudgeContent(dir, "a.bin", pointer); err != nil || !bytes.Equal(smudge, pointer) {
+		t.Errorf("smudged a missing object to %q, %v", smudge, err)
+	}
+
+	for _, bad := range []string{
+		"version https://git-lfs.github.com/spec/v1\noid sha256:abc\nsize 3\n",
+		"version https://example.com/v9\noid sha256:" + strings.Repeat("a", 64) + "\nsize 3\n",
+		"version https://git-lfs.github.com/spec/v1\noid sha256:" + strings.Repeat("a", 64) + "\nsize -1\n",
+		"not a pointer",
+	} {
+		if parseLFSPointer([]byte(bad)) != nil {
+			t.Errorf("parsed %q as a pointer", bad)
+		}
+	}
+}
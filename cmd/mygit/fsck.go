@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Usage: mygit fsck [--no-dangling]
+func fsckCmd(args []string) (bool, error) {
+	dangling := true
+	for _, arg := range args {
+		switch arg {
+		case "--dangling":
+			dangling = true
+		case "--no-dangling":
+			dangling = false
+		default:
+			return false, fmt.Errorf("unknown option: %s", arg)
+		}
+	}
+	return Fsck(".", dangling)
+}
+
+// An object found while checking, with the objects it refers to.
+type fsckObject struct {
+	Type     string
+	Links    []fsckLink
+	Borrowed bool // from an alternate
+	Promisor bool // from a promisor pack, so what it links to may be missing
+}
+
+type fsckLink struct {
+	Sha  string
+	Type string
+}
+
+type fsckChecker struct {
+	localDir string
+	objects  map[string]*fsckObject
+	ok       bool
+	borrow   bool // checking an alternate's objects
+	promisor bool // checking a promisor pack's objects
+}
+
+// Verify every loose and packed object and the packs themselves, then check
+// that everything reachable from refs, reflogs and the index is present.
+// Problems are reported like git does; the result is false if any were
+// errors.
+// ref: https://git-scm.com/docs/git-fsck
+func Fsck(localDir string, dangling bool) (bool, error) {
+	c := &fsckChecker{localDir: localDir, objects: make(map[string]*fsckObject), ok: true}
+	objectDirs := append([]string{filepath.Join(gitDir(localDir), "objects")}, alternateObjectDirs(localDir)...)
+	for i, dir := range objectDirs {
+		// Objects borrowed from alternates are checked too, but never
+		// reported dangling.
+		c.borrow = i > 0
+		if err := c.checkLooseObjects(dir); err != nil {
+			return false, err
+		}
+		packs, err := loadPackDir(filepath.Join(dir, "pack"))
+		if err != nil {
+			return false, err
+		}
+		if err := c.checkPacks(packs); err != nil {
+			return false, err
+		}
+	}
+	reachable, err := c.checkConnectivity()
+	if err != nil {
+		return false, err
+	}
+	if dangling {
+		c.reportDangling(reachable)
+	}
+	return c.ok, nil
+}
+
+func (c *fsckChecker) errorf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+	c.ok = false
+}
+
+// Report a problem found in an object under git's message id.
+func (c *fsckChecker) report(warning bool, objectType, sha, id, message string) {
+	level := "error"
+	if warning {
+		level = "warning"
+	} else {
+		c.ok = false
+	}
+	fmt.Fprintf(os.Stderr, "%s in %s %s: %s: %s\n", level, objectType, sha, id, message)
+}
+
+func (c *fsckChecker) checkLooseObjects(objectsDir string) error {
+	return walkObjectDir(objectsDir, func(sha, filename string) error {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		inflated, err := decompressZlib(bytes.NewBuffer(data))
+		if err != nil {
+			c.errorf("%s: object corrupt or missing: %s", sha, filename)
+			return nil
+		}
+		raw := inflated.Bytes()
+		header, content := Cut(raw, 0x00)
+		objectType, size, ok := strings.Cut(string(header), " ")
+		if _, err := objectTypeCode(objectType); !ok || err != nil || len(header) == len(raw) {
+			c.errorf("unable to parse header of %s", filename)
+			return nil
+		}
+		if n, err := strconv.Atoi(size); err != nil || n != len(content) {
+			c.errorf("%s: object corrupt: declared size %s, actual size %d", sha, size, len(content))
+			return nil
+		}
+		if real := fmt.Sprintf("%x", sha1.Sum(raw)); real != sha {
+			c.errorf("%s: hash-path mismatch, found at: %s", real, filename)
+			return nil
+		}
+		if _, seen := c.objects[sha]; !seen {
+			c.checkObject(sha, objectType, content)
+		}
+		return nil
+	})
+}
+
+// Verify each pack's checksums and the CRC and hash of every object in it.
+func (c *fsckChecker) checkPacks(packs []*packFile) error {
+	for _, pack := range packs {
+		idxName := strings.TrimSuffix(pack.Path, ".pack") + ".idx"
+		trailer := pack.index[len(pack.index)-40:]
+		if !bytes.Equal(sha1Sum(pack.index[:len(pack.index)-20]), trailer[20:]) {
+			c.errorf("%s: bad index file checksum", idxName)
+			continue
+		}
+		data, err := os.ReadFile(pack.Path)
+		if err != nil {
+			return err
+		}
+		if len(data) < 12+20 || string(data[:4]) != "PACK" {
+			c.errorf("%s: not a pack file", pack.Path)
+			continue
+		}
+		if !bytes.Equal(sha1Sum(data[:len(data)-20]), data[len(data)-20:]) {
+			c.errorf("%s pack checksum mismatch", pack.Path)
+		}
+		if !bytes.Equal(data[len(data)-20:], trailer[:20]) || int(binary.BigEndian.Uint32(data[8:12])) != pack.count {
+			c.errorf("packfile %s does not match index", pack.Path)
+			continue
+		}
+
+		// Each object's bytes run up to the next object's offset.
+		order := make([]int, pack.count)
+		for i := range order {
+			order[i] = i
+		}
+		sort.Slice(order, func(a, b int) bool { return pack.offset(order[a]) < pack.offset(order[b]) })
+		for n, i := range order {
+			sha := hex.EncodeToString(pack.sha(i))
+			start, end := pack.offset(i), int64(len(data)-20)
+			if n+1 < len(order) {
+				end = pack.offset(order[n+1])
+			}
+			if start >= end || end > int64(len(data)-20) || crc32.ChecksumIEEE(data[start:end]) != pack.crc(i) {
+				c.errorf("index CRC mismatch for object %s from %s at offset %d", sha, pack.Path, start)
+				continue
+			}
+			obj, err := pack.readAt(c.localDir, start)
+			if err != nil {
+				c.errorf("%s: object corrupt or missing: %v", sha, err)
+				continue
+			}
+			if real, err := obj.sha(); err != nil || real != sha {
+				c.errorf("%s: object corrupt or missing: hash mismatch in %s", sha, pack.Path)
+				continue
+			}
+			if _, seen := c.objects[sha]; !seen {
+				objectType, _ := obj.typeString()
+				c.promisor = pack.Promisor
+				c.checkObject(sha, objectType, obj.Buf)
+				c.promisor = false
+			}
+		}
+	}
+	return nil
+}
+
+func sha1Sum(data []byte) []byte {
+	sum := sha1.Sum(data)
+	return sum[:]
+}
+
+// Check an object's syntax and record what it links to.
+func (c *fsckChecker) checkObject(sha, objectType string, content []byte) {
+	object := &fsckObject{Type: objectType, Borrowed: c.borrow, Promisor: c.promisor}
+	c.objects[sha] = object
+	switch objectType {
+	case "commit":
+		object.Links = c.checkCommit(sha, content)
+	case "tag":
+		object.Links = c.checkTag(sha, content)
+	case "tree":
+		object.Links = c.checkTree(sha, content)
+	}
+}
+
+func isObjectName(s string) bool {
+	return len(s) == 40 && isHex(s) && strings.ToLower(s) == s
+}
+
+func (c *fsckChecker) checkCommit(sha string, content []byte) []fsckLink {
+	header, _, _ := strings.Cut(string(content), "\n\n")
+	lines := strings.Split(header, "\n")
+	var links []fsckLink
+	tree, ok := cutPrefix(lines[0], "tree ")
+	if !ok {
+		c.report(false, "commit", sha, "missingTree", "invalid format - expected 'tree' line")
+		return nil
+	}
+	if !isObjectName(tree) {
+		c.report(false, "commit", sha, "badTreeSha1", "invalid 'tree' line format - bad sha1")
+		return nil
+	}
+	links = append(links, fsckLink{tree, "tree"})
+	lines = lines[1:]
+	for len(lines) > 0 && strings.HasPrefix(lines[0], "parent ") {
+		parent := strings.TrimPrefix(lines[0], "parent ")
+		if !isObjectName(parent) {
+			c.report(false, "commit", sha, "badParentSha1", "invalid 'parent' line format - bad sha1")
+			return links
+		}
+		// A shallow repository lacks the parents of its boundary commits.
+		if !isShallow(c.localDir, sha) {
+			links = append(links, fsckLink{parent, "commit"})
+		}
+		lines = lines[1:]
+	}
+	for _, field := range []string{"author", "committer"} {
+		if len(lines) == 0 || !strings.HasPrefix(lines[0], field+" ") {
+			id := "missingAuthor"
+			if field == "committer" {
+				id = "missingCommitter"
+			}
+			c.report(false, "commit", sha, id, "invalid format - expected '"+field+"' line")
+			return links
+		}
+		if id, message := checkIdent(strings.TrimPrefix(lines[0], field+" ")); id != "" {
+			c.report(false, "commit", sha, id, "invalid author/committer line - "+message)
+		}
+		lines = lines[1:]
+		if field == "author" && len(lines) > 0 && strings.HasPrefix(lines[0], "author ") {
+			c.report(false, "commit", sha, "multipleAuthors", "invalid format - multiple 'author' lines")
+			return links
+		}
+	}
+	return links
+}
+
+// Check a "Name <email> 1234567890 +0000" identity, returning git's message
+// id and text for the first problem.
+func checkIdent(ident string) (string, string) {
+	lt := strings.IndexByte(ident, '<')
+	switch {
+	case lt < 0:
+		return "missingEmail", "missing email"
+	case lt == 0:
+		return "missingNameBeforeEmail", "missing name before email"
+	case ident[lt-1] != ' ':
+		return "missingSpaceBeforeEmail", "missing space before email"
+	}
+	gt := strings.IndexByte(ident[lt:], '>')
+	if gt < 0 || strings.ContainsAny(ident[lt+1:lt+gt], "<\n") {
+		return "badEmail", "bad email"
+	}
+	rest := ident[lt+gt+1:]
+	if !strings.HasPrefix(rest, " ") {
+		return "missingSpaceBeforeDate", "missing space before date"
+	}
+	date, zone, _ := strings.Cut(rest[1:], " ")
+	if len(date) > 1 && date[0] == '0' {
+		return "zeroPaddedDate", "zero-padded date"
+	}
+	if _, err := strconv.ParseUint(date, 10, 64); err != nil {
+		return "badDate", "bad date"
+	}
+	if len(zone) != 5 || (zone[0] != '+' && zone[0] != '-') || strings.Trim(zone[1:], "0123456789") != "" {
+		return "badTimezone", "bad time zone"
+	}
+	return "", ""
+}
+
+func (c *fsckChecker) checkTag(sha string, content []byte) []fsckLink {
+	header, _, _ := strings.Cut(string(content), "\n\n")
+	lines := strings.Split(header, "\n")
+	object, ok := cutPrefix(lines[0], "object ")
+	if !ok {
+		c.report(false, "tag", sha, "missingObject", "invalid format - expected 'object' line")
+		return nil
+	}
+	if !isObjectName(object) {
+		c.report(false, "tag", sha, "badObjectSha1", "invalid 'object' line format - bad sha1")
+		return nil
+	}
+	if len(lines) < 2 || !strings.HasPrefix(lines[1], "type ") {
+		c.report(false, "tag", sha, "missingTypeEntry", "invalid format - unexpected end after 'type' line")
+		return nil
+	}
+	objectType := strings.TrimPrefix(lines[1], "type ")
+	if _, err := objectTypeCode(objectType); err != nil {
+		c.report(false, "tag", sha, "badType", "invalid 'type' value")
+		return nil
+	}
+	if len(lines) < 3 || !strings.HasPrefix(lines[2], "tag ") {
+		c.report(false, "tag", sha, "missingTagEntry", "invalid format - expected 'tag' line")
+	}
+	return []fsckLink{{object, objectType}}
+}
+
+var validTreeModes = map[string]bool{"100644": true, "100755": true, "120000": true, "40000": true, "160000": true, "100664": true}
+
+func (c *fsckChecker) checkTree(sha string, content []byte) []fsckLink {
+	var links []fsckLink
+	reported := make(map[string]bool)
+	report := func(warning bool, id, message string) {
+		if !reported[id] {
+			reported[id] = true
+			c.report(warning, "tree", sha, id, message)
+		}
+	}
+	prevName, prevKey := "", ""
+	for first := true; len(content) > 0; first = false {
+		space := bytes.IndexByte(content, ' ')
+		nul := bytes.IndexByte(content, 0)
+		if space <= 0 || nul < space || len(content) < nul+1+20 {
+			report(false, "badTree", "cannot be parsed as a tree")
+			return links
+		}
+		mode, name := string(content[:space]), string(content[space+1:nul])
+		entrySha := hex.EncodeToString(content[nul+1 : nul+21])
+		content = content[nul+21:]
+		if strings.Trim(mode, "01234567") != "" {
+			report(false, "badTree", "cannot be parsed as a tree")
+			return links
+		}
+
+		switch {
+		case strings.HasPrefix(mode, "0"):
+			report(true, "zeroPaddedFilemode", "contains zero-padded file modes")
+		case !validTreeModes[mode]:
+			report(true, "badFilemode", "contains bad file modes")
+		}
+		switch {
+		case name == "":
+			report(true, "emptyName", "contains empty pathname")
+		case strings.Contains(name, "/"):
+			report(true, "fullPathname", "contains full pathnames")
+		case name == ".":
+			report(true, "hasDot", "contains '.'")
+		case name == "..":
+			report(true, "hasDotdot", "contains '..'")
+		case strings.EqualFold(name, ".git"):
+			report(true, "hasDotgit", "contains '.git'")
+		}
+		if entrySha == zeroSha {
+			report(true, "nullSha1", "contains entries pointing to null sha1")
+		}
+
+		isDir := strings.TrimLeft(mode, "0") == "40000"
+		key := name
+		if isDir {
+			key += "/"
+		}
+		if !first {
+			switch {
+			case name == prevName:
+				report(false, "duplicateEntries", "contains duplicate file entries")
+			case key < prevKey:
+				report(false, "treeNotSorted", "not properly sorted")
+			}
+		}
+		prevName, prevKey = name, key
+
+		switch {
+		case isDir:
+			links = append(links, fsckLink{entrySha, "tree"})
+		case mode == "160000":
+			// Submodule commits live in another repository.
+		default:
+			links = append(links, fsckLink{entrySha, "blob"})
+		}
+	}
+	return links
+}
+
+// Walk from refs, HEAD, reflogs and the index, reporting broken links and
+// missing objects, and return what was reached.
+func (c *fsckChecker) checkConnectivity() (map[string]bool, error) {
+	refs, err := localRefs(c.localDir, "refs/")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := c.objects[refs[name]]; !ok {
+			c.errorf("%s: invalid sha1 pointer %s", name, refs[name])
+		}
+	}
+	headRef, headSha, err := readHead(c.localDir)
+	if err != nil {
+		return nil, err
+	}
+	if headSha == "" {
+		fmt.Fprintf(os.Stderr, "notice: HEAD points to an unborn branch (%s)\n", branchName(headRef))
+	}
+	if len(refs) == 0 {
+		fmt.Fprintln(os.Stderr, "notice: No default references")
+	}
+
+	roots, err := reachabilityRoots(c.localDir)
+	if err != nil {
+		return nil, err
+	}
+	index, err := readIndex(c.localDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range index.files() {
+		if file.Mode != "160000" {
+			roots = append(roots, file.Sha)
+		}
+	}
+
+	reachable := make(map[string]bool)
+	missing := make(map[string]string)
+	stack := []string{}
+	for _, root := range roots {
+		if _, ok := c.objects[root]; ok {
+			stack = append(stack, root)
+		}
+	}
+	for len(stack) > 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if reachable[sha] {
+			continue
+		}
+		reachable[sha] = true
+		object := c.objects[sha]
+		for _, link := range object.Links {
+			target, ok := c.objects[link.Sha]
+			switch {
+			case !ok && object.Promisor:
+				// The promisor remote has it.
+			case !ok:
+				fmt.Printf("broken link from %7s %s\n              to %7s %s\n", object.Type, sha, link.Type, link.Sha)
+				missing[link.Sha] = link.Type
+				c.ok = false
+			case target.Type != link.Type:
+				c.errorf("object %s is a %s, not a %s", link.Sha, target.Type, link.Type)
+			default:
+				stack = append(stack, link.Sha)
+			}
+		}
+	}
+	shas := make([]string, 0, len(missing))
+	for sha := range missing {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+	for _, sha := range shas {
+		fmt.Printf("missing %s %s\n", missing[sha], sha)
+	}
+	return reachable, nil
+}
+
+// Report unreachable objects that no other object refers to either.
+func (c *fsckChecker) reportDangling(reachable map[string]bool) {
+	referenced := make(map[string]bool)
+	for _, object := range c.objects {
+		for _, link := range object.Links {
+			referenced[link.Sha] = true
+		}
+	}
+	var dangling []string
+	for sha := range c.objects {
+		if !reachable[sha] && !referenced[sha] && !c.objects[sha].Borrowed {
+			dangling = append(dangling, sha)
+		}
+	}
+	sort.Strings(dangling)
+	for _, sha := range dangling {
+		fmt.Printf("dangling %s %s\n", c.objects[sha].Type, sha)
+	}
+}
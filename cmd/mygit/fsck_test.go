@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write an object of any type with content as given, however broken.
+func writeRawObject(t *testing.T, dir, objectType, content string) string {
+	t.Helper()
+	sha, err := writeGitObject(dir, []byte(fmt.Sprintf("%s %d\x00%s", objectType, len(content), content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+func runFsck(t *testing.T, dir string, dangling bool) (bool, string) {
+	t.Helper()
+	var ok bool
+	var err error
+	output := captureOutput(t, func() { ok, err = Fsck(dir, dangling) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok, output
+}
+
+// A repository with a two-commit master, its objects loose.
+func fsckRepo(t *testing.T) (dir, tip string) {
+	t.Helper()
+	dir = newTestRepo(t)
+	first := commitFiles(t, dir, "", "first", map[string]string{"a": "a\n", "dir/b": "b\n"})
+	tip = commitFiles(t, dir, first, "second", map[string]string{"a": "changed\n"})
+	if err := writeRef(dir, "refs/heads/master", tip); err != nil {
+		t.Fatal(err)
+	}
+	return dir, tip
+}
+
+func TestFsckClean(t *testing.T) {
+	dir, _ := fsckRepo(t)
+	if ok, output := runFsck(t, dir, true); !ok || output != "" {
+		t.Errorf("fsck of a sound repository: %v\n%s", ok, output)
+	}
+	// Packed objects are checked the same.
+	if err := Repack(dir, true, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if ok, output := runFsck(t, dir, true); !ok || output != "" {
+		t.Errorf("fsck of a packed repository: %v\n%s", ok, output)
+	}
+}
+
+func TestFsckDangling(t *testing.T) {
+	dir, tip := fsckRepo(t)
+	blob := writeRawObject(t, dir, "blob", "nobody's\n")
+	orphan := commitFiles(t, dir, tip, "orphan", map[string]string{"c": "c\n"})
+
+	ok, output := runFsck(t, dir, true)
+	if !ok {
+		t.Error("dangling objects made fsck fail")
+	}
+	// Only the tip of what is unreachable dangles.
+	if want := fmt.Sprintf("dangling blob %s\ndangling commit %s\n", blob, orphan); output != want && output != fmt.Sprintf("dangling commit %s\ndangling blob %s\n", orphan, blob) {
+		t.Errorf("reported:\n%s", output)
+	}
+	if _, output := runFsck(t, dir, false); output != "" {
+		t.Errorf("--no-dangling reported:\n%s", output)
+	}
+}
+
+func TestFsckLooseCorruption(t *testing.T) {
+	dir, tip := fsckRepo(t)
+	blob := treeFiles(t, dir, tip)["dir/b"].Sha
+	path := filepath.Join(dir, ".git", "objects", blob[:2], blob[2:])
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Garbage where the object was: corrupt, and so missing.
+	if err := os.WriteFile(path, []byte("not zlib"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ok, output := runFsck(t, dir, false)
+	for _, want := range []string{"error: " + blob + ": object corrupt or missing", "missing blob " + blob} {
+		if !strings.Contains(output, want) {
+			t.Errorf("no %q in:\n%s", want, output)
+		}
+	}
+	if ok {
+		t.Error("fsck passed with a corrupt object")
+	}
+
+	// A valid object under the wrong name.
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := writeRawObject(t, dir, "blob", "other\n")
+	otherPath := filepath.Join(dir, ".git", "objects", other[:2], other[2:])
+	os.Chmod(otherPath, 0644)
+	if err := os.WriteFile(otherPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ok, output := runFsck(t, dir, false); ok || !strings.Contains(output, "error: "+blob+": hash-path mismatch") {
+		t.Errorf("a misplaced object: %v\n%s", ok, output)
+	}
+	os.Remove(otherPath)
+
+	// Gone altogether.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	ok, output = runFsck(t, dir, false)
+	if ok || !strings.Contains(output, "broken link from    tree") || !strings.Contains(output, "missing blob "+blob) {
+		t.Errorf("a missing object: %v\n%s", ok, output)
+	}
+}
+
+func TestFsckMalformedObjects(t *testing.T) {
+	dir, tip := fsckRepo(t)
+	commit, err := readCommit(dir, tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := commit.Tree
+	ident := "A U Thor <author@example.com> 1700000000 +0000"
+	blob := treeFiles(t, dir, tip)["a"].Sha
+	tests := []struct {
+		name, objectType, content string
+		errors                    bool
+		id                        string
+	}{
+		{"commit without a tree", "commit", "author " + ident + "\ncommitter " + ident + "\n\nmsg\n", true, "missingTree"},
+		{"bad parent", "commit", "tree " + tree + "\nparent xyz\nauthor " + ident + "\ncommitter " + ident + "\n\nmsg\n", true, "badParentSha1"},
+		{"no committer", "commit", "tree " + tree + "\nauthor " + ident + "\n\nmsg\n", true, "missingCommitter"},
+		{"bad email", "commit", "tree " + tree + "\nauthor A U Thor <author<example.com> 1700000000 +0000\ncommitter " + ident + "\n\nmsg\n", true, "badEmail"},
+		{"tag without a type", "tag", "object " + tree + "\n", true, "missingTypeEntry"},
+		{"tag of a bad type", "tag", "object " + tree + "\ntype thing\ntag v1\ntagger " + ident + "\n\nmsg\n", true, "badType"},
+		{"unsorted tree", "tree", "100644 b\x00" + hexBytes(t, blob) + "100644 a\x00" + hexBytes(t, blob), true, "treeNotSorted"},
+		{"duplicate entries", "tree", "100644 a\x00" + hexBytes(t, blob) + "100644 a\x00" + hexBytes(t, blob), true, "duplicateEntries"},
+		{"truncated tree", "tree", "100644 a\x00abc", true, "badTree"},
+		{".git in a tree", "tree", "100644 .git\x00" + hexBytes(t, blob), false, "hasDotgit"},
+		{"zero-padded mode", "tree", "0100644 a\x00" + hexBytes(t, blob), false, "zeroPaddedFilemode"},
+	}
+	for _, tt := range tests {
+		sha := writeRawObject(t, dir, tt.objectType, tt.content)
+		ok, output := runFsck(t, dir, false)
+		level := "warning"
+		if tt.errors {
+			level = "error"
+		}
+		if want := fmt.Sprintf("%s in %s %s: %s: ", level, tt.objectType, sha, tt.id); !strings.Contains(output, want) {
+			t.Errorf("%s: no %q in:\n%s", tt.name, want, output)
+		}
+		if ok == tt.errors {
+			t.Errorf("%s: fsck says %v", tt.name, ok)
+		}
+		os.Remove(filepath.Join(dir, ".git", "objects", sha[:2], sha[2:]))
+	}
+}
+
+func hexBytes(t *testing.T, sha string) string {
+	t.Helper()
+	raw, err := hex.DecodeString(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func TestFsckPackCorruption(t *testing.T) {
+	dir, _ := fsckRepo(t)
+	if err := Repack(dir, true, true, false); err != nil {
+		t.Fatal(err)
+	}
+	packs := packFiles(t, dir)
+	if len(packs) != 1 {
+		t.Fatalf("%d packs", len(packs))
+	}
+	pack := packs[0]
+	data, err := os.ReadFile(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(pack, 0644); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(at int) {
+		t.Helper()
+		broken := append([]byte{}, data...)
+		broken[at] ^= 0xff
+		if err := os.WriteFile(pack, broken, 0644); err != nil {
+			t.Fatal(err)
+		}
+		closePacks(dir)
+	}
+
+	// A byte of an object: its CRC and the pack checksum are both wrong.
+	corrupt(12 + 2)
+	ok, output := runFsck(t, dir, false)
+	if ok || !strings.Contains(output, "pack checksum mismatch") || !strings.Contains(output, "index CRC mismatch for object") {
+		t.Errorf("a corrupt object in a pack: %v\n%s", ok, output)
+	}
+
+	// The trailer no longer matches the index.
+	corrupt(len(data) - 1)
+	if ok, output := runFsck(t, dir, false); ok || !strings.Contains(output, "does not match index") {
+		t.Errorf("a corrupt pack trailer: %v\n%s", ok, output)
+	}
+
+	// A corrupt index.
+	if err := os.WriteFile(pack, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	idx := strings.TrimSuffix(pack, ".pack") + ".idx"
+	index, err := os.ReadFile(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index[len(index)-30] ^= 0xff
+	os.Chmod(idx, 0644)
+	if err := os.WriteFile(idx, index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	closePacks(dir)
+	if ok, output := runFsck(t, dir, false); ok || !strings.Contains(output, "bad index file checksum") {
+		t.Errorf("a corrupt index: %v\n%s", ok, output)
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Unreachable objects younger than this survive gc, so that objects being
+// written by a concurrent command are not pulled from under it.
+const defaultPruneExpire = "2.weeks.ago"
+
+// Usage: mygit gc [--prune=<date> | --no-prune]
+func gcCmd(args []string) error {
+	expire, ok := configValue(".", "gc.pruneExpire")
+	if !ok {
+		expire = defaultPruneExpire
+	}
+	for _, arg := range args {
+		switch {
+		case arg == "--no-prune":
+			expire = "never"
+		case arg == "--prune":
+			expire = defaultPruneExpire
+		case strings.HasPrefix(arg, "--prune="):
+			expire = strings.TrimPrefix(arg, "--prune=")
+		default:
+			return fmt.Errorf("unknown option: %s", arg)
+		}
+	}
+	return GC(".", expire)
+}
+
+// Usage: mygit repack [-a] [-A] [-d]
+func repackCmd(args []string) error {
+	all, loosen, deleteOld := false, false, false
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") || strings.HasPrefix(arg, "--") || len(arg) < 2 {
+			return fmt.Errorf("unknown option: %s", arg)
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'a':
+				all = true
+			case 'A':
+				all, loosen = true, true
+			case 'd':
+				deleteOld = true
+			default:
+				return fmt.Errorf("unknown switch '%c'", flag)
+			}
+		}
+	}
+	return Repack(".", all, deleteOld, loosen)
+}
+
+// Usage: mygit pack-refs [--all] [--no-prune]
+func packRefsCmd(args []string) error {
+	all, prune := false, true
+	for _, arg := range args {
+		switch arg {
+		case "--all":
+			all = true
+		case "--no-prune":
+			prune = false
+		case "--prune":
+			prune = true
+		default:
+			return fmt.Errorf("unknown option: %s", arg)
+		}
+	}
+	return PackRefs(".", all, prune)
+}
+
+// Pack refs and objects and prune unreachable loose objects older than
+// expire, which is "now", "never", a date or a relative time like
+// "2.weeks.ago".
+// ref: https://git-scm.com/docs/git-gc
+func GC(localDir, expire string) error {
+	cutoff, prune, err := parseExpiry(expire, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := PackRefs(localDir, true, true); err != nil {
+		return err
+	}
+	// Unreachable packed objects are made loose so the grace period applies
+	// to them as well.
+	if err := Repack(localDir, true, true, true); err != nil {
+		return err
+	}
+	if !prune {
+		return nil
+	}
+	return Prune(localDir, cutoff)
+}
+
+// Parse an expiry date. prune is false for "never".
+func parseExpiry(value string, now time.Time) (cutoff time.Time, prune bool, err error) {
+	switch value {
+	case "never", "false":
+		return time.Time{}, false, nil
+	case "now", "all":
+		return now, true, nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, true, nil
+		}
+	}
+	fields := strings.FieldsFunc(value, func(c rune) bool { return c == '.' || c == ' ' })
+	if len(fields) == 3 && fields[2] == "ago" {
+		n, err := strconv.Atoi(fields[0])
+		unit := strings.TrimSuffix(fields[1], "s")
+		if err == nil {
+			switch unit {
+			case "second":
+				return now.Add(-time.Duration(n) * time.Second), true, nil
+			case "minute":
+				return now.Add(-time.Duration(n) * time.Minute), true, nil
+			case "hour":
+				return now.Add(-time.Duration(n) * time.Hour), true, nil
+			case "day":
+				return now.AddDate(0, 0, -n), true, nil
+			case "week":
+				return now.AddDate(0, 0, -7*n), true, nil
+			case "month":
+				return now.AddDate(0, -n, 0), true, nil
+			case "year":
+				return now.AddDate(-n, 0, 0), true, nil
+			}
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("invalid expiry date '%s'", value)
+}
+
+// The objects refs, HEAD and reflog entries point at.
+func reachabilityRoots(localDir string) ([]string, error) {
+	refs, err := localRefs(localDir, "refs/")
+	if err != nil {
+		return nil, err
+	}
+	var roots []string
+	for _, sha := range refs {
+		roots = append(roots, sha)
+	}
+	sort.Strings(roots)
+	if _, head, err := readHead(localDir); err == nil && head != "" {
+		roots = append(roots, head)
+	}
+	err = filepath.Walk(filepath.Join(gitDir(localDir), "logs"), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Join(gitDir(localDir), "logs"), path)
+		if err != nil {
+			return err
+		}
+		entries, err := readReflog(localDir, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			// Entries may name objects that are long gone.
+			for _, sha := range []string{entry.Old, entry.New} {
+				if sha != zeroSha && hasObject(localDir, sha) {
+					roots = append(roots, sha)
+				}
+			}
+		}
+		return nil
+	})
+	return roots, err
+}
+
+// Everything reachable from refs, HEAD, reflogs and the index, in the order
+// objectsToPack lists it with index-only blobs last.
+func reachableObjects(localDir string) ([]packObject, error) {
+	roots, err := reachabilityRoots(localDir)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := objectsToPack(localDir, roots, nil)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, object := range objects {
+		seen[object.Sha] = true
+	}
+	index, err := readIndex(localDir)
+	if err != nil {
+		return nil, err
+	}
+	files := index.files()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if sha := files[name].Sha; !seen[sha] && files[name].Mode != "160000" {
+			seen[sha] = true
+			objects = append(objects, packObject{Sha: sha, Path: name})
+		}
+	}
+	return objects, nil
+}
+
+// Pack reachable objects. Without all only loose objects go into the new
+// pack; with all everything reachable does and deleteOld removes the packs
+// it replaces. Unreachable objects in those packs are dropped, or written
+// loose with the pack's time when loosen is set. deleteOld also removes
+// loose objects that are now packed.
+// ref: https://git-scm.com/docs/git-repack
+func Repack(localDir string, all, deleteOld, loosen bool) error {
+	objects, err := reachableObjects(localDir)
+	if err != nil {
+		return err
+	}
+	oldPacks, err := loadPacks(localDir)
+	if err != nil {
+		return err
+	}
+	// Objects borrowed from alternates are left there, as with repack -l.
+	var local []packObject
+	for _, object := range objects {
+		packed := packsContain(oldPacks, object.Sha)
+		if (all && packed) || (!packed && hasLooseObject(localDir, object.Sha)) {
+			local = append(local, object)
+		}
+	}
+	objects = local
+	if len(objects) == 0 {
+		fmt.Println("Nothing new to pack.")
+	} else {
+		prefix := filepath.Join(packDir(localDir), "pack")
+		options := defaultPackOptions
+		options.Progress = progressEnabled()
+		name, err := writePackFiles(prefix, localDir, objects, options)
+		if err != nil {
+			return err
+		}
+		// What promisor packs referred to may still be missing, so the pack
+		// replacing them is a promisor pack too.
+		if all && anyPromisorPack(oldPacks) {
+			marker := prefix + "-" + name + ".promisor"
+			if _, err := os.Stat(marker); os.IsNotExist(err) {
+				if err := os.WriteFile(marker, nil, 0444); err != nil {
+					return err
+				}
+			}
+		}
+		if all && deleteOld {
+			if err := removeOldPacks(localDir, oldPacks, objects, name, loosen); err != nil {
+				return err
+			}
+		}
+		closePacks(localDir)
+	}
+	if deleteOld {
+		return prunePacked(localDir)
+	}
+	return nil
+}
+
+// Delete packs replaced by a new one, first writing their unreachable objects
+// loose when asked to.
+func removeOldPacks(localDir string, oldPacks []*packFile, kept []packObject, newName string, loosen bool) error {
+	keep := make(map[string]bool)
+	for _, object := range kept {
+		keep[object.Sha] = true
+	}
+	for _, pack := range oldPacks {
+		if strings.HasSuffix(pack.Path, "pack-"+newName+".pack") {
+			// Repacking the same objects gives the same pack.
+			continue
+		}
+		if loosen {
+			mtime := pack.modTime()
+			for _, sha := range pack.shas() {
+				if keep[sha] || hasLooseObject(localDir, sha) {
+					continue
+				}
+				obj, err := readPackedObject(localDir, sha)
+				if err != nil {
+					return err
+				}
+				content, err := obj.wrappedBuf()
+				if err != nil {
+					return err
+				}
+				if _, err := writeGitObject(localDir, content); err != nil {
+					return err
+				}
+				filename := objectPath(localDir, sha)
+				if err := os.Chtimes(filename, mtime, mtime); err != nil {
+					return err
+				}
+			}
+		}
+		if pack.file != nil {
+			pack.file.Close()
+			pack.file = nil
+		}
+		base := strings.TrimSuffix(pack.Path, ".pack")
+		for _, ext := range []string{".pack", ".idx", ".promisor"} {
+			if err := os.Remove(base + ext); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func anyPromisorPack(packs []*packFile) bool {
+	for _, pack := range packs {
+		if pack.Promisor {
+			return true
+		}
+	}
+	return false
+}
+
+func hasLooseObject(localDir, sha string) bool {
+	_, err := os.Stat(objectPath(localDir, sha))
+	return err == nil
+}
+
+// Call visit with the sha and path of every loose object.
+func walkLooseObjects(localDir string, visit func(sha, filename string) error) error {
+	return walkObjectDir(filepath.Join(gitDir(localDir), "objects"), visit)
+}
+
+func walkObjectDir(objectsDir string, visit func(sha, filename string) error) error {
+	dirs, err := filepath.Glob(filepath.Join(objectsDir, "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			sha := filepath.Base(dir) + entry.Name()
+			if len(sha) != 40 || !isHex(sha) {
+				continue
+			}
+			if err := visit(sha, filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Drop fan-out directories left empty by pruning.
+func removeEmptyObjectDirs(localDir string) {
+	dirs, _ := filepath.Glob(filepath.Join(gitDir(localDir), "objects", "[0-9a-f][0-9a-f]"))
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+}
+
+// Remove loose objects that are also in a pack.
+func prunePacked(localDir string) error {
+	defer removeEmptyObjectDirs(localDir)
+	return walkLooseObjects(localDir, func(sha, filename string) error {
+		if isPacked(localDir, sha) {
+			return os.Remove(filename)
+		}
+		return nil
+	})
+}
+
+// Remove unreachable loose objects last modified before cutoff.
+// ref: https://git-scm.com/docs/git-prune
+func Prune(localDir string, cutoff time.Time) error {
+	objects, err := reachableObjects(localDir)
+	if err != nil {
+		return err
+	}
+	reachable := make(map[string]bool)
+	for _, object := range objects {
+		reachable[object.Sha] = true
+	}
+	defer removeEmptyObjectDirs(localDir)
+	return walkLooseObjects(localDir, func(sha, filename string) error {
+		if reachable[sha] {
+			return nil
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		return os.Remove(filename)
+	})
+}
+
+// Move refs into .git/packed-refs: all of them with all, or else tags and
+// refs already packed. Symbolic refs stay loose. With prune the loose files
+// are removed.
+// ref: https://git-scm.com/docs/git-pack-refs
+func PackRefs(localDir string, all, prune bool) error {
+	packed, err := readPackedRefs(localDir)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]packedRef)
+	for _, ref := range packed {
+		byName[ref.Name] = ref
+	}
+
+	refsDir := filepath.Join(gitDir(localDir), "refs")
+	var loose []string
+	var dirs []string
+	err = filepath.Walk(refsDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		rel, err := filepath.Rel(gitDir(localDir), path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sha := strings.TrimSpace(string(data))
+		if strings.HasPrefix(sha, symrefPrefix) {
+			return nil
+		}
+		if _, wasPacked := byName[name]; !all && !wasPacked && !strings.HasPrefix(name, "refs/tags/") {
+			return nil
+		}
+		if len(sha) != 40 || !isHex(sha) {
+			return fmt.Errorf("%s: invalid ref", name)
+		}
+		byName[name] = packedRef{Name: name, Sha: sha}
+		loose = append(loose, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	packed = packed[:0]
+	for _, ref := range byName {
+		peeled, err := peelTag(localDir, ref.Sha)
+		if err != nil {
+			return err
+		}
+		ref.Peeled = ""
+		if peeled != ref.Sha {
+			ref.Peeled = peeled
+		}
+		packed = append(packed, ref)
+	}
+	if err := writePackedRefs(localDir, packed); err != nil {
+		return err
+	}
+	if !prune {
+		return nil
+	}
+	for _, path := range loose {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	// Remove directories left empty, deepest first, keeping the standard ones.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		switch dirs[i] {
+		case refsDir, filepath.Join(refsDir, "heads"), filepath.Join(refsDir, "tags"):
+		default:
+			os.Remove(dirs[i])
+		}
+	}
+	return nil
+}
+
+// Follow annotated tags to the object they finally point at.
+func peelTag(localDir, sha string) (string, error) {
+	for depth := 0; depth < 10; depth++ {
+		objectType, content, err := readGitObject(localDir, sha)
+		if err != nil {
+			return "", err
+		}
+		if objectType != "tag" {
+			return sha, nil
+		}
+		target, _, _ := strings.Cut(string(content), "\n")
+		sha = strings.TrimPrefix(target, "object ")
+	}
+	return "", errors.New("tag nesting too deep: " + sha)
+}
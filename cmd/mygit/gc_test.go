@@ -0,0 +1,252 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		value string
+		want  time.Time
+		prune bool
+	}{
+		{"now", now, true},
+		{"all", now, true},
+		{"never", time.Time{}, false},
+		{"false", time.Time{}, false},
+		{"2.weeks.ago", now.AddDate(0, 0, -14), true},
+		{"1 day ago", now.AddDate(0, 0, -1), true},
+		{"3.hours.ago", now.Add(-3 * time.Hour), true},
+		{"1.month.ago", now.AddDate(0, -1, 0), true},
+		{"2024-01-02", time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local), true},
+		{"2024-01-02 03:04:05", time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local), true},
+	}
+	for _, tt := range tests {
+		got, prune, err := parseExpiry(tt.value, now)
+		if err != nil || !got.Equal(tt.want) || prune != tt.prune {
+			t.Errorf("parseExpiry(%q) = %v, %v, %v; want %v, %v", tt.value, got, prune, err, tt.want, tt.prune)
+		}
+	}
+	for _, bad := range []string{"", "soon", "2.fortnights.ago", "x.days.ago"} {
+		if _, _, err := parseExpiry(bad, now); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+func looseObjects(t *testing.T, dir string) map[string]bool {
+	t.Helper()
+	objects := make(map[string]bool)
+	err := walkLooseObjects(dir, func(sha, filename string) error {
+		objects[sha] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return objects
+}
+
+func packFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	packs, err := filepath.Glob(filepath.Join(packDir(dir), "*.pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packs
+}
+
+// Write a loose blob nobody refers to, last modified age ago.
+func unreachableBlob(t *testing.T, dir, content string, age time.Duration) string {
+	t.Helper()
+	sha, err := writeGitObject(dir, (&GitBlob{Content: []byte(content)}).Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Now().Add(-age)
+	if err := os.Chtimes(filepath.Join(gitDir(dir), "objects", sha[:2], sha[2:]), when, when); err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+func TestGC(t *testing.T) {
+	dir, tip := deltaHistory(t)
+	if err := writeRef(dir, "refs/heads/master", tip); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "tag", "-a", "-m", "a tag", "v1", tip)
+	tag := mustRevParse(t, dir, "refs/tags/v1")
+	old := unreachableBlob(t, dir, "old garbage\n", 30*24*time.Hour)
+	recent := unreachableBlob(t, dir, "recent garbage\n", time.Hour)
+	reachable, err := reachableObjects(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := GC(dir, "2.weeks.ago"); err != nil {
+		t.Fatal(err)
+	}
+	if packs := packFiles(t, dir); len(packs) != 1 {
+		t.Errorf("gc left %d packs", len(packs))
+	}
+	loose := looseObjects(t, dir)
+	if len(loose) != 1 || !loose[recent] {
+		t.Errorf("gc left loose objects %v, want only %s", loose, recent)
+	}
+	if hasObject(dir, old) {
+		t.Error("an old unreachable object survived")
+	}
+	for _, object := range reachable {
+		if !isPacked(dir, object.Sha) {
+			t.Errorf("%s was not packed", object.Sha)
+		}
+	}
+
+	// Refs are packed, with the tag peeled.
+	if _, err := os.Stat(filepath.Join(dir, ".git", "refs", "heads", "master")); !os.IsNotExist(err) {
+		t.Error("refs/heads/master is still loose")
+	}
+	checkRef(t, dir, "refs/heads/master", tip)
+	packedRefs := readTestFile(t, dir, ".git/packed-refs")
+	if want := tag + " refs/tags/v1\n^" + tip + "\n"; !strings.Contains(packedRefs, want) {
+		t.Errorf("packed-refs does not peel the tag:\n%s", packedRefs)
+	}
+	runGit(t, dir, "fsck", "--strict", "--no-dangling")
+	if got := runGit(t, dir, "show-ref"); got != tip+" refs/heads/master\n"+tag+" refs/tags/v1\n" {
+		t.Errorf("git show-ref after gc:\n%s", got)
+	}
+}
+
+func TestGCUnreachablePacked(t *testing.T) {
+	dir, tip := deltaHistory(t)
+	if err := writeRef(dir, "refs/heads/master", tip); err != nil {
+		t.Fatal(err)
+	}
+	side := commitFiles(t, dir, tip, "side", map[string]string{"side.txt": "side\n"})
+	if err := writeRef(dir, "refs/heads/side", side); err != nil {
+		t.Fatal(err)
+	}
+	if err := Repack(dir, true, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteRef(dir, "refs/heads/side"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kept, but loose, while it is young.
+	if err := GC(dir, "never"); err != nil {
+		t.Fatal(err)
+	}
+	if !looseObjects(t, dir)[side] || isPacked(dir, side) {
+		t.Error("an unreachable packed commit was not made loose")
+	}
+	if err := GC(dir, "now"); err != nil {
+		t.Fatal(err)
+	}
+	if hasObject(dir, side) {
+		t.Error("gc --prune=now kept an unreachable commit")
+	}
+	if len(looseObjects(t, dir)) != 0 {
+		t.Error("loose objects are left")
+	}
+	runGit(t, dir, "fsck", "--strict")
+}
+
+func TestRepack(t *testing.T) {
+	dir, tip := deltaHistory(t)
+	if err := writeRef(dir, "refs/heads/master", tip); err != nil {
+		t.Fatal(err)
+	}
+	before := looseObjects(t, dir)
+
+	// Loose objects go into a pack of their own and stay loose without -d.
+	if err := Repack(dir, false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if packs := packFiles(t, dir); len(packs) != 1 {
+		t.Fatalf("%d packs after repack", len(packs))
+	}
+	if len(looseObjects(t, dir)) != len(before) {
+		t.Error("repack without -d removed loose objects")
+	}
+
+	// New objects make a second pack, and -d drops what is packed.
+	next := commitFiles(t, dir, tip, "next", map[string]string{"next.txt": "next\n"})
+	if err := writeRef(dir, "refs/heads/master", next); err != nil {
+		t.Fatal(err)
+	}
+	if err := Repack(dir, false, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if packs := packFiles(t, dir); len(packs) != 2 {
+		t.Errorf("%d packs after an incremental repack", len(packs))
+	}
+	if loose := looseObjects(t, dir); len(loose) != 0 {
+		t.Errorf("repack -d left %d loose objects", len(loose))
+	}
+
+	// -a -d puts everything in one pack.
+	if err := Repack(dir, true, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if packs := packFiles(t, dir); len(packs) != 1 {
+		t.Errorf("%d packs after repack -a -d", len(packs))
+	}
+	if !equalContents(commitContents(t, dir, "master"), map[string]string{
+		"file.txt":     commitContents(t, dir, tip)["file.txt"],
+		"dir/copy.txt": commitContents(t, dir, tip)["dir/copy.txt"],
+		"next.txt":     "next\n",
+	}) {
+		t.Error("the repacked history reads back differently")
+	}
+	runGit(t, dir, "fsck", "--strict")
+	runGit(t, dir, "verify-pack", strings.TrimSuffix(packFiles(t, dir)[0], ".pack")+".idx")
+}
+
+func TestPackRefs(t *testing.T) {
+	dir, tip := deltaHistory(t)
+	for _, ref := range []string{"refs/heads/master", "refs/heads/a/b", "refs/tags/light"} {
+		if err := writeRef(dir, ref, tip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Without --all only tags are packed.
+	if err := PackRefs(dir, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if packed := readTestFile(t, dir, ".git/packed-refs"); packed != packedRefsHeader+tip+" refs/tags/light\n" {
+		t.Errorf("packed-refs without --all:\n%s", packed)
+	}
+	if readTestFile(t, dir, ".git/refs/heads/master") == "" {
+		t.Error("a branch was packed without --all")
+	}
+
+	if err := PackRefs(dir, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if readTestFile(t, dir, ".git/refs/heads/master") == "" {
+		t.Error("--no-prune removed a loose ref")
+	}
+	if err := PackRefs(dir, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git", "refs", "heads", "a")); !os.IsNotExist(err) {
+		t.Error("an emptied ref directory was kept")
+	}
+	for _, ref := range []string{"refs/heads/master", "refs/heads/a/b", "refs/tags/light"} {
+		checkRef(t, dir, ref, tip)
+	}
+	// HEAD stays a symbolic ref.
+	if ref, _, err := readHead(dir); err != nil || ref != "refs/heads/master" {
+		t.Errorf("HEAD is %q: %v", ref, err)
+	}
+	if got := runGit(t, dir, "for-each-ref", "--format=%(refname)"); got != "refs/heads/a/b\nrefs/heads/master\nrefs/tags/light\n" {
+		t.Errorf("git lists the packed refs as:\n%s", got)
+	}
+}
@@ -9,12 +9,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -33,8 +35,6 @@ const (
 	firstRemMask = uint8(0b00001111)
 )
 
-var shaToObj map[string]Object = make(map[string]Object)
-
 // Plain object for cloning purpose
 type Object struct {
 	Type byte // object type.
@@ -56,7 +56,6 @@ type TreeEntry struct {
 	IsBlob bool
 }
 
-var author = "Manh Tu <xxlaguna93@gmail.com>"
 var filePerm = []byte{'1', '0', '0', '6', '4', '4'}
 var dirPerm = []byte{'4', '0', '0', '0', '0'}
 
@@ -95,23 +94,33 @@ func (t *GitTree) Serialize() []byte {
 	return content
 }
 
+// Identity and timestamp recorded in the author/committer lines.
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+func (s Signature) String() string {
+	return fmt.Sprintf("%s <%s> %d %s", s.Name, s.Email, s.When.Unix(), s.When.Format("-0700"))
+}
+
 type GitCommit struct {
-	Tree    string
-	Parent  string
-	Author  string
-	Email   string
-	Time    time.Time
-	Message string
+	Tree      string
+	Parents   []string
+	Author    Signature
+	Committer Signature
+	Message   string
 }
 
 func (c *GitCommit) Serialize() []byte {
-	timeFormat := c.Time.Unix()
-	location, _ := c.Time.Zone()
-	fileContent := fmt.Sprintf("tree %s\nparent %s\nauthor %s %s %d %s00\ncommitter %s %s %d %s00\n\n%s\n",
-		c.Tree, c.Parent,
-		c.Author, c.Email, timeFormat, location,
-		c.Author, c.Email, timeFormat, location,
-		c.Message)
+	var body strings.Builder
+	fmt.Fprintf(&body, "tree %s\n", c.Tree)
+	for _, parent := range c.Parents {
+		fmt.Fprintf(&body, "parent %s\n", parent)
+	}
+	fmt.Fprintf(&body, "author %s\ncommitter %s\n\n%s\n", c.Author, c.Committer, c.Message)
+	fileContent := body.String()
 	content := []byte("commit ")
 	content = append(content, []byte(strconv.Itoa((len(fileContent))))...)
 	content = append(content, 0x00)
@@ -119,6 +128,109 @@ func (c *GitCommit) Serialize() []byte {
 	return content
 }
 
+// Subject returns the first line of the commit message.
+func (c *GitCommit) Subject() string {
+	subject, _, _ := strings.Cut(c.Message, "\n")
+	return subject
+}
+
+// Parse the content of a commit object (without the "commit <len>\0" header).
+func ParseCommit(content []byte) (*GitCommit, error) {
+	header, message, found := bytes.Cut(content, []byte("\n\n"))
+	if !found {
+		return nil, fmt.Errorf("invalid commit: missing message")
+	}
+	commit := &GitCommit{Message: strings.TrimSuffix(string(message), "\n")}
+	for _, line := range strings.Split(string(header), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		var err error
+		switch key {
+		case "tree":
+			commit.Tree = value
+		case "parent":
+			commit.Parents = append(commit.Parents, value)
+		case "author":
+			commit.Author, err = parseSignature(value)
+		case "committer":
+			commit.Committer, err = parseSignature(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if commit.Tree == "" {
+		return nil, fmt.Errorf("invalid commit: missing tree")
+	}
+	return commit, nil
+}
+
+// Parse "Name <email> 1700000000 +0100".
+func parseSignature(line string) (Signature, error) {
+	start, end := strings.Index(line, "<"), strings.LastIndex(line, ">")
+	if start < 0 || end < start {
+		return Signature{}, fmt.Errorf("invalid signature: %s", line)
+	}
+	sig := Signature{
+		Name:  strings.TrimSpace(line[:start]),
+		Email: line[start+1 : end],
+	}
+	fields := strings.Fields(line[end+1:])
+	if len(fields) != 2 {
+		return Signature{}, fmt.Errorf("invalid signature: %s", line)
+	}
+	unix, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return Signature{}, err
+	}
+	zone, err := time.Parse("-0700", fields[1])
+	if err != nil {
+		return Signature{}, err
+	}
+	sig.When = time.Unix(unix, 0).In(zone.Location())
+	return sig, nil
+}
+
+// The identity of the author or committer, role being "AUTHOR" or
+// "COMMITTER": GIT_<role>_NAME and GIT_<role>_EMAIL, else user.name and
+// user.email, else EMAIL. Whatever is missing is made up from the login
+// and host names, and reported as an error, which reflogs ignore but
+// commits do not.
+// ref: https://git-scm.com/docs/git-commit#_commit_information
+func newSignature(localDir, role string) (Signature, error) {
+	sig := Signature{Name: os.Getenv("GIT_" + role + "_NAME"), Email: os.Getenv("GIT_" + role + "_EMAIL"), When: time.Now()}
+	if sig.Name == "" {
+		sig.Name, _ = configValue(localDir, "user.name")
+	}
+	if sig.Email == "" {
+		sig.Email, _ = configValue(localDir, "user.email")
+	}
+	if sig.Email == "" {
+		sig.Email = os.Getenv("EMAIL")
+	}
+	if sig.Name != "" && sig.Email != "" {
+		return sig, nil
+	}
+	login := "unknown"
+	if u, err := user.Current(); err == nil {
+		login = u.Username
+	}
+	host, _ := os.Hostname()
+	if sig.Name == "" {
+		sig.Name = login
+	}
+	if sig.Email == "" {
+		sig.Email = login + "@" + host
+	}
+	who := strings.ToUpper(role[:1]) + strings.ToLower(role[1:])
+	return sig, fmt.Errorf("%s identity unknown\n\n"+
+		"*** Please tell me who you are.\n\n"+
+		"Run\n\n"+
+		"  mygit config --global user.email \"you@example.com\"\n"+
+		"  mygit config --global user.name \"Your Name\"\n\n"+
+		"to set your account's default identity.\n"+
+		"Omit --global to set the identity only in this repository.", who)
+}
+
 func (o *GitBlob) Serialize() []byte {
 	content := []byte("blob ")
 	content = append(content, []byte(strconv.Itoa((len(o.Content))))...)
@@ -138,27 +250,124 @@ func Init(root string) {
 			fmt.Fprintf(os.Stderr, "Error creating directory: %s\n", err)
 		}
 	}
-	headFileContents := []byte("ref: refs/heads/master\n")
+	headFileContents := []byte(symrefPrefix + "refs/heads/" + initialBranch(root) + "\n")
 	if err := os.WriteFile(filepath.Join(root, ".git/HEAD"), headFileContents, 0644); err != nil {
 		fmt.Fprintf(os.Stderr, "Error writing file: %s\n", err)
 	}
+	if err := setConfigSection(root, "core", "",
+		configEntry{"repositoryformatversion", "0"},
+		configEntry{"filemode", "true"},
+		configEntry{"bare", "false"},
+		configEntry{"logallrefupdates", "true"}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing file: %s\n", err)
+	}
 
 	fmt.Println("Initialized git directory")
 }
 
+// The branch a new repository starts on: init.defaultBranch, or master.
+func initialBranch(root string) string {
+	name, ok := configValue(root, "init.defaultBranch")
+	if !ok || name == "" {
+		return "master"
+	}
+	if !checkRefFormat("refs/heads/" + name) {
+		fmt.Fprintf(os.Stderr, "warning: invalid initial branch name: '%s'; using master\n", name)
+		return "master"
+	}
+	return name
+}
+
+// Create a bare repository, whose directory is what .git would be.
+func initBare(root string) error {
+	for _, dir := range []string{"objects", "refs"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return err
+		}
+	}
+	headFileContents := []byte(symrefPrefix + "refs/heads/" + initialBranch(root) + "\n")
+	if err := os.WriteFile(filepath.Join(root, "HEAD"), headFileContents, 0644); err != nil {
+		return err
+	}
+	return setConfigSection(root, "core", "",
+		configEntry{"repositoryformatversion", "0"},
+		configEntry{"filemode", "true"},
+		configEntry{"bare", "true"})
+}
+
 func CatFile(localDir, objectSha string) ([]byte, error) {
+	_, content, err := readGitObject(localDir, objectSha)
+	return content, err
+}
 
-	filename := filepath.Join(localDir, objectPath(objectSha))
-	fileContent, err := os.ReadFile(filename)
-	must(err)
+// Read an object, loose or packed, and return its type and content.
+func readGitObject(localDir, objectSha string) (string, []byte, error) {
+	if len(objectSha) != 40 {
+		return "", nil, fmt.Errorf("invalid object name: %s", objectSha)
+	}
+	fileContent, err := os.ReadFile(objectPath(localDir, objectSha))
+	if os.IsNotExist(err) {
+		if borrowed, ok := alternateObjectPath(localDir, objectSha); ok {
+			fileContent, err = os.ReadFile(borrowed)
+		}
+	}
+	if os.IsNotExist(err) {
+		obj, packErr := readPackedObject(localDir, objectSha)
+		if packErr == errNotPacked {
+			// A partial clone fetches what it was promised on demand.
+			if fetchMissingObject(localDir, objectSha) {
+				return readGitObject(localDir, objectSha)
+			}
+			return "", nil, err
+		}
+		if packErr != nil {
+			return "", nil, packErr
+		}
+		objectType, err := obj.typeString()
+		return objectType, obj.Buf, err
+	}
+	if err != nil {
+		return "", nil, err
+	}
 	data, err := decompressZlib(bytes.NewBuffer(fileContent))
-	dataBytes := data.Bytes()
-	must(err)
-	header, content := Cut(dataBytes, 0x00)
-	objectType, objectLen := Cut(header, 0x20)
-	_ = objectType
-	_ = objectLen
-	return content, nil
+	if err != nil {
+		return "", nil, err
+	}
+	header, content := Cut(data.Bytes(), 0x00)
+	objectType, _ := Cut(header, 0x20)
+	return string(objectType), content, nil
+}
+
+// Report whether the repository has an object.
+func hasObject(localDir, objectSha string) bool {
+	if len(objectSha) != 40 {
+		return false
+	}
+	if _, err := os.Stat(objectPath(localDir, objectSha)); err == nil {
+		return true
+	}
+	_, borrowed := alternateObjectPath(localDir, objectSha)
+	return borrowed || isPacked(localDir, objectSha)
+}
+
+// Read and parse a commit object.
+func readCommit(localDir, commitSha string) (*GitCommit, error) {
+	objectType, content, err := readGitObject(localDir, commitSha)
+	if err != nil {
+		return nil, err
+	}
+	if objectType != "commit" {
+		return nil, fmt.Errorf("%s is a %s, not a commit", commitSha, objectType)
+	}
+	commit, err := ParseCommit(content)
+	if err != nil {
+		return nil, err
+	}
+	// History ends at the boundary of a shallow repository.
+	if isShallow(localDir, commitSha) {
+		commit.Parents = nil
+	}
+	return commit, nil
 }
 
 func HashObject(filename string) string {
@@ -167,6 +376,8 @@ func HashObject(filename string) string {
 
 	content, err := io.ReadAll(file)
 	must(err)
+	content, err = cleanContent(".", filename, content)
+	must(err)
 	blob := &GitBlob{Content: content}
 	hash, err := writeGitObject(".", blob.Serialize())
 	must(err)
@@ -174,15 +385,8 @@ func HashObject(filename string) string {
 }
 
 func ListTree(localDir, treeSha string) *GitTree {
-	filename := filepath.Join(localDir, objectPath(treeSha))
-	fileContent, err := os.ReadFile(filename)
-	must(err)
-	data, err := decompressZlib(bytes.NewBuffer(fileContent))
-	dataBytes := data.Bytes()
+	_, content, err := readGitObject(localDir, treeSha)
 	must(err)
-	header, content := Cut(dataBytes, 0x00)
-	treeType, _ := Cut(header, 0x20)
-	_ = treeType
 	tree := &GitTree{Entry: make([]*TreeEntry, 0)}
 	reader := bytes.NewReader(content)
 	for {
@@ -204,21 +408,29 @@ func ListTree(localDir, treeSha string) *GitTree {
 }
 
 func WriteTree(root string) string {
+	return writeTree(root, "", newIgnoreMatcher(root))
+}
+
+// Write the tree for dir, a slash-separated path relative to root, skipping
+// ignored files.
+func writeTree(root, dir string, ignore *ignoreMatcher) string {
 	tree := &GitTree{make([]*TreeEntry, 0)}
-	_ = tree
 
-	entries, err := os.ReadDir(root)
-	if err != nil {
-		fmt.Println(err)
-	}
+	entries, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(dir)))
+	must(err)
 	for _, entry := range entries {
-		if entry.Name() == ".git" {
+		name := path.Join(dir, entry.Name())
+		if entry.Name() == ".git" || ignore.ignored(name, entry.IsDir()) {
 			continue
 		}
-		fullPath := filepath.Join(root, entry.Name())
+		fullPath := filepath.Join(root, filepath.FromSlash(name))
 		if entry.IsDir() {
 			// recursively create the blob, skip for now
-			dirHash := WriteTree(fullPath)
+			dirHash := writeTree(root, name, ignore)
+			if dirHash == emptyTreeSha {
+				// Git does not track empty directories.
+				continue
+			}
 			hashBytes, err := hex.DecodeString(dirHash)
 			must(err)
 			var hash [20]byte
@@ -227,152 +439,546 @@ func WriteTree(root string) string {
 			tree.Entry = append(tree.Entry, dirEntry)
 		} else {
 			info, _ := entry.Info()
-			mode := fmt.Sprintf("100%03o", info.Mode().Perm()) // Get Unix permissions as octal string
 			treeEntry := NewTreeEntry(fullPath)
-			treeEntry.Perm = []byte(mode)
+			treeEntry.Perm = []byte(gitFileMode(info.Mode()))
 			tree.Entry = append(tree.Entry, treeEntry)
 		}
 	}
+	sortTreeEntries(tree.Entry)
 	hash, err := writeGitObject(".", tree.Serialize())
 	must(err)
 	return hash
 }
 
-func CommitTree(treeSha, parentSha, message string) string {
-	commit := &GitCommit{
-		Tree:    treeSha,
-		Parent:  parentSha,
-		Author:  "Manh Tu",
-		Email:   "xxlaguna93@gmail.com",
-		Time:    time.Now(),
-		Message: message,
+// Git only records whether a regular file is executable.
+func gitFileMode(mode os.FileMode) string {
+	if mode.Perm()&0111 != 0 {
+		return "100755"
 	}
-
-	hash, err := writeGitObject(".", commit.Serialize())
-	must(err)
-	return hash
+	return "100644"
 }
 
-func Clone(repo, localDir string) {
-	Init(localDir)
-
-	commitSha, err := fetchLatestCommitHash(repo)
-	must(err)
-	fmt.Println("commit sha", commitSha)
-
-	err = writeBranchRefFile(localDir, "master", commitSha)
-	must(err)
-
-	err = fetchObjects(repo, commitSha)
-	must(err)
+// Sort entries in git's canonical tree order, where directories compare as if
+// their name had a trailing slash.
+func sortTreeEntries(entries []*TreeEntry) {
+	sortKey := func(e *TreeEntry) string {
+		if e.IsBlob {
+			return string(e.Name)
+		}
+		return string(e.Name) + "/"
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortKey(entries[i]) < sortKey(entries[j])
+	})
+}
 
-	err = writeFetchedObjects(localDir)
+func CommitTree(treeSha, parentSha, message string) string {
+	var parents []string
+	if parentSha != "" {
+		parents = []string{parentSha}
+	}
+	hash, err := commitTree(".", treeSha, parents, message)
 	must(err)
+	return hash
+}
 
-	err = restoreRepository(localDir, commitSha)
-	must(err)
+// Write a commit object authored and committed now by the configured
+// identities.
+func commitTree(localDir, treeSha string, parents []string, message string) (string, error) {
+	author, err := newSignature(localDir, "AUTHOR")
+	if err != nil {
+		return "", err
+	}
+	committer, err := newSignature(localDir, "COMMITTER")
+	if err != nil {
+		return "", err
+	}
+	commit := &GitCommit{
+		Tree:      treeSha,
+		Parents:   parents,
+		Author:    author,
+		Committer: committer,
+		Message:   message,
+	}
+	return writeGitObject(localDir, commit.Serialize())
 }
 
-func fetchObjects(repoUrl, commitSha string) error {
-	packfileBuf := fetchPackfile(repoUrl, commitSha)
+// Usage: mygit clone [-l|--local] [--no-local] [-s|--shared] [--no-hardlinks]
+// [--bare|--mirror] [-b <name>|--branch=<name>] [--[no-]single-branch] [-n|--no-checkout]
+// [--depth=<n>] [--shallow-since=<date>] [--shallow-exclude=<ref>] [--filter=<filter-spec>] <repo> <dir>
+func cloneCmd(args []string) error {
+	var options cloneOptions
+	noLocal := false
+	singleBranch, noSingleBranch := false, false
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "-l", "--local":
+			// A local path already implies it, and URLs ignore it.
+		case "--no-local":
+			noLocal = true
+		case "-s", "--shared":
+			options.Shared = true
+		case "--no-hardlinks":
+			options.NoHardlinks = true
+		case "--bare":
+			options.Bare = true
+		case "--mirror":
+			options.Bare, options.Mirror = true, true
+		case "-b", "--branch":
+			if i+1 == len(args) {
+				return fmt.Errorf("switch `%s' requires a value", strings.TrimLeft(arg, "-"))
+			}
+			i++
+			options.Branch = args[i]
+		case "--single-branch":
+			singleBranch, noSingleBranch = true, false
+		case "--no-single-branch":
+			singleBranch, noSingleBranch = false, true
+		case "-n", "--no-checkout":
+			options.NoCheckout = true
+		default:
+			if value, ok := cutPrefix(arg, "--branch="); ok {
+				options.Branch = value
+				continue
+			}
+			if value, ok := cutPrefix(arg, "--threads="); ok {
+				threads, err := strconv.Atoi(value)
+				if err != nil || threads < 0 {
+					return fmt.Errorf("invalid number of threads specified (%s)", value)
+				}
+				options.Threads = threads
+				continue
+			}
+			if spec, ok := cutPrefix(arg, "--filter="); ok {
+				filter, err := parseFilterSpec(spec)
+				if err != nil {
+					return err
+				}
+				options.Filter = filter
+				continue
+			}
+			if ok, err := parseDeepenOption(arg, &options.Deepen); ok || err != nil {
+				if err != nil {
+					return err
+				}
+				if options.Deepen.Relative {
+					return fmt.Errorf("unknown option: %s", arg)
+				}
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
+				return fmt.Errorf("unknown option: %s", arg)
+			}
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 {
+		return errors.New("usage: mygit clone [<options>] <repo> <dir>")
+	}
+	repo := positional[0]
+	// Like git, a shallow clone fetches one branch unless told otherwise.
+	options.SingleBranch = singleBranch || (options.Deepen.requested() && !noSingleBranch)
+	// Like git, only a plain path is cloned by copying the object store,
+	// unless objects are to be shared.
+	if _, ok := localRepositoryPath(repo); ok {
+		options.Local = options.Shared || (!noLocal && !strings.HasPrefix(repo, "file://"))
+	}
+	if options.Local {
+		// The object store is copied whole.
+		d := options.Deepen
+		if d.Depth > 0 {
+			fmt.Fprintln(os.Stderr, "warning: --depth is ignored in local clones; use file:// instead.")
+		}
+		if d.Since != 0 {
+			fmt.Fprintln(os.Stderr, "warning: --shallow-since is ignored in local clones; use file:// instead.")
+		}
+		if len(d.Not) > 0 {
+			fmt.Fprintln(os.Stderr, "warning: --shallow-exclude is ignored in local clones; use file:// instead.")
+		}
+		if options.Filter.Spec != "" {
+			fmt.Fprintln(os.Stderr, "warning: --filter is ignored in local clones; use file:// instead.")
+		}
+		options.Deepen, options.Filter = deepenOptions{}, objectFilter{}
+	}
+	return Clone(repo, positional[1], options)
+}
 
-	// parse packfile for debugging
-	sign := packfileBuf[:4]
-	version := binary.BigEndian.Uint32(packfileBuf[4:8])
-	numObjects := binary.BigEndian.Uint32(packfileBuf[8:12])
-	log.Printf("[Debug] packfile sign: %s\n", string(sign))
-	log.Printf("[Debug] version: %d\n", version)
-	log.Printf("[Debug] num objects: %d\n", numObjects)
+// Clone a repository into localDir: fetch its branches and tags, or only the
+// branch to check out with SingleBranch, then check out the remote's HEAD
+// or the branch or tag asked for. A tag is checked out detached.
+// ref: https://git-scm.com/docs/git-clone
+func Clone(repo, localDir string, options cloneOptions) error {
+	// Like git, clone only into a new or empty directory, and leave nothing
+	// of a failed clone behind.
+	entries, err := os.ReadDir(localDir)
+	existed := err == nil
+	if len(entries) > 0 || (err != nil && !os.IsNotExist(err)) {
+		return fmt.Errorf("destination path '%s' already exists and is not an empty directory", localDir)
+	}
+	if err := cloneInto(repo, localDir, options); err != nil {
+		if !existed {
+			os.RemoveAll(localDir)
+			return err
+		}
+		entries, _ := os.ReadDir(localDir)
+		for _, entry := range entries {
+			os.RemoveAll(filepath.Join(localDir, entry.Name()))
+		}
+		return err
+	}
+	return nil
+}
 
-	// verify checksum
-	checkumLen := 20
-	storedChecksum := packfileBuf[len(packfileBuf)-checkumLen:]
-	actualChecksum := sha1.Sum(packfileBuf[:len(packfileBuf)-checkumLen])
-	if !bytes.Equal(storedChecksum, actualChecksum[:]) {
-		return fmt.Errorf("expected checksum: %v, got %v", storedChecksum, actualChecksum)
+func cloneInto(repo, localDir string, options cloneOptions) error {
+	if options.Bare {
+		if err := initBare(localDir); err != nil {
+			return err
+		}
+	} else {
+		Init(localDir)
 	}
 
-	headerLen := 12
-	bufReader := bytes.NewReader(packfileBuf[headerLen:])
-	for i := 0; i < int(numObjects); i++ {
-		err := readObject(bufReader)
+	// A mirror takes every ref; other clones take branches and tags.
+	prefixes := []string{"HEAD", "refs/heads/", "refs/tags/"}
+	if options.Mirror {
+		prefixes = nil
+	}
+	var remote *gitRemote
+	var refs []remoteRef
+	var err error
+	if options.Local {
+		source, _ := localRepositoryPath(repo)
+		refs, err = cloneLocalObjects(source, localDir, options)
+		if err != nil {
+			return err
+		}
+		refs = filterRefs(refs, prefixes)
+	} else {
+		remote, err = connectRemote(localDir, repo)
+		if err != nil {
+			return err
+		}
+		defer remote.close()
+		refs, err = remote.listRefs(prefixes)
 		if err != nil {
 			return err
 		}
+		if options.Filter.Spec != "" && !remote.fetchSupports("filter") {
+			fmt.Fprintln(os.Stderr, "warning: filtering not recognized by server, ignoring")
+			options.Filter = objectFilter{}
+		}
 	}
-	return nil
-}
 
-func readSha(reader *bytes.Reader) (string, error) {
-	sha := make([]byte, 20)
-	if _, err := reader.Read(sha); err != nil {
-		return "", err
+	// The ref whose commit is checked out: the remote's HEAD, or the branch
+	// or tag named by Branch.
+	var head, checkout *remoteRef
+	for i := range refs {
+		if refs[i].Name == "HEAD" {
+			head = &refs[i]
+		}
+	}
+	checkout = head
+	if options.Branch != "" {
+		checkout = nil
+		for _, name := range []string{"refs/heads/" + options.Branch, "refs/tags/" + options.Branch} {
+			for i := range refs {
+				if checkout == nil && refs[i].Name == name {
+					checkout = &refs[i]
+				}
+			}
+		}
+		if checkout == nil {
+			return fmt.Errorf("Remote branch %s not found in upstream origin", options.Branch)
+		}
+	}
+	checkoutRef := ""
+	switch {
+	case checkout == nil:
+	case checkout.Name == "HEAD":
+		checkoutRef = checkout.Symref
+	default:
+		checkoutRef = checkout.Name
 	}
-	return fmt.Sprintf("%x", sha), nil
-}
 
-func objectPath(sha string) string {
-	return filepath.Join(".git", "objects", sha[:2], sha[2:])
-}
+	var fetched []remoteRef
+	for _, ref := range refs {
+		if ref.Name == "HEAD" {
+			continue
+		}
+		if !options.SingleBranch || ref.Name == checkoutRef {
+			fetched = append(fetched, ref)
+		}
+	}
 
-// Read objects from packfile.
-func readObject(reader *bytes.Reader) error {
-	objType, objLen, err := readObjectTypeAndLen(reader)
-	if err != nil {
+	remoteConfig := []configEntry{{"url", repo}}
+	switch {
+	case options.Mirror:
+		remoteConfig = append(remoteConfig, configEntry{"fetch", "+refs/*:refs/*"}, configEntry{"mirror", "true"})
+	case options.Bare:
+		// Branches are fetched into place rather than tracked.
+	case options.SingleBranch && strings.HasPrefix(checkoutRef, "refs/heads/"):
+		name := branchName(checkoutRef)
+		remoteConfig = append(remoteConfig, configEntry{"fetch", "+" + checkoutRef + ":refs/remotes/origin/" + name})
+	case options.SingleBranch && checkoutRef != "":
+		remoteConfig = append(remoteConfig, configEntry{"fetch", "+" + checkoutRef + ":" + checkoutRef})
+	default:
+		remoteConfig = append(remoteConfig, configEntry{"fetch", "+refs/heads/*:refs/remotes/origin/*"})
+	}
+	partial := options.Filter.Spec != ""
+	if partial {
+		// Objects the filter leaves out are fetched from origin when needed.
+		remoteConfig = append(remoteConfig, configEntry{"promisor", "true"}, configEntry{"partialclonefilter", options.Filter.Spec})
+	}
+	if err := appendConfigSection(localDir, "remote", "origin", remoteConfig...); err != nil {
 		return err
 	}
-
-	switch objType {
-	case OBJECT_REF_DELTA:
-		baseObjSha, err := readSha(reader)
-		if err != nil {
+	if partial {
+		if err := setConfigValue(localDir, "core.repositoryformatversion", "1"); err != nil {
 			return err
 		}
-		baseObj, ok := shaToObj[baseObjSha]
-		if !ok {
-			return fmt.Errorf("unknown obj sha: %s", baseObjSha)
+		if err := appendConfigSection(localDir, "extensions", "", configEntry{"partialclone", "origin"}); err != nil {
+			return err
+		}
+	}
+	if checkout == nil {
+		fmt.Fprintln(os.Stderr, "warning: You appear to have cloned an empty repository.")
+		return nil
+	}
+	commitSha := checkout.Sha
+	if checkout.Peeled != "" {
+		commitSha = checkout.Peeled
+	}
+
+	if remote != nil {
+		var wants []string
+		wanted := make(map[string]bool)
+		for _, sha := range append(refShas(fetched), checkout.Sha) {
+			if !wanted[sha] {
+				wanted[sha] = true
+				wants = append(wants, sha)
+			}
+		}
+		// Tags into the history of a single branch come along with it.
+		remote.FollowTags = options.SingleBranch
+		remote.Deepen, remote.Filter = options.Deepen, options.Filter
+		if err := remote.checkShallowSupport(); err != nil {
+			return err
 		}
-		decompressed, err := decompressObject(reader)
+		pack, err := remote.fetchPack(wants, nil)
 		if err != nil {
 			return err
 		}
-
-		deltified, err := readDeltified(decompressed, &baseObj)
+		// Like git, a clone keeps the pack however small.
+		_, err = indexPack(localDir, pack, indexPackOptions{Threads: options.Threads, Promisor: partial, Progress: progressEnabled()})
+		pack.Close()
 		if err != nil {
 			return err
 		}
+		if err := updateShallow(localDir, remote.NewShallow, remote.Unshallow); err != nil {
+			return err
+		}
+	}
+	if options.SingleBranch {
+		for _, ref := range refs {
+			if strings.HasPrefix(ref.Name, "refs/tags/") && ref.Name != checkoutRef && hasObject(localDir, ref.Sha) {
+				fetched = append(fetched, ref)
+			}
+		}
+	}
 
-		obj := Object{
-			Type: baseObj.Type,
-			Buf:  deltified.Bytes(),
+	// Bare repositories keep no reflogs.
+	reflogMessage := "clone: from " + anonymizeURL(repo)
+	for _, ref := range fetched {
+		name, ok := options.localRef(ref.Name)
+		if !ok {
+			continue
 		}
-		if err := saveObj(&obj); err != nil {
+		if err := writeRef(localDir, name, ref.Sha); err != nil {
 			return err
 		}
-	case OBJECT_OFS_DELTA:
-		// TODO : Implement this section
-		return errors.New("Unsupported")
-	default:
-		decompressed, err := decompressObject(reader)
-		if err != nil {
+		if strings.HasPrefix(name, "refs/remotes/") {
+			if err := appendReflog(localDir, name, "", ref.Sha, reflogMessage); err != nil {
+				return err
+			}
+		}
+	}
+	if !options.Bare && head != nil && head.Symref != "" {
+		// origin/HEAD follows the remote's default branch, if fetched.
+		tracking := "refs/remotes/origin/" + branchName(head.Symref)
+		if _, err := readRef(localDir, tracking); err == nil {
+			if err := writeSymref(localDir, "refs/remotes/origin/HEAD", tracking); err != nil {
+				return err
+			}
+		}
+	}
+	if !strings.HasPrefix(checkoutRef, "refs/heads/") {
+		// A tag, or HEAD without a symref, is checked out detached.
+		if err := writeDetachedHead(localDir, commitSha); err != nil {
+			return err
+		}
+	} else if options.Bare {
+		if err := writeSymbolicHead(localDir, checkoutRef); err != nil {
+			return err
+		}
+		return nil
+	} else {
+		name := branchName(checkoutRef)
+		if err := writeRef(localDir, checkoutRef, commitSha); err != nil {
+			return err
+		}
+		if err := appendReflog(localDir, checkoutRef, "", commitSha, reflogMessage); err != nil {
 			return err
 		}
-		obj := Object{
-			Type: objType,
-			Buf:  decompressed.Bytes(),
+		if err := writeSymbolicHead(localDir, checkoutRef); err != nil {
+			return err
 		}
-		if objLen != decompressed.Len() {
-			fmt.Println("object doesn't match", objType, decompressed)
-			fmt.Println("expected length", objLen, "actual", decompressed.Len())
+		if err := appendConfigSection(localDir, "branch", name,
+			configEntry{"remote", "origin"},
+			configEntry{"merge", checkoutRef}); err != nil {
+			return err
 		}
-		if err := saveObj(&obj); err != nil {
+	}
+	if options.Bare {
+		return nil
+	}
+	if err := appendReflog(localDir, "HEAD", "", commitSha, reflogMessage); err != nil {
+		return err
+	}
+
+	if !options.NoCheckout {
+		if err := restoreRepository(localDir, commitSha); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func decompressObject(reader *bytes.Reader) (*bytes.Buffer, error) {
+func refShas(refs []remoteRef) []string {
+	shas := make([]string, len(refs))
+	for i, ref := range refs {
+		shas[i] = ref.Sha
+	}
+	return shas
+}
+
+// Where a clone keeps one of the remote's refs: branches become
+// remote-tracking refs unless bare, tags keep their name, and a mirror
+// keeps every ref as it is.
+func (o cloneOptions) localRef(name string) (string, bool) {
+	switch {
+	case o.Mirror, strings.HasPrefix(name, "refs/tags/"):
+		return name, true
+	case !strings.HasPrefix(name, "refs/heads/"):
+		return "", false
+	case o.Bare:
+		return name, true
+	}
+	return "refs/remotes/origin/" + branchName(name), true
+}
+
+// Where an object is stored loose.
+func objectPath(localDir, sha string) string {
+	return filepath.Join(gitDir(localDir), "objects", sha[:2], sha[2:])
+}
+
+// Object directories of other repositories that objects may be borrowed
+// from, listed in objects/info/alternates and followed recursively.
+// ref: https://git-scm.com/docs/gitrepository-layout#Documentation/gitrepository-layout.txt-objectsinfoalternates
+func alternateObjectDirs(localDir string) []string {
+	own := filepath.Join(gitDir(localDir), "objects")
+	alternatesLock.Lock()
+	defer alternatesLock.Unlock()
+	if dirs, ok := alternates[own]; ok {
+		return dirs
+	}
+	seen := map[string]bool{own: true}
+	var dirs []string
+	var visit func(objectsDir string, depth int)
+	visit = func(objectsDir string, depth int) {
+		data, err := os.ReadFile(filepath.Join(objectsDir, "info", "alternates"))
+		if err != nil || depth > 5 {
+			return
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			dir := line
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(objectsDir, dir)
+			}
+			dir = filepath.Clean(dir)
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+				visit(dir, depth+1)
+			}
+		}
+	}
+	visit(own, 0)
+	alternates[own] = dirs
+	return dirs
+}
+
+// Alternates by objects directory, as they are looked up for every object
+// not found locally.
+var (
+	alternates     = make(map[string][]string)
+	alternatesLock sync.Mutex
+)
+
+// Forget the alternates of a repository after they were written.
+func forgetAlternates(localDir string) {
+	alternatesLock.Lock()
+	defer alternatesLock.Unlock()
+	delete(alternates, filepath.Join(gitDir(localDir), "objects"))
+}
+
+// Find an object stored loose in one of the alternates.
+func alternateObjectPath(localDir, sha string) (string, bool) {
+	for _, dir := range alternateObjectDirs(localDir) {
+		filename := filepath.Join(dir, sha[:2], sha[2:])
+		if _, err := os.Stat(filename); err == nil {
+			return filename, true
+		}
+	}
+	return "", false
+}
+
+// Load an object from the repository in the form packs are parsed into.
+func readLocalObject(localDir, sha string) (*Object, error) {
+	objectType, content, err := readGitObject(localDir, sha)
+	if err != nil {
+		return nil, err
+	}
+	code, err := objectTypeCode(objectType)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{Type: code, Buf: content}, nil
+}
+
+// Read the distance back to an OFS_DELTA base, a big-endian varint where
+// every continuation adds one.
+func readOffsetDistance(reader io.ByteReader) (int64, error) {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	distance := int64(b & remMask)
+	for b&msbMask != 0 {
+		if b, err = reader.ReadByte(); err != nil {
+			return 0, err
+		}
+		distance = ((distance + 1) << 7) | int64(b&remMask)
+	}
+	return distance, nil
+}
+
+func decompressObject(reader io.Reader) (*bytes.Buffer, error) {
 	decompressedReader, err := zlib.NewReader(reader)
 	if err != nil {
 		return nil, err
@@ -437,6 +1043,12 @@ func readDeltified(reader *bytes.Buffer, baseObj *Object) (*bytes.Buffer, error)
 			// log.Printf("[Debug] offset: %d\n", offset)
 			// log.Printf("[Debug] size: %d\n", size)
 			// log.Printf("[Debug] size: %b\n", size)
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > len(baseObj.Buf) {
+				return nil, fmt.Errorf("delta copies past the end of its base")
+			}
 			if _, err := result.Write(baseObj.Buf[offset : offset+size]); err != nil {
 				return nil, err
 			}
@@ -447,17 +1059,6 @@ func readDeltified(reader *bytes.Buffer, baseObj *Object) (*bytes.Buffer, error)
 	}
 	return result, nil
 }
-func saveObj(o *Object) error {
-	objSha, err := o.sha()
-	if err != nil {
-		return err
-	}
-	shaToObj[objSha] = *o
-	// log.Printf("[Debug] obj sha: %s\n", objSha)
-	// log.Printf("[Debug] actual obj len: %d\n", len(o.Buf))
-	return nil
-}
-
 func (o *Object) sha() (string, error) {
 	b, err := o.wrappedBuf()
 	if err != nil {
@@ -466,8 +1067,9 @@ func (o *Object) sha() (string, error) {
 	return fmt.Sprintf("%x", sha1.Sum(b)), nil
 }
 
-// this might be wrong
-func readObjectTypeAndLen(reader *bytes.Reader) (byte, int, error) {
+// Read an object header: the type and a little-endian varint size whose first
+// four bits share a byte with the type.
+func readObjectTypeAndLen(reader io.ByteReader) (byte, int, error) {
 	num := 0
 	b, err := reader.ReadByte()
 	if err != nil {
@@ -484,7 +1086,7 @@ func readObjectTypeAndLen(reader *bytes.Reader) (byte, int, error) {
 		if err != nil {
 			return 0, 0, err
 		}
-		num += int(b) << (4 + 7*i)
+		num += int(b&remMask) << (4 + 7*i)
 		if (b & msbMask) == 0 {
 			break
 		}
@@ -495,79 +1097,6 @@ func readObjectTypeAndLen(reader *bytes.Reader) (byte, int, error) {
 	return objType, num, nil
 
 }
-func fetchPackfile(repoUrl, commitSha string) []byte {
-	buf := bytes.NewBuffer([]byte{})
-	buf.WriteString(packetLine(fmt.Sprintf("want %s no-progress\n", commitSha)))
-	buf.WriteString("0000") // flush
-	buf.WriteString(packetLine("done\n"))
-	uploadPackUrl := fmt.Sprintf("%s/git-upload-pack", repoUrl)
-	resp, err := http.Post(uploadPackUrl, "", buf)
-	must(err)
-	defer resp.Body.Close()
-	result := bytes.NewBuffer([]byte{})
-	_, err = io.Copy(result, resp.Body)
-	must(err)
-	packfileBuf := result.Bytes()[8:] // skip like "0031ACK\n"
-	return packfileBuf
-}
-
-func packetLine(rawLine string) string {
-	size := len(rawLine) + 4
-	return fmt.Sprintf("%04x%s", size, rawLine)
-}
-
-func writeBranchRefFile(localRepo string, branch string, commitSha string) error {
-	refFilePath := filepath.Join(localRepo, ".git", "refs", "heads", branch)
-	if err := os.MkdirAll(filepath.Dir(refFilePath), 0755); err != nil {
-		return err
-	}
-	refFileContent := []byte(commitSha)
-	if err := os.WriteFile(refFilePath, refFileContent, 0644); err != nil {
-		return err
-	}
-	return nil
-}
-
-func fetchLatestCommitHash(repoUrl string) (string, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/info/refs?service=git-upload-pack", repoUrl))
-	must(err)
-	defer resp.Body.Close()
-	buf := bytes.NewBuffer([]byte{})
-	_, err = io.Copy(buf, resp.Body)
-	must(err)
-	reader := bytes.NewReader(buf.Bytes())
-	// read the 001e# service=git-upload-pack
-	_, err = readPacketLine(reader)
-	must(err)
-	// read the 0000
-	_, err = readPacketLine(reader)
-	must(err)
-	// read the first line (HEAD)
-	head, err := readPacketLine(reader)
-	must(err)
-	commitSha := strings.Split(string(head), " ")[0]
-	return commitSha, nil
-}
-
-func readPacketLine(reader *bytes.Reader) ([]byte, error) {
-	// read the first 4 byte => lengthInHex
-	lengthInHex := make([]byte, 4)
-	_, err := reader.Read(lengthInHex)
-	if err != nil {
-		return []byte{}, err
-	}
-	length, err := strconv.ParseInt(string(lengthInHex), 16, 64)
-	if err != nil {
-		return []byte{}, err
-	}
-	if length == 0 {
-		return []byte{}, nil // 0000
-	}
-	data := make([]byte, length-4)
-	_, err = reader.Read(data)
-	return data, err
-}
-
 func writeFile(filename string, data []byte) error {
 	err := os.MkdirAll(filepath.Dir(filename), 0755)
 	if err != nil {
@@ -660,6 +1189,21 @@ func (o *Object) wrappedBuf() ([]byte, error) {
 	return wrappedBuf.Bytes(), nil
 }
 
+func objectTypeCode(name string) (byte, error) {
+	switch name {
+	case "commit":
+		return OBJECT_COMMIT, nil
+	case "tree":
+		return OBJECT_TREE, nil
+	case "blob":
+		return OBJECT_BLOB, nil
+	case "tag":
+		return OBJECT_TAG, nil
+	default:
+		return 0, fmt.Errorf("invalid type: %s", name)
+	}
+}
+
 func (o *Object) typeString() (string, error) {
 	switch o.Type {
 	case OBJECT_COMMIT:
@@ -685,26 +1229,12 @@ func wrapContent(contents []byte, objectType string) (*bytes.Buffer, error) {
 	return outerContents, nil
 }
 
-// Write objects in shaToObj to .git/objects.
-func writeFetchedObjects(localRepo string) error {
-	for _, object := range shaToObj {
-		b, err := object.wrappedBuf()
-		if err != nil {
-			return err
-		}
-		if _, err := writeGitObject(localRepo, b); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 // Write the git object and return the sha1.
 func writeGitObject(localDir string, content []byte) (string, error) {
 	blobSha := fmt.Sprintf("%x", sha1.Sum(content))
 	// log.Printf("[Debug] object sha: %s\n", blobSha)
 
-	objectFilePath := filepath.Join(localDir, objectPath(blobSha))
+	objectFilePath := objectPath(localDir, blobSha)
 	if err := os.MkdirAll(filepath.Dir(objectFilePath), 0755); err != nil {
 		return "", err
 	}
@@ -728,11 +1258,9 @@ func restoreRepository(repoPath, commitSha string) error {
 	if err != nil {
 		return err
 	}
-	log.Printf("[Debug] latest commit sha: %s\n", commitSha)
 	reader := bytes.NewReader(commitBuf)
 	treePrefix, err := readUntil(reader, ' ')
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
 	if string(treePrefix) != "tree" {
@@ -742,12 +1270,18 @@ func restoreRepository(repoPath, commitSha string) error {
 	if err != nil {
 		return err
 	}
+	files, err := flattenTree(repoPath, string(treeSha))
+	if err != nil {
+		return err
+	}
+	if err := prefetchFiles(repoPath, files); err != nil {
+		return err
+	}
 	// Traverse tree objects.
 	if err := restoreTree(repoPath, "", string(treeSha)); err != nil {
-		fmt.Println(err)
 		return err
 	}
-	return nil
+	return writeIndexFromTree(repoPath, string(treeSha))
 }
 
 func restoreTree(repoPath, curDir, treeSha string) error {
@@ -756,11 +1290,11 @@ func restoreTree(repoPath, curDir, treeSha string) error {
 		sha := hex.EncodeToString(child.Hash[:])
 		if child.IsBlob {
 			// Create a file
-			blobBuf, err := CatFile(repoPath, sha)
-			must(err)
-			filename := filepath.Join(repoPath, curDir, string(child.Name))
-			err = writeFile(filename, blobBuf)
-			must(err)
+			name := filepath.ToSlash(filepath.Join(curDir, string(child.Name)))
+			file := treeFile{Mode: string(child.Perm), Sha: sha}
+			if err := writeWorkFile(repoPath, name, file); err != nil {
+				return err
+			}
 		} else {
 			// traverse recursively.
 			childDir := filepath.Join(curDir, string(child.Name))
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Programs tests need to run, such as a filter process, are the test binary
+// itself run with MYGIT_TEST_HELPER naming the one to act as.
+var testHelpers = map[string]func() int{
+	"filter-process": filterProcessHelper,
+	"ssh":            sshHelper,
+}
+
+func TestMain(m *testing.M) {
+	if name := os.Getenv("MYGIT_TEST_HELPER"); name != "" {
+		os.Exit(testHelpers[name]())
+	}
+	os.Exit(m.Run())
+}
+
+// The command that runs the test binary as a helper.
+func helperCommand(t *testing.T, name string) string {
+	t.Helper()
+	t.Setenv("MYGIT_TEST_HELPER", name)
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shellQuote(executable)
+}
+
+// Keep the user's and the system's config out of a test, and give it a
+// fixed identity and an editor that leaves messages as they are.
+func isolateConfig(t *testing.T) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_EDITOR", ":")
+	t.Setenv("GIT_TERMINAL_PROMPT", "0")
+	for _, role := range []string{"AUTHOR", "COMMITTER"} {
+		t.Setenv("GIT_"+role+"_NAME", "A U Thor")
+		t.Setenv("GIT_"+role+"_EMAIL", "author@example.com")
+	}
+	for _, env := range []string{"XDG_CONFIG_HOME", "GIT_CONFIG_GLOBAL", "GIT_DIR", "GIT_ASKPASS", "SSH_ASKPASS", "GIT_SSH_COMMAND"} {
+		unsetenv(t, env)
+	}
+}
+
+// Unset an environment variable for the rest of a test.
+func unsetenv(t *testing.T, name string) {
+	t.Helper()
+	t.Setenv(name, "")
+	os.Unsetenv(name)
+}
+
+// Run the rest of a test from dir, as the commands run from the repository.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	old, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(old) })
+}
+
+// Make an empty repository in a temporary directory and run the rest of the
+// test from inside it.
+func newTestRepo(t *testing.T) string {
+	t.Helper()
+	isolateConfig(t)
+	dir := t.TempDir()
+	chdir(t, dir)
+	Init(dir)
+	return dir
+}
+
+// Commit files on top of parent, or as a root commit when parent is empty,
+// without touching HEAD, the index or the working tree. An empty content
+// deletes the file.
+func commitFiles(t *testing.T, dir, parent, message string, files map[string]string) string {
+	t.Helper()
+	tree := make(map[string]treeFile)
+	var parents []string
+	if parent != "" {
+		commit, err := readCommit(dir, parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tree, err = flattenTree(dir, commit.Tree); err != nil {
+			t.Fatal(err)
+		}
+		parents = []string{parent}
+	}
+	for name, content := range files {
+		if content == "" {
+			delete(tree, name)
+			continue
+		}
+		blob := &GitBlob{Content: []byte(content)}
+		sha, err := writeGitObject(dir, blob.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree[name] = treeFile{Mode: "100644", Sha: sha}
+	}
+	treeSha, err := writeTreeFromFiles(dir, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha, err := commitTree(dir, treeSha, parents, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+// Move the current branch to a commit and check it out.
+func resetHard(t *testing.T, dir, rev string) {
+	t.Helper()
+	if err := Reset(dir, "hard", rev); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func headSha(t *testing.T, dir string) string {
+	t.Helper()
+	_, sha, err := readHead(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+func mustRevParse(t *testing.T, dir, rev string) string {
+	t.Helper()
+	sha, err := revParse(dir, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+// The files of a commit's tree and their contents.
+func commitContents(t *testing.T, dir, rev string) map[string]string {
+	t.Helper()
+	commit, err := readCommit(dir, mustRevParse(t, dir, rev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := flattenTree(dir, commit.Tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	for name, file := range files {
+		content, err := CatFile(dir, file.Sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[name] = string(content)
+	}
+	return contents
+}
+
+func equalContents(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, content := range a {
+		if other, ok := b[name]; !ok || other != content {
+			return false
+		}
+	}
+	return true
+}
+
+func indexFiles(t *testing.T, dir string) map[string]treeFile {
+	t.Helper()
+	index, err := readIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return index.files()
+}
+
+func treeFiles(t *testing.T, dir, rev string) map[string]treeFile {
+	t.Helper()
+	commit, err := readCommit(dir, mustRevParse(t, dir, rev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := flattenTree(dir, commit.Tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func sameFiles(a, b map[string]treeFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, file := range a {
+		if b[name] != file {
+			return false
+		}
+	}
+	return true
+}
+
+func writeTestFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := writeFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A file's content in the working tree, or "" when it is missing.
+func readTestFile(t *testing.T, dir, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// Run the real git, which checks what mygit wrote; tests needing it are
+// skipped where it is not installed.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+	}
+	return string(output)
+}
+
+// Run f and return what it printed to stdout and stderr, interleaved.
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		r.Close()
+		done <- string(data)
+	}()
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	func() {
+		// Restored even if f stops the test.
+		defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+		f()
+	}()
+	w.Close()
+	return <-done
+}
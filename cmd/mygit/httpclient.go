@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How requests to a remote are made beyond the client itself, from the
+// http.* and http.<url>.* config and the environment variables git reads
+// for them.
+// ref: https://git-scm.com/docs/git-config#Documentation/git-config.txt-http
+type httpConfig struct {
+	ExtraHeaders  []string // "Name: value", sent with every request
+	LowSpeedLimit int64    // bytes a second
+	LowSpeedTime  time.Duration
+	MaxRetries    int64
+	MaxRetryTime  time.Duration
+}
+
+// The client and settings for requests to a URL: its proxy, the CAs its
+// certificate is checked against, a client certificate, and how slow or
+// failing requests are given up on.
+func newHTTPClient(localDir, url string) (*http.Client, httpConfig, error) {
+	var config httpConfig
+	value := func(key, env string) (string, bool) {
+		if v, ok := os.LookupEnv(env); ok && env != "" {
+			return v, true
+		}
+		return urlConfigValue(localDir, "http", strings.ToLower(key), url)
+	}
+	path := func(key, env string) string {
+		if v, ok := value(key, env); ok && v != "" {
+			return expandHome(v)
+		}
+		return ""
+	}
+	integer := func(key, env string, fallback int64) (int64, error) {
+		v, ok := value(key, env)
+		if !ok {
+			return fallback, nil
+		}
+		return parseConfigInt(v)
+	}
+
+	tlsConfig := &tls.Config{}
+	if v, ok := value("sslVerify", ""); ok {
+		verify, err := parseConfigBool(v)
+		if err != nil {
+			return nil, config, err
+		}
+		tlsConfig.InsecureSkipVerify = !verify
+	}
+	if _, ok := os.LookupEnv("GIT_SSL_NO_VERIFY"); ok {
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if v, ok := value("sslVersion", "GIT_SSL_VERSION"); ok && v != "" {
+		version, ok := tlsVersions[strings.ToLower(v)]
+		if !ok {
+			return nil, config, fmt.Errorf("unsupported SSL version %s", v)
+		}
+		tlsConfig.MinVersion = version
+	}
+	// A CA bundle or directory replaces the system's CAs, as with curl.
+	caInfo, caPath := path("sslCAInfo", "GIT_SSL_CAINFO"), path("sslCAPath", "GIT_SSL_CAPATH")
+	if caInfo != "" || caPath != "" {
+		pool := x509.NewCertPool()
+		if caInfo != "" {
+			data, err := os.ReadFile(caInfo)
+			if err != nil || !pool.AppendCertsFromPEM(data) {
+				return nil, config, fmt.Errorf("error setting certificate file: %s", caInfo)
+			}
+		}
+		if caPath != "" {
+			entries, err := os.ReadDir(caPath)
+			if err != nil {
+				return nil, config, fmt.Errorf("error setting certificate path: %s", caPath)
+			}
+			for _, entry := range entries {
+				if data, err := os.ReadFile(filepath.Join(caPath, entry.Name())); err == nil {
+					pool.AppendCertsFromPEM(data)
+				}
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cert := path("sslCert", "GIT_SSL_CERT"); cert != "" {
+		key := path("sslKey", "GIT_SSL_KEY")
+		if key == "" {
+			key = cert
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, config, fmt.Errorf("could not load client certificate '%s': %v", cert, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	// http.proxy wins over HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+	proxy := http.ProxyFromEnvironment
+	if v, ok := value("proxy", ""); ok && v != "" {
+		if !strings.Contains(v, "://") {
+			v = "http://" + v
+		}
+		u, err := neturl.Parse(v)
+		if err != nil {
+			return nil, config, fmt.Errorf("invalid proxy URL '%s'", anonymizeURL(v))
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	for _, v := range urlConfigVars(localDir, "http", "extraheader", url) {
+		if v.Value == "" {
+			config.ExtraHeaders = nil
+		} else {
+			config.ExtraHeaders = append(config.ExtraHeaders, v.Value)
+		}
+	}
+	var err error
+	if config.LowSpeedLimit, err = integer("lowSpeedLimit", "GIT_HTTP_LOW_SPEED_LIMIT", 0); err != nil {
+		return nil, config, err
+	}
+	seconds, err := integer("lowSpeedTime", "GIT_HTTP_LOW_SPEED_TIME", 0)
+	if err != nil {
+		return nil, config, err
+	}
+	config.LowSpeedTime = time.Duration(seconds) * time.Second
+	if config.MaxRetries, err = integer("maxRetries", "GIT_HTTP_MAX_RETRIES", 3); err != nil {
+		return nil, config, err
+	}
+	if seconds, err = integer("maxRetryTime", "GIT_HTTP_MAX_RETRY_TIME", 300); err != nil {
+		return nil, config, err
+	}
+	config.MaxRetryTime = time.Duration(seconds) * time.Second
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, config, nil
+}
+
+// The http.sslVersion values there is a Go version for; each is the least
+// version allowed.
+var tlsVersions = map[string]uint16{
+	"tlsv1":   tls.VersionTLS10,
+	"tlsv1.0": tls.VersionTLS10,
+	"tlsv1.1": tls.VersionTLS11,
+	"tlsv1.2": tls.VersionTLS12,
+	"tlsv1.3": tls.VersionTLS13,
+}
+
+// Add the configured extra headers to a request.
+func (c httpConfig) addHeaders(req *http.Request) {
+	for _, header := range c.ExtraHeaders {
+		name, value, ok := strings.Cut(header, ":")
+		if ok {
+			req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+}
+
+// Responses a server may give while it is overloaded or restarting, which
+// are worth asking again for.
+func transientHTTPStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// The longest a retry waits without the server saying how long to.
+const maxRetryBackoff = time.Minute
+
+// How long to wait before retrying: what Retry-After says, in seconds or as
+// a date, else a second doubled for every retry so far, up to a minute.
+// ref: https://www.rfc-editor.org/rfc/rfc9110#field.retry-after
+func retryDelay(resp *http.Response, retries int64) time.Duration {
+	if after := resp.Header.Get("Retry-After"); after != "" {
+		if seconds, err := strconv.ParseInt(after, 10, 64); err == nil && seconds >= 0 {
+			if seconds > int64(math.MaxInt64/time.Second) {
+				return math.MaxInt64
+			}
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(after); err == nil {
+			if delay := time.Until(date); delay > 0 {
+				return delay
+			}
+			return 0
+		}
+	}
+	delay := time.Second
+	for i := int64(0); i < retries && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay
+}
+
+// Compress a request body, as git does for upload-pack requests too big to
+// send as they are cheaply.
+func gzipBody(body []byte) ([]byte, error) {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	if _, err := gz.Write(body); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Watches a request's transfer both ways and cancels it once fewer than
+// limit bytes a second have moved over a period, as curl's low speed limit
+// does.
+// ref: https://curl.se/libcurl/c/CURLOPT_LOW_SPEED_LIMIT.html
+type speedMonitor struct {
+	limit  int64
+	period time.Duration
+	moved  atomic.Int64
+	slow   atomic.Bool
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Start watching a request, returning it bound to the monitor.
+func watchSpeed(req *http.Request, limit int64, period time.Duration) (*http.Request, *speedMonitor) {
+	ctx, cancel := context.WithCancel(req.Context())
+	m := &speedMonitor{limit: limit, period: period, cancel: cancel, done: make(chan struct{})}
+	if req.Body != nil {
+		req.Body = &monitoredBody{ReadCloser: req.Body, m: m}
+	}
+	go m.run()
+	return req.WithContext(ctx), m
+}
+
+func (m *speedMonitor) run() {
+	ticker := time.NewTicker(m.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			if m.moved.Swap(0) < m.limit*int64(m.period/time.Second) {
+				m.slow.Store(true)
+				m.cancel()
+				return
+			}
+		}
+	}
+}
+
+func (m *speedMonitor) stop() {
+	m.once.Do(func() {
+		close(m.done)
+		m.cancel()
+	})
+}
+
+func (m *speedMonitor) err() error {
+	return fmt.Errorf("Operation too slow. Less than %d bytes/sec transferred the last %d seconds", m.limit, int64(m.period/time.Second))
+}
+
+// A request or response body whose bytes count towards a monitor; closing
+// the response body ends the watch.
+type monitoredBody struct {
+	io.ReadCloser
+	m        *speedMonitor
+	response bool
+}
+
+func (b *monitoredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.m.moved.Add(int64(n))
+	if err != nil && err != io.EOF && b.m.slow.Load() {
+		err = b.m.err()
+	}
+	return n, err
+}
+
+func (b *monitoredBody) Close() error {
+	if b.response {
+		b.m.stop()
+	}
+	return b.ReadCloser.Close()
+}
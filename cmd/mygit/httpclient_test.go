@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Keep the config and the environment's HTTP settings out of a test.
+func isolateHTTPConfig(t *testing.T) {
+	t.Helper()
+	isolateConfig(t)
+	for _, env := range []string{"GIT_HTTP_MAX_RETRIES", "GIT_HTTP_MAX_RETRY_TIME", "GIT_HTTP_LOW_SPEED_LIMIT", "GIT_HTTP_LOW_SPEED_TIME"} {
+		unsetenv(t, env)
+	}
+}
+
+// A server answering with the given statuses in turn, then with 200 for
+// every request after them.
+func statusServer(t *testing.T, retryAfter string, statuses ...int) (*httptest.Server, *int64) {
+	t.Helper()
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&requests, 1)
+		if int(n) <= len(statuses) {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func getWith(t *testing.T, url string) (string, error) {
+	t.Helper()
+	tr, err := newHTTPTransport(t.TempDir(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.do(func() (*http.Request, error) {
+		return http.NewRequest("GET", tr.URL+"/info/refs", nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		retryAfter string
+		retries    int64
+		want       time.Duration
+	}{
+		{"", 0, time.Second},
+		{"", 1, 2 * time.Second},
+		{"", 5, 32 * time.Second},
+		{"", 6, maxRetryBackoff},
+		{"", 64, maxRetryBackoff},
+		{"", math.MaxInt64, maxRetryBackoff},
+		{"0", 3, 0},
+		{"7", 3, 7 * time.Second},
+		{"99999999999999999", 0, math.MaxInt64},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", 0, 0},
+		{"soon", 2, 4 * time.Second},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.retryAfter != "" {
+			resp.Header.Set("Retry-After", tt.retryAfter)
+		}
+		if got := retryDelay(resp, tt.retries); got != tt.want {
+			t.Errorf("retryDelay(Retry-After %q, %d) = %v, want %v", tt.retryAfter, tt.retries, got, tt.want)
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if got := retryDelay(resp, 0); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("retryDelay(Retry-After in an hour) = %v", got)
+	}
+}
+
+func TestHTTPRetriesTransientStatuses(t *testing.T) {
+	isolateHTTPConfig(t)
+	for _, status := range []int{429, 502, 503, 504} {
+		server, requests := statusServer(t, "0", status, status)
+		body, err := getWith(t, server.URL)
+		if err != nil {
+			t.Errorf("status %d: %v", status, err)
+			continue
+		}
+		if body != "ok" || *requests != 3 {
+			t.Errorf("status %d: got %q after %d requests, want \"ok\" after 3", status, body, *requests)
+		}
+	}
+
+	server, requests := statusServer(t, "0", http.StatusInternalServerError)
+	if _, err := getWith(t, server.URL); err == nil || !strings.Contains(err.Error(), "returned error: 500") {
+		t.Errorf("status 500: got %v", err)
+	}
+	if *requests != 1 {
+		t.Errorf("status 500 was retried: %d requests", *requests)
+	}
+}
+
+func TestHTTPRetryAfter(t *testing.T) {
+	isolateHTTPConfig(t)
+	server, _ := statusServer(t, "1", 503)
+	start := time.Now()
+	if _, err := getWith(t, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Retry-After: 1 waited only %v", elapsed)
+	}
+
+	// HTTP dates have whole seconds, so two from now is at least one away.
+	server, requests := statusServer(t, time.Now().Add(2*time.Second).UTC().Format(http.TimeFormat), 429)
+	start = time.Now()
+	if _, err := getWith(t, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || *requests != 2 {
+		t.Errorf("Retry-After as a date waited %v over %d requests", elapsed, *requests)
+	}
+}
+
+func TestHTTPRetryLimits(t *testing.T) {
+	isolateHTTPConfig(t)
+	t.Setenv("GIT_HTTP_MAX_RETRIES", "2")
+	server, requests := statusServer(t, "0", 503, 503, 503, 503)
+	if _, err := getWith(t, server.URL); err == nil || !strings.Contains(err.Error(), "returned error: 503") {
+		t.Errorf("http.maxRetries=2: got %v", err)
+	}
+	if *requests != 3 {
+		t.Errorf("http.maxRetries=2 made %d requests, want 3", *requests)
+	}
+
+	unsetenv(t, "GIT_HTTP_MAX_RETRIES")
+	t.Setenv("GIT_HTTP_MAX_RETRY_TIME", "1")
+	server, requests = statusServer(t, "5", 503)
+	if _, err := getWith(t, server.URL); err == nil {
+		t.Error("a Retry-After past http.maxRetryTime was waited for")
+	}
+	if *requests != 1 {
+		t.Errorf("http.maxRetryTime=1 with Retry-After: 5 made %d requests, want 1", *requests)
+	}
+
+	// The second wait would go past the limit.
+	server, requests = statusServer(t, "1", 503, 503)
+	if _, err := getWith(t, server.URL); err == nil {
+		t.Error("retried past http.maxRetryTime")
+	}
+	if *requests != 2 {
+		t.Errorf("http.maxRetryTime=1 with Retry-After: 1 made %d requests, want 2", *requests)
+	}
+
+	// A Retry-After too big for a Duration must not wrap around.
+	server, requests = statusServer(t, "99999999999999999", 503)
+	if _, err := getWith(t, server.URL); err == nil || *requests != 1 {
+		t.Errorf("huge Retry-After: got %v after %d requests", err, *requests)
+	}
+}
+
+func TestHTTPLowSpeedLimit(t *testing.T) {
+	isolateHTTPConfig(t)
+	t.Setenv("GIT_HTTP_LOW_SPEED_LIMIT", "1000")
+	t.Setenv("GIT_HTTP_LOW_SPEED_TIME", "1")
+	stall := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}
+
+	// Stalling before the headers.
+	server := httptest.NewServer(http.HandlerFunc(stall))
+	defer server.Close()
+	start := time.Now()
+	if _, err := getWith(t, server.URL); err == nil || !strings.Contains(err.Error(), "Operation too slow") {
+		t.Errorf("stalled headers: got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("stalled headers took %v to give up on", elapsed)
+	}
+
+	// Stalling in the body.
+	trickle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "x")
+		w.(http.Flusher).Flush()
+		stall(w, r)
+	}))
+	defer trickle.Close()
+	if _, err := getWith(t, trickle.URL); err == nil || !strings.Contains(err.Error(), "Operation too slow") {
+		t.Errorf("stalled body: got %v", err)
+	}
+
+	// A fast transfer is left alone.
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 1<<16))
+	}))
+	defer fast.Close()
+	if body, err := getWith(t, fast.URL); err != nil || len(body) != 1<<16 {
+		t.Errorf("fast transfer: got %d bytes, %v", len(body), err)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A path pattern as used by .gitignore and .gitattributes files.
+// ref: https://git-scm.com/docs/gitignore#_pattern_format
+type pathPattern struct {
+	Pattern  string // with "!", a leading "/" and a trailing "/" removed
+	Negate   bool
+	DirOnly  bool
+	Anchored bool   // matched against the path relative to Base instead of the basename
+	Base     string // directory holding the pattern file, "" for the top level
+	Source   string // file the pattern came from
+	Line     int
+	Text     string // pattern as written
+}
+
+// Report whether the pattern matches a path relative to the repository root.
+func (p *pathPattern) matches(name string, isDir bool) bool {
+	if p.DirOnly && !isDir {
+		return false
+	}
+	if p.Base != "" {
+		if !strings.HasPrefix(name, p.Base+"/") {
+			return false
+		}
+		name = name[len(p.Base)+1:]
+	}
+	if !p.Anchored {
+		return wildmatch(p.Pattern, path.Base(name))
+	}
+	return wildmatch(p.Pattern, name)
+}
+
+// Parse one pattern; the negation prefix is only honoured when allowNegate.
+func parsePathPattern(text, base, source string, line int, allowNegate bool) *pathPattern {
+	p := &pathPattern{Base: base, Source: source, Line: line, Text: text}
+	if allowNegate && text[0] == '!' {
+		p.Negate, text = true, text[1:]
+	} else if strings.HasPrefix(text, `\!`) || strings.HasPrefix(text, `\#`) {
+		text = text[1:]
+	}
+	if strings.HasSuffix(text, "/") {
+		p.DirOnly, text = true, strings.TrimSuffix(text, "/")
+	}
+	p.Anchored = strings.Contains(text, "/")
+	p.Pattern = strings.TrimPrefix(text, "/")
+	return p
+}
+
+func parseIgnorePatterns(content, base, source string) []*pathPattern {
+	var patterns []*pathPattern
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		// Trailing spaces are dropped unless escaped.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if p := parsePathPattern(line, base, source, i+1, true); p.Pattern != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// Decides which paths are ignored, combining core.excludesFile,
+// .git/info/exclude and every .gitignore on the way to a path.
+type ignoreMatcher struct {
+	root   string
+	global []*pathPattern // lowest precedence first
+	perDir map[string][]*pathPattern
+}
+
+func newIgnoreMatcher(root string) *ignoreMatcher {
+	m := &ignoreMatcher{root: root, perDir: make(map[string][]*pathPattern)}
+	excludesFile, ok := configPath(root, "core.excludesFile")
+	if !ok {
+		if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+			excludesFile = filepath.Join(xdg, "git", "ignore")
+		} else if home, err := os.UserHomeDir(); err == nil {
+			excludesFile = filepath.Join(home, ".config", "git", "ignore")
+		}
+	}
+	for _, source := range []string{excludesFile, filepath.Join(gitDir(root), "info", "exclude")} {
+		if data, err := os.ReadFile(source); err == nil {
+			m.global = append(m.global, parseIgnorePatterns(string(data), "", displayPath(root, source))...)
+		}
+	}
+	return m
+}
+
+// Show files inside the repository relative to it, others as given.
+func displayPath(root, file string) string {
+	if rel, err := filepath.Rel(root, file); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return file
+}
+
+// Patterns of the .gitignore in dir ("" for the top level), loaded once.
+func (m *ignoreMatcher) dirPatterns(dir string) []*pathPattern {
+	if patterns, ok := m.perDir[dir]; ok {
+		return patterns
+	}
+	source := path.Join(dir, ".gitignore")
+	var patterns []*pathPattern
+	if data, err := os.ReadFile(filepath.Join(m.root, filepath.FromSlash(source))); err == nil {
+		patterns = parseIgnorePatterns(string(data), dir, source)
+	}
+	m.perDir[dir] = patterns
+	return patterns
+}
+
+// Find the pattern deciding whether a path is ignored, or nil when none
+// applies. A negated result means the path is explicitly not ignored.
+func (m *ignoreMatcher) match(name string, isDir bool) *pathPattern {
+	// Nothing inside an ignored directory can be re-included.
+	for i := strings.Index(name, "/"); i >= 0; i = nextSlash(name, i) {
+		if p := m.matchPath(name[:i], true); p != nil && !p.Negate {
+			return p
+		}
+	}
+	return m.matchPath(name, isDir)
+}
+
+func nextSlash(name string, i int) int {
+	j := strings.Index(name[i+1:], "/")
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+func (m *ignoreMatcher) matchPath(name string, isDir bool) *pathPattern {
+	// Deeper .gitignore files take precedence, and within a file the last
+	// matching line wins.
+	dir := path.Dir(name)
+	for {
+		if dir == "." {
+			dir = ""
+		}
+		if p := lastMatch(m.dirPatterns(dir), name, isDir); p != nil {
+			return p
+		}
+		if dir == "" {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	return lastMatch(m.global, name, isDir)
+}
+
+func lastMatch(patterns []*pathPattern, name string, isDir bool) *pathPattern {
+	for i := len(patterns) - 1; i >= 0; i-- {
+		if patterns[i].matches(name, isDir) {
+			return patterns[i]
+		}
+	}
+	return nil
+}
+
+func (m *ignoreMatcher) ignored(name string, isDir bool) bool {
+	p := m.match(name, isDir)
+	return p != nil && !p.Negate
+}
+
+// Match a path against a pattern where "*", "?" and "[...]" never match a
+// slash and "**" spans directories when it is a whole path component.
+func wildmatch(pattern, name string) bool {
+	return wildmatchAt(pattern, 0, name)
+}
+
+func wildmatchAt(pattern string, pi int, name string) bool {
+	for pi < len(pattern) {
+		switch c := pattern[pi]; c {
+		case '*':
+			end := pi
+			for end < len(pattern) && pattern[end] == '*' {
+				end++
+			}
+			componentStart := pi == 0 || pattern[pi-1] == '/'
+			componentEnd := end == len(pattern) || pattern[end] == '/'
+			if end-pi >= 2 && componentStart && componentEnd {
+				if end == len(pattern) {
+					return true
+				}
+				// "**/" matches zero or more directories.
+				if wildmatchAt(pattern, end+1, name) {
+					return true
+				}
+				for i := 0; i < len(name); i++ {
+					if name[i] == '/' && wildmatchAt(pattern, end+1, name[i+1:]) {
+						return true
+					}
+				}
+				return false
+			}
+			for i := 0; i <= len(name); i++ {
+				if wildmatchAt(pattern, end, name[i:]) {
+					return true
+				}
+				if i < len(name) && name[i] == '/' {
+					break
+				}
+			}
+			return false
+		case '?':
+			if name == "" || name[0] == '/' {
+				return false
+			}
+			pi, name = pi+1, name[1:]
+		case '[':
+			if name == "" || name[0] == '/' {
+				return false
+			}
+			matched, next, ok := matchClass(pattern, pi, name[0])
+			if !ok {
+				// An unterminated class is a literal "[".
+				if name[0] != '[' {
+					return false
+				}
+				pi, name = pi+1, name[1:]
+				continue
+			}
+			if !matched {
+				return false
+			}
+			pi, name = next, name[1:]
+		case '\\':
+			if pi+1 < len(pattern) {
+				pi++
+			}
+			fallthrough
+		default:
+			if name == "" || name[0] != pattern[pi] {
+				return false
+			}
+			pi, name = pi+1, name[1:]
+		}
+	}
+	return name == ""
+}
+
+// Match c against the bracket expression starting at pattern[pi] and return
+// the index after it.
+func matchClass(pattern string, pi int, c byte) (bool, int, bool) {
+	i := pi + 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		negate = true
+		i++
+	}
+	matched := false
+	for first := true; i < len(pattern); first = false {
+		if pattern[i] == ']' && !first {
+			return matched != negate, i + 1, true
+		}
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+		i++
+	}
+	return false, 0, false
+}
+
+// Usage: mygit check-ignore [-v] [-n] [--no-index] <pathname>...
+//
+// Reports whether any path was ignored, which decides the exit status.
+func checkIgnoreCmd(args []string) (bool, error) {
+	verbose, nonMatching, noIndex := false, false, false
+	var paths []string
+	for _, arg := range args {
+		switch arg {
+		case "-v", "--verbose":
+			verbose = true
+		case "-n", "--non-matching":
+			nonMatching = true
+		case "--no-index":
+			noIndex = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				return false, fmt.Errorf("unknown option: %s", arg)
+			}
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 {
+		return false, errors.New("no path specified")
+	}
+	if nonMatching && !verbose {
+		return false, errors.New("--non-matching is only valid with --verbose")
+	}
+	return CheckIgnore(".", paths, verbose, nonMatching, noIndex)
+}
+
+func CheckIgnore(localDir string, paths []string, verbose, nonMatching, noIndex bool) (bool, error) {
+	matcher := newIgnoreMatcher(localDir)
+	index := &Index{}
+	if !noIndex {
+		var err error
+		if index, err = readIndex(localDir); err != nil {
+			return false, err
+		}
+	}
+	anyIgnored := false
+	for _, arg := range paths {
+		name := filepath.ToSlash(filepath.Clean(arg))
+		isDir := strings.HasSuffix(arg, "/")
+		if info, err := os.Stat(filepath.Join(localDir, arg)); err == nil {
+			isDir = info.IsDir()
+		}
+		var p *pathPattern
+		// Tracked files are never ignored.
+		if index.entry(name) == nil {
+			p = matcher.match(name, isDir)
+		}
+		if p != nil && !p.Negate {
+			anyIgnored = true
+		}
+		switch {
+		case verbose && p != nil:
+			fmt.Printf("%s:%d:%s\t%s\n", p.Source, p.Line, p.Text, arg)
+		case p != nil && !p.Negate:
+			fmt.Println(arg)
+		case verbose && nonMatching:
+			fmt.Printf("::\t%s\n", arg)
+		}
+	}
+	return anyIgnored, nil
+}
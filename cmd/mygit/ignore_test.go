@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWildmatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"", "", true},
+		{"???", "foo", true},
+		{"??", "foo", false},
+		{"*", "foo", true},
+		{"f*", "foo", true},
+		{"*f", "foo", false},
+		{"*foo*", "foo", true},
+		{"*ob*a*r*", "foobar", true},
+		{"*.txt", "a.txt", true},
+		{"*.txt", "dir/a.txt", false},
+
+		// Only "**" crosses slashes.
+		{"*", "foo/bar", false},
+		{"foo?bar", "foo/bar", false},
+		{"foo/*", "foo/bar", true},
+		{"foo/*", "foo/bar/baz", false},
+		{"**", "foo/bar", true},
+		{"**/foo", "foo", true},
+		{"**/foo", "a/b/foo", true},
+		{"**/foo", "a/b/foobar", false},
+		{"foo/**", "foo/a/b", true},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/y/c", false},
+		{"a/**b", "a/x/b", false},
+		{"a/**b", "a/xb", true},
+
+		// Bracket expressions.
+		{"[a-c]at", "bat", true},
+		{"[a-c]at", "dat", false},
+		{"[!a-c]at", "dat", true},
+		{"[^a]", "b", true},
+		{"[^a]", "a", false},
+		{"[]]", "]", true},
+		{"[]a]", "a", true},
+		{"[a-]", "-", true},
+		{`[\]]`, "]", true},
+		{"[/]", "/", false},
+		{"[ab", "[ab", true},
+		{"[ab", "a", false},
+
+		// Escapes.
+		{`\*`, "*", true},
+		{`\*`, "x", false},
+		{`\?`, "?", true},
+		{`foo\[bar`, "foo[bar", true},
+	}
+	for _, tt := range tests {
+		if got := wildmatch(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("wildmatch(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseIgnorePatterns(t *testing.T) {
+	content := "# comment\n\n*.o\n!keep.o\nbuild/\n/top\ndoc/*.html\ntrailing  \nescaped\\ \n\\#hash\n\\!bang\r\n"
+	var got []string
+	for _, p := range parseIgnorePatterns(content, "", ".gitignore") {
+		flags := ""
+		if p.Negate {
+			flags += "!"
+		}
+		if p.DirOnly {
+			flags += "d"
+		}
+		if p.Anchored {
+			flags += "a"
+		}
+		got = append(got, p.Pattern+"|"+flags)
+	}
+	want := "*.o| keep.o|! build|d top|a doc/*.html|a trailing| escaped\\ | #hash| !bang|"
+	if strings.Join(got, " ") != want {
+		t.Errorf("parsed %q, want %q", strings.Join(got, " "), want)
+	}
+}
+
+// Ignore files at every level, checked against the answers of git
+// check-ignore where git is installed.
+func TestIgnoreMatcher(t *testing.T) {
+	dir := newTestRepo(t)
+	excludes := filepath.Join(t.TempDir(), "excludes")
+	if err := os.WriteFile(excludes, []byte("*.global\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setConfigValue(dir, "core.excludesFile", excludes); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		".git/info/exclude":   "*.exclude\n!*.global\n",
+		".gitignore":          "*.o\n!keep.o\nbuild/\n/top.txt\nlogs\ndoc/**/*.html\n",
+		"sub/.gitignore":      "!*.o\n*.tmp\n!/build/\n",
+		"sub/deep/.gitignore": "/only-here\n",
+	} {
+		writeTestFile(t, dir, name, content)
+	}
+	paths := map[string]bool{
+		"a.o":                false,
+		"keep.o":             false,
+		"x.global":           false,
+		"x.exclude":          false,
+		"build":              true,
+		"build/out":          false,
+		"build/keep.o":       false,
+		"top.txt":            false,
+		"sub/top.txt":        false,
+		"logs":               false,
+		"sub/logs":           false,
+		"doc/a.html":         false,
+		"doc/x/y/a.html":     false,
+		"doc/a.htm":          false,
+		"sub/a.o":            false,
+		"sub/a.tmp":          false,
+		"sub/build":          true,
+		"sub/build/x":        false,
+		"sub/deep/only-here": false,
+		"only-here":          false,
+	}
+	for name, isDir := range paths {
+		if isDir {
+			if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			writeTestFile(t, dir, name, "x\n")
+		}
+	}
+
+	want := map[string]bool{
+		"a.o": true, "x.global": false, "x.exclude": true, "build": true, "build/out": true,
+		"build/keep.o": true, "top.txt": true, "logs": true, "sub/logs": true,
+		"doc/a.html": true, "doc/x/y/a.html": true, "sub/a.tmp": true,
+		"sub/deep/only-here": true,
+	}
+	m := newIgnoreMatcher(dir)
+	for name, isDir := range paths {
+		if got := m.ignored(name, isDir); got != want[name] {
+			t.Errorf("ignored(%s) = %v, want %v", name, got, want[name])
+		}
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		return
+	}
+	for name := range paths {
+		cmd := exec.Command("git", "check-ignore", "-q", name)
+		cmd.Dir = dir
+		if gitIgnores := cmd.Run() == nil; gitIgnores != want[name] {
+			t.Errorf("git check-ignore %s says %v", name, gitIgnores)
+		}
+	}
+}
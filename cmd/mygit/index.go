@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ref: https://git-scm.com/docs/index-format
+const (
+	indexSignature   = "DIRC"
+	indexVersion     = 2
+	indexEntryFixed  = 62
+	indexNameMask    = 0x0fff
+	indexStageShift  = 12
+	indexExtendedBit = 0x4000
+)
+
+type IndexEntry struct {
+	CTime time.Time
+	MTime time.Time
+	Dev   uint32
+	Ino   uint32
+	Mode  uint32
+	UID   uint32
+	GID   uint32
+	Size  uint32
+	Hash  [20]byte
+	Stage int
+	Name  string
+}
+
+type Index struct {
+	Entries []*IndexEntry
+}
+
+// Mode as written in trees, e.g. "100644".
+func (e *IndexEntry) TreeMode() string {
+	return strconv.FormatUint(uint64(e.Mode), 8)
+}
+
+func (e *IndexEntry) File() treeFile {
+	return treeFile{Mode: e.TreeMode(), Sha: hex.EncodeToString(e.Hash[:])}
+}
+
+// Refresh the cached stat data from the working tree file, if present.
+func (e *IndexEntry) updateStat(localDir string) {
+	info, err := os.Lstat(filepath.Join(localDir, filepath.FromSlash(e.Name)))
+	if err != nil {
+		return
+	}
+	e.CTime, e.MTime = info.ModTime(), info.ModTime()
+	e.Size = uint32(info.Size())
+}
+
+func newIndexEntry(name string, file treeFile) (*IndexEntry, error) {
+	mode, err := strconv.ParseUint(file.Mode, 8, 32)
+	if err != nil {
+		return nil, err
+	}
+	hashBytes, err := hex.DecodeString(file.Sha)
+	if err != nil {
+		return nil, err
+	}
+	entry := &IndexEntry{Mode: uint32(mode), Name: name}
+	copy(entry.Hash[:], hashBytes)
+	return entry, nil
+}
+
+func indexPath(localDir string) string {
+	return filepath.Join(gitDir(localDir), "index")
+}
+
+// Read .git/index. A missing index is an empty one.
+func readIndex(localDir string) (*Index, error) {
+	data, err := os.ReadFile(indexPath(localDir))
+	if os.IsNotExist(err) {
+		return &Index{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseIndex(data)
+}
+
+func ParseIndex(data []byte) (*Index, error) {
+	if len(data) < 12+20 || string(data[:4]) != indexSignature {
+		return nil, fmt.Errorf("index file corrupt: bad signature")
+	}
+	checksum := sha1.Sum(data[:len(data)-20])
+	if !bytes.Equal(checksum[:], data[len(data)-20:]) {
+		return nil, fmt.Errorf("index file corrupt: bad checksum")
+	}
+	version := binary.BigEndian.Uint32(data[4:8])
+	if version < 2 || version > 3 {
+		return nil, fmt.Errorf("unsupported index version %d", version)
+	}
+	count := binary.BigEndian.Uint32(data[8:12])
+	reader := bytes.NewReader(data[12 : len(data)-20])
+	index := &Index{Entries: make([]*IndexEntry, 0, count)}
+	for i := uint32(0); i < count; i++ {
+		start := reader.Len()
+		var fixed struct {
+			CTimeSec, CTimeNsec, MTimeSec, MTimeNsec uint32
+			Dev, Ino, Mode, UID, GID, Size           uint32
+			Hash                                     [20]byte
+			Flags                                    uint16
+		}
+		if err := binary.Read(reader, binary.BigEndian, &fixed); err != nil {
+			return nil, fmt.Errorf("index file corrupt: %w", err)
+		}
+		if fixed.Flags&indexExtendedBit != 0 {
+			if _, err := reader.Seek(2, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		}
+		name, err := readUntil(reader, 0x00)
+		if err != nil {
+			return nil, fmt.Errorf("index file corrupt: %w", err)
+		}
+		// Entries are NUL padded to a multiple of eight bytes.
+		for (start-reader.Len())%8 != 0 {
+			if _, err := reader.ReadByte(); err != nil {
+				return nil, fmt.Errorf("index file corrupt: %w", err)
+			}
+		}
+		index.Entries = append(index.Entries, &IndexEntry{
+			CTime: time.Unix(int64(fixed.CTimeSec), int64(fixed.CTimeNsec)),
+			MTime: time.Unix(int64(fixed.MTimeSec), int64(fixed.MTimeNsec)),
+			Dev:   fixed.Dev,
+			Ino:   fixed.Ino,
+			Mode:  fixed.Mode,
+			UID:   fixed.UID,
+			GID:   fixed.GID,
+			Size:  fixed.Size,
+			Hash:  fixed.Hash,
+			Stage: int(fixed.Flags>>indexStageShift) & 0x3,
+			Name:  string(name),
+		})
+	}
+	// Extensions such as the cached tree are not needed and get dropped on write.
+	return index, nil
+}
+
+func (idx *Index) Serialize() []byte {
+	sort.Slice(idx.Entries, func(i, j int) bool {
+		if idx.Entries[i].Name != idx.Entries[j].Name {
+			return idx.Entries[i].Name < idx.Entries[j].Name
+		}
+		return idx.Entries[i].Stage < idx.Entries[j].Stage
+	})
+	var buf bytes.Buffer
+	buf.WriteString(indexSignature)
+	binary.Write(&buf, binary.BigEndian, uint32(indexVersion))
+	binary.Write(&buf, binary.BigEndian, uint32(len(idx.Entries)))
+	for _, e := range idx.Entries {
+		nameLen := len(e.Name)
+		if nameLen > indexNameMask {
+			nameLen = indexNameMask
+		}
+		binary.Write(&buf, binary.BigEndian, []uint32{
+			uint32(e.CTime.Unix()), uint32(e.CTime.Nanosecond()),
+			uint32(e.MTime.Unix()), uint32(e.MTime.Nanosecond()),
+			e.Dev, e.Ino, e.Mode, e.UID, e.GID, e.Size,
+		})
+		buf.Write(e.Hash[:])
+		binary.Write(&buf, binary.BigEndian, uint16(e.Stage<<indexStageShift|nameLen))
+		buf.WriteString(e.Name)
+		padding := 8 - (indexEntryFixed+len(e.Name))%8
+		buf.Write(make([]byte, padding))
+	}
+	checksum := sha1.Sum(buf.Bytes())
+	buf.Write(checksum[:])
+	return buf.Bytes()
+}
+
+func (idx *Index) write(localDir string) error {
+	return writeFile(indexPath(localDir), idx.Serialize())
+}
+
+// Look up the stage 0 entry for a path.
+func (idx *Index) entry(name string) *IndexEntry {
+	for _, e := range idx.Entries {
+		if e.Name == name && e.Stage == 0 {
+			return e
+		}
+	}
+	return nil
+}
+
+// Replace all stages of a path with a single entry, or drop the path when
+// entry is nil.
+func (idx *Index) set(name string, entry *IndexEntry) {
+	entries := idx.Entries[:0]
+	for _, e := range idx.Entries {
+		if e.Name != name {
+			entries = append(entries, e)
+		}
+	}
+	idx.Entries = entries
+	if entry != nil {
+		idx.Entries = append(idx.Entries, entry)
+	}
+}
+
+// Files recorded at stage 0, keyed by path.
+func (idx *Index) files() map[string]treeFile {
+	files := make(map[string]treeFile)
+	for _, e := range idx.Entries {
+		if e.Stage == 0 {
+			files[e.Name] = e.File()
+		}
+	}
+	return files
+}
+
+// Build an index that matches a tree, taking stat data from the working tree.
+func indexFromTree(localDir, treeSha string) (*Index, error) {
+	files, err := flattenTree(localDir, treeSha)
+	if err != nil {
+		return nil, err
+	}
+	index := &Index{}
+	for name, file := range files {
+		entry, err := newIndexEntry(name, file)
+		if err != nil {
+			return nil, err
+		}
+		entry.updateStat(localDir)
+		index.Entries = append(index.Entries, entry)
+	}
+	return index, nil
+}
+
+// Overwrite .git/index with the content of a tree.
+func writeIndexFromTree(localDir, treeSha string) error {
+	index, err := indexFromTree(localDir, treeSha)
+	if err != nil {
+		return err
+	}
+	return index.write(localDir)
+}
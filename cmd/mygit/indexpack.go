@@ -0,0 +1,703 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Usage: mygit index-pack [--threads=<n>] --stdin
+//
+// Stores a pack read from stdin under .git/objects/pack with its index,
+// completing a thin pack with objects from the repository.
+func indexPackCmd(args []string) error {
+	options := indexPackOptions{Progress: progressEnabled()}
+	stdin := false
+	for _, arg := range args {
+		switch {
+		case arg == "--stdin":
+			stdin = true
+		case arg == "--promisor":
+			options.Promisor = true
+		case strings.HasPrefix(arg, "--threads="):
+			threads, err := strconv.Atoi(strings.TrimPrefix(arg, "--threads="))
+			if err != nil || threads < 0 {
+				return fmt.Errorf("invalid number of threads specified (%s)", strings.TrimPrefix(arg, "--threads="))
+			}
+			options.Threads = threads
+		default:
+			return fmt.Errorf("unknown option: %s", arg)
+		}
+	}
+	if !stdin {
+		return errors.New("usage: mygit index-pack [--threads=<n>] [--promisor] --stdin")
+	}
+	name, err := indexPack(".", os.Stdin, options)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("pack\t%s\n", name)
+	return nil
+}
+
+// Reads a pack from a stream, hashing what it consumes so the trailing
+// checksum can be verified and copying it to tee. Being an io.ByteReader
+// keeps zlib from reading past the end of each object.
+type packReader struct {
+	r      *bufio.Reader
+	hash   hash.Hash
+	tee    io.Writer
+	offset int64
+}
+
+func (p *packReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.hash.Write(b[:n])
+	p.tee.Write(b[:n])
+	p.offset += int64(n)
+	return n, err
+}
+
+func (p *packReader) ReadByte() (byte, error) {
+	c, err := p.r.ReadByte()
+	if err == nil {
+		p.hash.Write([]byte{c})
+		p.tee.Write([]byte{c})
+		p.offset++
+	}
+	return c, err
+}
+
+// An object of a pack being indexed.
+type indexedObject struct {
+	Offset     int64
+	Type       byte   // as stored, so a delta type for deltas
+	Sha        string // "" until a delta is resolved
+	CRC        uint32
+	BaseOffset int64  // of an OFS_DELTA base
+	BaseSha    string // of a REF_DELTA base
+	Local      bool   // appended from the repository to complete a thin pack
+}
+
+// How much inflated base data is kept while resolving deltas, like git's
+// core.deltaBaseCacheLimit, shared between the threads.
+const deltaBaseCacheLimit = 96 << 20
+
+// Objects stored whole up to this size are hashed off the receiving
+// goroutine; larger ones are hashed as they are inflated.
+const maxHashJobSize = 1 << 20
+
+// How indexPack stores a pack.
+type indexPackOptions struct {
+	UnpackLimit int  // packs with fewer objects are stored loose
+	Threads     int  // goroutines resolving deltas; 0 for pack.threads or one per CPU
+	Promisor    bool // from a promisor remote: kept as a pack marked with a .promisor file
+	Progress    bool // show progress on stderr
+}
+
+// Indexes a pack as index-pack does: the pack is written to disk as it
+// arrives with only the position and sha of each object kept in memory, then
+// deltas are resolved in a second pass that reads them back from the file.
+// Each delta tree, a base and everything deltified against it, is resolved
+// by one of several goroutines with a base cache of its own.
+// ref: https://git-scm.com/docs/git-index-pack
+type packIndexer struct {
+	localDir     string
+	file         *os.File
+	end          int64 // where the objects end and the checksum starts
+	threads      int
+	progress     bool
+	objects      []*indexedObject
+	byOffset     map[int64]int
+	byBaseOffset map[int64][]int
+
+	lock      sync.Mutex // over the fields below while resolving
+	bySha     map[string]int
+	byBaseSha map[string][]int // REF_DELTAs whose base is not yet resolved
+	resolving *progressMeter
+	resolved  int
+}
+
+// Store a pack read from a stream. Packs of fewer than UnpackLimit objects
+// are exploded into loose objects; others are kept as
+// objects/pack/pack-<checksum>.pack with an index, whose name is returned.
+// Bases missing from a thin pack are taken from the repository.
+func indexPack(localDir string, pack io.Reader, options indexPackOptions) (string, error) {
+	dir := packDir(localDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(dir, "tmp_pack_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	ix := &packIndexer{
+		localDir:     localDir,
+		file:         file,
+		threads:      packThreads(localDir, options.Threads),
+		progress:     options.Progress,
+		byOffset:     make(map[int64]int),
+		byBaseOffset: make(map[int64][]int),
+		bySha:        make(map[string]int),
+		byBaseSha:    make(map[string][]int),
+	}
+	if err := ix.receive(pack); err != nil {
+		return "", err
+	}
+	if err := ix.resolveDeltas(); err != nil {
+		return "", err
+	}
+	// Objects from a promisor remote stay packed so that they are known
+	// as such.
+	if len(ix.objects) < options.UnpackLimit && !options.Promisor {
+		return "", ix.unpack()
+	}
+	if len(ix.objects) == 0 {
+		return "", nil
+	}
+	return ix.store(options.Promisor)
+}
+
+// The first pass: copy the pack to the file, noting where each object
+// starts and the sha of those stored whole, and verify the checksum.
+func (ix *packIndexer) receive(pack io.Reader) error {
+	out := bufio.NewWriterSize(ix.file, 64<<10)
+	crc := crc32.NewIEEE()
+	reader := &packReader{r: bufio.NewReaderSize(pack, 64<<10), hash: sha1.New(), tee: io.MultiWriter(out, crc)}
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("reading pack header: %v", err)
+	}
+	if string(header[:4]) != "PACK" {
+		return errors.New("invalid packfile")
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != 2 && version != 3 {
+		return fmt.Errorf("unsupported pack version %d", version)
+	}
+	numObjects := int(binary.BigEndian.Uint32(header[8:12]))
+
+	hashes := make(chan hashJob, ix.threads)
+	var hashing sync.WaitGroup
+	for t := 0; t < ix.threads; t++ {
+		hashing.Add(1)
+		go func() {
+			defer hashing.Done()
+			for job := range hashes {
+				sha := sha1.New()
+				io.WriteString(sha, job.header)
+				sha.Write(job.content)
+				job.object.Sha = hex.EncodeToString(sha.Sum(nil))
+			}
+		}()
+	}
+	receiving := newProgress("Receiving objects", numObjects, ix.progress)
+	var err error
+	for i := 0; i < numObjects && err == nil; i++ {
+		crc.Reset()
+		var object *indexedObject
+		if object, err = readPackEntry(reader, hashes); err == nil {
+			object.CRC = crc.Sum32()
+			ix.add(object)
+			receiving.update(i+1, reader.offset)
+		}
+	}
+	close(hashes)
+	hashing.Wait()
+	if err != nil {
+		return err
+	}
+	for i, object := range ix.objects {
+		if object.Sha != "" {
+			ix.bySha[object.Sha] = i
+		}
+	}
+
+	actualChecksum := reader.hash.Sum(nil)
+	storedChecksum := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(reader.r, storedChecksum); err != nil {
+		return fmt.Errorf("reading pack checksum: %v", err)
+	}
+	if !bytes.Equal(storedChecksum, actualChecksum) {
+		return fmt.Errorf("expected checksum: %x, got %x", storedChecksum, actualChecksum)
+	}
+	ix.end = reader.offset
+	receiving.done(numObjects, reader.offset+sha1.Size)
+	if _, err := out.Write(storedChecksum); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// An object stored whole, to be hashed by another goroutine.
+type hashJob struct {
+	object  *indexedObject
+	header  string
+	content []byte
+}
+
+// Read the next entry of a pack, skipping over the data of deltas. Objects
+// stored whole are hashed, small ones by handing them to hashes.
+func readPackEntry(reader *packReader, hashes chan<- hashJob) (*indexedObject, error) {
+	object := &indexedObject{Offset: reader.offset}
+	objType, objLen, err := readObjectTypeAndLen(reader)
+	if err != nil {
+		return nil, err
+	}
+	object.Type = objType
+	var header string
+	switch objType {
+	case OBJECT_REF_DELTA:
+		baseSha := make([]byte, sha1.Size)
+		if _, err := io.ReadFull(reader, baseSha); err != nil {
+			return nil, err
+		}
+		object.BaseSha = hex.EncodeToString(baseSha)
+	case OBJECT_OFS_DELTA:
+		distance, err := readOffsetDistance(reader)
+		if err != nil {
+			return nil, err
+		}
+		if distance <= 0 || distance > object.Offset {
+			return nil, fmt.Errorf("invalid delta base offset for object at %d", object.Offset)
+		}
+		object.BaseOffset = object.Offset - distance
+	case OBJECT_COMMIT, OBJECT_TREE, OBJECT_BLOB, OBJECT_TAG:
+		typeName, _ := (&Object{Type: objType}).typeString()
+		header = fmt.Sprintf("%s %d\x00", typeName, objLen)
+	default:
+		return nil, fmt.Errorf("invalid object type %d at offset %d", objType, object.Offset)
+	}
+	inflated, err := zlib.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if header == "" {
+		_, err := io.Copy(io.Discard, inflated)
+		return object, err
+	}
+	var content bytes.Buffer
+	var sha hash.Hash
+	var out io.Writer = &content
+	if objLen > maxHashJobSize {
+		sha = sha1.New()
+		io.WriteString(sha, header)
+		out = sha
+	}
+	n, err := io.Copy(out, inflated)
+	if err != nil {
+		return nil, err
+	}
+	if n != int64(objLen) {
+		return nil, fmt.Errorf("object at offset %d: expected length %d, got %d", object.Offset, objLen, n)
+	}
+	if sha != nil {
+		object.Sha = hex.EncodeToString(sha.Sum(nil))
+	} else {
+		hashes <- hashJob{object, header, content.Bytes()}
+	}
+	return object, nil
+}
+
+func (ix *packIndexer) add(object *indexedObject) {
+	ix.byOffset[object.Offset] = len(ix.objects)
+	ix.objects = append(ix.objects, object)
+}
+
+// The second pass: apply deltas to their bases. The objects stored whole
+// are the roots of delta trees, each resolved on one goroutine working down
+// its chains so that a base is usually still cached when its deltas need it.
+func (ix *packIndexer) resolveDeltas() error {
+	var roots []int
+	deltas := 0
+	for i, object := range ix.objects {
+		switch object.Type {
+		case OBJECT_OFS_DELTA:
+			ix.byBaseOffset[object.BaseOffset] = append(ix.byBaseOffset[object.BaseOffset], i)
+		case OBJECT_REF_DELTA:
+			ix.byBaseSha[object.BaseSha] = append(ix.byBaseSha[object.BaseSha], i)
+		default:
+			roots = append(roots, i)
+			continue
+		}
+		deltas++
+	}
+	if deltas == 0 {
+		return nil
+	}
+	ix.resolving = newProgress("Resolving deltas", deltas, ix.progress)
+	for {
+		if err := ix.resolveTrees(roots); err != nil {
+			return err
+		}
+		if len(ix.byBaseSha) == 0 {
+			break
+		}
+		// Only deltas against objects outside the pack are left.
+		i, err := ix.completeThinPack()
+		if err != nil {
+			return err
+		}
+		roots = []int{i}
+	}
+	ix.resolving.done(ix.resolved, 0)
+	return nil
+}
+
+// Resolve the delta trees under roots, handing them out to the threads.
+func (ix *packIndexer) resolveTrees(roots []int) error {
+	trees := make(chan int)
+	errs := make([]error, ix.threads)
+	var failed atomic.Bool
+	var workers sync.WaitGroup
+	for t := 0; t < ix.threads; t++ {
+		workers.Add(1)
+		go func(t int) {
+			defer workers.Done()
+			bases := newBaseCache(deltaBaseCacheLimit / ix.threads)
+			for root := range trees {
+				if failed.Load() {
+					continue
+				}
+				if err := ix.resolveTree(root, bases); err != nil {
+					errs[t] = err
+					failed.Store(true)
+				}
+			}
+		}(t)
+	}
+	for _, root := range roots {
+		if ix.hasChildren(root) {
+			trees <- root
+		}
+	}
+	close(trees)
+	workers.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ix *packIndexer) hasChildren(i int) bool {
+	object := ix.objects[i]
+	if len(ix.byBaseOffset[object.Offset]) > 0 {
+		return true
+	}
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	return len(ix.byBaseSha[object.Sha]) > 0
+}
+
+// Resolve every delta whose chain leads back to root.
+func (ix *packIndexer) resolveTree(root int, bases *baseCache) error {
+	stack := []int{root}
+	for len(stack) > 0 {
+		base := ix.objects[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+		children := append(ix.byBaseOffset[base.Offset], ix.takeRefDeltas(base.Sha)...)
+		for _, i := range children {
+			object, err := ix.object(i, bases)
+			if err != nil {
+				return fmt.Errorf("resolving delta at offset %d: %v", ix.objects[i].Offset, err)
+			}
+			sha, err := object.sha()
+			if err != nil {
+				return err
+			}
+			ix.lock.Lock()
+			ix.objects[i].Sha = sha
+			ix.bySha[sha] = i
+			ix.resolved++
+			ix.resolving.update(ix.resolved, 0)
+			ix.lock.Unlock()
+			stack = append(stack, i)
+		}
+	}
+	return nil
+}
+
+// Claim the REF_DELTAs against a base, so that a base in the pack twice
+// only has them resolved once.
+func (ix *packIndexer) takeRefDeltas(sha string) []int {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	children := ix.byBaseSha[sha]
+	delete(ix.byBaseSha, sha)
+	return children
+}
+
+// Append one of the bases a thin pack leaves out, taken from the repository,
+// to the end of the pack.
+// ref: https://git-scm.com/docs/git-index-pack#Documentation/git-index-pack.txt---fix-thin
+func (ix *packIndexer) completeThinPack() (int, error) {
+	var missing []string
+	for sha := range ix.byBaseSha {
+		missing = append(missing, sha)
+	}
+	sort.Strings(missing)
+	for _, sha := range missing {
+		base, err := readLocalObject(ix.localDir, sha)
+		if err != nil {
+			continue
+		}
+		var entry bytes.Buffer
+		entry.Write(encodeObjectHeader(base.Type, len(base.Buf)))
+		compressed := zlib.NewWriter(&entry)
+		compressed.Write(base.Buf)
+		if err := compressed.Close(); err != nil {
+			return 0, err
+		}
+		if _, err := ix.file.WriteAt(entry.Bytes(), ix.end); err != nil {
+			return 0, err
+		}
+		ix.add(&indexedObject{Offset: ix.end, Type: base.Type, Sha: sha, CRC: crc32.ChecksumIEEE(entry.Bytes()), Local: true})
+		ix.bySha[sha] = len(ix.objects) - 1
+		ix.end += int64(entry.Len())
+		return len(ix.objects) - 1, nil
+	}
+	deltas := 0
+	for _, children := range ix.byBaseSha {
+		deltas += len(children)
+	}
+	return 0, fmt.Errorf("pack has %d unresolved deltas", deltas)
+}
+
+// Inflate and undeltify the i-th object, going back to the file for bases
+// that are no longer cached.
+func (ix *packIndexer) object(i int, bases *baseCache) (*Object, error) {
+	entry := ix.objects[i]
+	if object := bases.get(entry.Offset); object != nil {
+		return object, nil
+	}
+	reader := bufio.NewReader(io.NewSectionReader(ix.file, entry.Offset, 1<<62))
+	if _, _, err := readObjectTypeAndLen(reader); err != nil {
+		return nil, err
+	}
+	var base *Object
+	var err error
+	switch entry.Type {
+	case OBJECT_OFS_DELTA:
+		if _, err := readOffsetDistance(reader); err != nil {
+			return nil, err
+		}
+		base, err = ix.object(ix.byOffset[entry.BaseOffset], bases)
+	case OBJECT_REF_DELTA:
+		if _, err := io.ReadFull(reader, make([]byte, sha1.Size)); err != nil {
+			return nil, err
+		}
+		ix.lock.Lock()
+		j, ok := ix.bySha[entry.BaseSha]
+		ix.lock.Unlock()
+		if ok {
+			base, err = ix.object(j, bases)
+		} else {
+			err = fmt.Errorf("delta base %s not found", entry.BaseSha)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := decompressObject(reader)
+	if err != nil {
+		return nil, err
+	}
+	object := &Object{Type: entry.Type, Buf: data.Bytes()}
+	if base != nil {
+		undeltified, err := readDeltified(data, base)
+		if err != nil {
+			return nil, err
+		}
+		object = &Object{Type: base.Type, Buf: undeltified.Bytes()}
+	}
+	bases.add(entry.Offset, object)
+	return object, nil
+}
+
+// Write every object of the pack loose, rather than keep a small pack,
+// spreading runs of neighbouring objects over the threads.
+func (ix *packIndexer) unpack() error {
+	const run = 64
+	starts := make(chan int)
+	errs := make([]error, ix.threads)
+	var workers sync.WaitGroup
+	for t := 0; t < ix.threads; t++ {
+		workers.Add(1)
+		go func(t int) {
+			defer workers.Done()
+			bases := newBaseCache(deltaBaseCacheLimit / ix.threads)
+			for start := range starts {
+				for i := start; i < start+run && i < len(ix.objects) && errs[t] == nil; i++ {
+					errs[t] = ix.writeLoose(i, bases)
+				}
+			}
+		}(t)
+	}
+	for start := 0; start < len(ix.objects); start += run {
+		starts <- start
+	}
+	close(starts)
+	workers.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ix *packIndexer) writeLoose(i int, bases *baseCache) error {
+	if ix.objects[i].Local {
+		return nil
+	}
+	object, err := ix.object(i, bases)
+	if err != nil {
+		return err
+	}
+	b, err := object.wrappedBuf()
+	if err != nil {
+		return err
+	}
+	_, err = writeGitObject(ix.localDir, b)
+	return err
+}
+
+// Move the pack into place with its index, and a .promisor file when asked.
+// A completed thin pack gets a new object count and checksum.
+func (ix *packIndexer) store(promisor bool) (string, error) {
+	if err := ix.file.Truncate(ix.end); err != nil {
+		return "", err
+	}
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, uint32(len(ix.objects)))
+	if _, err := ix.file.WriteAt(count, 8); err != nil {
+		return "", err
+	}
+	checksum := sha1.New()
+	if _, err := io.Copy(checksum, io.NewSectionReader(ix.file, 0, ix.end)); err != nil {
+		return "", err
+	}
+	sum := checksum.Sum(nil)
+	if _, err := ix.file.WriteAt(sum, ix.end); err != nil {
+		return "", err
+	}
+	if err := ix.file.Close(); err != nil {
+		return "", err
+	}
+
+	entries := make([]packIndexEntry, len(ix.objects))
+	for i, object := range ix.objects {
+		entries[i] = packIndexEntry{Sha: object.Sha, Offset: object.Offset, CRC: object.CRC}
+	}
+	var index bytes.Buffer
+	if err := writePackIndex(&index, entries, sum); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(sum)
+	prefix := filepath.Join(packDir(ix.localDir), "pack-"+name)
+	if err := os.Rename(ix.file.Name(), prefix+".pack"); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(prefix+".pack", 0444); err != nil {
+		return "", err
+	}
+	if promisor {
+		if err := os.WriteFile(prefix+".promisor", nil, 0444); err != nil {
+			return "", err
+		}
+	}
+	if err := os.WriteFile(prefix+".idx", index.Bytes(), 0444); err != nil {
+		return "", err
+	}
+	closePacks(ix.localDir)
+	return name, nil
+}
+
+// The unpackLimit for fetch or receive: packs with fewer objects are stored
+// loose. Defaults to transfer.unpackLimit, and that to 100.
+// ref: https://git-scm.com/docs/git-config#Documentation/git-config.txt-fetchunpackLimit
+func unpackLimit(localDir, command string) int {
+	for _, key := range []string{command + ".unpackLimit", "transfer.unpackLimit"} {
+		if value, ok := configValue(localDir, key); ok {
+			if limit, err := parseConfigInt(value); err == nil {
+				return int(limit)
+			}
+		}
+	}
+	return 100
+}
+
+// How many goroutines resolve deltas: the given number, else pack.threads,
+// else one per CPU.
+// ref: https://git-scm.com/docs/git-config#Documentation/git-config.txt-packthreads
+func packThreads(localDir string, threads int) int {
+	if threads == 0 {
+		threads = int(configInt(localDir, "pack.threads", 0))
+	}
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	return threads
+}
+
+// Inflated objects by pack offset, least recently used dropped first once
+// their size passes a limit.
+type baseCache struct {
+	limit   int
+	size    int
+	order   *list.List // of *baseCacheEntry, most recent first
+	entries map[int64]*list.Element
+}
+
+type baseCacheEntry struct {
+	offset int64
+	object *Object
+}
+
+func newBaseCache(limit int) *baseCache {
+	return &baseCache{limit: limit, order: list.New(), entries: make(map[int64]*list.Element)}
+}
+
+func (c *baseCache) get(offset int64) *Object {
+	element, ok := c.entries[offset]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*baseCacheEntry).object
+}
+
+func (c *baseCache) add(offset int64, object *Object) {
+	if _, ok := c.entries[offset]; ok || len(object.Buf) > c.limit {
+		return
+	}
+	c.entries[offset] = c.order.PushFront(&baseCacheEntry{offset, object})
+	c.size += len(object.Buf)
+	for c.size > c.limit {
+		oldest := c.order.Back()
+		entry := c.order.Remove(oldest).(*baseCacheEntry)
+		delete(c.entries, entry.offset)
+		c.size -= len(entry.object.Buf)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBaseCache(t *testing.T) {
+	object := func(size int) *Object {
+		return &Object{Type: OBJECT_BLOB, Buf: make([]byte, size)}
+	}
+	c := newBaseCache(100)
+	c.add(1, object(40))
+	c.add(2, object(40))
+	if c.get(1) == nil || c.get(2) == nil {
+		t.Fatal("cached objects are missing")
+	}
+	// 1 was used before 2, so it goes first.
+	c.add(3, object(40))
+	if c.get(1) != nil || c.get(2) == nil || c.get(3) == nil {
+		t.Error("the least recently used object was not the one dropped")
+	}
+	// Using 2 keeps it over 3.
+	c.get(2)
+	c.add(4, object(40))
+	if c.get(3) != nil || c.get(2) == nil {
+		t.Error("a lookup did not count as a use")
+	}
+	if c.size != 80 {
+		t.Errorf("the cache holds %d bytes, want 80", c.size)
+	}
+	// An object over the limit is not cached at all, and evicts nothing.
+	c.add(5, object(101))
+	if c.get(5) != nil || c.get(2) == nil || c.get(4) == nil {
+		t.Error("an object over the limit changed the cache")
+	}
+	// Adding an offset twice counts it once.
+	c.add(4, object(40))
+	if c.size != 80 || c.order.Len() != 2 {
+		t.Errorf("%d entries of %d bytes after adding one again", c.order.Len(), c.size)
+	}
+}
+
+// The pack writePack makes of everything reachable from tip, with the index
+// writePackFiles would give it.
+func packOf(t *testing.T, dir, tip string, options packOptions) (pack, idx []byte, name string) {
+	t.Helper()
+	objects, err := objectsToPack(dir, []string{tip}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf, index bytes.Buffer
+	entries, sum, err := writePack(&buf, dir, objects, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writePackIndex(&index, entries, sum); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), index.Bytes(), hex.EncodeToString(sum)
+}
+
+// A history with deltas and a blob too big to hash off the reading goroutine.
+func indexPackHistory(t *testing.T) (dir, tip string) {
+	t.Helper()
+	dir, tip = deltaHistory(t)
+	big := make([]byte, maxHashJobSize+1000)
+	rand.New(rand.NewSource(2)).Read(big)
+	tip = commitFiles(t, dir, tip, "big", map[string]string{"big.bin": string(big)})
+	return dir, tip
+}
+
+func TestIndexPackStream(t *testing.T) {
+	src, tip := indexPackHistory(t)
+	for _, ofsDelta := range []bool{true, false} {
+		options := defaultPackOptions
+		options.OfsDelta = ofsDelta
+		pack, idx, want := packOf(t, src, tip, options)
+
+		// Read a byte at a time, the pack still comes out whole.
+		dst := t.TempDir()
+		Init(dst)
+		name, err := indexPack(dst, iotest.OneByteReader(bytes.NewReader(pack)), indexPackOptions{Threads: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != want {
+			t.Errorf("ofs-delta %v: indexed as pack-%s, want pack-%s", ofsDelta, name, want)
+		}
+		prefix := filepath.Join(packDir(dst), "pack-"+name)
+		if stored, _ := os.ReadFile(prefix + ".pack"); !bytes.Equal(stored, pack) {
+			t.Errorf("ofs-delta %v: the stored pack differs from the one sent", ofsDelta)
+		}
+		if got, _ := os.ReadFile(prefix + ".idx"); !bytes.Equal(got, idx) {
+			t.Errorf("ofs-delta %v: the index differs from the one writePack's entries give", ofsDelta)
+		}
+		if !equalContents(commitContents(t, dst, tip), commitContents(t, src, tip)) {
+			t.Errorf("ofs-delta %v: the indexed pack reads back differently", ofsDelta)
+		}
+		if tmp, _ := filepath.Glob(filepath.Join(packDir(dst), "tmp_pack_*")); len(tmp) > 0 {
+			t.Errorf("left %v behind", tmp)
+		}
+		runGit(t, dst, "fsck", "--strict", tip)
+	}
+}
+
+func TestIndexPackUnpackLimit(t *testing.T) {
+	src, tip := indexPackHistory(t)
+	pack, _, _ := packOf(t, src, tip, defaultPackOptions)
+	objects, err := objectsToPack(src, []string{tip}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	Init(dst)
+	name, err := indexPack(dst, bytes.NewReader(pack), indexPackOptions{UnpackLimit: len(objects) + 1})
+	if err != nil || name != "" {
+		t.Fatalf("a pack under the limit was kept as %q: %v", name, err)
+	}
+	if packs := packFiles(t, dst); len(packs) != 0 {
+		t.Errorf("a pack under the limit was kept: %v", packs)
+	}
+	loose := looseObjects(t, dst)
+	for _, object := range objects {
+		if !loose[object.Sha] {
+			t.Errorf("%s was not written loose", object.Sha)
+		}
+	}
+	runGit(t, dst, "fsck", "--strict", tip)
+
+	// At the limit it is kept.
+	dst = t.TempDir()
+	Init(dst)
+	if name, err := indexPack(dst, bytes.NewReader(pack), indexPackOptions{UnpackLimit: len(objects)}); err != nil || name == "" {
+		t.Errorf("a pack at the limit was not kept: %v", err)
+	}
+}
+
+func TestIndexPackErrors(t *testing.T) {
+	src, tip := deltaHistory(t)
+	pack, _, _ := packOf(t, src, tip, defaultPackOptions)
+	corrupt := func(at int) []byte {
+		broken := append([]byte{}, pack...)
+		broken[at] ^= 0xff
+		return broken
+	}
+	tests := []struct {
+		name string
+		pack []byte
+		want string
+	}{
+		{"empty", nil, "pack header"},
+		{"not a pack", []byte("PACX\x00\x00\x00\x02\x00\x00\x00\x00"), "invalid packfile"},
+		{"version 4", []byte("PACK\x00\x00\x00\x04\x00\x00\x00\x00"), "unsupported pack version"},
+		{"truncated", pack[:len(pack)/2], ""},
+		{"no checksum", pack[:len(pack)-20], "checksum"},
+		{"bad checksum", corrupt(len(pack) - 1), "checksum"},
+		{"bad object type", append(append(pack[:12:12], 0x50), pack[13:]...), "invalid object type"},
+	}
+	for _, tt := range tests {
+		dst := t.TempDir()
+		Init(dst)
+		_, err := indexPack(dst, bytes.NewReader(tt.pack), indexPackOptions{})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if left, _ := os.ReadDir(packDir(dst)); len(left) > 0 {
+			t.Errorf("%s: left %d files in the pack directory", tt.name, len(left))
+		}
+	}
+}
+
+// An entry of a hand-made pack: an object stored whole, or a delta against
+// an object named by sha or against an earlier entry.
+type testPackEntry struct {
+	Type      byte
+	Content   []byte
+	BaseSha   string // for a REF_DELTA
+	BaseEntry int    // for an OFS_DELTA, the index of the base's entry
+}
+
+// Encode entries as a version 2 pack.
+func buildPack(t *testing.T, entries []testPackEntry) []byte {
+	t.Helper()
+	var pack bytes.Buffer
+	pack.WriteString("PACK\x00\x00\x00\x02")
+	pack.Write([]byte{byte(len(entries) >> 24), byte(len(entries) >> 16), byte(len(entries) >> 8), byte(len(entries))})
+	offsets := make([]int64, len(entries))
+	for i, entry := range entries {
+		offsets[i] = int64(pack.Len())
+		pack.Write(encodeObjectHeader(entry.Type, len(entry.Content)))
+		switch entry.Type {
+		case OBJECT_REF_DELTA:
+			sha, err := hex.DecodeString(entry.BaseSha)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pack.Write(sha)
+		case OBJECT_OFS_DELTA:
+			pack.Write(encodeOffsetDistance(offsets[i] - offsets[entry.BaseEntry]))
+		}
+		compressed := zlib.NewWriter(&pack)
+		compressed.Write(entry.Content)
+		if err := compressed.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+	return pack.Bytes()
+}
+
+func blobSha(content string) string {
+	return fmt.Sprintf("%x", sha1.Sum((&GitBlob{Content: []byte(content)}).Serialize()))
+}
+
+// A thin pack of delta chains, some starting from blobs only the receiving
+// repository has, mixing OFS_DELTAs and REF_DELTAs against objects in the
+// pack, deltified or not. Returns the pack, the blobs it leaves out and
+// every blob it holds.
+func thinPack(t *testing.T) (pack []byte, external, blobs map[string]string) {
+	t.Helper()
+	external, blobs = make(map[string]string), make(map[string]string)
+	var entries []testPackEntry
+	delta := func(base, target string) []byte {
+		return newDeltaIndex([]byte(base)).createDelta([]byte(target), len(target)+1000)
+	}
+	lines := numberedLines(400)
+	// A delta sent before its base.
+	early := strings.Replace(lines, "line 7 ", "early ", 1)
+	entries = append(entries, testPackEntry{Type: OBJECT_REF_DELTA, Content: delta(lines, early), BaseSha: blobSha(lines)})
+	blobs[blobSha(early)] = early
+	for chain := 0; chain < 40; chain++ {
+		edit := func(step int) string {
+			return strings.Replace(lines, fmt.Sprintf("line %d ", chain*10+step), fmt.Sprintf("chain %d step %d ", chain, step), 1) + fmt.Sprintf("chain %d step %d\n", chain, step)
+		}
+		base := edit(0)
+		if chain%2 == 0 {
+			// Based outside the pack.
+			external[blobSha(base)] = base
+		} else {
+			blobs[blobSha(base)] = base
+			entries = append(entries, testPackEntry{Type: OBJECT_BLOB, Content: []byte(base)})
+		}
+		first := edit(1)
+		entries = append(entries, testPackEntry{Type: OBJECT_REF_DELTA, Content: delta(base, first), BaseSha: blobSha(base)})
+		blobs[blobSha(first)] = first
+		second := edit(2)
+		entries = append(entries, testPackEntry{Type: OBJECT_OFS_DELTA, Content: delta(first, second), BaseEntry: len(entries) - 1})
+		blobs[blobSha(second)] = second
+		// A REF_DELTA against a delta, which only has a sha once resolved.
+		third := edit(3)
+		entries = append(entries, testPackEntry{Type: OBJECT_REF_DELTA, Content: delta(second, third), BaseSha: blobSha(second)})
+		blobs[blobSha(third)] = third
+	}
+	entries = append(entries, testPackEntry{Type: OBJECT_BLOB, Content: []byte(lines)})
+	blobs[blobSha(lines)] = lines
+	return buildPack(t, entries), external, blobs
+}
+
+// Index the same packs with one thread and with several, which should give
+// identical results; run with -race, this also checks the threads share
+// nothing unguarded.
+func TestIndexPackThreads(t *testing.T) {
+	src, tip := indexPackHistory(t)
+	ofs, _, _ := packOf(t, src, tip, defaultPackOptions)
+	ref, _, _ := packOf(t, src, tip, packOptions{Window: 10, Depth: 50})
+	thin, external, blobs := thinPack(t)
+
+	for _, tt := range []struct {
+		name string
+		pack []byte
+	}{{"ofs-delta", ofs}, {"ref-delta", ref}, {"thin", thin}} {
+		var firstIdx []byte
+		var firstName string
+		for _, threads := range []int{1, 8} {
+			dst := t.TempDir()
+			Init(dst)
+			for _, content := range external {
+				if _, err := writeGitObject(dst, (&GitBlob{Content: []byte(content)}).Serialize()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			name, err := indexPack(dst, bytes.NewReader(tt.pack), indexPackOptions{Threads: threads})
+			if err != nil {
+				t.Fatalf("%s with %d threads: %v", tt.name, threads, err)
+			}
+			idxPath := filepath.Join(packDir(dst), "pack-"+name+".idx")
+			idx, err := os.ReadFile(idxPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if firstIdx == nil {
+				firstIdx, firstName = idx, name
+			} else if name != firstName || !bytes.Equal(idx, firstIdx) {
+				t.Errorf("%s: %d threads made pack-%s, one made pack-%s", tt.name, threads, name, firstName)
+			}
+
+			if tt.name == "thin" {
+				// Every blob, the completed bases included, is in the pack.
+				pack, err := openPack(idxPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(pack.shas()), len(blobs)+len(external); got != want {
+					t.Errorf("%d threads: the completed pack has %d objects, want %d", threads, got, want)
+				}
+				for sha, content := range blobs {
+					if got, err := CatFile(dst, sha); err != nil || string(got) != content {
+						t.Errorf("%d threads: blob %s reads back wrong: %v", threads, sha, err)
+					}
+				}
+				for sha := range external {
+					if !packsContain([]*packFile{pack}, sha) {
+						t.Errorf("%d threads: the base %s was not added to the pack", threads, sha)
+					}
+				}
+			} else if !equalContents(commitContents(t, dst, tip), commitContents(t, src, tip)) {
+				t.Errorf("%s with %d threads reads back differently", tt.name, threads)
+			}
+			verify := runGit(t, dst, "verify-pack", "-v", idxPath)
+			if !strings.Contains(verify, "chain length = ") {
+				t.Errorf("%s: git finds no deltas:\n%s", tt.name, verify)
+			}
+		}
+	}
+
+	// Without the bases the thin pack cannot be completed.
+	dst := t.TempDir()
+	Init(dst)
+	if _, err := indexPack(dst, bytes.NewReader(thin), indexPackOptions{Threads: 4}); err == nil || !strings.Contains(err.Error(), "unresolved deltas") {
+		t.Errorf("indexed a thin pack without its bases: %v", err)
+	}
+}
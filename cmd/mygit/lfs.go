@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Git LFS stores large files outside the repository and commits a small
+// pointer blob in their place.
+// ref: https://github.com/git-lfs/git-lfs/blob/main/docs/spec.md
+const lfsSpecVersion = "https://git-lfs.github.com/spec/v1"
+
+// Pointer files are never larger than this.
+const lfsMaxPointerSize = 1024
+
+type lfsPointer struct {
+	Oid  string // sha256 of the content, hex encoded
+	Size int64
+}
+
+func (p *lfsPointer) Serialize() []byte {
+	return []byte(fmt.Sprintf("version %s\noid sha256:%s\nsize %d\n", lfsSpecVersion, p.Oid, p.Size))
+}
+
+// Parse an LFS pointer, returning nil when the content is not one.
+func parseLFSPointer(content []byte) *lfsPointer {
+	if len(content) > lfsMaxPointerSize || !bytes.HasPrefix(content, []byte("version ")) {
+		return nil
+	}
+	values := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		key, value, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil
+		}
+		values[key] = value
+	}
+	oid, ok := cutPrefix(values["oid"], "sha256:")
+	if values["version"] != lfsSpecVersion || !ok || len(oid) != 64 || !isHex(oid) {
+		return nil
+	}
+	size, err := strconv.ParseInt(values["size"], 10, 64)
+	if err != nil || size < 0 {
+		return nil
+	}
+	return &lfsPointer{Oid: oid, Size: size}
+}
+
+// Directory holding LFS objects, laid out as objects/ab/cd/abcd....
+func lfsStorageDir(localDir string) string {
+	if dir, ok := configPath(localDir, "lfs.storage"); ok {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(gitDir(localDir), dir)
+		}
+		return dir
+	}
+	return filepath.Join(gitDir(localDir), "lfs")
+}
+
+func lfsObjectPath(localDir, oid string) string {
+	return filepath.Join(lfsStorageDir(localDir), "objects", oid[0:2], oid[2:4], oid)
+}
+
+// Move file content into the LFS store and return the pointer to commit.
+// Content that already is a pointer is committed as it is.
+func lfsClean(localDir string, content []byte) ([]byte, error) {
+	if parseLFSPointer(content) != nil {
+		return content, nil
+	}
+	sum := sha256.Sum256(content)
+	pointer := &lfsPointer{Oid: hex.EncodeToString(sum[:]), Size: int64(len(content))}
+	filename := lfsObjectPath(localDir, pointer.Oid)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if err := writeFile(filename, content); err != nil {
+			return nil, err
+		}
+	}
+	return pointer.Serialize(), nil
+}
+
+// Replace a pointer with the object it refers to when the local store has it.
+// Otherwise the pointer itself is checked out.
+func lfsSmudge(localDir, name string, content []byte) []byte {
+	pointer := parseLFSPointer(content)
+	if pointer == nil {
+		return content
+	}
+	data, err := os.ReadFile(lfsObjectPath(localDir, pointer.Oid))
+	if err != nil || int64(len(data)) != pointer.Size {
+		fmt.Fprintf(os.Stderr, "warning: %s: LFS object %s is not available locally, keeping the pointer\n", name, shortSha(pointer.Oid))
+		return content
+	}
+	return data
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The path of a repository given as a local path or file:// URL.
+func localRepositoryPath(url string) (string, bool) {
+	if path, ok := cutPrefix(url, "file://"); ok {
+		return path, true
+	}
+	if strings.Contains(url, "://") || isSSHURL(url) {
+		return "", false
+	}
+	return url, true
+}
+
+func isRepository(dir string) bool {
+	info, err := os.Stat(filepath.Join(gitDir(dir), "objects"))
+	return err == nil && info.IsDir()
+}
+
+// A repository on this machine, served by an in-process git-upload-pack or
+// git-receive-pack over a pair of pipes just as one would be over SSH.
+type localTransport struct {
+	Dir string
+	pipeConn
+}
+
+func (t *localTransport) advertise(service string, version int) (io.ReadCloser, error) {
+	if !isRepository(t.Dir) {
+		return nil, fmt.Errorf("'%s' does not appear to be a git repository", t.Dir)
+	}
+	var serve func(r io.Reader, w io.Writer) error
+	switch service {
+	case "git-upload-pack":
+		serve = func(r io.Reader, w io.Writer) error { return serveUploadPack(t.Dir, r, w, version, false) }
+	case "git-receive-pack":
+		serve = func(r io.Reader, w io.Writer) error { return serveReceivePack(t.Dir, r, w, false) }
+	default:
+		return nil, fmt.Errorf("%s is not supported over the local transport", service)
+	}
+	requestReader, requestWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	responseReader, responseWriter, err := os.Pipe()
+	if err != nil {
+		requestReader.Close()
+		requestWriter.Close()
+		return nil, err
+	}
+	served := make(chan error, 1)
+	go func() {
+		err := serve(requestReader, responseWriter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+		}
+		responseWriter.Close()
+		requestReader.Close()
+		served <- err
+	}()
+	t.stdin, t.stdout = requestWriter, bufio.NewReader(responseReader)
+	t.wait = func() error {
+		err := <-served
+		responseReader.Close()
+		return err
+	}
+	return io.NopCloser(t.stdout), nil
+}
+
+// How a clone gets the objects of its source, and which of its refs it
+// takes.
+type cloneOptions struct {
+	Local        bool          // copy the object store rather than use the transport
+	Shared       bool          // borrow objects through objects/info/alternates
+	NoHardlinks  bool          // copy files even where they could be hard-linked
+	Threads      int           // goroutines indexing a fetched pack, 0 for the default
+	Deepen       deepenOptions // how much history to fetch, all when zero
+	Filter       objectFilter  // objects a partial clone goes without
+	Branch       string        // branch or tag to check out instead of the remote's HEAD
+	Bare         bool          // make a bare repository, with the remote's branches as its own
+	Mirror       bool          // make a bare repository mirroring every ref of the remote
+	SingleBranch bool          // fetch only the branch or tag checked out
+	NoCheckout   bool          // leave the work tree and index empty
+}
+
+// Take the objects of a local repository for a clone: borrow them through
+// objects/info/alternates when shared, or else hard-link or copy the
+// source's object store, and return its refs as an advertisement would.
+// ref: https://git-scm.com/docs/git-clone#Documentation/git-clone.txt---local
+func cloneLocalObjects(source, localDir string, options cloneOptions) ([]remoteRef, error) {
+	if !isRepository(source) {
+		return nil, fmt.Errorf("repository '%s' does not exist", source)
+	}
+	sourceObjects, err := filepath.Abs(filepath.Join(gitDir(source), "objects"))
+	if err != nil {
+		return nil, err
+	}
+	objectsDir := filepath.Join(gitDir(localDir), "objects")
+	if options.Shared {
+		err = writeFile(filepath.Join(objectsDir, "info", "alternates"), []byte(sourceObjects+"\n"))
+	} else {
+		err = copyObjectDir(sourceObjects, objectsDir, !options.NoHardlinks)
+	}
+	if err != nil {
+		return nil, err
+	}
+	forgetAlternates(localDir)
+	return advertisedRefs(source)
+}
+
+// Copy an objects directory, hard-linking files where possible. Relative
+// alternates are made absolute so they still resolve from the copy.
+func copyObjectDir(source, dest string, hardlink bool) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, 0755)
+		case rel == filepath.Join("info", "alternates"):
+			return copyAlternates(source, path, target)
+		}
+		if hardlink {
+			if err := os.Link(path, target); err == nil {
+				return nil
+			}
+			// Fall back to copying across filesystems.
+		}
+		return copyFile(path, target, info.Mode())
+	})
+}
+
+func copyAlternates(sourceObjects, path, target string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") && !filepath.IsAbs(line) {
+			line = filepath.Join(sourceObjects, line)
+		}
+		lines = append(lines, line)
+	}
+	return writeFile(target, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+func copyFile(source, target string, mode os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalRepositoryPath(t *testing.T) {
+	tests := []struct {
+		url, path string
+		local     bool
+	}{
+		{"/srv/repo.git", "/srv/repo.git", true},
+		{"../repo", "../repo", true},
+		{"./a:b", "./a:b", true},
+		{"file:///srv/repo.git", "/srv/repo.git", true},
+		{"host:repo.git", "", false},
+		{"ssh://host/repo.git", "", false},
+		{"https://host/repo.git", "", false},
+	}
+	for _, tt := range tests {
+		if path, local := localRepositoryPath(tt.url); path != tt.path || local != tt.local {
+			t.Errorf("localRepositoryPath(%q) = %q, %v", tt.url, path, local)
+		}
+	}
+}
+
+// A bare repository with master checked out by HEAD and a topic branch.
+func localUpstream(t *testing.T) (upstream, master, topic string) {
+	t.Helper()
+	_, upstream = bareRepo(t)
+	master = commitFiles(t, upstream, "", "first", map[string]string{"a": "a\n", "dir/b": "b\n"})
+	topic = commitFiles(t, upstream, master, "topic", map[string]string{"c": "c\n"})
+	for ref, sha := range map[string]string{"refs/heads/master": master, "refs/heads/topic": topic} {
+		if err := writeRef(upstream, ref, sha); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return upstream, master, topic
+}
+
+func TestLocalTransport(t *testing.T) {
+	upstream, master, topic := localUpstream(t)
+
+	// file:// goes through upload-pack rather than copying.
+	clone := filepath.Join(t.TempDir(), "clone")
+	if err := Clone("file://"+upstream, clone, cloneOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkRef(t, clone, "refs/remotes/origin/master", master)
+	checkRef(t, clone, "refs/remotes/origin/topic", topic)
+	if got := readTestFile(t, clone, "dir/b"); got != "b\n" {
+		t.Errorf("checked out dir/b as %q", got)
+	}
+	if packs := packFiles(t, clone); len(packs) != 1 {
+		t.Errorf("the clone has %d packs", len(packs))
+	}
+	runGit(t, clone, "fsck", "--strict")
+
+	// A plain path works as a remote for fetch and push.
+	next := commitFiles(t, clone, master, "next", map[string]string{"a": "next\n"})
+	if err := writeRef(clone, "refs/heads/master", next); err != nil {
+		t.Fatal(err)
+	}
+	if err := Push(clone, upstream, []string{"master:refs/heads/pushed"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	checkRef(t, upstream, "refs/heads/pushed", next)
+	other := newTestRepo(t)
+	if err := Fetch(other, upstream, []string{"refs/heads/*:refs/heads/*"}, fetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for ref, sha := range map[string]string{"refs/heads/master": master, "refs/heads/topic": topic, "refs/heads/pushed": next} {
+		checkRef(t, other, ref, sha)
+	}
+
+	for _, missing := range []string{filepath.Join(t.TempDir(), "missing"), "file://" + filepath.Join(t.TempDir(), "missing")} {
+		err := Fetch(other, missing, nil, fetchOptions{})
+		if err == nil || !strings.Contains(err.Error(), "does not appear to be a git repository") {
+			t.Errorf("fetching from %s gave %v", missing, err)
+		}
+	}
+}
+
+func TestCloneLocalObjects(t *testing.T) {
+	upstream, master, _ := localUpstream(t)
+	object := func(dir, sha string) string {
+		return filepath.Join(gitDir(dir), "objects", sha[:2], sha[2:])
+	}
+	sameFile := func(a, b string) bool {
+		t.Helper()
+		ai, err := os.Stat(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bi, err := os.Stat(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return os.SameFile(ai, bi)
+	}
+
+	linked := filepath.Join(t.TempDir(), "linked")
+	if err := Clone(upstream, linked, cloneOptions{Local: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !sameFile(object(upstream, master), object(linked, master)) {
+		t.Error("a local clone did not hard-link its objects")
+	}
+
+	copied := filepath.Join(t.TempDir(), "copied")
+	if err := Clone(upstream, copied, cloneOptions{Local: true, NoHardlinks: true}); err != nil {
+		t.Fatal(err)
+	}
+	if sameFile(object(upstream, master), object(copied, master)) {
+		t.Error("--no-hardlinks linked the objects")
+	}
+
+	shared := filepath.Join(t.TempDir(), "shared")
+	if err := Clone(upstream, shared, cloneOptions{Local: true, Shared: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(object(shared, master)); !os.IsNotExist(err) {
+		t.Error("--shared copied the objects")
+	}
+	alternates := readTestFile(t, shared, ".git/objects/info/alternates")
+	if want := filepath.Join(upstream, "objects") + "\n"; alternates != want {
+		t.Errorf("alternates is %q, want %q", alternates, want)
+	}
+
+	for _, dir := range []string{linked, copied, shared} {
+		checkRef(t, dir, "refs/remotes/origin/master", master)
+		if !equalContents(commitContents(t, dir, "HEAD"), map[string]string{"a": "a\n", "dir/b": "b\n"}) {
+			t.Errorf("%s: HEAD has the wrong files", filepath.Base(dir))
+		}
+		if got := readTestFile(t, dir, "a"); got != "a\n" {
+			t.Errorf("%s: checked out a as %q", filepath.Base(dir), got)
+		}
+		runGit(t, dir, "fsck", "--strict")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 )
@@ -16,7 +17,8 @@ func main() {
 	case "init":
 		Init(".")
 	case "cat-file":
-		content, _ := CatFile(".", os.Args[3])
+		content, err := CatFile(".", os.Args[3])
+		must(err)
 		fmt.Print(string(content))
 	case "hash-object":
 		hash := HashObject(os.Args[3])
@@ -34,8 +36,57 @@ func main() {
 		hash := CommitTree(treeSha, parentSha, message)
 		fmt.Println(hash)
 	case "clone":
-		repo, localDir := os.Args[2], os.Args[3]
-		Clone(repo, localDir)
+		must(cloneCmd(os.Args[2:]))
+	case "rebase":
+		must(rebaseCmd(os.Args[2:]))
+	case "reset":
+		must(resetCmd(os.Args[2:]))
+	case "stash":
+		must(stashCmd(os.Args[2:]))
+	case "add":
+		must(addCmd(os.Args[2:]))
+	case "status":
+		must(statusCmd(os.Args[2:]))
+	case "check-ignore":
+		ignored, err := checkIgnoreCmd(os.Args[2:])
+		must(err)
+		if !ignored {
+			os.Exit(1)
+		}
+	case "check-attr":
+		must(checkAttrCmd(os.Args[2:]))
+	case "fetch":
+		must(fetchCmd(os.Args[2:]))
+	case "push":
+		must(pushCmd(os.Args[2:]))
+	case "remote":
+		must(remoteCmd(os.Args[2:]))
+	case "config":
+		found, err := configCmd(os.Args[2:])
+		must(err)
+		if !found {
+			os.Exit(1)
+		}
+	case "credential":
+		must(credentialCmd(os.Args[2:]))
+	case "index-pack":
+		must(indexPackCmd(os.Args[2:]))
+	case "serve":
+		must(serveCmd(os.Args[2:]))
+	case "pack-objects":
+		must(packObjectsCmd(os.Args[2:]))
+	case "repack":
+		must(repackCmd(os.Args[2:]))
+	case "pack-refs":
+		must(packRefsCmd(os.Args[2:]))
+	case "gc":
+		must(gcCmd(os.Args[2:]))
+	case "fsck":
+		ok, err := fsckCmd(os.Args[2:])
+		must(err)
+		if !ok {
+			os.Exit(1)
+		}
 
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command %s\n", command)
@@ -45,7 +96,32 @@ func main() {
 
 func must(err error) {
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		status := 1
+		var exit *exitError
+		if errors.As(err, &exit) {
+			status = exit.Status
+		}
+		if err.Error() != "" {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(status)
 	}
 }
+
+// An error that ends the command with an exit status other than 1, as git
+// config's documented statuses need. Without an error it exits quietly.
+type exitError struct {
+	Status int
+	Err    error
+}
+
+func (e *exitError) Error() string {
+	if e.Err == nil {
+		return ""
+	}
+	return e.Err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.Err
+}
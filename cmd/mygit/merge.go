@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const emptyTreeSha = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// A file in a flattened tree.
+type treeFile struct {
+	Mode string
+	Sha  string
+}
+
+// Flatten a tree into a map from slash-separated path to file.
+func flattenTree(localDir, treeSha string) (map[string]treeFile, error) {
+	files := make(map[string]treeFile)
+	if treeSha == "" || treeSha == emptyTreeSha {
+		return files, nil
+	}
+	var walk func(prefix, sha string) error
+	walk = func(prefix, sha string) error {
+		objectType, _, err := readGitObject(localDir, sha)
+		if err != nil {
+			return err
+		}
+		if objectType != "tree" {
+			return fmt.Errorf("%s is a %s, not a tree", sha, objectType)
+		}
+		for _, entry := range ListTree(localDir, sha).Entry {
+			name := path.Join(prefix, string(entry.Name))
+			entrySha := hex.EncodeToString(entry.Hash[:])
+			if string(entry.Perm) == string(dirPerm) {
+				if err := walk(name, entrySha); err != nil {
+					return err
+				}
+				continue
+			}
+			files[name] = treeFile{Mode: string(entry.Perm), Sha: entrySha}
+		}
+		return nil
+	}
+	return files, walk("", treeSha)
+}
+
+// Write nested tree objects for a flat set of files and return the root sha.
+func writeTreeFromFiles(localDir string, files map[string]treeFile) (string, error) {
+	tree := &GitTree{Entry: make([]*TreeEntry, 0)}
+	subdirs := make(map[string]map[string]treeFile)
+	for name, file := range files {
+		dir, rest, nested := strings.Cut(name, "/")
+		if nested {
+			if _, ok := files[dir]; ok {
+				return "", fmt.Errorf("%s is both a file and a directory", dir)
+			}
+			if subdirs[dir] == nil {
+				subdirs[dir] = make(map[string]treeFile)
+			}
+			subdirs[dir][rest] = file
+			continue
+		}
+		entry, err := newTreeEntryFromSha(file.Mode, name, file.Sha)
+		if err != nil {
+			return "", err
+		}
+		entry.IsBlob = true
+		tree.Entry = append(tree.Entry, entry)
+	}
+	for dir, children := range subdirs {
+		sha, err := writeTreeFromFiles(localDir, children)
+		if err != nil {
+			return "", err
+		}
+		entry, err := newTreeEntryFromSha(string(dirPerm), dir, sha)
+		if err != nil {
+			return "", err
+		}
+		tree.Entry = append(tree.Entry, entry)
+	}
+	sortTreeEntries(tree.Entry)
+	return writeGitObject(localDir, tree.Serialize())
+}
+
+func newTreeEntryFromSha(mode, name, sha string) (*TreeEntry, error) {
+	hashBytes, err := hex.DecodeString(sha)
+	if err != nil {
+		return nil, err
+	}
+	entry := &TreeEntry{Perm: []byte(mode), Name: []byte(name)}
+	copy(entry.Hash[:], hashBytes)
+	return entry, nil
+}
+
+// Outcome of merging two trees against a common base.
+type treeMerge struct {
+	// Files to check out, with conflict markers in conflicted files.
+	Files map[string]treeFile
+	// Conflicted paths, in sorted order.
+	Conflicts []string
+}
+
+// Three-way merge of trees, the way cherry-pick applies a commit: base is the
+// picked commit's parent, ours the current HEAD and theirs the picked commit.
+func mergeTrees(localDir, baseTree, oursTree, theirsTree, oursLabel, theirsLabel string) (*treeMerge, error) {
+	base, err := flattenTree(localDir, baseTree)
+	if err != nil {
+		return nil, err
+	}
+	ours, err := flattenTree(localDir, oursTree)
+	if err != nil {
+		return nil, err
+	}
+	theirs, err := flattenTree(localDir, theirsTree)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]bool)
+	for _, files := range []map[string]treeFile{base, ours, theirs} {
+		for name := range files {
+			paths[name] = true
+		}
+	}
+	result := &treeMerge{Files: make(map[string]treeFile)}
+	for name := range paths {
+		b, inBase := base[name]
+		o, inOurs := ours[name]
+		t, inTheirs := theirs[name]
+		switch {
+		case inOurs == inTheirs && o == t:
+			if inOurs {
+				result.Files[name] = o
+			}
+		case inBase == inOurs && b == o:
+			if inTheirs {
+				result.Files[name] = t
+			}
+		case inBase == inTheirs && b == t:
+			if inOurs {
+				result.Files[name] = o
+			}
+		case !inOurs || !inTheirs:
+			// modify/delete: keep the modified side so it can be resolved.
+			if inOurs {
+				result.Files[name] = o
+				fmt.Printf("CONFLICT (modify/delete): %s deleted in %s and modified in %s.\n", name, theirsLabel, oursLabel)
+			} else {
+				result.Files[name] = t
+				fmt.Printf("CONFLICT (modify/delete): %s deleted in %s and modified in %s.\n", name, oursLabel, theirsLabel)
+			}
+			result.Conflicts = append(result.Conflicts, name)
+		default:
+			merged, clean, err := mergeFile(localDir, name, b, o, t, oursLabel, theirsLabel)
+			if err != nil {
+				return nil, err
+			}
+			result.Files[name] = merged
+			if !clean {
+				result.Conflicts = append(result.Conflicts, name)
+			}
+		}
+	}
+	resolveDirectoryConflicts(result, ours, oursLabel, theirsLabel)
+	sort.Strings(result.Conflicts)
+	return result, nil
+}
+
+// A merge can leave a file where the other side added a directory. As git
+// does, the file moves aside to <name>~<label of its side> and counts as a
+// conflict, so no tree ever holds both.
+func resolveDirectoryConflicts(result *treeMerge, ours map[string]treeFile, oursLabel, theirsLabel string) {
+	dirs := make(map[string]bool)
+	for name := range result.Files {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	var inTheWay []string
+	for name := range result.Files {
+		if dirs[name] {
+			inTheWay = append(inTheWay, name)
+		}
+	}
+	sort.Strings(inTheWay)
+	for _, name := range inTheWay {
+		file := result.Files[name]
+		label := theirsLabel
+		if o, ok := ours[name]; ok && o == file {
+			label = oursLabel
+		}
+		suffix := strings.ReplaceAll(label, "/", "_")
+		moved := name + "~" + suffix
+		for i := 0; ; i++ {
+			if _, taken := result.Files[moved]; !taken && !dirs[moved] {
+				break
+			}
+			moved = fmt.Sprintf("%s~%s_%d", name, suffix, i)
+		}
+		fmt.Printf("CONFLICT (file/directory): directory in the way of %s from %s; moving it to %s instead.\n", name, label, moved)
+		delete(result.Files, name)
+		result.Files[moved] = file
+		conflicts := result.Conflicts[:0]
+		for _, conflict := range result.Conflicts {
+			if conflict != name {
+				conflicts = append(conflicts, conflict)
+			}
+		}
+		result.Conflicts = append(conflicts, moved)
+	}
+}
+
+// Merge the contents of a file changed on both sides.
+func mergeFile(localDir, name string, base, ours, theirs treeFile, oursLabel, theirsLabel string) (treeFile, bool, error) {
+	mode := ours.Mode
+	if ours.Mode == base.Mode {
+		mode = theirs.Mode
+	}
+	if ours.Sha == theirs.Sha {
+		return treeFile{Mode: mode, Sha: ours.Sha}, true, nil
+	}
+	var baseContent []byte
+	if base.Sha != "" {
+		var err error
+		if baseContent, err = CatFile(localDir, base.Sha); err != nil {
+			return treeFile{}, false, err
+		}
+	}
+	ourContent, err := CatFile(localDir, ours.Sha)
+	if err != nil {
+		return treeFile{}, false, err
+	}
+	theirContent, err := CatFile(localDir, theirs.Sha)
+	if err != nil {
+		return treeFile{}, false, err
+	}
+	// -merge (as set by the binary macro) merges like a binary file.
+	if isBinary(baseContent) || isBinary(ourContent) || isBinary(theirContent) ||
+		attributesFor(localDir, name)["merge"] == attrUnset {
+		fmt.Printf("warning: Cannot merge binary files: %s (%s vs. %s)\n", name, oursLabel, theirsLabel)
+		fmt.Printf("CONFLICT (content): Merge conflict in %s\n", name)
+		return treeFile{Mode: mode, Sha: ours.Sha}, false, nil
+	}
+
+	merged := mergeLines(baseContent, ourContent, theirContent, oursLabel, theirsLabel)
+	blob := &GitBlob{Content: merged.Content}
+	sha, err := writeGitObject(localDir, blob.Serialize())
+	if err != nil {
+		return treeFile{}, false, err
+	}
+	if merged.Conflicts > 0 {
+		fmt.Printf("CONFLICT (content): Merge conflict in %s\n", name)
+	}
+	return treeFile{Mode: mode, Sha: sha}, merged.Conflicts == 0, nil
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Usage: mygit pack-objects [--stdout] [--revs] [--window=<n>] [--depth=<n>] [<base-name>]
+//
+// Reads object names, optionally followed by their path, from stdin. With
+// --revs it reads revisions instead and packs what they reach, excluding
+// what revisions prefixed with ^ reach.
+func packObjectsCmd(args []string) error {
+	toStdout, revs := false, false
+	options := defaultPackOptions
+	options.Progress = progressEnabled()
+	baseName := ""
+	for _, arg := range args {
+		switch {
+		case arg == "--stdout":
+			toStdout = true
+		case arg == "--revs":
+			revs = true
+		case strings.HasPrefix(arg, "--window="), strings.HasPrefix(arg, "--depth="):
+			name, value, _ := strings.Cut(arg, "=")
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid value for %s: %s", name, value)
+			}
+			if name == "--window" {
+				options.Window = n
+			} else {
+				options.Depth = n
+			}
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option: %s", arg)
+		default:
+			baseName = arg
+		}
+	}
+	if toStdout == (baseName != "") {
+		return errors.New("usage: mygit pack-objects [--stdout] [--revs] [--window=<n>] [--depth=<n>] [<base-name>]")
+	}
+
+	var objects []packObject
+	var tips, exclude []string
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !revs {
+			sha, name, _ := strings.Cut(line, " ")
+			objects = append(objects, packObject{Sha: sha, Path: name})
+			continue
+		}
+		rev, negated := cutPrefix(line, "^")
+		sha, err := revParse(".", rev)
+		if err != nil {
+			return err
+		}
+		if negated {
+			exclude = append(exclude, sha)
+		} else {
+			tips = append(tips, sha)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if revs {
+		var err error
+		if objects, err = objectsToPack(".", tips, exclude); err != nil {
+			return err
+		}
+	}
+
+	if toStdout {
+		out := bufio.NewWriter(os.Stdout)
+		if _, _, err := writePack(out, ".", objects, options); err != nil {
+			return err
+		}
+		return out.Flush()
+	}
+	name, err := writePackFiles(baseName, ".", objects, options)
+	if err != nil {
+		return err
+	}
+	fmt.Println(name)
+	return nil
+}
+
+// An object headed for a pack, with the path it was found at. Objects with
+// similar paths make good delta bases for each other.
+type packObject struct {
+	Sha  string
+	Path string
+}
+
+// List the objects reachable from tips but not from exclude: commits and
+// tags first, then trees and blobs. Like git, everything in the trees of the
+// excluded commits at the boundary is assumed to be on the other side too.
+func objectsToPack(localDir string, tips, exclude []string) ([]packObject, error) {
+	return objectsToPackShallow(localDir, tips, exclude, nil, nil, objectFilter{})
+}
+
+// List objects for a shallow or partial client: the parents of commits in
+// shallow are not sent, and since the client's history ends at theirShallow,
+// nothing past those commits counts as excluded. Trees and blobs below the
+// tips are left out as the filter says.
+func objectsToPackShallow(localDir string, tips, exclude []string, shallow, theirShallow map[string]bool, filter objectFilter) ([]packObject, error) {
+	var excludedCommits []string
+	for _, sha := range exclude {
+		if commit, err := peelToCommit(localDir, sha); err == nil {
+			excludedCommits = append(excludedCommits, commit)
+		}
+	}
+	excluded, err := reachableCommitsWithin(localDir, excludedCommits, theirShallow)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []packObject
+	var commits, trees []string
+	seen := make(map[string]bool)
+	add := func(sha, name string) {
+		if !seen[sha] {
+			seen[sha] = true
+			objects = append(objects, packObject{Sha: sha, Path: name})
+		}
+	}
+	stack := []string{}
+	for _, tip := range tips {
+		// Annotated tags are sent along with whatever they point at.
+		for tip != "" && !seen[tip] {
+			objectType, content, err := readGitObject(localDir, tip)
+			if err != nil {
+				return nil, err
+			}
+			switch objectType {
+			case "commit":
+				stack = append(stack, tip)
+				tip = ""
+			case "tag":
+				add(tip, "")
+				target, _, _ := strings.Cut(string(content), "\n")
+				tip = strings.TrimPrefix(target, "object ")
+			case "tree":
+				// Asked for by name, it is sent whatever the filter says.
+				add(tip, "")
+				trees = append(trees, tip)
+				tip = ""
+			default:
+				add(tip, "")
+				tip = ""
+			}
+		}
+	}
+	var boundary []string
+	for len(stack) > 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[sha] {
+			continue
+		}
+		if excluded[sha] {
+			seen[sha] = true
+			boundary = append(boundary, sha)
+			continue
+		}
+		add(sha, "")
+		commit, err := readCommit(localDir, sha)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, sha)
+		if !shallow[sha] {
+			stack = append(stack, commit.Parents...)
+		}
+	}
+
+	// Mark what the other side has before collecting what it lacks.
+	have := make(map[string]bool)
+	for _, sha := range boundary {
+		commit, err := readCommit(localDir, sha)
+		if err != nil {
+			return nil, err
+		}
+		if err := walkTreeObjects(localDir, commit.Tree, "", have, objectFilter{}, nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, sha := range commits {
+		commit, err := readCommit(localDir, sha)
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, commit.Tree)
+	}
+	for _, tree := range trees {
+		err := walkTreeObjects(localDir, tree, "", have, filter, func(sha, name string) {
+			add(sha, name)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// Visit a tree and everything below it that is not yet in seen, marking it.
+// Submodule commits are skipped as they live in another repository, and so
+// is what the filter leaves out. Trees a partial clone lacks are skipped too.
+func walkTreeObjects(localDir, treeSha, name string, seen map[string]bool, filter objectFilter, visit func(sha, name string)) error {
+	if seen[treeSha] || filter.omitsTree(name) {
+		return nil
+	}
+	if !hasObject(localDir, treeSha) {
+		if isPartialClone(localDir) {
+			return nil
+		}
+		return fmt.Errorf("missing tree %s", treeSha)
+	}
+	seen[treeSha] = true
+	if visit != nil {
+		visit(treeSha, name)
+	}
+	for _, entry := range ListTree(localDir, treeSha).Entry {
+		sha := hex.EncodeToString(entry.Hash[:])
+		entryName := path.Join(name, string(entry.Name))
+		switch string(entry.Perm) {
+		case string(dirPerm):
+			if err := walkTreeObjects(localDir, sha, entryName, seen, filter, visit); err != nil {
+				return err
+			}
+		case "160000":
+		default:
+			if !seen[sha] && !filter.omitsBlob(localDir, sha, entryName) {
+				seen[sha] = true
+				if visit != nil {
+					visit(sha, entryName)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// How writePack looks for deltas.
+type packOptions struct {
+	Window   int  // how many similar objects to try as bases, 0 for no deltas
+	Depth    int  // longest delta chain
+	OfsDelta bool // name bases by pack offset instead of by sha
+	Progress bool // show progress on stderr
+}
+
+var defaultPackOptions = packOptions{Window: 10, Depth: 50, OfsDelta: true}
+
+// Where an object was written in a pack, as recorded in the pack index.
+type packIndexEntry struct {
+	Sha    string
+	Offset int64
+	CRC    uint32
+}
+
+// An object being packed, with the delta chosen for it if any.
+type packCandidate struct {
+	packObject
+	Type     byte
+	Content  []byte
+	NameHash uint32
+	Order    int
+
+	Base   *packCandidate
+	Delta  []byte
+	Depth  int
+	Offset int64 // -1 until written
+
+	index *deltaIndex
+}
+
+// Git's path hash: mostly the last characters, so files with the same name
+// or extension sort next to each other.
+func packNameHash(name string) uint32 {
+	h := uint32(0)
+	for _, c := range []byte(name) {
+		if strings.IndexByte(" \t\n\v\f\r", c) >= 0 {
+			continue
+		}
+		h = (h >> 2) + uint32(c)<<24
+	}
+	return h
+}
+
+// Write a version 2 pack holding the objects and return the index entries
+// and the pack checksum. Objects are deltified against similar ones seen
+// within the window, and written in the order given with bases first.
+// ref: https://git-scm.com/docs/gitformat-pack
+func writePack(w io.Writer, localDir string, objects []packObject, options packOptions) ([]packIndexEntry, []byte, error) {
+	candidates := make([]*packCandidate, len(objects))
+	for i, object := range objects {
+		objectType, content, err := readGitObject(localDir, object.Sha)
+		if err != nil {
+			return nil, nil, err
+		}
+		typeCode, err := objectTypeCode(objectType)
+		if err != nil {
+			return nil, nil, err
+		}
+		candidates[i] = &packCandidate{packObject: object, Type: typeCode, Content: content, NameHash: packNameHash(object.Path), Order: i, Offset: -1}
+	}
+	if options.Window > 0 {
+		findDeltas(candidates, options)
+	}
+
+	checksum := sha1.New()
+	out := io.MultiWriter(w, checksum)
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(candidates)))
+	if _, err := out.Write(header); err != nil {
+		return nil, nil, err
+	}
+
+	progress := newProgress("Writing objects", len(candidates), options.Progress)
+	entries := make([]packIndexEntry, 0, len(candidates))
+	offset := int64(len(header))
+	deltas := 0
+	var write func(c *packCandidate) error
+	write = func(c *packCandidate) error {
+		if c.Base != nil && c.Base.Offset < 0 {
+			if err := write(c.Base); err != nil {
+				return err
+			}
+		}
+		var entry bytes.Buffer
+		data := c.Content
+		switch {
+		case c.Base == nil:
+			entry.Write(encodeObjectHeader(c.Type, len(c.Content)))
+		case options.OfsDelta:
+			entry.Write(encodeObjectHeader(OBJECT_OFS_DELTA, len(c.Delta)))
+			entry.Write(encodeOffsetDistance(offset - c.Base.Offset))
+			data = c.Delta
+		default:
+			entry.Write(encodeObjectHeader(OBJECT_REF_DELTA, len(c.Delta)))
+			baseSha, err := hex.DecodeString(c.Base.Sha)
+			if err != nil {
+				return err
+			}
+			entry.Write(baseSha)
+			data = c.Delta
+		}
+		compressed := zlib.NewWriter(&entry)
+		if _, err := compressed.Write(data); err != nil {
+			return err
+		}
+		if err := compressed.Close(); err != nil {
+			return err
+		}
+		if _, err := out.Write(entry.Bytes()); err != nil {
+			return err
+		}
+		c.Offset = offset
+		entries = append(entries, packIndexEntry{Sha: c.Sha, Offset: offset, CRC: crc32.ChecksumIEEE(entry.Bytes())})
+		offset += int64(entry.Len())
+		if c.Base != nil {
+			deltas++
+		}
+		progress.update(len(entries), offset)
+		return nil
+	}
+	for _, c := range candidates {
+		if c.Offset < 0 {
+			if err := write(c); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	progress.done(len(entries), offset)
+	sum := checksum.Sum(nil)
+	if _, err := w.Write(sum); err != nil {
+		return nil, nil, err
+	}
+	if options.Progress {
+		fmt.Fprintf(os.Stderr, "Total %d (delta %d), reused 0 (delta 0), pack-reused 0\n", len(entries), deltas)
+	}
+	return entries, sum, nil
+}
+
+// Choose delta bases with a sliding window over the objects sorted by type,
+// path hash and size, so likely bases sit next to each other. Larger objects
+// come first as deleting data makes smaller deltas than adding it.
+func findDeltas(candidates []*packCandidate, options packOptions) {
+	sorted := append([]*packCandidate{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Type != b.Type {
+			return a.Type > b.Type
+		}
+		if a.NameHash != b.NameHash {
+			return a.NameHash > b.NameHash
+		}
+		if len(a.Content) != len(b.Content) {
+			return len(a.Content) > len(b.Content)
+		}
+		return a.Order < b.Order
+	})
+
+	progress := newProgress("Compressing objects", len(sorted), options.Progress)
+	for i, target := range sorted {
+		if i > options.Window && sorted[i-options.Window-1] != nil {
+			// Out of the window, so its index is no longer needed.
+			sorted[i-options.Window-1].index = nil
+		}
+		// Tiny objects do not gain anything from a delta.
+		if len(target.Content) >= 50 {
+			for j := i - 1; j >= 0 && j >= i-options.Window; j-- {
+				base := sorted[j]
+				if base.Type != target.Type {
+					break
+				}
+				tryDelta(target, base, options.Depth)
+			}
+		}
+		progress.update(i+1, 0)
+	}
+	progress.done(len(sorted), 0)
+}
+
+// Use base for target if that gives a smaller delta than what target has.
+func tryDelta(target, base *packCandidate, maxDepth int) {
+	if base.Depth >= maxDepth {
+		return
+	}
+	maxSize := len(target.Content)/2 - sha1.Size
+	if target.Delta != nil {
+		maxSize = len(target.Delta) - 1
+	}
+	// Leave room for longer chains to be built on bases that are still short.
+	maxSize = maxSize * (maxDepth - base.Depth) / maxDepth
+	if maxSize <= 0 || len(target.Content)-len(base.Content) >= maxSize || len(target.Content) < len(base.Content)/32 {
+		return
+	}
+	if base.index == nil {
+		base.index = newDeltaIndex(base.Content)
+	}
+	delta := base.index.createDelta(target.Content, maxSize)
+	if delta == nil {
+		return
+	}
+	target.Base, target.Delta, target.Depth = base, delta, base.Depth+1
+}
+
+// Encode a pack object header, the inverse of readObjectTypeAndLen.
+func encodeObjectHeader(objectType byte, size int) []byte {
+	b := objectType<<4 | byte(size)&firstRemMask
+	size >>= 4
+	var header []byte
+	for size > 0 {
+		header = append(header, b|msbMask)
+		b = byte(size) & remMask
+		size >>= 7
+	}
+	return append(header, b)
+}
+
+// Encode the distance back to an OFS_DELTA base, the inverse of
+// readOffsetDistance.
+func encodeOffsetDistance(distance int64) []byte {
+	encoded := []byte{byte(distance) & remMask}
+	for distance >>= 7; distance > 0; distance >>= 7 {
+		distance--
+		encoded = append([]byte{byte(distance)&remMask | msbMask}, encoded...)
+	}
+	return encoded
+}
+
+// Write a version 2 pack index: a fan-out table, the sorted shas, their
+// CRCs and offsets, then the pack checksum and the index's own.
+// ref: https://git-scm.com/docs/gitformat-pack#_version_2_pack_idx_files_support_packs_larger_than_4_gib_and
+func writePackIndex(w io.Writer, entries []packIndexEntry, packChecksum []byte) error {
+	sorted := append([]packIndexEntry{}, entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Sha < sorted[j].Sha })
+
+	checksum := sha1.New()
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 't', 'O', 'c'})
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+	var fanout [256]uint32
+	for _, entry := range sorted {
+		first, err := hex.DecodeString(entry.Sha[:2])
+		if err != nil {
+			return err
+		}
+		for b := int(first[0]); b < 256; b++ {
+			fanout[b]++
+		}
+	}
+	binary.Write(&buf, binary.BigEndian, fanout)
+	for _, entry := range sorted {
+		sha, err := hex.DecodeString(entry.Sha)
+		if err != nil {
+			return err
+		}
+		buf.Write(sha)
+	}
+	for _, entry := range sorted {
+		binary.Write(&buf, binary.BigEndian, entry.CRC)
+	}
+	// Offsets past 2 GiB go in a table of 8-byte offsets.
+	var large []uint64
+	for _, entry := range sorted {
+		if entry.Offset < 0x80000000 {
+			binary.Write(&buf, binary.BigEndian, uint32(entry.Offset))
+			continue
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(0x80000000|len(large)))
+		large = append(large, uint64(entry.Offset))
+	}
+	for _, offset := range large {
+		binary.Write(&buf, binary.BigEndian, offset)
+	}
+	buf.Write(packChecksum)
+	checksum.Write(buf.Bytes())
+	buf.Write(checksum.Sum(nil))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Write the objects to <prefix>-<checksum>.pack with its .idx next to it and
+// return the checksum.
+func writePackFiles(prefix, localDir string, objects []packObject, options packOptions) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(prefix), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(prefix), "tmp_pack_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	entries, sum, err := writePack(tmp, localDir, objects, options)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	var index bytes.Buffer
+	if err := writePackIndex(&index, entries, sum); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(sum)
+	if err := os.WriteFile(prefix+"-"+name+".idx", index.Bytes(), 0444); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), prefix+"-"+name+".pack"); err != nil {
+		return "", err
+	}
+	return name, os.Chmod(prefix+"-"+name+".pack", 0444)
+}
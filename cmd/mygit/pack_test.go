@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Numbered lines, so edits leave most blocks shared with the original.
+func numberedLines(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "line %d of the file\n", i)
+	}
+	return b.String()
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	random := make([]byte, 3*maxCopySize)
+	rand.New(rand.NewSource(1)).Read(random)
+	edited := append(append(append([]byte{}, random[:maxCopySize+100]...), "an edit"...), random[maxCopySize+200:]...)
+	lines := numberedLines(200)
+
+	tests := []struct {
+		name         string
+		base, target string
+	}{
+		{"empty", "", ""},
+		{"empty base", "", "new content\n"},
+		{"empty target", lines, ""},
+		{"identical", lines, lines},
+		{"shorter than a block", "abc", "abd"},
+		{"prepended", lines, "header\n" + lines},
+		{"appended", lines, lines + "trailer\n"},
+		{"line changed", lines, strings.Replace(lines, "line 100 ", "LINE 100 ", 1)},
+		{"moved", lines, lines[len(lines)/2:] + lines[:len(lines)/2]},
+		{"long insert", lines, lines[:100] + strings.Repeat("x", 1000) + lines[100:]},
+		{"repetitive", strings.Repeat("ab", 5000), strings.Repeat("ab", 4000) + "c" + strings.Repeat("ab", 1000)},
+		{"copies over the size limit", string(random), string(edited)},
+		{"unrelated", lines, string(random[:1000])},
+	}
+	for _, tt := range tests {
+		delta := newDeltaIndex([]byte(tt.base)).createDelta([]byte(tt.target), len(tt.target)+1000)
+		if delta == nil {
+			t.Errorf("%s: no delta", tt.name)
+			continue
+		}
+		got, err := readDeltified(bytes.NewBuffer(delta), &Object{Type: 3, Buf: []byte(tt.base)})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got.String() != tt.target {
+			t.Errorf("%s: the delta gives %d bytes, want %d", tt.name, got.Len(), len(tt.target))
+		}
+	}
+
+	// Similar content makes a small delta.
+	target := strings.Replace(lines, "line 100 ", "LINE 100 ", 1)
+	if delta := newDeltaIndex([]byte(lines)).createDelta([]byte(target), len(target)); len(delta) > 100 {
+		t.Errorf("a one-line change took a %d byte delta", len(delta))
+	}
+	// And a delta over the limit is not made.
+	if delta := newDeltaIndex([]byte(lines)).createDelta(random[:1000], 500); delta != nil {
+		t.Errorf("made a %d byte delta over a limit of 500", len(delta))
+	}
+}
+
+// A history whose file changes a little in each commit, so a pack of it
+// has delta chains.
+func deltaHistory(t *testing.T) (dir, tip string) {
+	t.Helper()
+	dir = newTestRepo(t)
+	content := numberedLines(300)
+	for i := 0; i < 6; i++ {
+		content = strings.Replace(content, fmt.Sprintf("line %d ", i*40), fmt.Sprintf("edit %d ", i), 1)
+		tip = commitFiles(t, dir, tip, fmt.Sprintf("commit %d", i), map[string]string{
+			"file.txt":     content,
+			"dir/copy.txt": content + "copied\n",
+		})
+	}
+	return dir, tip
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	src, tip := deltaHistory(t)
+	objects, err := objectsToPack(src, []string{tip}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ofsDelta := range []bool{true, false} {
+		dst := t.TempDir()
+		Init(dst)
+		options := defaultPackOptions
+		options.OfsDelta = ofsDelta
+		name, err := writePackFiles(filepath.Join(packDir(dst), "pack"), src, objects, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix := filepath.Join(packDir(dst), "pack-"+name)
+
+		// Every object reads back the same from the pack.
+		for _, object := range objects {
+			wantType, want, err := readGitObject(src, object.Sha)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotType, got, err := readGitObject(dst, object.Sha)
+			if err != nil || gotType != wantType || !bytes.Equal(got, want) {
+				t.Errorf("ofs-delta %v: %s reads back as a %s of %d bytes: %v", ofsDelta, object.Sha, gotType, len(got), err)
+			}
+		}
+
+		// git reads the pack, finds deltas in it, and indexes it the same.
+		verify := runGit(t, dst, "verify-pack", "-v", prefix+".idx")
+		if !strings.Contains(verify, "chain length = ") {
+			t.Errorf("ofs-delta %v: no deltas in the pack:\n%s", ofsDelta, verify)
+		}
+		gitIdx := filepath.Join(t.TempDir(), "git.idx")
+		runGit(t, dst, "index-pack", "-o", gitIdx, prefix+".pack")
+		ours, err := os.ReadFile(prefix + ".idx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if theirs, _ := os.ReadFile(gitIdx); !bytes.Equal(ours, theirs) {
+			t.Errorf("ofs-delta %v: the index differs from git's", ofsDelta)
+		}
+		runGit(t, dst, "fsck", "--strict", tip)
+	}
+
+	// Without a window nothing is deltified.
+	dst := t.TempDir()
+	Init(dst)
+	name, err := writePackFiles(filepath.Join(packDir(dst), "pack"), src, objects, packOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := runGit(t, dst, "verify-pack", "-v", filepath.Join(packDir(dst), "pack-"+name+".idx"))
+	if strings.Contains(verify, "chain length = ") {
+		t.Errorf("deltas without a window:\n%s", verify)
+	}
+}
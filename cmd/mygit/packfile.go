@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A pack under .git/objects/pack, looked up through its version 2 index.
+// ref: https://git-scm.com/docs/gitformat-pack#_version_2_pack_idx_files_support_packs_larger_than_4_gib_and
+type packFile struct {
+	Path     string // the .pack file
+	Promisor bool   // fetched from a promisor remote, which has what it refers to
+	index    []byte
+	count    int
+	file     *os.File
+
+	// Recently inflated objects by offset, as delta chains share bases.
+	cache map[int64]*Object
+	lock  sync.Mutex // over file and cache
+}
+
+const packCacheSize = 256
+
+// Packs are opened once per pack directory, until a repack replaces them.
+var (
+	openPacks     = make(map[string][]*packFile)
+	openPacksLock sync.Mutex
+)
+
+func packDir(localDir string) string {
+	return filepath.Join(gitDir(localDir), "objects", "pack")
+}
+
+// Open the packs of a repository, newest first.
+func loadPacks(localDir string) ([]*packFile, error) {
+	return loadPackDir(packDir(localDir))
+}
+
+// The repository's own packs followed by those of its alternates.
+func allPacks(localDir string) ([]*packFile, error) {
+	own, err := loadPacks(localDir)
+	if err != nil {
+		return nil, err
+	}
+	packs := own
+	for _, dir := range alternateObjectDirs(localDir) {
+		if len(packs) == len(own) {
+			packs = append([]*packFile{}, own...)
+		}
+		borrowed, err := loadPackDir(filepath.Join(dir, "pack"))
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, borrowed...)
+	}
+	return packs, nil
+}
+
+func loadPackDir(dir string) ([]*packFile, error) {
+	openPacksLock.Lock()
+	defer openPacksLock.Unlock()
+	if packs, ok := openPacks[dir]; ok {
+		return packs, nil
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	var packs []*packFile
+	for _, name := range names {
+		pack, err := openPack(name)
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, pack)
+	}
+	sort.SliceStable(packs, func(i, j int) bool { return packs[i].modTime().After(packs[j].modTime()) })
+	openPacks[dir] = packs
+	return packs, nil
+}
+
+// Forget the open packs, for after they were rewritten or deleted.
+func closePacks(localDir string) {
+	openPacksLock.Lock()
+	defer openPacksLock.Unlock()
+	for _, pack := range openPacks[packDir(localDir)] {
+		if pack.file != nil {
+			pack.file.Close()
+		}
+	}
+	delete(openPacks, packDir(localDir))
+}
+
+func openPack(idxPath string) (*packFile, error) {
+	data, err := os.ReadFile(idxPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8+256*4 || !bytes.Equal(data[:4], []byte{0xff, 't', 'O', 'c'}) || binary.BigEndian.Uint32(data[4:8]) != 2 {
+		return nil, fmt.Errorf("%s: unsupported pack index", idxPath)
+	}
+	count := int(binary.BigEndian.Uint32(data[8+255*4:]))
+	if len(data) < 8+256*4+count*(20+4+4)+40 {
+		return nil, fmt.Errorf("%s: pack index is truncated", idxPath)
+	}
+	base := strings.TrimSuffix(idxPath, ".idx")
+	_, err = os.Stat(base + ".promisor")
+	return &packFile{Path: base + ".pack", Promisor: err == nil, index: data, count: count, cache: make(map[int64]*Object)}, nil
+}
+
+func (p *packFile) modTime() (t time.Time) {
+	if info, err := os.Stat(p.Path); err == nil {
+		t = info.ModTime()
+	}
+	return t
+}
+
+// The raw sha of the i-th object in sha order.
+func (p *packFile) sha(i int) []byte {
+	start := 8 + 256*4 + i*20
+	return p.index[start : start+20]
+}
+
+func (p *packFile) offset(i int) int64 {
+	table := 8 + 256*4 + p.count*(20+4)
+	offset := binary.BigEndian.Uint32(p.index[table+i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset)
+	}
+	large := table + p.count*4 + int(offset&0x7fffffff)*8
+	return int64(binary.BigEndian.Uint64(p.index[large:]))
+}
+
+// The CRC32 of the i-th object's packed bytes.
+func (p *packFile) crc(i int) uint32 {
+	return binary.BigEndian.Uint32(p.index[8+256*4+p.count*20+i*4:])
+}
+
+// The range of objects whose sha starts with the given byte.
+func (p *packFile) fanout(first byte) (int, int) {
+	end := int(binary.BigEndian.Uint32(p.index[8+int(first)*4:]))
+	start := 0
+	if first > 0 {
+		start = int(binary.BigEndian.Uint32(p.index[8+int(first-1)*4:]))
+	}
+	return start, end
+}
+
+// Find an object by its raw sha.
+func (p *packFile) find(sha []byte) (int, bool) {
+	start, end := p.fanout(sha[0])
+	i := start + sort.Search(end-start, func(i int) bool { return bytes.Compare(p.sha(start+i), sha) >= 0 })
+	return i, i < end && bytes.Equal(p.sha(i), sha)
+}
+
+// All object shas in the pack, in sha order.
+func (p *packFile) shas() []string {
+	shas := make([]string, p.count)
+	for i := range shas {
+		shas[i] = hex.EncodeToString(p.sha(i))
+	}
+	return shas
+}
+
+// Read and undeltify the object at an offset. Bases named by sha may live
+// in another pack or be loose.
+func (p *packFile) readAt(localDir string, offset int64) (*Object, error) {
+	if obj := p.cached(offset); obj != nil {
+		return obj, nil
+	}
+	file, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, 1<<62))
+	objType, objLen, err := readObjectTypeAndLen(reader)
+	if err != nil {
+		return nil, err
+	}
+	var base *Object
+	switch objType {
+	case OBJECT_OFS_DELTA:
+		distance, err := readOffsetDistance(reader)
+		if err != nil {
+			return nil, err
+		}
+		if distance <= 0 || distance > offset {
+			return nil, fmt.Errorf("%s: invalid delta base offset for object at %d", p.Path, offset)
+		}
+		if base, err = p.readAt(localDir, offset-distance); err != nil {
+			return nil, err
+		}
+	case OBJECT_REF_DELTA:
+		baseSha := make([]byte, 20)
+		if _, err := io.ReadFull(reader, baseSha); err != nil {
+			return nil, err
+		}
+		if base, err = readLocalObject(localDir, hex.EncodeToString(baseSha)); err != nil {
+			return nil, err
+		}
+	case OBJECT_COMMIT, OBJECT_TREE, OBJECT_BLOB, OBJECT_TAG:
+	default:
+		return nil, fmt.Errorf("%s: invalid object type %d at offset %d", p.Path, objType, offset)
+	}
+	data, err := decompressObject(reader)
+	if err != nil {
+		return nil, err
+	}
+	obj := &Object{Type: objType, Buf: data.Bytes()}
+	if base != nil {
+		undeltified, err := readDeltified(data, base)
+		if err != nil {
+			return nil, err
+		}
+		obj = &Object{Type: base.Type, Buf: undeltified.Bytes()}
+	} else if len(obj.Buf) != objLen {
+		return nil, fmt.Errorf("%s: object at offset %d: expected length %d, got %d", p.Path, offset, objLen, len(obj.Buf))
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.cache) >= packCacheSize {
+		p.cache = make(map[int64]*Object)
+	}
+	p.cache[offset] = obj
+	return obj, nil
+}
+
+func (p *packFile) cached(offset int64) *Object {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.cache[offset]
+}
+
+func (p *packFile) open() (*os.File, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.file == nil {
+		file, err := os.Open(p.Path)
+		if err != nil {
+			return nil, err
+		}
+		p.file = file
+	}
+	return p.file, nil
+}
+
+var errNotPacked = errors.New("object not in any pack")
+
+// Read an object from whichever pack has it, including those of alternates.
+func readPackedObject(localDir, sha string) (*Object, error) {
+	raw, err := hex.DecodeString(sha)
+	if err != nil || len(raw) != 20 {
+		return nil, fmt.Errorf("invalid object name: %s", sha)
+	}
+	packs, err := allPacks(localDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, pack := range packs {
+		if i, ok := pack.find(raw); ok {
+			return pack.readAt(localDir, pack.offset(i))
+		}
+	}
+	return nil, errNotPacked
+}
+
+// Report whether any pack, including those of alternates, has an object.
+func isPacked(localDir, sha string) bool {
+	packs, _ := allPacks(localDir)
+	return packsContain(packs, sha)
+}
+
+func packsContain(packs []*packFile, sha string) bool {
+	raw, err := hex.DecodeString(sha)
+	if err != nil || len(raw) != 20 {
+		return false
+	}
+	for _, pack := range packs {
+		if _, ok := pack.find(raw); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Packed objects whose sha starts with a hex prefix of at least two digits.
+func packedObjectsWithPrefix(localDir, prefix string) ([]string, error) {
+	first, err := hex.DecodeString(prefix[:2])
+	if err != nil {
+		return nil, err
+	}
+	packs, err := allPacks(localDir)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, pack := range packs {
+		start, end := pack.fanout(first[0])
+		for i := start; i < end; i++ {
+			if sha := hex.EncodeToString(pack.sha(i)); strings.HasPrefix(sha, prefix) {
+				matches = append(matches, sha)
+			}
+		}
+	}
+	return matches, nil
+}
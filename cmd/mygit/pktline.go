@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Largest payload a single pkt-line can carry.
+const maxPktPayload = 65516
+
+// Read one pkt-line from a stream. A flush packet ("0000") returns nil data
+// and flush=true.
+func readPkt(r io.Reader) (data []byte, flush bool, err error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, false, err
+	}
+	length, err := strconv.ParseUint(string(header[:]), 16, 16)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid pkt-line length %q", header[:])
+	}
+	switch {
+	case length == 0:
+		return nil, true, nil
+	case length < 4:
+		// Delimiter and response-end packets carry no data either.
+		return nil, false, nil
+	}
+	data = make([]byte, length-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, false, err
+	}
+	return data, false, nil
+}
+
+// Read text pkt-lines up to the next flush, without trailing newlines.
+func readPktLines(r io.Reader) ([]string, error) {
+	var lines []string
+	for {
+		data, flush, err := readPkt(r)
+		if err != nil {
+			return nil, err
+		}
+		if flush {
+			return lines, nil
+		}
+		lines = append(lines, trimNewline(string(data)))
+	}
+}
+
+func trimNewline(line string) string {
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		return line[:len(line)-1]
+	}
+	return line
+}
+
+func writePkt(w io.Writer, data []byte) error {
+	if _, err := fmt.Fprintf(w, "%04x", len(data)+4); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Write text lines as pkt-lines, each terminated by a newline, then a flush.
+func writePktLines(w io.Writer, lines ...string) error {
+	for _, line := range lines {
+		if err := writePkt(w, []byte(line+"\n")); err != nil {
+			return err
+		}
+	}
+	return writeFlush(w)
+}
+
+func writeFlush(w io.Writer) error {
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+// End a section of a v2 message.
+func writeDelim(w io.Writer) error {
+	_, err := io.WriteString(w, "0001")
+	return err
+}
+
+// Send content split into pkt-lines, followed by a flush.
+func writePktData(w io.Writer, content []byte) error {
+	for len(content) > 0 {
+		n := len(content)
+		if n > maxPktPayload {
+			n = maxPktPayload
+		}
+		if err := writePkt(w, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return writeFlush(w)
+}
+
+// Receive content sent as pkt-lines up to a flush.
+func readPktData(r io.Reader) ([]byte, error) {
+	var content []byte
+	for {
+		data, flush, err := readPkt(r)
+		if err != nil {
+			return nil, err
+		}
+		if flush {
+			return content, nil
+		}
+		content = append(content, data...)
+	}
+}
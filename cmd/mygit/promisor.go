@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A filter-spec choosing the objects a partial clone goes without. Objects
+// asked for by name are sent whatever the filter says. The zero value
+// filters nothing.
+// ref: https://git-scm.com/docs/rev-list-options#Documentation/rev-list-options.txt---filterltfilter-specgt
+type objectFilter struct {
+	Spec      string // as sent to the server, "" for no filter
+	BlobLimit int64  // leave out blobs of at least this many bytes, -1 for none
+	TreeDepth int    // leave out trees and blobs this deep below the root, -1 for none
+}
+
+var noFilter = objectFilter{BlobLimit: -1, TreeDepth: -1}
+
+// Parse blob:none, blob:limit=<n>[kmg] or tree:<depth>. Sizes are spelled
+// out in bytes in the spec sent on, as git does.
+func parseFilterSpec(spec string) (objectFilter, error) {
+	f := noFilter
+	switch {
+	case spec == "blob:none":
+		f.BlobLimit = 0
+	case strings.HasPrefix(spec, "blob:limit="):
+		limit, ok := parseSize(strings.TrimPrefix(spec, "blob:limit="))
+		if !ok {
+			return noFilter, fmt.Errorf("invalid filter-spec '%s'", spec)
+		}
+		f.BlobLimit = limit
+		spec = "blob:limit=" + strconv.FormatInt(limit, 10)
+	case strings.HasPrefix(spec, "tree:"):
+		depth, err := strconv.Atoi(strings.TrimPrefix(spec, "tree:"))
+		if err != nil || depth < 0 {
+			return noFilter, errors.New("expected 'tree:<depth>'")
+		}
+		f.TreeDepth = depth
+	default:
+		return noFilter, fmt.Errorf("invalid filter-spec '%s'", spec)
+	}
+	f.Spec = spec
+	return f, nil
+}
+
+// Parse a size with an optional k, m or g suffix.
+func parseSize(value string) (int64, bool) {
+	scale := int64(1)
+	if n := len(value); n > 0 {
+		switch strings.ToLower(value[n-1:]) {
+		case "k":
+			scale = 1 << 10
+		case "m":
+			scale = 1 << 20
+		case "g":
+			scale = 1 << 30
+		}
+		if scale > 1 {
+			value = value[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size * scale, true
+}
+
+// Whether a tree at a path, "" being the root, is left out with all below it.
+func (f objectFilter) omitsTree(name string) bool {
+	return f.Spec != "" && f.TreeDepth >= 0 && pathDepth(name) >= f.TreeDepth
+}
+
+// Whether the blob at a path is left out. Only a size limit needs the blob
+// read.
+func (f objectFilter) omitsBlob(localDir, sha, name string) bool {
+	switch {
+	case f.Spec == "":
+		return false
+	case f.TreeDepth >= 0 && pathDepth(name) >= f.TreeDepth:
+		return true
+	case f.BlobLimit < 0:
+		return false
+	case f.BlobLimit == 0:
+		return true
+	}
+	content, err := CatFile(localDir, sha)
+	return err == nil && int64(len(content)) >= f.BlobLimit
+}
+
+func pathDepth(name string) int {
+	if name == "" {
+		return 0
+	}
+	return strings.Count(name, "/") + 1
+}
+
+// The remote that promises the objects a partial clone lacks, named by
+// extensions.partialClone as clone sets it up.
+// ref: https://git-scm.com/docs/partial-clone
+func promisorRemote(localDir string) (string, bool) {
+	name, ok := configValue(localDir, "extensions.partialClone")
+	return name, ok && name != ""
+}
+
+func isPartialClone(localDir string) bool {
+	_, ok := promisorRemote(localDir)
+	return ok
+}
+
+// The filter a fetch from a promisor remote keeps using.
+func remoteFilter(localDir, remoteName string) (objectFilter, error) {
+	spec, ok := configValue(localDir, "remote."+remoteName+".partialCloneFilter")
+	if !ok || !configBool(localDir, "remote."+remoteName+".promisor") {
+		return noFilter, nil
+	}
+	return parseFilterSpec(spec)
+}
+
+// Missing objects are fetched from the promisor remote one batch at a time;
+// objects it failed to send are not asked for again.
+var (
+	lazyFetchLock   sync.Mutex
+	lazyFetching    bool
+	lazyFetchFailed = make(map[string]bool)
+)
+
+// Fetch a missing object a partial clone was promised, reporting whether
+// it is now there. Objects needed during a lazy fetch are not fetched in
+// turn.
+func fetchMissingObject(localDir, sha string) bool {
+	if !isPartialClone(localDir) {
+		return false
+	}
+	return fetchPromisedObjects(localDir, []string{sha}) == nil && hasObject(localDir, sha)
+}
+
+// Fetch objects from the promisor remote as git does, by name and with
+// blob:none so that a tree does not bring every blob below it.
+func fetchPromisedObjects(localDir string, shas []string) error {
+	lazyFetchLock.Lock()
+	if lazyFetching {
+		lazyFetchLock.Unlock()
+		return errors.New("objects are already being fetched")
+	}
+	var wants []string
+	for _, sha := range shas {
+		if !lazyFetchFailed[sha] {
+			wants = append(wants, sha)
+		}
+	}
+	lazyFetching = len(wants) > 0
+	lazyFetchLock.Unlock()
+	if len(wants) == 0 {
+		return fmt.Errorf("could not fetch %s from promisor remote", shas[0])
+	}
+	err := lazyFetch(localDir, wants)
+	lazyFetchLock.Lock()
+	defer lazyFetchLock.Unlock()
+	lazyFetching = false
+	for _, sha := range wants {
+		if err != nil || !hasObject(localDir, sha) {
+			lazyFetchFailed[sha] = true
+		}
+	}
+	return err
+}
+
+func lazyFetch(localDir string, wants []string) error {
+	name, ok := promisorRemote(localDir)
+	if !ok {
+		return errors.New("no promisor remote")
+	}
+	url, _, err := remoteURL(localDir, name)
+	if err != nil {
+		return err
+	}
+	remote, err := connectRemote(localDir, url)
+	if err != nil {
+		return err
+	}
+	defer remote.close()
+	remote.Filter, _ = parseFilterSpec("blob:none")
+	if !remote.fetchSupports("filter") {
+		remote.Filter = objectFilter{}
+	}
+	pack, err := remote.fetchPack(wants, nil)
+	if err != nil {
+		return fmt.Errorf("could not fetch %s from promisor remote: %v", wants[0], err)
+	}
+	defer pack.Close()
+	_, err = indexPack(localDir, pack, indexPackOptions{Promisor: true, Progress: progressEnabled()})
+	return err
+}
+
+// Fetch in one go the missing blobs of files about to be checked out,
+// rather than one at a time as each is read.
+func prefetchFiles(localDir string, files map[string]treeFile) error {
+	if !isPartialClone(localDir) {
+		return nil
+	}
+	missing := make(map[string]bool)
+	for _, file := range files {
+		if file.Mode != "160000" && !missing[file.Sha] && !hasObject(localDir, file.Sha) {
+			missing[file.Sha] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fetchPromisedObjects(localDir, sortedKeys(missing))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFilterSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want objectFilter
+	}{
+		{"blob:none", objectFilter{Spec: "blob:none", BlobLimit: 0, TreeDepth: -1}},
+		{"blob:limit=100", objectFilter{Spec: "blob:limit=100", BlobLimit: 100, TreeDepth: -1}},
+		{"blob:limit=2k", objectFilter{Spec: "blob:limit=2048", BlobLimit: 2048, TreeDepth: -1}},
+		{"blob:limit=1M", objectFilter{Spec: "blob:limit=1048576", BlobLimit: 1 << 20, TreeDepth: -1}},
+		{"tree:0", objectFilter{Spec: "tree:0", BlobLimit: -1, TreeDepth: 0}},
+		{"tree:2", objectFilter{Spec: "tree:2", BlobLimit: -1, TreeDepth: 2}},
+	}
+	for _, tt := range tests {
+		if got, err := parseFilterSpec(tt.spec); err != nil || got != tt.want {
+			t.Errorf("parseFilterSpec(%q) = %+v, %v; want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "blob", "blob:limit=", "blob:limit=x", "blob:limit=-1", "tree:", "tree:-1", "sparse:oid=x"} {
+		if _, err := parseFilterSpec(bad); err == nil {
+			t.Errorf("parsed %q", bad)
+		}
+	}
+}
+
+// An upstream with a small and a large file at the top, one further down,
+// and an older version of each, served in the protocol version the clients
+// are configured for.
+func partialUpstream(t *testing.T, version string) (upstream, url string, blobs map[string]string) {
+	t.Helper()
+	root, upstream := bareRepo(t)
+	files := map[string]string{
+		"small.txt":        "small\n",
+		"large.txt":        numberedLines(100),
+		"dir/sub/deep.txt": "deep\n",
+	}
+	first := commitFiles(t, upstream, "", "first", map[string]string{"small.txt": "old small\n", "large.txt": "old large\n", "dir/sub/deep.txt": "old deep\n"})
+	tip := commitFiles(t, upstream, first, "second", files)
+	if err := writeRef(upstream, "refs/heads/master", tip); err != nil {
+		t.Fatal(err)
+	}
+	blobs = make(map[string]string)
+	for name, file := range treeFiles(t, upstream, tip) {
+		blobs[name] = file.Sha
+	}
+	for name, file := range treeFiles(t, upstream, first) {
+		blobs["old "+name] = file.Sha
+	}
+	if err := os.WriteFile(filepath.Join(os.Getenv("HOME"), ".gitconfig"), []byte("[protocol]\n\tversion = "+version+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base, _ := serveRepos(t, root)
+	return upstream, base + "/upstream.git", blobs
+}
+
+func promisorPacks(t *testing.T, dir string) int {
+	t.Helper()
+	markers, err := filepath.Glob(filepath.Join(packDir(dir), "*.promisor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(markers)
+}
+
+func TestPartialClone(t *testing.T) {
+	for _, version := range []string{"2", "0"} {
+		upstream, url, blobs := partialUpstream(t, version)
+		filter, _ := parseFilterSpec("blob:none")
+		dir := filepath.Join(t.TempDir(), "clone")
+		if err := Clone(url, dir, cloneOptions{Filter: filter, NoCheckout: true}); err != nil {
+			t.Fatalf("protocol %s: %v", version, err)
+		}
+		for name, want := range map[string]string{
+			"remote.origin.promisor":           "true",
+			"remote.origin.partialclonefilter": "blob:none",
+			"core.repositoryformatversion":     "1",
+			"extensions.partialclone":          "origin",
+		} {
+			if got, _ := configValue(dir, name); got != want {
+				t.Errorf("protocol %s: %s is %q, want %q", version, name, got, want)
+			}
+		}
+		if n := promisorPacks(t, dir); n != 1 || len(packFiles(t, dir)) != 1 {
+			t.Errorf("protocol %s: %d promisor packs of %d", version, n, len(packFiles(t, dir)))
+		}
+		for name, sha := range blobs {
+			if hasObject(dir, sha) {
+				t.Errorf("protocol %s: blob:none fetched %s", version, name)
+			}
+		}
+		if ok, output := runFsck(t, dir, false); !ok || output != "" {
+			t.Errorf("protocol %s: fsck of a partial clone: %v\n%s", version, ok, output)
+		}
+		runGit(t, dir, "fsck", "--strict")
+
+		// A missing blob is fetched when read, into a promisor pack of its own.
+		content, err := CatFile(dir, blobs["old small.txt"])
+		if err != nil || string(content) != "old small\n" {
+			t.Errorf("protocol %s: lazily fetched %q: %v", version, content, err)
+		}
+		if n := promisorPacks(t, dir); n != 2 {
+			t.Errorf("protocol %s: %d promisor packs after a lazy fetch", version, n)
+		}
+		if hasObject(dir, blobs["old large.txt"]) {
+			t.Errorf("protocol %s: a lazy fetch brought more than was asked for", version)
+		}
+
+		// A checkout fetches what the work tree needs, and no more.
+		checkout := filepath.Join(t.TempDir(), "checkout")
+		if err := Clone(url, checkout, cloneOptions{Filter: filter}); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestFile(t, checkout, "dir/sub/deep.txt"); got != "deep\n" {
+			t.Errorf("protocol %s: checked out %q", version, got)
+		}
+		if !hasObject(checkout, blobs["large.txt"]) || hasObject(checkout, blobs["old large.txt"]) {
+			t.Errorf("protocol %s: checkout fetched the wrong blobs", version)
+		}
+
+		// Later fetches keep to the filter.
+		next := commitFiles(t, upstream, mustRevParse(t, upstream, "master"), "next", map[string]string{"next.txt": "next\n"})
+		if err := writeRef(upstream, "refs/heads/master", next); err != nil {
+			t.Fatal(err)
+		}
+		if err := Fetch(dir, "origin", nil, fetchOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		checkRef(t, dir, "refs/remotes/origin/master", next)
+		if hasObject(dir, treeFiles(t, upstream, next)["next.txt"].Sha) {
+			t.Errorf("protocol %s: a fetch ignored the partial clone filter", version)
+		}
+		runGit(t, dir, "fsck", "--strict")
+	}
+}
+
+func TestPartialCloneFilters(t *testing.T) {
+	_, url, blobs := partialUpstream(t, "2")
+	tests := []struct {
+		spec    string
+		missing []string
+	}{
+		{"blob:limit=1k", []string{"large.txt"}},
+		{"tree:2", []string{"dir/sub/deep.txt", "old dir/sub/deep.txt"}},
+	}
+	for _, tt := range tests {
+		filter, err := parseFilterSpec(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := filepath.Join(t.TempDir(), "clone")
+		if err := Clone(url, dir, cloneOptions{Filter: filter, NoCheckout: true}); err != nil {
+			t.Fatalf("%s: %v", tt.spec, err)
+		}
+		missing := make(map[string]bool)
+		for _, name := range tt.missing {
+			missing[name] = true
+		}
+		for name, sha := range blobs {
+			if hasObject(dir, sha) == missing[name] {
+				t.Errorf("%s: has %s is %v", tt.spec, name, !missing[name])
+			}
+		}
+		if ok, output := runFsck(t, dir, false); !ok || output != "" {
+			t.Errorf("%s: fsck of a partial clone: %v\n%s", tt.spec, ok, output)
+		}
+		if got := runGit(t, dir, "show", "HEAD:"+strings.TrimPrefix(tt.missing[0], "old ")); got == "" {
+			t.Errorf("%s: git could not fetch what was left out", tt.spec)
+		}
+	}
+}
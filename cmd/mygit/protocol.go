@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Identifies us to servers that advertise the agent capability.
+const agentName = "mygit/1.0"
+
+// A ref as advertised by a remote.
+type remoteRef struct {
+	Name   string
+	Sha    string
+	Symref string // target of a symbolic ref such as HEAD
+	Peeled string // commit an annotated tag points at
+}
+
+// A remote repository spoken to over the smart protocol, whatever the
+// transport. Protocol v2 is requested and the server's answer decides which
+// version is used.
+// ref: https://git-scm.com/docs/pack-protocol
+// ref: https://git-scm.com/docs/protocol-v2
+type gitRemote struct {
+	URL          string
+	Transport    transport
+	Version      int
+	Capabilities map[string]string // v2 server capabilities, or v0/v1 ones from the first ref
+	Refs         []remoteRef       // advertised refs, v0/v1 only
+
+	Shallow    []string      // our shallow commits, sent with every fetch
+	Deepen     deepenOptions // how far to deepen history
+	NewShallow []string      // commits the server made shallow
+	Unshallow  []string      // commits whose parents the server is sending
+	Filter     objectFilter  // objects to go without in a partial clone
+	FollowTags bool          // have tags pointing into the pack sent along with it
+
+	sentWants bool          // whether a stateful conversation is past the want list
+	pending   io.ReadCloser // a v2 response to a round that ended ready, up to its pack
+}
+
+// Connect to a repository to fetch from, asking for protocol v2 unless
+// protocol.version says otherwise.
+func connectRemote(localDir, url string) (*gitRemote, error) {
+	return connectService(localDir, url, "git-upload-pack")
+}
+
+// Read the ref advertisement of a service. Only git-upload-pack speaks
+// protocol v2; git-receive-pack always answers in v0. The remote must be
+// closed once done with.
+func connectService(localDir, url, service string) (*gitRemote, error) {
+	t, err := newTransport(localDir, url)
+	if err != nil {
+		return nil, err
+	}
+	remote := &gitRemote{URL: url, Transport: t, Capabilities: make(map[string]string)}
+	wantVersion := 2
+	if version, ok := configValue(localDir, "protocol.version"); (ok && version != "2") || service != "git-upload-pack" {
+		wantVersion = 0
+	}
+	body, err := t.advertise(service, wantVersion)
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	defer body.Close()
+	if err := remote.readAdvertisement(bufio.NewReader(body)); err != nil {
+		t.close()
+		return nil, fmt.Errorf("reading ref advertisement from '%s': %v", anonymizeURL(url), err)
+	}
+	return remote, nil
+}
+
+func (r *gitRemote) close() error {
+	return r.Transport.close()
+}
+
+func (r *gitRemote) readAdvertisement(body io.Reader) error {
+	line, err := readAdvertisementLine(body)
+	if err != nil {
+		return err
+	}
+	// v0/v1 answers start with a service announcement, v2 ones may not.
+	if strings.HasPrefix(line, "# service=") {
+		if _, err := readPktLines(body); err != nil {
+			return err
+		}
+		if line, err = readAdvertisementLine(body); err != nil {
+			return err
+		}
+	}
+	switch line {
+	case "version 2":
+		r.Version = 2
+		lines, err := readPktLines(body)
+		if err != nil {
+			return err
+		}
+		for _, capability := range lines {
+			key, value, _ := strings.Cut(capability, "=")
+			r.Capabilities[key] = value
+		}
+		return nil
+	case "version 1":
+		r.Version = 1
+		if line, err = readAdvertisementLine(body); err != nil {
+			return err
+		}
+	}
+	// An empty repository sends no refs at all.
+	for line != "" {
+		ref, capabilities, hasCapabilities := strings.Cut(line, "\x00")
+		if hasCapabilities {
+			r.parseV0Capabilities(capabilities)
+		}
+		sha, name, ok := strings.Cut(ref, " ")
+		if !ok {
+			return fmt.Errorf("malformed ref line %q", line)
+		}
+		switch {
+		case name == "capabilities^{}":
+		case strings.HasSuffix(name, "^{}") && len(r.Refs) > 0:
+			r.Refs[len(r.Refs)-1].Peeled = sha
+		default:
+			r.Refs = append(r.Refs, remoteRef{Name: name, Sha: sha, Symref: r.symrefTarget(name)})
+		}
+		if line, err = readAdvertisementLine(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read a text pkt-line, returning "" at a flush.
+func readAdvertisementLine(r io.Reader) (string, error) {
+	data, _, err := readPkt(r)
+	if err != nil {
+		return "", err
+	}
+	line := trimNewline(string(data))
+	if msg, ok := cutPrefix(line, "ERR "); ok {
+		return "", fmt.Errorf("remote error: %s", msg)
+	}
+	return line, nil
+}
+
+func (r *gitRemote) parseV0Capabilities(capabilities string) {
+	for _, capability := range strings.Fields(capabilities) {
+		key, value, _ := strings.Cut(capability, "=")
+		if key == "symref" {
+			// There can be several symref capabilities; keep them all.
+			if prev, ok := r.Capabilities[key]; ok {
+				value = prev + " " + value
+			}
+		}
+		r.Capabilities[key] = value
+	}
+}
+
+func (r *gitRemote) symrefTarget(name string) string {
+	for _, symref := range strings.Fields(r.Capabilities["symref"]) {
+		if source, target, ok := strings.Cut(symref, ":"); ok && source == name {
+			return target
+		}
+	}
+	return ""
+}
+
+// Send a request to git-upload-pack and return the response.
+func (r *gitRemote) uploadPack(body []byte) (io.ReadCloser, error) {
+	return r.Transport.request("git-upload-pack", r.Version, body)
+}
+
+// Send ref update commands and a pack to git-receive-pack.
+func (r *gitRemote) receivePack(body []byte) (io.ReadCloser, error) {
+	return r.Transport.request("git-receive-pack", r.Version, body)
+}
+
+// Build a v2 command request: the command and capabilities, a delimiter,
+// then the arguments.
+func (r *gitRemote) commandRequest(command string, args []string) []byte {
+	var buf bytes.Buffer
+	writePkt(&buf, []byte("command="+command+"\n"))
+	if _, ok := r.Capabilities["agent"]; ok {
+		writePkt(&buf, []byte("agent="+agentName+"\n"))
+	}
+	if format, ok := r.Capabilities["object-format"]; ok {
+		writePkt(&buf, []byte("object-format="+format+"\n"))
+	}
+	writeDelim(&buf)
+	for _, arg := range args {
+		writePkt(&buf, []byte(arg+"\n"))
+	}
+	writeFlush(&buf)
+	return buf.Bytes()
+}
+
+// List the remote's refs that start with one of the prefixes, or all refs
+// when there are none.
+func (r *gitRemote) listRefs(prefixes []string) ([]remoteRef, error) {
+	if r.Version != 2 {
+		return filterRefs(r.Refs, prefixes), nil
+	}
+
+	if _, ok := r.Capabilities["ls-refs"]; !ok {
+		return nil, errors.New("server does not support ls-refs")
+	}
+	args := []string{"symrefs", "peel"}
+	for _, prefix := range prefixes {
+		args = append(args, "ref-prefix "+prefix)
+	}
+	body, err := r.uploadPack(r.commandRequest("ls-refs", args))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	lines, err := readPktLines(bufio.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	var refs []remoteRef
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("malformed ls-refs line %q", line)
+		}
+		ref := remoteRef{Sha: fields[0], Name: fields[1]}
+		for _, attr := range fields[2:] {
+			if target, ok := cutPrefix(attr, "symref-target:"); ok {
+				ref.Symref = target
+			} else if peeled, ok := cutPrefix(attr, "peeled:"); ok {
+				ref.Peeled = peeled
+			}
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+func filterRefs(refs []remoteRef, prefixes []string) []remoteRef {
+	var filtered []remoteRef
+	for _, ref := range refs {
+		if hasAnyPrefix(ref.Name, prefixes) {
+			filtered = append(filtered, ref)
+		}
+	}
+	return filtered
+}
+
+func hasAnyPrefix(name string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// A pack being received; closing it releases the connection.
+type packStream struct {
+	io.Reader
+	body io.Closer
+}
+
+func (p *packStream) Close() error {
+	return p.body.Close()
+}
+
+// Ask for a pack holding wants and everything they need that haves lack.
+// Remote progress messages are shown on stderr when it is a terminal.
+func (r *gitRemote) fetchPack(wants, haves []string) (io.ReadCloser, error) {
+	if len(wants) == 0 {
+		return nil, errors.New("nothing to fetch")
+	}
+	if r.pending != nil {
+		body := r.pending
+		r.pending = nil
+		return r.readFetchResponse(body)
+	}
+	if r.Version == 2 {
+		return r.fetchPackV2(wants, haves)
+	}
+	return r.fetchPackV0(wants, haves)
+}
+
+func (r *gitRemote) fetchPackV2(wants, haves []string) (io.ReadCloser, error) {
+	if _, ok := r.Capabilities["fetch"]; !ok {
+		return nil, errors.New("server does not support fetch")
+	}
+	args := append(r.fetchArgs(wants, haves), "done")
+	body, err := r.uploadPack(r.commandRequest("fetch", args))
+	if err != nil {
+		return nil, err
+	}
+	return r.readFetchResponse(body)
+}
+
+// Whether the server can do something for a fetch: a v0 capability, or in
+// protocol v2 a feature of the fetch command.
+func (r *gitRemote) fetchSupports(feature string) bool {
+	if r.Version != 2 {
+		_, ok := r.Capabilities[feature]
+		return ok
+	}
+	for _, supported := range strings.Fields(r.Capabilities["fetch"]) {
+		if supported == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Arguments of a v2 fetch command, which in a negotiation round must ask for
+// the same pack as the final request would.
+func (r *gitRemote) fetchArgs(wants, haves []string) []string {
+	args := []string{"thin-pack", "ofs-delta"}
+	if !progressEnabled() {
+		args = append(args, "no-progress")
+	}
+	if r.FollowTags {
+		args = append(args, "include-tag")
+	}
+	for _, sha := range wants {
+		args = append(args, "want "+sha)
+	}
+	args = append(args, r.shallowLines()...)
+	if r.Filter.Spec != "" {
+		args = append(args, "filter "+r.Filter.Spec)
+	}
+	for _, sha := range haves {
+		args = append(args, "have "+sha)
+	}
+	return args
+}
+
+func (r *gitRemote) readFetchResponse(body io.ReadCloser) (io.ReadCloser, error) {
+	reader := bufio.NewReader(body)
+
+	// The response is a series of sections, each introduced by its name and
+	// ended by a delimiter, the last one being the packfile. The packfile
+	// section is always multiplexed.
+	for {
+		header, err := readAdvertisementLine(reader)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		switch header {
+		case "packfile":
+			return &packStream{Reader: newSideBandReader(reader, os.Stderr), body: body}, nil
+		case "shallow-info":
+			err = r.readShallowSection(reader, false)
+		case "acknowledgments", "wanted-refs", "packfile-uris":
+			err = skipSection(reader)
+		case "":
+			err = errors.New("server sent no packfile")
+		default:
+			err = fmt.Errorf("unexpected section %q in fetch response", header)
+		}
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+	}
+}
+
+// Skip the lines of a response section up to its delimiter.
+func skipSection(r io.Reader) error {
+	for {
+		data, flush, err := readPkt(r)
+		if err != nil {
+			return err
+		}
+		if flush {
+			return errors.New("unexpected flush in fetch response")
+		}
+		if data == nil {
+			return nil
+		}
+	}
+}
+
+// Read the shallow and unshallow lines telling where our history now ends,
+// up to a flush in v0 or the section delimiter in v2.
+func (r *gitRemote) readShallowSection(reader io.Reader, v0 bool) error {
+	r.NewShallow, r.Unshallow = nil, nil
+	for {
+		data, flush, err := readPkt(reader)
+		if err != nil {
+			return err
+		}
+		if flush || data == nil {
+			if flush != v0 {
+				return errors.New("unexpected end of shallow section")
+			}
+			return nil
+		}
+		line := trimNewline(string(data))
+		if strings.HasPrefix(line, "ERR ") {
+			return fmt.Errorf("remote error: %s", strings.TrimPrefix(line, "ERR "))
+		}
+		if !r.readShallowLine(line) {
+			return fmt.Errorf("expected shallow/unshallow, got %q", line)
+		}
+	}
+}
+
+// Capabilities to request in a v0/v1 want list, limited to those the server
+// offered.
+func (r *gitRemote) v0Capabilities() []string {
+	var capabilities []string
+	for _, capability := range []string{"multi_ack_detailed", "side-band-64k", "thin-pack", "ofs-delta"} {
+		if _, ok := r.Capabilities[capability]; ok {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	if _, ok := r.Capabilities["no-progress"]; ok && !progressEnabled() {
+		capabilities = append(capabilities, "no-progress")
+	}
+	if _, ok := r.Capabilities["include-tag"]; ok && r.FollowTags {
+		capabilities = append(capabilities, "include-tag")
+	}
+	if r.Deepen.Since != 0 {
+		capabilities = append(capabilities, "deepen-since")
+	}
+	if len(r.Deepen.Not) > 0 {
+		capabilities = append(capabilities, "deepen-not")
+	}
+	if r.Deepen.Relative {
+		capabilities = append(capabilities, "deepen-relative")
+	}
+	if r.Filter.Spec != "" {
+		capabilities = append(capabilities, "filter")
+	}
+	if _, ok := r.Capabilities["agent"]; ok {
+		capabilities = append(capabilities, "agent="+agentName)
+	}
+	return capabilities
+}
+
+// Write want lines, the first carrying the capabilities, and our shallow
+// boundary, then haves. A stateful conversation sends the wants only once;
+// the result tells whether they went out, since the server then answers
+// with the new boundary first when deepening.
+func (r *gitRemote) writeV0Request(buf *bytes.Buffer, wants, haves []string) bool {
+	sent := false
+	if r.Transport.stateless() || !r.sentWants {
+		capabilities := r.v0Capabilities()
+		for i, sha := range wants {
+			line := "want " + sha
+			if i == 0 && len(capabilities) > 0 {
+				line += " " + strings.Join(capabilities, " ")
+			}
+			writePkt(buf, []byte(line+"\n"))
+		}
+		for _, line := range r.shallowLines() {
+			writePkt(buf, []byte(line+"\n"))
+		}
+		if r.Filter.Spec != "" {
+			writePkt(buf, []byte("filter "+r.Filter.Spec+"\n"))
+		}
+		writeFlush(buf)
+		r.sentWants, sent = true, true
+	}
+	for _, sha := range haves {
+		writePkt(buf, []byte("have "+sha+"\n"))
+	}
+	return sent && r.Deepen.requested()
+}
+
+func (r *gitRemote) fetchPackV0(wants, haves []string) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	deepen := r.writeV0Request(&buf, wants, haves)
+	writePkt(&buf, []byte("done\n"))
+
+	body, err := r.uploadPack(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(body)
+	if deepen {
+		if err := r.readShallowSection(reader, true); err != nil {
+			body.Close()
+			return nil, err
+		}
+	}
+	// The server acknowledges common commits again and ends with a final
+	// ACK or NAK before the pack.
+	for {
+		line, err := readAdvertisementLine(reader)
+		if err == nil && !strings.HasPrefix(line, "ACK ") && line != "NAK" {
+			err = fmt.Errorf("expected ACK/NAK, got %q", line)
+		}
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		if line == "NAK" || len(strings.Fields(line)) == 2 {
+			break
+		}
+	}
+	if _, ok := r.Capabilities["side-band-64k"]; ok {
+		return &packStream{Reader: newSideBandReader(reader, os.Stderr), body: body}, nil
+	}
+	return &packStream{Reader: reader, body: body}, nil
+}
+
+// Give up on finding more common commits after this many haves in a row
+// went unacknowledged.
+const maxHavesInVain = 256
+
+// Offer local commits in growing batches until the server has enough to
+// send a pack or we run out, and return the commits found to be in common.
+// ref: https://git-scm.com/docs/pack-protocol#_packfile_negotiation
+func (r *gitRemote) negotiate(wants []string, walker *haveWalker) ([]string, error) {
+	if _, ok := r.Capabilities["multi_ack_detailed"]; r.Version != 2 && !ok {
+		// Without it a stateless server cannot tell us what it has.
+		return nil, nil
+	}
+	var common []string
+	batch, inVain := 16, 0
+	for {
+		var round []string
+		for len(round) < batch {
+			sha, ok := walker.next()
+			if !ok {
+				break
+			}
+			round = append(round, sha)
+		}
+		if len(round) == 0 {
+			return common, nil
+		}
+		// Stateless servers forget everything between requests, so the
+		// common commits are sent again every round.
+		acks, ready, err := r.sendHaves(wants, append(append([]string{}, common...), round...))
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, sha := range acks {
+			if !walker.isCommon(sha) {
+				walker.markCommon(sha)
+				common = append(common, sha)
+				found = true
+			}
+		}
+		if ready {
+			return common, nil
+		}
+		if found {
+			inVain = 0
+		} else if len(common) > 0 {
+			if inVain += len(round); inVain >= maxHavesInVain {
+				return common, nil
+			}
+		}
+		if batch < 256 {
+			batch *= 2
+		}
+	}
+}
+
+// Send one negotiation round and return the acknowledged commits and whether
+// the server is ready to send the pack.
+func (r *gitRemote) sendHaves(wants, haves []string) ([]string, bool, error) {
+	var request []byte
+	deepen := false
+	if r.Version == 2 {
+		request = r.commandRequest("fetch", r.fetchArgs(wants, haves))
+	} else {
+		var buf bytes.Buffer
+		deepen = r.writeV0Request(&buf, wants, haves)
+		writeFlush(&buf)
+		request = buf.Bytes()
+	}
+	body, err := r.uploadPack(request)
+	if err != nil {
+		return nil, false, err
+	}
+	reader := bufio.NewReader(body)
+	fail := func(err error) ([]string, bool, error) {
+		body.Close()
+		return nil, false, err
+	}
+
+	if deepen {
+		if err := r.readShallowSection(reader, true); err != nil {
+			return fail(err)
+		}
+	}
+	if r.Version == 2 {
+		if header, err := readAdvertisementLine(reader); err != nil || header != "acknowledgments" {
+			if err == nil {
+				err = fmt.Errorf("expected acknowledgments, got %q", header)
+			}
+			return fail(err)
+		}
+	}
+	var acks []string
+	ready := false
+	for {
+		data, flush, err := readPkt(reader)
+		if err != nil {
+			return fail(err)
+		}
+		// v2 ends the section with a flush, or a delimiter when the pack
+		// follows, which is kept for fetchPack; v0 ends the round with NAK.
+		if flush || data == nil {
+			if data == nil && !flush {
+				r.pending = &packStream{Reader: reader, body: body}
+			} else {
+				body.Close()
+			}
+			return acks, ready, nil
+		}
+		fields := strings.Fields(trimNewline(string(data)))
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "ready":
+			ready = true
+		case fields[0] == "NAK":
+			if r.Version != 2 {
+				body.Close()
+				return acks, ready, nil
+			}
+		case fields[0] == "ACK" && len(fields) >= 2:
+			acks = append(acks, fields[1])
+			if len(fields) == 3 && fields[2] == "ready" {
+				ready = true
+			}
+		case fields[0] == "ERR":
+			return fail(fmt.Errorf("remote error: %s", strings.Join(fields[1:], " ")))
+		}
+	}
+}
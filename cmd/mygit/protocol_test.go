@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	mainSha = "1111111111111111111111111111111111111111"
+	tagSha  = "2222222222222222222222222222222222222222"
+	peelSha = "3333333333333333333333333333333333333333"
+)
+
+// Encode pkt-lines: "0000" is a flush, "0001" a delimiter and anything else
+// a line.
+func pktText(lines ...string) []byte {
+	var b bytes.Buffer
+	for _, line := range lines {
+		switch line {
+		case "0000":
+			writeFlush(&b)
+		case "0001":
+			writeDelim(&b)
+		default:
+			writePkt(&b, []byte(line+"\n"))
+		}
+	}
+	return b.Bytes()
+}
+
+// A scripted git-upload-pack behind smart HTTP, recording what it is asked.
+type fakeUploadPack struct {
+	advertisement []byte
+	respond       func(request []string) []byte
+
+	mu        sync.Mutex
+	protocols []string   // Git-Protocol headers, one per request
+	requests  [][]string // POSTed pkt-lines, delimiters as ""
+}
+
+func (f *fakeUploadPack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.protocols = append(f.protocols, r.Header.Get("Git-Protocol"))
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/info/refs":
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		w.Write(f.advertisement)
+	case r.Method == "POST" && r.URL.Path == "/git-upload-pack":
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+		var request []string
+		reader := bufio.NewReader(body)
+		for {
+			lines, err := readPktLines(reader)
+			if err != nil {
+				break
+			}
+			request = append(request, lines...)
+		}
+		f.requests = append(f.requests, request)
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		w.Write(f.respond(request))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func startFakeUploadPack(t *testing.T, f *fakeUploadPack) string {
+	t.Helper()
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func hasLine(lines []string, want string) bool {
+	for _, line := range lines {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
+
+var v2Advertisement = pktText("# service=git-upload-pack", "0000",
+	"version 2", "agent=git/2.39.5", "ls-refs=unborn", "fetch=shallow filter", "object-format=sha1", "0000")
+
+func TestLsRefsV2(t *testing.T) {
+	dir := newTestRepo(t)
+	refs := []string{
+		mainSha + " HEAD symref-target:refs/heads/main",
+		mainSha + " refs/heads/main",
+		tagSha + " refs/tags/v1 peeled:" + peelSha,
+	}
+	f := &fakeUploadPack{
+		advertisement: v2Advertisement,
+		respond: func(request []string) []byte {
+			var prefixes, lines []string
+			for _, line := range request {
+				if prefix, ok := cutPrefix(line, "ref-prefix "); ok {
+					prefixes = append(prefixes, prefix)
+				}
+			}
+			for _, ref := range refs {
+				if hasAnyPrefix(strings.Fields(ref)[1], prefixes) {
+					lines = append(lines, ref)
+				}
+			}
+			return pktText(append(lines, "0000")...)
+		},
+	}
+	remote, err := connectRemote(dir, startFakeUploadPack(t, f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.close()
+	if remote.Version != 2 || remote.Capabilities["fetch"] != "shallow filter" {
+		t.Fatalf("connected with version %d and capabilities %v", remote.Version, remote.Capabilities)
+	}
+
+	got, err := remote.listRefs([]string{"refs/tags/", "HEAD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []remoteRef{
+		{Name: "HEAD", Sha: mainSha, Symref: "refs/heads/main"},
+		{Name: "refs/tags/v1", Sha: tagSha, Peeled: peelSha},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("listed %+v, want %+v", got, want)
+	}
+
+	request := f.requests[0]
+	for _, line := range []string{"command=ls-refs", "agent=" + agentName, "object-format=sha1", "", "symrefs", "peel", "ref-prefix refs/tags/", "ref-prefix HEAD"} {
+		if !hasLine(request, line) {
+			t.Errorf("ls-refs request lacks %q: %q", line, request)
+		}
+	}
+	for i, protocol := range f.protocols {
+		if protocol != "version=2" {
+			t.Errorf("request %d sent Git-Protocol %q", i, protocol)
+		}
+	}
+}
+
+func TestFetchResponseSectionsV2(t *testing.T) {
+	dir := newTestRepo(t)
+	pack := []byte("PACK not really a pack")
+	var response bytes.Buffer
+	response.Write(pktText("acknowledgments", "ACK "+mainSha, "ready", "0001",
+		"shallow-info", "shallow "+tagSha, "unshallow "+peelSha, "0001",
+		"wanted-refs", mainSha+" refs/heads/main", "0001",
+		"packfile"))
+	writePkt(&response, append([]byte{2}, "Counting objects: 1, done.\n"...))
+	writePkt(&response, append([]byte{1}, pack[:4]...))
+	writePkt(&response, append([]byte{1}, pack[4:]...))
+	writeFlush(&response)
+
+	f := &fakeUploadPack{
+		advertisement: v2Advertisement,
+		respond:       func([]string) []byte { return response.Bytes() },
+	}
+	remote, err := connectRemote(dir, startFakeUploadPack(t, f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.close()
+	remote.Shallow = []string{peelSha}
+	remote.Deepen = deepenOptions{Depth: 2}
+
+	stream, err := remote.fetchPack([]string{mainSha}, []string{tagSha})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(stream)
+	stream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, pack) {
+		t.Errorf("read pack %q, want %q", got, pack)
+	}
+	if strings.Join(remote.NewShallow, " ") != tagSha || strings.Join(remote.Unshallow, " ") != peelSha {
+		t.Errorf("shallow %v, unshallow %v", remote.NewShallow, remote.Unshallow)
+	}
+
+	request := f.requests[0]
+	for _, line := range []string{"command=fetch", "thin-pack", "ofs-delta", "want " + mainSha, "have " + tagSha, "shallow " + peelSha, "deepen 2", "done"} {
+		if !hasLine(request, line) {
+			t.Errorf("fetch request lacks %q: %q", line, request)
+		}
+	}
+}
+
+func TestFetchResponseErrorsV2(t *testing.T) {
+	dir := newTestRepo(t)
+	tests := []struct {
+		name     string
+		response []byte
+		err      string
+	}{
+		{"no packfile", pktText("acknowledgments", "NAK", "0001", "0000"), "no packfile"},
+		{"unknown section", pktText("surprise", "0001"), "unexpected section"},
+		{"error line", pktText("ERR access denied"), "remote error: access denied"},
+		{"error in shallow-info", pktText("shallow-info", "ERR bad depth", "0001"), "remote error: bad depth"},
+	}
+	for _, tt := range tests {
+		response := tt.response
+		f := &fakeUploadPack{
+			advertisement: v2Advertisement,
+			respond:       func([]string) []byte { return response },
+		}
+		remote, err := connectRemote(dir, startFakeUploadPack(t, f))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := remote.fetchPack([]string{mainSha}, nil); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want an error with %q", tt.name, err, tt.err)
+		}
+		remote.close()
+	}
+
+	// A remote-side error in the pack stream ends it.
+	var response bytes.Buffer
+	response.Write(pktText("packfile"))
+	writePkt(&response, append([]byte{1}, "PACK"...))
+	writePkt(&response, append([]byte{3}, "out of memory"...))
+	f := &fakeUploadPack{
+		advertisement: v2Advertisement,
+		respond:       func([]string) []byte { return response.Bytes() },
+	}
+	remote, err := connectRemote(dir, startFakeUploadPack(t, f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.close()
+	stream, err := remote.fetchPack([]string{mainSha}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := io.ReadAll(stream); err == nil || !strings.Contains(err.Error(), "out of memory") {
+		t.Errorf("reading the pack gave %v", err)
+	}
+}
+
+func TestAdvertisementV0Fallback(t *testing.T) {
+	dir := newTestRepo(t)
+	refs := []string{
+		mainSha + " HEAD\x00multi_ack_detailed side-band-64k thin-pack ofs-delta symref=HEAD:refs/heads/main agent=git/2.39.5",
+		mainSha + " refs/heads/main",
+		tagSha + " refs/tags/v1",
+		peelSha + " refs/tags/v1^{}",
+		"0000",
+	}
+	wantRefs := []remoteRef{
+		{Name: "HEAD", Sha: mainSha, Symref: "refs/heads/main"},
+		{Name: "refs/heads/main", Sha: mainSha},
+		{Name: "refs/tags/v1", Sha: tagSha, Peeled: peelSha},
+	}
+	tests := []struct {
+		name          string
+		advertisement []byte
+		version       int
+	}{
+		{"v0 with a service line", pktText(append([]string{"# service=git-upload-pack", "0000"}, refs...)...), 0},
+		{"v0 without a service line", pktText(refs...), 0},
+		{"v1", pktText(append([]string{"# service=git-upload-pack", "0000", "version 1"}, refs...)...), 1},
+	}
+	for _, tt := range tests {
+		f := &fakeUploadPack{advertisement: tt.advertisement}
+		remote, err := connectRemote(dir, startFakeUploadPack(t, f))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if remote.Version != tt.version || len(remote.Refs) != len(wantRefs) {
+			t.Fatalf("%s: version %d with refs %+v", tt.name, remote.Version, remote.Refs)
+		}
+		for i, ref := range remote.Refs {
+			if ref != wantRefs[i] {
+				t.Errorf("%s: ref %d is %+v, want %+v", tt.name, i, ref, wantRefs[i])
+			}
+		}
+		if !remote.fetchSupports("side-band-64k") || remote.fetchSupports("filter") {
+			t.Errorf("%s: capabilities %v", tt.name, remote.Capabilities)
+		}
+		// Refs are filtered locally rather than asked for.
+		tags, err := remote.listRefs([]string{"refs/tags/"})
+		if err != nil || len(tags) != 1 || tags[0] != wantRefs[2] {
+			t.Errorf("%s: listed %+v, %v", tt.name, tags, err)
+		}
+		if len(f.requests) != 0 {
+			t.Errorf("%s: made %d requests for the ref list", tt.name, len(f.requests))
+		}
+		remote.close()
+	}
+
+	// An empty repository advertises only its capabilities.
+	f := &fakeUploadPack{advertisement: pktText("# service=git-upload-pack", "0000",
+		zeroSha+" capabilities^{}\x00multi_ack_detailed side-band-64k", "0000")}
+	remote, err := connectRemote(dir, startFakeUploadPack(t, f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remote.Refs) != 0 || !remote.fetchSupports("multi_ack_detailed") {
+		t.Errorf("empty repository gave refs %+v and capabilities %v", remote.Refs, remote.Capabilities)
+	}
+	remote.close()
+
+	// protocol.version=0 stops us asking for v2.
+	if err := setConfigValue(dir, "protocol.version", "0"); err != nil {
+		t.Fatal(err)
+	}
+	f = &fakeUploadPack{advertisement: pktText(refs...)}
+	if remote, err = connectRemote(dir, startFakeUploadPack(t, f)); err != nil {
+		t.Fatal(err)
+	}
+	remote.close()
+	if f.protocols[0] != "" {
+		t.Errorf("protocol.version=0 sent Git-Protocol %q", f.protocols[0])
+	}
+}
+
+func TestAdvertisementErrors(t *testing.T) {
+	dir := newTestRepo(t)
+	for _, advertisement := range [][]byte{
+		pktText("# service=git-upload-pack", "0000", "ERR repository not found"),
+		pktText(mainSha + "-no-space"),
+		[]byte("00"),
+	} {
+		f := &fakeUploadPack{advertisement: advertisement}
+		if remote, err := connectRemote(dir, startFakeUploadPack(t, f)); err == nil {
+			remote.close()
+			t.Errorf("connected despite advertisement %q", advertisement)
+		}
+	}
+}
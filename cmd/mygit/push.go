@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Usage: mygit push [-f | --force] [-d | --delete] [<remote> [<refspec>...]]
+func pushCmd(args []string) error {
+	force, deleteRefs := false, false
+	var rest []string
+	for _, arg := range args {
+		switch arg {
+		case "-f", "--force":
+			force = true
+		case "-d", "--delete":
+			deleteRefs = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				return fmt.Errorf("unknown option: %s", arg)
+			}
+			rest = append(rest, arg)
+		}
+	}
+	remote := ""
+	if len(rest) > 0 {
+		remote, rest = rest[0], rest[1:]
+	}
+	if deleteRefs && len(rest) == 0 {
+		return errors.New("--delete doesn't make sense without any refs")
+	}
+	return Push(".", remote, rest, force, deleteRefs)
+}
+
+// A ref the push wants to change on the remote.
+type pushUpdate struct {
+	Src   string // local name shown in the report, "" for a deletion
+	Dst   string // full remote ref name
+	Old   string // sha the remote has, "" when the ref is new
+	New   string // sha to set, "" to delete
+	Force bool
+
+	// Filled in as the update is checked and sent.
+	Code     byte
+	Summary  string
+	Note     string
+	Rejected bool
+}
+
+// Push local refs to a remote over git-receive-pack. Without refspecs the
+// remote's configured push refspecs are used, or else the current branch is
+// pushed to the branch of the same name.
+// ref: https://git-scm.com/docs/pack-protocol#_pushing_data_to_a_server
+func Push(localDir, remoteName string, specs []string, force, deleteRefs bool) error {
+	if remoteName == "" {
+		remoteName = defaultRemote(localDir)
+	}
+	url, named, err := remoteURL(localDir, remoteName)
+	if err != nil {
+		return err
+	}
+	if len(specs) == 0 {
+		specs = configValues(localDir, "remote."+remoteName+".push")
+	}
+	if len(specs) == 0 {
+		ref, _, err := readHead(localDir)
+		if err != nil {
+			return err
+		}
+		if ref == "" {
+			return errors.New("You are not currently on a branch.")
+		}
+		specs = []string{ref + ":" + ref}
+	}
+	if !named {
+		return pushTo(localDir, remoteName, url, false, specs, force, deleteRefs)
+	}
+	// Like git, a remote with several push URLs is pushed to at each.
+	for _, url := range remotePushURLs(localDir, remoteName) {
+		if err := pushTo(localDir, remoteName, url, true, specs, force, deleteRefs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The URLs pushes to a remote go to: remote.<name>.pushurl, or else
+// remote.<name>.url.
+func remotePushURLs(localDir, remoteName string) []string {
+	if urls := configValues(localDir, "remote."+remoteName+".pushurl"); len(urls) > 0 {
+		return urls
+	}
+	return configValues(localDir, "remote."+remoteName+".url")
+}
+
+func pushTo(localDir, remoteName, url string, named bool, specs []string, force, deleteRefs bool) error {
+	remote, err := connectService(localDir, url, "git-receive-pack")
+	if err != nil {
+		return err
+	}
+	defer remote.close()
+	updates, err := matchPushRefspecs(localDir, remote.Refs, specs, force, deleteRefs)
+	if err != nil {
+		return err
+	}
+
+	var commands []*pushUpdate
+	var tips []string
+	for _, update := range updates {
+		if update.Old == update.New {
+			continue
+		}
+		if err := checkPushUpdate(localDir, remote, update); err != nil {
+			return err
+		}
+		if update.Rejected {
+			continue
+		}
+		commands = append(commands, update)
+		if update.New != "" {
+			tips = append(tips, update.New)
+		}
+	}
+	if len(commands) == 0 && !anyRejected(updates) {
+		fmt.Fprintln(os.Stderr, "Everything up-to-date")
+		return nil
+	}
+
+	if len(commands) > 0 {
+		var exclude []string
+		for _, ref := range remote.Refs {
+			if hasObject(localDir, ref.Sha) {
+				exclude = append(exclude, ref.Sha)
+			}
+		}
+		if err := remote.sendPushCommands(localDir, commands, tips, exclude); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "To %s\n", anonymizeURL(url))
+	for _, update := range updates {
+		if update.Summary == "" {
+			continue
+		}
+		target := prettyRefName(update.Dst)
+		if update.Src != "" {
+			target = prettyRefName(update.Src) + " -> " + target
+		}
+		note := ""
+		if update.Note != "" {
+			note = " (" + update.Note + ")"
+		}
+		fmt.Fprintf(os.Stderr, " %c %-17s %s%s\n", update.Code, update.Summary, target, note)
+	}
+	if named {
+		if err := updateTrackingRefs(localDir, remoteName, updates); err != nil {
+			return err
+		}
+	}
+	if anyRejected(updates) {
+		return fmt.Errorf("failed to push some refs to '%s'", anonymizeURL(url))
+	}
+	return nil
+}
+
+// Turn push refspecs into updates. A refspec without a destination pushes to
+// the ref of the same name, and a short destination is completed from the
+// remote's refs or the kind of the source.
+func matchPushRefspecs(localDir string, remoteRefs []remoteRef, specs []string, force, deleteRefs bool) ([]*pushUpdate, error) {
+	remoteShas := make(map[string]string)
+	for _, ref := range remoteRefs {
+		remoteShas[ref.Name] = ref.Sha
+	}
+	var updates []*pushUpdate
+	for _, spec := range specs {
+		if deleteRefs {
+			if strings.Contains(spec, ":") {
+				return nil, errors.New("--delete only accepts plain target ref names")
+			}
+			spec = ":" + spec
+		}
+		forced := force
+		if strings.HasPrefix(spec, "+") {
+			forced, spec = true, spec[1:]
+		}
+		src, dst, hasDst := strings.Cut(spec, ":")
+
+		if strings.Contains(src, "*") {
+			pattern := refspec{Src: src, Dst: dst}
+			if !hasDst || strings.Count(src, "*") != 1 || strings.Count(dst, "*") != 1 {
+				return nil, fmt.Errorf("invalid refspec '%s'", spec)
+			}
+			refs, err := localRefs(localDir, "refs/")
+			if err != nil {
+				return nil, err
+			}
+			var names []string
+			for name := range refs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if target, ok := pattern.match(name); ok {
+					updates = append(updates, &pushUpdate{Src: name, Dst: target, Old: remoteShas[target], New: refs[name], Force: forced})
+				}
+			}
+			continue
+		}
+
+		if src == "" {
+			if dst == "" {
+				return nil, fmt.Errorf("invalid refspec '%s'", spec)
+			}
+			name := completeRemoteRef(dst, "", remoteShas)
+			if remoteShas[name] == "" {
+				return nil, fmt.Errorf("unable to delete '%s': remote ref does not exist", dst)
+			}
+			updates = append(updates, &pushUpdate{Dst: name, Old: remoteShas[name], Force: true})
+			continue
+		}
+
+		srcRef, sha, ok := expandRef(localDir, src)
+		if !ok {
+			var err error
+			if sha, err = revParse(localDir, src); err != nil {
+				return nil, fmt.Errorf("src refspec %s does not match any", src)
+			}
+		}
+		if srcRef == "HEAD" {
+			ref, _, err := readHead(localDir)
+			if err != nil {
+				return nil, err
+			}
+			srcRef = ref
+		}
+		name := src
+		if srcRef != "" {
+			name = srcRef
+		}
+		if !hasDst {
+			if !strings.HasPrefix(srcRef, "refs/") {
+				return nil, fmt.Errorf("the destination refspec for %s must be given", src)
+			}
+			dst = srcRef
+		}
+		target := completeRemoteRef(dst, srcRef, remoteShas)
+		if !strings.HasPrefix(target, "refs/") {
+			return nil, fmt.Errorf("the destination you provided is not a full refname: %s", dst)
+		}
+		updates = append(updates, &pushUpdate{Src: name, Dst: target, Old: remoteShas[target], New: sha, Force: forced})
+	}
+	return updates, nil
+}
+
+// Expand a short destination: to a ref the remote already has, or else
+// to a ref of the same kind as the source.
+func completeRemoteRef(dst, srcRef string, remoteShas map[string]string) string {
+	if strings.HasPrefix(dst, "refs/") {
+		return dst
+	}
+	for _, name := range expandRefspecSource(dst) {
+		if _, ok := remoteShas[name]; ok {
+			return name
+		}
+	}
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		if strings.HasPrefix(srcRef, prefix) {
+			return prefix + dst
+		}
+	}
+	return dst
+}
+
+// Decide how an update is reported, rejecting it when it would lose commits
+// on the remote and was not forced.
+func checkPushUpdate(localDir string, remote *gitRemote, update *pushUpdate) error {
+	reject := func(note string) {
+		update.Code, update.Summary, update.Note, update.Rejected = '!', "[rejected]", note, true
+	}
+	switch {
+	case update.New == "":
+		if _, ok := remote.Capabilities["delete-refs"]; !ok {
+			reject("remote does not support deleting refs")
+			return nil
+		}
+		update.Code, update.Summary = '-', "[deleted]"
+	case update.Old == "":
+		update.Code = '*'
+		switch {
+		case strings.HasPrefix(update.Dst, "refs/tags/"):
+			update.Summary = "[new tag]"
+		case strings.HasPrefix(update.Dst, "refs/heads/"):
+			update.Summary = "[new branch]"
+		default:
+			update.Summary = "[new reference]"
+		}
+	case strings.HasPrefix(update.Dst, "refs/tags/") && !update.Force:
+		reject("already exists")
+	case !hasObject(localDir, update.Old):
+		if !update.Force {
+			reject("fetch first")
+			return nil
+		}
+		update.Code, update.Summary, update.Note = '+', shortSha(update.Old)+"..."+shortSha(update.New), "forced update"
+	default:
+		fastForward, err := isFastForward(localDir, update.Old, update.New)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fastForward:
+			update.Code, update.Summary = ' ', shortSha(update.Old)+".."+shortSha(update.New)
+		case update.Force:
+			update.Code, update.Summary, update.Note = '+', shortSha(update.Old)+"..."+shortSha(update.New), "forced update"
+		default:
+			reject("non-fast-forward")
+		}
+	}
+	return nil
+}
+
+func anyRejected(updates []*pushUpdate) bool {
+	for _, update := range updates {
+		if update.Rejected {
+			return true
+		}
+	}
+	return false
+}
+
+// Send the update commands followed by a pack of the objects the remote
+// lacks, then read the report-status answer into the updates.
+func (r *gitRemote) sendPushCommands(localDir string, commands []*pushUpdate, tips, exclude []string) error {
+	capabilities := []string{}
+	for _, capability := range []string{"report-status", "side-band-64k", "delete-refs", "ofs-delta"} {
+		if _, ok := r.Capabilities[capability]; ok {
+			capabilities = append(capabilities, capability)
+		}
+	}
+	if _, ok := r.Capabilities["quiet"]; ok && !progressEnabled() {
+		capabilities = append(capabilities, "quiet")
+	}
+	if _, ok := r.Capabilities["agent"]; ok {
+		capabilities = append(capabilities, "agent="+agentName)
+	}
+
+	var body bytes.Buffer
+	for i, update := range commands {
+		line := fmt.Sprintf("%s %s %s", orZeroSha(update.Old), orZeroSha(update.New), update.Dst)
+		if i == 0 {
+			line += "\x00" + strings.Join(capabilities, " ")
+		}
+		writePkt(&body, []byte(line))
+	}
+	writeFlush(&body)
+	if len(tips) > 0 {
+		objects, err := objectsToPack(localDir, tips, exclude)
+		if err != nil {
+			return err
+		}
+		options := defaultPackOptions
+		_, options.OfsDelta = r.Capabilities["ofs-delta"]
+		options.Progress = progressEnabled()
+		if _, _, err := writePack(&body, localDir, objects, options); err != nil {
+			return err
+		}
+	}
+
+	resp, err := r.receivePack(body.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	if _, ok := r.Capabilities["report-status"]; !ok {
+		// Nothing to learn from the server, so assume it went through.
+		io.Copy(io.Discard, resp)
+		return nil
+	}
+	var status io.Reader = resp
+	if _, ok := r.Capabilities["side-band-64k"]; ok {
+		status = newSideBandReader(resp, os.Stderr)
+	}
+	return readReportStatus(status, commands)
+}
+
+// Read "unpack ok" and an "ok <ref>" or "ng <ref> <reason>" line per ref.
+// ref: https://git-scm.com/docs/pack-protocol#_report_status
+func readReportStatus(r io.Reader, commands []*pushUpdate) error {
+	lines, err := readPktLines(r)
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return errors.New("no report-status from the remote")
+	}
+	unpack, ok := cutPrefix(lines[0], "unpack ")
+	if !ok {
+		return fmt.Errorf("unexpected report-status line %q", lines[0])
+	}
+	byRef := make(map[string]*pushUpdate)
+	for _, update := range commands {
+		byRef[update.Dst] = update
+	}
+	remoteReject := func(update *pushUpdate, reason string) {
+		update.Code, update.Summary, update.Note, update.Rejected = '!', "[remote rejected]", reason, true
+	}
+	if unpack != "ok" {
+		fmt.Fprintf(os.Stderr, "error: remote unpack failed: %s\n", unpack)
+		for _, update := range commands {
+			remoteReject(update, "unpacker error")
+		}
+	}
+	for _, line := range lines[1:] {
+		if name, ok := cutPrefix(line, "ng "); ok {
+			name, reason, _ := strings.Cut(name, " ")
+			if update := byRef[name]; update != nil {
+				remoteReject(update, reason)
+			}
+		}
+	}
+	return nil
+}
+
+func orZeroSha(sha string) string {
+	if sha == "" {
+		return zeroSha
+	}
+	return sha
+}
+
+// Move the remote-tracking refs of successfully pushed refs, as a fetch
+// right after the push would have.
+func updateTrackingRefs(localDir, remoteName string, updates []*pushUpdate) error {
+	specs, err := configuredRefspecs(localDir, remoteName)
+	if err != nil {
+		return err
+	}
+	for _, update := range updates {
+		if update.Rejected || update.Summary == "" {
+			continue
+		}
+		for _, spec := range specs {
+			tracking, ok := spec.match(update.Dst)
+			if !ok || tracking == "" {
+				continue
+			}
+			if update.New == "" {
+				if err := deleteRef(localDir, tracking); err != nil {
+					return err
+				}
+				break
+			}
+			oldSha, _ := readRef(localDir, tracking)
+			if err := writeRef(localDir, tracking, update.New); err != nil {
+				return err
+			}
+			if err := appendReflog(localDir, tracking, oldSha, update.New, "update by push"); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
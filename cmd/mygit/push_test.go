@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// An upstream taking pushes, and a repository that has fetched its master
+// and topic and has a local master one commit ahead.
+func pushRepos(t *testing.T) (upstream, local string) {
+	t.Helper()
+	upstream, local, _, _ = fetchRepos(t)
+	if err := setConfigValue(upstream, "http.receivepack", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Fetch(local, "origin", nil, fetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ahead := commitFiles(t, local, mustRevParse(t, local, "origin/master"), "ahead", map[string]string{"a": "ahead\n"})
+	if err := writeRef(local, "refs/heads/master", ahead); err != nil {
+		t.Fatal(err)
+	}
+	return upstream, local
+}
+
+func TestPush(t *testing.T) {
+	upstream, local := pushRepos(t)
+	master := mustRevParse(t, local, "master")
+	if err := Push(local, "origin", nil, false, false); err != nil {
+		t.Fatal(err)
+	}
+	checkRef(t, upstream, "refs/heads/master", master)
+	checkRef(t, local, "refs/remotes/origin/master", master)
+
+	// A new branch, named in full on the remote.
+	if err := Push(local, "origin", []string{"master:refs/heads/new"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	checkRef(t, upstream, "refs/heads/new", master)
+	checkRef(t, local, "refs/remotes/origin/new", master)
+	runGit(t, upstream, "fsck", "--strict")
+
+	// Pushing again has nothing to send.
+	if err := Push(local, "origin", []string{"master"}, false, false); err != nil {
+		t.Errorf("an up-to-date push failed: %v", err)
+	}
+}
+
+func TestPushNonFastForward(t *testing.T) {
+	upstream, local := pushRepos(t)
+	topic := mustRevParse(t, local, "origin/topic")
+	old := mustRevParse(t, upstream, "master")
+
+	// Known to be behind: topic does not contain master.
+	err := Push(local, "origin", []string{"origin/topic:refs/heads/master"}, false, false)
+	if err == nil || !strings.Contains(err.Error(), "failed to push") {
+		t.Errorf("pushed a non-fast-forward: %v", err)
+	}
+	checkRef(t, upstream, "refs/heads/master", old)
+
+	// The remote has moved on to something we have never seen.
+	elsewhere := commitFiles(t, upstream, old, "elsewhere", map[string]string{"e": "e\n"})
+	if err := writeRef(upstream, "refs/heads/master", elsewhere); err != nil {
+		t.Fatal(err)
+	}
+	if err := Push(local, "origin", []string{"master"}, false, false); err == nil {
+		t.Error("pushed over a commit we do not have")
+	}
+	checkRef(t, upstream, "refs/heads/master", elsewhere)
+
+	// --force and a "+" refspec both overwrite.
+	if err := Push(local, "origin", []string{"master"}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	checkRef(t, upstream, "refs/heads/master", mustRevParse(t, local, "master"))
+	if err := Push(local, "origin", []string{"+origin/topic:refs/heads/master"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	checkRef(t, upstream, "refs/heads/master", topic)
+}
+
+func TestPushDelete(t *testing.T) {
+	upstream, local := pushRepos(t)
+	if err := Push(local, "origin", []string{"topic"}, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readRef(upstream, "refs/heads/topic"); err == nil {
+		t.Error("the remote branch is still there")
+	}
+	if _, err := readRef(local, "refs/remotes/origin/topic"); err == nil {
+		t.Error("the remote-tracking ref is still there")
+	}
+	// So is a ":<dst>" refspec.
+	if err := Push(local, "origin", []string{"master:refs/heads/gone"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Push(local, "origin", []string{":refs/heads/gone"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readRef(upstream, "refs/heads/gone"); err == nil {
+		t.Error("a push of nothing did not delete")
+	}
+}
+
+func TestPushRemoteRejection(t *testing.T) {
+	upstream, local := pushRepos(t)
+	for name, value := range map[string]string{"receive.denyDeletes": "true", "receive.denyNonFastForwards": "true"} {
+		if err := setConfigValue(upstream, name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	topic := mustRevParse(t, upstream, "topic")
+	if err := Push(local, "origin", []string{"topic"}, false, true); err == nil {
+		t.Error("deleted with receive.denyDeletes set")
+	}
+	checkRef(t, upstream, "refs/heads/topic", topic)
+	checkRef(t, local, "refs/remotes/origin/topic", topic)
+
+	// The server refuses what --force lets through on our side.
+	if err := Push(local, "origin", []string{"master:topic"}, true, false); err == nil {
+		t.Error("forced a push past receive.denyNonFastForwards")
+	}
+	checkRef(t, upstream, "refs/heads/topic", topic)
+}
+
+func TestReadReportStatus(t *testing.T) {
+	commands := func() []*pushUpdate {
+		return []*pushUpdate{{Dst: "refs/heads/a", Summary: "[new branch]"}, {Dst: "refs/heads/b", Summary: "[new branch]"}}
+	}
+	updates := commands()
+	status := pktText("unpack ok", "ok refs/heads/a", "ng refs/heads/b hook declined", "0000")
+	if err := readReportStatus(bytes.NewReader(status), updates); err != nil {
+		t.Fatal(err)
+	}
+	if updates[0].Rejected || updates[0].Summary != "[new branch]" {
+		t.Errorf("ok turned into %+v", *updates[0])
+	}
+	if b := updates[1]; !b.Rejected || b.Summary != "[remote rejected]" || b.Note != "hook declined" {
+		t.Errorf("ng turned into %+v", *b)
+	}
+
+	// An unpack failure rejects every ref.
+	updates = commands()
+	status = pktText("unpack index-pack failed", "ng refs/heads/a unpacker error", "ng refs/heads/b unpacker error", "0000")
+	if err := readReportStatus(bytes.NewReader(status), updates); err != nil {
+		t.Fatal(err)
+	}
+	for _, update := range updates {
+		if !update.Rejected || update.Note != "unpacker error" {
+			t.Errorf("%s after an unpack failure: %+v", update.Dst, *update)
+		}
+	}
+
+	for _, bad := range [][]byte{pktText("0000"), pktText("ok refs/heads/a", "0000")} {
+		if err := readReportStatus(bytes.NewReader(bad), commands()); err == nil {
+			t.Errorf("read %q as a status", bad)
+		}
+	}
+}
+
+func TestPushHidesURLPassword(t *testing.T) {
+	upstream, local := pushRepos(t)
+	url, _ := configValue(local, "remote.origin.url")
+	secret := strings.Replace(url, "http://", "http://user:secret@", 1)
+	if err := SetRemoteURL(local, "origin", secret, "", false, false, false); err != nil {
+		t.Fatal(err)
+	}
+	// The remote has moved on, so the push is rejected.
+	elsewhere := commitFiles(t, upstream, mustRevParse(t, upstream, "master"), "elsewhere", map[string]string{"e": "e\n"})
+	if err := writeRef(upstream, "refs/heads/master", elsewhere); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	output := captureOutput(t, func() { err = Push(local, "origin", []string{"master"}, false, false) })
+	if err == nil {
+		t.Fatal("pushed a non-fast-forward")
+	}
+	if strings.Contains(output+err.Error(), "secret") {
+		t.Errorf("the password is shown:\n%s%v", output, err)
+	}
+	if !strings.Contains(err.Error(), url) {
+		t.Errorf("the error does not name the remote: %v", err)
+	}
+}
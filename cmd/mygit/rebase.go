@@ -0,0 +1,620 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// State of an in-progress rebase lives in .git/rebase-merge, using the same
+// file names as git so it survives process restarts:
+//
+//	head-name       branch being rebased, or "detached HEAD"
+//	onto            commit the branch is replayed onto
+//	orig-head       branch tip before the rebase started
+//	git-rebase-todo steps still to run
+//	done            steps already run, the last one being the current step
+//	stopped-sha     commit that failed to apply
+//	message         commit message to use once conflicts are resolved
+//	amend           commit to replace when a stopped squash/fixup resumes
+//	worktree        tree written to the working directory when stopping
+//	conflicts       paths that were left with conflict markers
+const rebaseDirName = "rebase-merge"
+
+var rebaseCommands = map[string]string{
+	"p": "pick", "pick": "pick",
+	"r": "reword", "reword": "reword",
+	"s": "squash", "squash": "squash",
+	"f": "fixup", "fixup": "fixup",
+	"d": "drop", "drop": "drop",
+}
+
+// One line of the rebase todo list.
+type rebaseStep struct {
+	Command string
+	Sha     string
+	Subject string
+}
+
+func (s rebaseStep) String() string {
+	return fmt.Sprintf("%s %s %s", s.Command, s.Sha, s.Subject)
+}
+
+// Usage:
+//
+//	mygit rebase [--todo <file>] <upstream>
+//	mygit rebase --continue | --skip | --abort
+func rebaseCmd(args []string) error {
+	var upstream, todoFile string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--continue":
+			return RebaseContinue(".")
+		case arg == "--skip":
+			return RebaseSkip(".")
+		case arg == "--abort":
+			return RebaseAbort(".")
+		case arg == "--todo" && i+1 < len(args):
+			i++
+			todoFile = args[i]
+		case strings.HasPrefix(arg, "--todo="):
+			todoFile = strings.TrimPrefix(arg, "--todo=")
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option: %s", arg)
+		default:
+			upstream = arg
+		}
+	}
+	if upstream == "" {
+		return errors.New("usage: mygit rebase [--todo <file>] <upstream>")
+	}
+	return Rebase(".", upstream, todoFile)
+}
+
+func rebaseDir(localDir string) string {
+	return filepath.Join(gitDir(localDir), rebaseDirName)
+}
+
+func readRebaseFile(localDir, name string) string {
+	data, err := os.ReadFile(filepath.Join(rebaseDir(localDir), name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(string(data), "\n")
+}
+
+func writeRebaseFile(localDir, name, content string) error {
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return writeFile(filepath.Join(rebaseDir(localDir), name), []byte(content))
+}
+
+func rebaseInProgress(localDir string) bool {
+	_, err := os.Stat(rebaseDir(localDir))
+	return err == nil
+}
+
+// Replay the commits of the current branch that are not in upstream on top of
+// upstream. When todoFile is given it replaces the generated pick list.
+func Rebase(localDir, upstream, todoFile string) error {
+	if rebaseInProgress(localDir) {
+		return errors.New("a rebase is already in progress; use --continue, --skip or --abort")
+	}
+	headRef, head, err := readHead(localDir)
+	if err != nil {
+		return err
+	}
+	if head == "" {
+		return errors.New("cannot rebase an unborn branch")
+	}
+	headCommit, err := readCommit(localDir, head)
+	if err != nil {
+		return err
+	}
+	if err := requireCleanWorkTree(localDir, headCommit.Tree, "rebase"); err != nil {
+		return err
+	}
+	onto, err := revParse(localDir, upstream)
+	if err != nil {
+		return err
+	}
+	if onto, err = peelToCommit(localDir, onto); err != nil {
+		return err
+	}
+
+	var steps []rebaseStep
+	if todoFile != "" {
+		data, err := os.ReadFile(todoFile)
+		if err != nil {
+			return err
+		}
+		if steps, err = parseRebaseTodo(localDir, string(data)); err != nil {
+			return err
+		}
+	} else {
+		upToDate, err := isAncestor(localDir, onto, head)
+		if err != nil {
+			return err
+		}
+		if upToDate {
+			fmt.Printf("Current branch %s is up to date.\n", branchName(headRef))
+			return nil
+		}
+		commits, err := commitsBetween(localDir, []string{onto}, head)
+		if err != nil {
+			return err
+		}
+		for _, sha := range commits {
+			commit, err := readCommit(localDir, sha)
+			if err != nil {
+				return err
+			}
+			if len(commit.Parents) > 1 {
+				continue
+			}
+			steps = append(steps, rebaseStep{Command: "pick", Sha: sha, Subject: commit.Subject()})
+		}
+	}
+
+	headName := headRef
+	if headName == "" {
+		headName = "detached HEAD"
+	}
+	for name, content := range map[string]string{
+		"head-name":       headName,
+		"onto":            onto,
+		"orig-head":       head,
+		"git-rebase-todo": formatRebaseTodo(steps),
+		"done":            "",
+	} {
+		if err := writeRebaseFile(localDir, name, content); err != nil {
+			return err
+		}
+	}
+	if err := writeRef(localDir, "ORIG_HEAD", head); err != nil {
+		return err
+	}
+
+	ontoCommit, err := readCommit(localDir, onto)
+	if err != nil {
+		return err
+	}
+	if err := checkoutTree(localDir, headCommit.Tree, ontoCommit.Tree); err != nil {
+		return err
+	}
+	if err := writeDetachedHead(localDir, onto); err != nil {
+		return err
+	}
+	return runRebase(localDir)
+}
+
+// Resume after the user resolved the conflicts of the stopped step.
+func RebaseContinue(localDir string) error {
+	if !rebaseInProgress(localDir) {
+		return errors.New("no rebase in progress")
+	}
+	stopped := readRebaseFile(localDir, "stopped-sha")
+	if stopped == "" {
+		return runRebase(localDir)
+	}
+	for _, name := range strings.Split(readRebaseFile(localDir, "conflicts"), "\n") {
+		content, err := os.ReadFile(filepath.Join(localDir, filepath.FromSlash(name)))
+		if err == nil && hasConflictMarkers(content) {
+			return fmt.Errorf("%s still contains conflict markers; resolve it before continuing", name)
+		}
+	}
+
+	// Record the resolved working tree state of every path the step touched.
+	tree, err := headTree(localDir)
+	if err != nil {
+		return err
+	}
+	paths, err := treePaths(localDir, tree, readRebaseFile(localDir, "worktree"))
+	if err != nil {
+		return err
+	}
+	files, err := snapshotWorkFiles(localDir, paths, true)
+	if err != nil {
+		return err
+	}
+	resolved, err := writeTreeFromFiles(localDir, files)
+	if err != nil {
+		return err
+	}
+	picked, err := readCommit(localDir, stopped)
+	if err != nil {
+		return err
+	}
+	step := currentRebaseStep(localDir)
+	message := readRebaseFile(localDir, "message")
+	if err := commitRebaseStep(localDir, step, picked, resolved, message, readRebaseFile(localDir, "amend")); err != nil {
+		return err
+	}
+	if err := clearRebaseStop(localDir); err != nil {
+		return err
+	}
+	return runRebase(localDir)
+}
+
+// Drop the stopped step and move on to the next one.
+func RebaseSkip(localDir string) error {
+	if !rebaseInProgress(localDir) {
+		return errors.New("no rebase in progress")
+	}
+	tree, err := headTree(localDir)
+	if err != nil {
+		return err
+	}
+	if err := resetWorkTree(localDir, tree, readRebaseFile(localDir, "worktree")); err != nil {
+		return err
+	}
+	if err := clearRebaseStop(localDir); err != nil {
+		return err
+	}
+	return runRebase(localDir)
+}
+
+// Give up on the rebase and restore the branch as it was before.
+func RebaseAbort(localDir string) error {
+	if !rebaseInProgress(localDir) {
+		return errors.New("no rebase in progress")
+	}
+	origHead := readRebaseFile(localDir, "orig-head")
+	origCommit, err := readCommit(localDir, origHead)
+	if err != nil {
+		return err
+	}
+	tree, err := headTree(localDir)
+	if err != nil {
+		return err
+	}
+	if err := resetWorkTree(localDir, origCommit.Tree, tree, readRebaseFile(localDir, "worktree")); err != nil {
+		return err
+	}
+	headName := readRebaseFile(localDir, "head-name")
+	if strings.HasPrefix(headName, "refs/") {
+		if err := writeRef(localDir, headName, origHead); err != nil {
+			return err
+		}
+		err = writeSymbolicHead(localDir, headName)
+	} else {
+		err = writeDetachedHead(localDir, origHead)
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeIndexFromTree(localDir, origCommit.Tree); err != nil {
+		return err
+	}
+	return os.RemoveAll(rebaseDir(localDir))
+}
+
+// Make the working tree match target, considering every path of the given
+// trees as possibly present on disk.
+func resetWorkTree(localDir, target string, trees ...string) error {
+	paths, err := treePaths(localDir, append([]string{target}, trees...)...)
+	if err != nil {
+		return err
+	}
+	current, err := snapshotWorkFiles(localDir, paths, false)
+	if err != nil {
+		return err
+	}
+	want, err := flattenTree(localDir, target)
+	if err != nil {
+		return err
+	}
+	return checkoutFiles(localDir, current, want)
+}
+
+// Run todo steps until the list is empty or a step stops on conflicts.
+func runRebase(localDir string) error {
+	for {
+		todo := strings.Split(readRebaseFile(localDir, "git-rebase-todo"), "\n")
+		line := strings.TrimSpace(todo[0])
+		if line == "" && len(todo) == 1 {
+			return finishRebase(localDir)
+		}
+		if err := writeRebaseFile(localDir, "git-rebase-todo", strings.Join(todo[1:], "\n")); err != nil {
+			return err
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		done := readRebaseFile(localDir, "done")
+		if done != "" {
+			done += "\n"
+		}
+		if err := writeRebaseFile(localDir, "done", done+line); err != nil {
+			return err
+		}
+		step, err := parseRebaseStep(localDir, line)
+		if err != nil {
+			return err
+		}
+		if step.Command == "drop" {
+			continue
+		}
+		if err := applyRebaseStep(localDir, step); err != nil {
+			return err
+		}
+	}
+}
+
+// Cherry-pick one commit onto HEAD. Squash and fixup fold it into HEAD instead
+// of creating a new commit.
+func applyRebaseStep(localDir string, step rebaseStep) error {
+	_, head, err := readHead(localDir)
+	if err != nil {
+		return err
+	}
+	headCommit, err := readCommit(localDir, head)
+	if err != nil {
+		return err
+	}
+	picked, err := readCommit(localDir, step.Sha)
+	if err != nil {
+		return err
+	}
+	if len(picked.Parents) > 1 {
+		return fmt.Errorf("commit %s is a merge and cannot be picked", step.Sha)
+	}
+
+	// Nothing to replay when the commit already sits on HEAD.
+	if step.Command == "pick" && len(picked.Parents) == 1 && picked.Parents[0] == head {
+		if err := checkoutTree(localDir, headCommit.Tree, picked.Tree); err != nil {
+			return err
+		}
+		return writeDetachedHead(localDir, step.Sha)
+	}
+
+	baseTree := emptyTreeSha
+	if len(picked.Parents) == 1 {
+		parent, err := readCommit(localDir, picked.Parents[0])
+		if err != nil {
+			return err
+		}
+		baseTree = parent.Tree
+	}
+	label := fmt.Sprintf("%s (%s)", shortSha(step.Sha), picked.Subject())
+	merge, err := mergeTrees(localDir, baseTree, headCommit.Tree, picked.Tree, "HEAD", label)
+	if err != nil {
+		return err
+	}
+	worktree, err := writeTreeFromFiles(localDir, merge.Files)
+	if err != nil {
+		return err
+	}
+	if err := checkoutTree(localDir, headCommit.Tree, worktree); err != nil {
+		return err
+	}
+
+	message, amend := picked.Message, ""
+	switch step.Command {
+	case "squash":
+		message, amend = headCommit.Message+"\n\n"+picked.Message, head
+	case "fixup":
+		message, amend = headCommit.Message, head
+	}
+
+	if len(merge.Conflicts) > 0 {
+		for name, content := range map[string]string{
+			"stopped-sha": step.Sha,
+			"message":     message,
+			"amend":       amend,
+			"worktree":    worktree,
+			"conflicts":   strings.Join(merge.Conflicts, "\n"),
+		} {
+			if err := writeRebaseFile(localDir, name, content); err != nil {
+				return err
+			}
+		}
+		if err := writeIndexFromTree(localDir, worktree); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "hint: Resolve all conflicts manually, then run \"mygit rebase --continue\".")
+		fmt.Fprintln(os.Stderr, "hint: You can instead skip this commit: run \"mygit rebase --skip\".")
+		fmt.Fprintln(os.Stderr, "hint: To abort and get back to the state before \"mygit rebase\", run \"mygit rebase --abort\".")
+		return fmt.Errorf("could not apply %s... %s", shortSha(step.Sha), picked.Subject())
+	}
+
+	if amend == "" && worktree == headCommit.Tree && !isEmptyCommit(localDir, picked) {
+		fmt.Printf("dropping %s %s -- patch contents already upstream\n", step.Sha, picked.Subject())
+		return nil
+	}
+	return commitRebaseStep(localDir, step, picked, worktree, message, amend)
+}
+
+// Create the commit for a step and move the detached HEAD to it.
+func commitRebaseStep(localDir string, step rebaseStep, picked *GitCommit, tree, message, amend string) error {
+	_, head, err := readHead(localDir)
+	if err != nil {
+		return err
+	}
+	parents, author := []string{head}, picked.Author
+	if amend != "" {
+		amended, err := readCommit(localDir, amend)
+		if err != nil {
+			return err
+		}
+		parents, author = amended.Parents, amended.Author
+	}
+	if step.Command == "reword" || step.Command == "squash" {
+		if message, err = editMessage(localDir, message); err != nil {
+			return err
+		}
+	}
+	committer, err := newSignature(localDir, "COMMITTER")
+	if err != nil {
+		return err
+	}
+	commit := &GitCommit{
+		Tree:      tree,
+		Parents:   parents,
+		Author:    author,
+		Committer: committer,
+		Message:   message,
+	}
+	sha, err := writeGitObject(localDir, commit.Serialize())
+	if err != nil {
+		return err
+	}
+	return writeDetachedHead(localDir, sha)
+}
+
+func isEmptyCommit(localDir string, commit *GitCommit) bool {
+	if len(commit.Parents) == 0 {
+		return commit.Tree == emptyTreeSha
+	}
+	parent, err := readCommit(localDir, commit.Parents[0])
+	return err == nil && parent.Tree == commit.Tree
+}
+
+func finishRebase(localDir string) error {
+	_, head, err := readHead(localDir)
+	if err != nil {
+		return err
+	}
+	tree, err := headTree(localDir)
+	if err != nil {
+		return err
+	}
+	if err := writeIndexFromTree(localDir, tree); err != nil {
+		return err
+	}
+	headName := readRebaseFile(localDir, "head-name")
+	if strings.HasPrefix(headName, "refs/") {
+		if err := writeRef(localDir, headName, head); err != nil {
+			return err
+		}
+		if err := writeSymbolicHead(localDir, headName); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(rebaseDir(localDir)); err != nil {
+		return err
+	}
+	fmt.Printf("Successfully rebased and updated %s.\n", headName)
+	return nil
+}
+
+func clearRebaseStop(localDir string) error {
+	for _, name := range []string{"stopped-sha", "message", "amend", "worktree", "conflicts"} {
+		if err := os.Remove(filepath.Join(rebaseDir(localDir), name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func currentRebaseStep(localDir string) rebaseStep {
+	done := strings.Split(readRebaseFile(localDir, "done"), "\n")
+	step, err := parseRebaseStep(localDir, done[len(done)-1])
+	if err != nil {
+		return rebaseStep{Command: "pick"}
+	}
+	return step
+}
+
+func parseRebaseStep(localDir, line string) (rebaseStep, error) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	command, ok := rebaseCommands[fields[0]]
+	if !ok {
+		return rebaseStep{}, fmt.Errorf("invalid rebase command: %s", line)
+	}
+	if len(fields) < 2 {
+		return rebaseStep{}, fmt.Errorf("missing commit in rebase step: %s", line)
+	}
+	sha, err := revParse(localDir, fields[1])
+	if err != nil {
+		return rebaseStep{}, err
+	}
+	step := rebaseStep{Command: command, Sha: sha}
+	if len(fields) == 3 {
+		step.Subject = fields[2]
+	}
+	return step, nil
+}
+
+// Parse a todo list, skipping blank lines and # comments.
+func parseRebaseTodo(localDir, todo string) ([]rebaseStep, error) {
+	var steps []rebaseStep
+	for _, line := range strings.Split(todo, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		step, err := parseRebaseStep(localDir, line)
+		if err != nil {
+			return nil, err
+		}
+		if len(steps) == 0 && (step.Command == "squash" || step.Command == "fixup") {
+			return nil, fmt.Errorf("cannot '%s' without a previous commit", step.Command)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func formatRebaseTodo(steps []rebaseStep) string {
+	lines := make([]string, len(steps))
+	for i, step := range steps {
+		lines[i] = step.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func hasConflictMarkers(content []byte) bool {
+	for _, line := range splitLines(content) {
+		if strings.HasPrefix(line, "<<<<<<< ") || strings.HasPrefix(line, ">>>>>>> ") {
+			return true
+		}
+	}
+	return false
+}
+
+func branchName(ref string) string {
+	return strings.TrimPrefix(ref, "refs/heads/")
+}
+
+// Let the user edit a commit message with $GIT_EDITOR, $VISUAL or $EDITOR.
+// Without an editor the message is used as is.
+func editMessage(localDir, message string) (string, error) {
+	editor := ""
+	for _, name := range []string{"GIT_EDITOR", "VISUAL", "EDITOR"} {
+		if editor = os.Getenv(name); editor != "" {
+			break
+		}
+	}
+	if editor == "" || editor == ":" {
+		return message, nil
+	}
+	filename := filepath.Join(gitDir(localDir), "COMMIT_EDITMSG")
+	if err := writeFile(filename, []byte(message+"\n")); err != nil {
+		return "", err
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor, filename)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("there was a problem with the editor '%s': %w", editor, err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	edited := strings.TrimSpace(strings.Join(lines, "\n"))
+	if edited == "" {
+		return "", errors.New("aborting due to empty commit message")
+	}
+	return edited, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The commits from HEAD back to stop, newest first.
+func commitsSince(t *testing.T, dir, stop string) []*GitCommit {
+	t.Helper()
+	var commits []*GitCommit
+	for sha := headSha(t, dir); sha != stop; {
+		commit, err := readCommit(dir, sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits = append(commits, commit)
+		if len(commit.Parents) == 0 {
+			t.Fatalf("%s is not an ancestor of HEAD", stop)
+		}
+		sha = commit.Parents[0]
+	}
+	return commits
+}
+
+func checkOnBranch(t *testing.T, dir, branch string) {
+	t.Helper()
+	ref, _, err := readHead(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != "refs/heads/"+branch {
+		t.Errorf("HEAD is at %q, want refs/heads/%s", ref, branch)
+	}
+	if rebaseInProgress(dir) {
+		t.Error("the rebase state was left behind")
+	}
+}
+
+func TestRebaseTodo(t *testing.T) {
+	dir := newTestRepo(t)
+	base := commitFiles(t, dir, "", "base", map[string]string{"a": "1\n2\n3\n"})
+	upstream := commitFiles(t, dir, base, "upstream", map[string]string{"a": "1\n2\nthree\n", "u": "u\n"})
+	if err := writeRef(dir, "refs/heads/upstream", upstream); err != nil {
+		t.Fatal(err)
+	}
+	one := commitFiles(t, dir, base, "one", map[string]string{"b": "b\n"})
+	two := commitFiles(t, dir, one, "two", map[string]string{"b": "b\nb2\n"})
+	three := commitFiles(t, dir, two, "three", map[string]string{"c": "c\n"})
+	four := commitFiles(t, dir, three, "four", map[string]string{"d": "d\n"})
+	resetHard(t, dir, four)
+
+	todo := filepath.Join(t.TempDir(), "todo")
+	steps := "pick " + one + " one\n" +
+		"# a comment\n" +
+		"squash " + two[:7] + " two\n" +
+		"drop " + three + " three\n" +
+		"fixup " + four + " four\n"
+	if err := os.WriteFile(todo, []byte(steps), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rebase(dir, "upstream", todo); err != nil {
+		t.Fatal(err)
+	}
+
+	checkOnBranch(t, dir, "master")
+	commits := commitsSince(t, dir, upstream)
+	if len(commits) != 1 {
+		t.Fatalf("rebased into %d commits, want 1", len(commits))
+	}
+	if message := commits[0].Message; !strings.HasPrefix(message, "one") || !strings.Contains(message, "two") || strings.Contains(message, "four") {
+		t.Errorf("squashed message %q", message)
+	}
+	want := map[string]string{"a": "1\n2\nthree\n", "u": "u\n", "b": "b\nb2\n", "d": "d\n"}
+	if got := commitContents(t, dir, "HEAD"); !equalContents(got, want) {
+		t.Errorf("rebased files %q, want %q", got, want)
+	}
+	if got := readTestFile(t, dir, "c"); got != "" {
+		t.Errorf("dropped file left in the working tree: %q", got)
+	}
+	if got := mustRevParse(t, dir, "ORIG_HEAD"); got != four {
+		t.Errorf("ORIG_HEAD is %s, want %s", got, four)
+	}
+}
+
+func TestRebasePicksEveryCommit(t *testing.T) {
+	dir := newTestRepo(t)
+	base := commitFiles(t, dir, "", "base", map[string]string{"a": "a\n"})
+	upstream := commitFiles(t, dir, base, "upstream", map[string]string{"u": "u\n"})
+	if err := writeRef(dir, "refs/heads/upstream", upstream); err != nil {
+		t.Fatal(err)
+	}
+	one := commitFiles(t, dir, base, "one", map[string]string{"b": "b\n"})
+	// Already upstream, so dropped.
+	same := commitFiles(t, dir, one, "same as upstream", map[string]string{"u": "u\n"})
+	resetHard(t, dir, commitFiles(t, dir, same, "two", map[string]string{"c": "c\n"}))
+
+	if err := Rebase(dir, "upstream", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkOnBranch(t, dir, "master")
+	var subjects []string
+	for _, commit := range commitsSince(t, dir, upstream) {
+		subjects = append(subjects, commit.Subject())
+	}
+	if got := strings.Join(subjects, ", "); got != "two, one" {
+		t.Errorf("rebased commits: %s", got)
+	}
+
+	// Nothing to do the second time.
+	head := headSha(t, dir)
+	if err := Rebase(dir, "upstream", ""); err != nil || headSha(t, dir) != head {
+		t.Errorf("rebasing again moved HEAD: %v", err)
+	}
+}
+
+// Start a rebase that stops on a conflict in "a", with a second commit
+// still to pick.
+func stoppedRebase(t *testing.T) (dir, upstream, orig string) {
+	dir = newTestRepo(t)
+	base := commitFiles(t, dir, "", "base", map[string]string{"a": "1\n2\n3\n", "dir/x": "x\n"})
+	upstream = commitFiles(t, dir, base, "upstream", map[string]string{"a": "1\nup\n3\n"})
+	if err := writeRef(dir, "refs/heads/upstream", upstream); err != nil {
+		t.Fatal(err)
+	}
+	mine := commitFiles(t, dir, base, "mine", map[string]string{"a": "1\nmine\n3\n"})
+	orig = commitFiles(t, dir, mine, "next", map[string]string{"b": "b\n"})
+	resetHard(t, dir, orig)
+
+	err := Rebase(dir, "upstream", "")
+	if err == nil || !strings.Contains(err.Error(), "could not apply") {
+		t.Fatalf("rebase did not stop on the conflict: %v", err)
+	}
+	if !rebaseInProgress(dir) {
+		t.Fatal("no rebase state was saved")
+	}
+	if got := readTestFile(t, dir, "a"); !strings.Contains(got, "<<<<<<< HEAD\nup\n=======\nmine\n>>>>>>> ") {
+		t.Fatalf("conflicted file:\n%s", got)
+	}
+	if err := Rebase(dir, "upstream", ""); err == nil {
+		t.Error("started a second rebase")
+	}
+	return dir, upstream, orig
+}
+
+func TestRebaseContinue(t *testing.T) {
+	dir, upstream, _ := stoppedRebase(t)
+	if err := RebaseContinue(dir); err == nil || !strings.Contains(err.Error(), "conflict markers") {
+		t.Errorf("continued with conflict markers: %v", err)
+	}
+
+	writeTestFile(t, dir, "a", "1\nboth\n3\n")
+	if err := RebaseContinue(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkOnBranch(t, dir, "master")
+	commits := commitsSince(t, dir, upstream)
+	if len(commits) != 2 || commits[1].Subject() != "mine" || commits[0].Subject() != "next" {
+		t.Fatalf("rebased into %d commits", len(commits))
+	}
+	want := map[string]string{"a": "1\nboth\n3\n", "b": "b\n", "dir/x": "x\n"}
+	if got := commitContents(t, dir, "HEAD"); !equalContents(got, want) {
+		t.Errorf("rebased files %q, want %q", got, want)
+	}
+}
+
+func TestRebaseSkip(t *testing.T) {
+	dir, upstream, _ := stoppedRebase(t)
+	if err := RebaseSkip(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkOnBranch(t, dir, "master")
+	commits := commitsSince(t, dir, upstream)
+	if len(commits) != 1 || commits[0].Subject() != "next" {
+		t.Fatalf("rebased into %d commits", len(commits))
+	}
+	if got := readTestFile(t, dir, "a"); got != "1\nup\n3\n" {
+		t.Errorf("skipped file is %q", got)
+	}
+}
+
+func TestRebaseAbort(t *testing.T) {
+	dir, _, orig := stoppedRebase(t)
+	if err := RebaseAbort(dir); err != nil {
+		t.Fatal(err)
+	}
+	checkOnBranch(t, dir, "master")
+	if got := headSha(t, dir); got != orig {
+		t.Errorf("aborted onto %s, want %s", got, orig)
+	}
+	for name, want := range map[string]string{"a": "1\nmine\n3\n", "b": "b\n", "dir/x": "x\n"} {
+		if got := readTestFile(t, dir, name); got != want {
+			t.Errorf("%s is %q after the abort, want %q", name, got, want)
+		}
+	}
+	if err := RebaseAbort(dir); err == nil {
+		t.Error("aborted a rebase that was not in progress")
+	}
+}
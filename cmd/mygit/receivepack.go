@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Capabilities offered to clients of git-receive-pack.
+var receivePackCapabilities = []string{"report-status", "delete-refs", "side-band-64k", "quiet", "ofs-delta"}
+
+// One "<old> <new> <ref>" line of a push.
+type receiveCommand struct {
+	Old, New, Ref string
+	Error         string // why the update was refused, "" once done
+}
+
+// Serve git-receive-pack over a connection: advertise the refs, read the
+// update commands and the pack, then apply the updates and report on each.
+// A stateless server skips the advertisement, as over HTTP.
+// ref: https://git-scm.com/docs/pack-protocol#_reference_update_request_and_packfile_transfer
+func serveReceivePack(localDir string, r io.Reader, w io.Writer, stateless bool) error {
+	if !stateless {
+		if err := advertiseReceivePack(localDir, w); err != nil {
+			return err
+		}
+	}
+	br := bufio.NewReader(r)
+	var commands []*receiveCommand
+	capabilities := make(map[string]bool)
+	for {
+		data, flush, err := readPkt(br)
+		if err == io.EOF && len(commands) == 0 {
+			// The client had nothing to push.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if flush {
+			break
+		}
+		line, capabilityList, _ := strings.Cut(trimNewline(string(data)), "\x00")
+		for _, capability := range strings.Fields(capabilityList) {
+			capabilities[capability] = true
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("protocol error: expected old/new/ref, got %q", line)
+		}
+		commands = append(commands, &receiveCommand{Old: fields[0], New: fields[1], Ref: fields[2]})
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+
+	unpack := "ok"
+	if !allDeletes(commands) {
+		if _, err := indexPack(localDir, br, indexPackOptions{UnpackLimit: unpackLimit(localDir, "receive")}); err != nil {
+			unpack = err.Error()
+		}
+	}
+	for _, command := range commands {
+		if unpack != "ok" {
+			command.Error = "unpacker error"
+			continue
+		}
+		command.Error = updateReceivedRef(localDir, command)
+	}
+	if !capabilities["report-status"] {
+		return nil
+	}
+	lines := []string{"unpack " + unpack}
+	for _, command := range commands {
+		if command.Error != "" {
+			lines = append(lines, "ng "+command.Ref+" "+command.Error)
+		} else {
+			lines = append(lines, "ok "+command.Ref)
+		}
+	}
+	if !capabilities["side-band-64k"] {
+		return writePktLines(w, lines...)
+	}
+	var status bytes.Buffer
+	writePktLines(&status, lines...)
+	if _, err := newSideBandWriter(w, 1, maxPktPayload-1).Write(status.Bytes()); err != nil {
+		return err
+	}
+	return writeFlush(w)
+}
+
+// Write the refs, without HEAD, and capabilities a push starts from.
+func advertiseReceivePack(localDir string, w io.Writer) error {
+	refs, err := advertisedRefs(localDir)
+	if err != nil {
+		return err
+	}
+	var advertised []remoteRef
+	for _, ref := range refs {
+		if ref.Name != "HEAD" {
+			ref.Peeled = ""
+			advertised = append(advertised, ref)
+		}
+	}
+	return advertiseV0(w, advertised, append([]string{}, receivePackCapabilities...))
+}
+
+func allDeletes(commands []*receiveCommand) bool {
+	for _, command := range commands {
+		if command.New != zeroSha {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply one pushed ref update, returning why it was refused or "".
+// ref: https://git-scm.com/docs/git-receive-pack
+func updateReceivedRef(localDir string, command *receiveCommand) string {
+	if !strings.HasPrefix(command.Ref, "refs/") || strings.Contains(command.Ref, "..") {
+		return "funny refname"
+	}
+	current, err := readRef(localDir, command.Ref)
+	if err != nil && !os.IsNotExist(err) {
+		return "failed to lock"
+	}
+	if orZeroSha(current) != command.Old {
+		return "failed to lock"
+	}
+	isDelete := command.New == zeroSha
+	if headRef, _, _ := readHead(localDir); headRef == command.Ref && !isBareRepository(localDir) {
+		if isDelete {
+			if denyDeleteCurrent, ok := configValue(localDir, "receive.denyDeleteCurrent"); !ok || isTrueOrRefuse(denyDeleteCurrent) {
+				return "deletion of the current branch prohibited"
+			}
+		} else if denyCurrent, ok := configValue(localDir, "receive.denyCurrentBranch"); !ok || isTrueOrRefuse(denyCurrent) {
+			return "branch is currently checked out"
+		}
+	}
+	if isDelete {
+		if configBool(localDir, "receive.denyDeletes") {
+			return "deletion prohibited"
+		}
+		if err := deleteRef(localDir, command.Ref); err != nil {
+			return "failed to delete"
+		}
+		return ""
+	}
+	if !isConnected(localDir, command.New) {
+		return "missing necessary objects"
+	}
+	if command.Old != zeroSha && configBool(localDir, "receive.denyNonFastForwards") && strings.HasPrefix(command.Ref, "refs/heads/") {
+		if ok, err := isFastForward(localDir, command.Old, command.New); err != nil || !ok {
+			return "non-fast-forward"
+		}
+	}
+	if err := writeRef(localDir, command.Ref, command.New); err != nil {
+		return "failed to write"
+	}
+	if !isBareRepository(localDir) {
+		appendReflog(localDir, command.Ref, command.Old, command.New, "push")
+	}
+	return ""
+}
+
+// Whether everything sha reaches is in the repository, down to what the
+// existing refs already reach, so a pack lacking a parent, a tree or a blob
+// cannot leave a ref pointing at a broken history.
+func isConnected(localDir, sha string) bool {
+	refs, err := localRefs(localDir, "refs/")
+	if err != nil {
+		return false
+	}
+	var exclude []string
+	for _, existing := range refs {
+		exclude = append(exclude, existing)
+	}
+	// Listing fails on a missing commit or tree; blobs are only named.
+	objects, err := objectsToPack(localDir, []string{sha}, exclude)
+	if err != nil {
+		return false
+	}
+	for _, object := range objects {
+		if !hasObject(localDir, object.Sha) {
+			return false
+		}
+	}
+	return true
+}
+
+// receive.denyCurrentBranch and friends take a boolean or "refuse".
+func isTrueOrRefuse(value string) bool {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1", "refuse":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// Push one ref update with a pack of the named objects of src, returning the
+// report's unpack status and ref status.
+func receivePush(t *testing.T, dir, src, old, new, ref string, objects ...string) []string {
+	t.Helper()
+	var entries []testPackEntry
+	for _, sha := range objects {
+		objectType, content, err := readGitObject(src, sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := objectTypeCode(objectType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, testPackEntry{Type: code, Content: content})
+	}
+	var request bytes.Buffer
+	if err := writePktLines(&request, old+" "+new+" "+ref+"\x00report-status"); err != nil {
+		t.Fatal(err)
+	}
+	request.Write(buildPack(t, entries))
+	var response bytes.Buffer
+	if err := serveReceivePack(dir, &request, &response, true); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := readPktLines(bufio.NewReader(&response))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestReceivePackConnectivity(t *testing.T) {
+	_, dir := bareRepo(t)
+	_, src := bareRepo(t)
+	first := commitFiles(t, src, "", "first", map[string]string{"a": "a\n"})
+	second := commitFiles(t, src, first, "second", map[string]string{"b": "b\n"})
+	third := commitFiles(t, src, second, "third", map[string]string{"c": "c\n"})
+	tree := func(commit string) string {
+		c, err := readCommit(src, commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Tree
+	}
+	const ref = "refs/heads/master"
+	push := func(old, new string, objects ...string) string {
+		t.Helper()
+		lines := receivePush(t, dir, src, old, new, ref, objects...)
+		if len(lines) != 2 || lines[0] != "unpack ok" {
+			t.Fatalf("pushing %s reported %q", new, lines)
+		}
+		return lines[1]
+	}
+
+	if status := push(zeroSha, first, first, tree(first), blobSha("a\n")); status != "ok "+ref {
+		t.Fatalf("a complete pack was refused: %s", status)
+	}
+
+	// Each pack lacks something the new tip needs and that the receiving
+	// repository does not have either.
+	for _, tt := range []struct {
+		name    string
+		tip     string
+		objects []string
+	}{
+		{"a parent", third, []string{third, tree(third), blobSha("c\n")}},
+		{"a tree", second, []string{second}},
+		{"a blob", second, []string{second, tree(second)}},
+	} {
+		if status := push(first, tt.tip, tt.objects...); status != "ng "+ref+" missing necessary objects" {
+			t.Errorf("a pack lacking %s reported %q", tt.name, status)
+		}
+		checkRef(t, dir, ref, first)
+	}
+
+	// Objects the repository has from earlier pushes need not be sent again.
+	if status := push(first, third, blobSha("b\n")); status != "ok "+ref {
+		t.Errorf("completing the history was refused: %s", status)
+	}
+	checkRef(t, dir, ref, third)
+	if ok, output := runFsck(t, dir, false); !ok {
+		t.Errorf("fsck failed:\n%s", output)
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	symrefPrefix = "ref: "
+	zeroSha      = "0000000000000000000000000000000000000000"
+)
+
+// Repository directories already found by gitDir, which is called for
+// every path. A served repository may be looked up from another goroutine.
+var (
+	gitDirs     = make(map[string]string)
+	gitDirsLock sync.Mutex
+)
+
+// The directory holding a repository's refs and objects: .git in a work
+// tree, or the repository itself when it is bare.
+// ref: https://git-scm.com/docs/gitrepository-layout
+func gitDir(localDir string) string {
+	gitDirsLock.Lock()
+	defer gitDirsLock.Unlock()
+	if dir, ok := gitDirs[localDir]; ok {
+		return dir
+	}
+	dir := filepath.Join(localDir, ".git")
+	if _, err := os.Stat(dir); err == nil {
+		gitDirs[localDir] = dir
+	} else if isBareRepository(localDir) {
+		dir = localDir
+		gitDirs[localDir] = dir
+	}
+	// Anything else may still be initialized, so is not remembered.
+	return dir
+}
+
+func isBareRepository(dir string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// One line of a reflog under .git/logs.
+type reflogEntry struct {
+	Old       string
+	New       string
+	Committer Signature
+	Message   string
+}
+
+func reflogPath(localDir, ref string) string {
+	return filepath.Join(gitDir(localDir), "logs", filepath.FromSlash(ref))
+}
+
+// Read a reflog, oldest entry first.
+func readReflog(localDir, ref string) ([]reflogEntry, error) {
+	data, err := os.ReadFile(reflogPath(localDir, ref))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []reflogEntry
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		header, message, _ := strings.Cut(line, "\t")
+		fields := strings.SplitN(header, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid reflog line: %s", line)
+		}
+		committer, err := parseSignature(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, reflogEntry{Old: fields[0], New: fields[1], Committer: committer, Message: message})
+	}
+	return entries, nil
+}
+
+func writeReflog(localDir, ref string, entries []reflogEntry) error {
+	var buf strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&buf, "%s %s %s\t%s\n", entry.Old, entry.New, entry.Committer, entry.Message)
+	}
+	return writeFile(reflogPath(localDir, ref), []byte(buf.String()))
+}
+
+func appendReflog(localDir, ref, oldSha, newSha, message string) error {
+	entries, err := readReflog(localDir, ref)
+	if err != nil {
+		return err
+	}
+	if oldSha == "" {
+		oldSha = zeroSha
+	}
+	// Like git, a reflog makes do with a made-up identity.
+	committer, _ := newSignature(localDir, "COMMITTER")
+	entry := reflogEntry{Old: oldSha, New: newSha, Committer: committer, Message: message}
+	return writeReflog(localDir, ref, append(entries, entry))
+}
+
+// Read HEAD and return the ref it points to ("" when detached) and the commit
+// sha it resolves to ("" on an unborn branch).
+func readHead(localDir string) (string, string, error) {
+	data, err := os.ReadFile(filepath.Join(gitDir(localDir), "HEAD"))
+	if err != nil {
+		return "", "", err
+	}
+	content := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(content, symrefPrefix) {
+		return "", content, nil
+	}
+	ref := strings.TrimPrefix(content, symrefPrefix)
+	sha, err := readRef(localDir, ref)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+	return ref, sha, nil
+}
+
+// Resolve a full ref name such as HEAD or refs/heads/master, following
+// symbolic refs.
+func readRef(localDir, ref string) (string, error) {
+	for depth := 0; depth < 5; depth++ {
+		data, err := os.ReadFile(filepath.Join(gitDir(localDir), ref))
+		if os.IsNotExist(err) && strings.HasPrefix(ref, "refs/") {
+			if packed, packedErr := readPackedRefs(localDir); packedErr == nil {
+				for _, packedRef := range packed {
+					if packedRef.Name == ref {
+						return packedRef.Sha, nil
+					}
+				}
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		content := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(content, symrefPrefix) {
+			return content, nil
+		}
+		ref = strings.TrimPrefix(content, symrefPrefix)
+	}
+	return "", fmt.Errorf("symbolic ref nesting too deep: %s", ref)
+}
+
+// The target of a loose symbolic ref, reporting whether ref is one.
+func readSymref(localDir, ref string) (string, bool) {
+	data, err := os.ReadFile(filepath.Join(gitDir(localDir), filepath.FromSlash(ref)))
+	if err != nil {
+		return "", false
+	}
+	return cutPrefix(strings.TrimSpace(string(data)), symrefPrefix)
+}
+
+// Whether a full ref name is well formed: no component starts with "." or
+// ends with ".lock", and there is no "..", "@{", "//", control character,
+// space or any of ~^:?*[\.
+// ref: https://git-scm.com/docs/git-check-ref-format
+func checkRefFormat(name string) bool {
+	if name == "" || name == "@" || strings.HasSuffix(name, ".") || strings.HasSuffix(name, "/") ||
+		strings.Contains(name, "..") || strings.Contains(name, "@{") || strings.Contains(name, "//") {
+		return false
+	}
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func writeRef(localDir, ref, sha string) error {
+	return writeFile(filepath.Join(gitDir(localDir), ref), []byte(sha+"\n"))
+}
+
+// Delete a ref, both its loose file and any packed-refs entry.
+func deleteRef(localDir, ref string) error {
+	err := os.Remove(filepath.Join(gitDir(localDir), ref))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	packed, err := readPackedRefs(localDir)
+	if err != nil {
+		return err
+	}
+	for i, packedRef := range packed {
+		if packedRef.Name == ref {
+			return writePackedRefs(localDir, append(packed[:i:i], packed[i+1:]...))
+		}
+	}
+	return nil
+}
+
+// A ref in .git/packed-refs, with what an annotated tag peels to.
+// ref: https://git-scm.com/docs/git-pack-refs
+type packedRef struct {
+	Name   string
+	Sha    string
+	Peeled string
+}
+
+const packedRefsHeader = "# pack-refs with: peeled fully-peeled sorted \n"
+
+func packedRefsPath(localDir string) string {
+	return filepath.Join(gitDir(localDir), "packed-refs")
+}
+
+// Read .git/packed-refs, which may not exist.
+func readPackedRefs(localDir string) ([]packedRef, error) {
+	data, err := os.ReadFile(packedRefsPath(localDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var refs []packedRef
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "^"):
+			if len(refs) > 0 {
+				refs[len(refs)-1].Peeled = line[1:]
+			}
+		default:
+			sha, name, ok := strings.Cut(line, " ")
+			if !ok {
+				return nil, fmt.Errorf("unexpected line in packed-refs: %s", line)
+			}
+			refs = append(refs, packedRef{Name: name, Sha: sha})
+		}
+	}
+	return refs, nil
+}
+
+func writePackedRefs(localDir string, refs []packedRef) error {
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+	var buf strings.Builder
+	buf.WriteString(packedRefsHeader)
+	for _, ref := range refs {
+		fmt.Fprintf(&buf, "%s %s\n", ref.Sha, ref.Name)
+		if ref.Peeled != "" {
+			fmt.Fprintf(&buf, "^%s\n", ref.Peeled)
+		}
+	}
+	return writeFile(packedRefsPath(localDir), []byte(buf.String()))
+}
+
+// Point HEAD at a branch.
+func writeSymbolicHead(localDir, ref string) error {
+	return writeSymref(localDir, "HEAD", ref)
+}
+
+// Make ref a symbolic ref pointing at target.
+func writeSymref(localDir, ref, target string) error {
+	return writeFile(filepath.Join(gitDir(localDir), filepath.FromSlash(ref)), []byte(symrefPrefix+target+"\n"))
+}
+
+// Detach HEAD at a commit.
+func writeDetachedHead(localDir, sha string) error {
+	return writeFile(filepath.Join(gitDir(localDir), "HEAD"), []byte(sha+"\n"))
+}
+
+// Move whatever HEAD points at to sha: the branch when attached, HEAD itself
+// when detached.
+func updateHead(localDir, sha string) error {
+	ref, _, err := readHead(localDir)
+	if err != nil {
+		return err
+	}
+	if ref == "" {
+		return writeDetachedHead(localDir, sha)
+	}
+	return writeRef(localDir, ref, sha)
+}
+
+// List the refs under a prefix such as "refs/heads/", mapping full names to
+// the shas they resolve to.
+func localRefs(localDir, prefix string) (map[string]string, error) {
+	refs := make(map[string]string)
+	root := gitDir(localDir)
+	err := filepath.Walk(filepath.Join(root, filepath.FromSlash(prefix)), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if sha, err := readRef(localDir, name); err == nil {
+			refs[name] = sha
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Loose refs take precedence over packed ones.
+	packed, err := readPackedRefs(localDir)
+	for _, ref := range packed {
+		if _, ok := refs[ref.Name]; !ok && strings.HasPrefix(ref.Name, prefix) {
+			refs[ref.Name] = ref.Sha
+		}
+	}
+	return refs, err
+}
+
+// Expand a short ref name using git's lookup order.
+func expandRef(localDir, name string) (string, string, bool) {
+	for _, pattern := range []string{"%s", "refs/%s", "refs/tags/%s", "refs/heads/%s", "refs/remotes/%s", "refs/remotes/%s/HEAD"} {
+		// Only pseudo-refs like HEAD and ORIG_HEAD live directly under .git.
+		if pattern == "%s" && !strings.HasPrefix(name, "refs/") && name != strings.ToUpper(name) {
+			continue
+		}
+		ref := fmt.Sprintf(pattern, name)
+		if sha, err := readRef(localDir, ref); err == nil {
+			return ref, sha, true
+		}
+	}
+	return "", "", false
+}
+
+// Resolve a revision such as HEAD~2, master^2, v1.0 or an abbreviated sha to
+// a full object sha.
+func revParse(localDir, rev string) (string, error) {
+	end := strings.IndexAny(rev, "~^")
+	if end < 0 {
+		end = len(rev)
+	}
+	sha, err := resolveName(localDir, rev[:end])
+	if err != nil {
+		return "", err
+	}
+	suffix := rev[end:]
+	for len(suffix) > 0 {
+		op := suffix[0]
+		digits := 0
+		for digits+1 < len(suffix) && suffix[digits+1] >= '0' && suffix[digits+1] <= '9' {
+			digits++
+		}
+		n := 1
+		if digits > 0 {
+			n, _ = strconv.Atoi(suffix[1 : 1+digits])
+		}
+		suffix = suffix[1+digits:]
+		if sha, err = peelToCommit(localDir, sha); err != nil {
+			return "", err
+		}
+		if op == '^' {
+			if n == 0 {
+				continue
+			}
+			commit, err := readCommit(localDir, sha)
+			if err != nil {
+				return "", err
+			}
+			if n > len(commit.Parents) {
+				return "", fmt.Errorf("bad revision '%s'", rev)
+			}
+			sha = commit.Parents[n-1]
+			continue
+		}
+		for i := 0; i < n; i++ {
+			commit, err := readCommit(localDir, sha)
+			if err != nil {
+				return "", err
+			}
+			if len(commit.Parents) == 0 {
+				return "", fmt.Errorf("bad revision '%s'", rev)
+			}
+			sha = commit.Parents[0]
+		}
+	}
+	return sha, nil
+}
+
+func resolveName(localDir, name string) (string, error) {
+	if name == "" || name == "@" {
+		name = "HEAD"
+	}
+	if base, selector, ok := strings.Cut(name, "@{"); ok && strings.HasSuffix(selector, "}") {
+		return resolveReflogEntry(localDir, base, strings.TrimSuffix(selector, "}"))
+	}
+	if _, sha, ok := expandRef(localDir, name); ok {
+		return sha, nil
+	}
+	if isHex(name) && len(name) == 40 {
+		return name, nil
+	}
+	if isHex(name) && len(name) >= 4 {
+		return expandShortSha(localDir, name)
+	}
+	return "", fmt.Errorf("bad revision '%s'", name)
+}
+
+// Resolve <ref>@{<n>}, the value ref had n updates ago.
+func resolveReflogEntry(localDir, name, selector string) (string, error) {
+	n, err := strconv.Atoi(selector)
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("bad revision '%s@{%s}'", name, selector)
+	}
+	if name == "" {
+		name = "HEAD"
+	}
+	ref, _, ok := expandRef(localDir, name)
+	if !ok {
+		return "", fmt.Errorf("bad revision '%s@{%s}'", name, selector)
+	}
+	entries, err := readReflog(localDir, ref)
+	if err != nil {
+		return "", err
+	}
+	if n >= len(entries) {
+		return "", fmt.Errorf("log for '%s' only has %d entries", name, len(entries))
+	}
+	return entries[len(entries)-1-n].New, nil
+}
+
+// Find the unique object, loose or packed, whose sha starts with prefix.
+func expandShortSha(localDir, prefix string) (string, error) {
+	prefix = strings.ToLower(prefix)
+	packed, err := packedObjectsWithPrefix(localDir, prefix)
+	if err != nil {
+		return "", err
+	}
+	objectDirs := append([]string{filepath.Join(gitDir(localDir), "objects")}, alternateObjectDirs(localDir)...)
+	for _, dir := range objectDirs {
+		entries, err := os.ReadDir(filepath.Join(dir, prefix[:2]))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), prefix[2:]) {
+				packed = append(packed, prefix[:2]+entry.Name())
+			}
+		}
+	}
+	var matches []string
+	seen := make(map[string]bool)
+	for _, sha := range packed {
+		if !seen[sha] {
+			seen[sha] = true
+			matches = append(matches, sha)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("bad revision '%s'", prefix)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("short object ID %s is ambiguous", prefix)
+	}
+}
+
+// Follow annotated tags until reaching a commit.
+func peelToCommit(localDir, sha string) (string, error) {
+	for {
+		objectType, content, err := readGitObject(localDir, sha)
+		if err != nil {
+			return "", err
+		}
+		switch objectType {
+		case "commit":
+			return sha, nil
+		case "tag":
+			target, _, _ := strings.Cut(string(content), "\n")
+			sha = strings.TrimPrefix(target, "object ")
+		default:
+			return "", fmt.Errorf("%s is a %s, not a commit", sha, objectType)
+		}
+	}
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+func shortSha(sha string) string {
+	if len(sha) < 7 {
+		return sha
+	}
+	return sha[:7]
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Usage: mygit remote [-v | --verbose]
+// mygit remote add [-f] [-t <branch>]... [-m <master>] [--[no-]tags] [--mirror=(fetch|push)] <name> <url>
+// mygit remote (remove | rm) <name>
+// mygit remote rename <old> <new>
+// mygit remote set-url [--push] [--add | --delete] <name> <newurl> [<oldurl>]
+// ref: https://git-scm.com/docs/git-remote
+func remoteCmd(args []string) error {
+	if len(args) == 0 || args[0] == "-v" || args[0] == "--verbose" {
+		return listRemotes(".", len(args) > 0)
+	}
+	switch args[0] {
+	case "add":
+		return remoteAddCmd(args[1:])
+	case "remove", "rm":
+		if len(args) != 2 {
+			return errors.New("usage: mygit remote remove <name>")
+		}
+		return RemoveRemote(".", args[1])
+	case "rename":
+		if len(args) != 3 {
+			return errors.New("usage: mygit remote rename <old> <new>")
+		}
+		return RenameRemote(".", args[1], args[2])
+	case "set-url":
+		return remoteSetURLCmd(args[1:])
+	}
+	return fmt.Errorf("unknown subcommand: %s", args[0])
+}
+
+// Names of the configured remotes, sorted.
+func remoteNames(localDir string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, v := range allConfigVars(localDir) {
+		if v.Section == "remote" && v.Subsection != "" && !seen[v.Subsection] {
+			seen[v.Subsection] = true
+			names = append(names, v.Subsection)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func remoteExists(localDir, name string) bool {
+	for _, remote := range remoteNames(localDir) {
+		if remote == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a remote can be named so: its refs/remotes/<name>/ must be a
+// valid ref prefix.
+func validRemoteName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "-") && checkRefFormat("refs/remotes/"+name+"/test")
+}
+
+func listRemotes(localDir string, verbose bool) error {
+	for _, name := range remoteNames(localDir) {
+		if !verbose {
+			fmt.Println(name)
+			continue
+		}
+		for _, url := range configValues(localDir, "remote."+name+".url") {
+			fmt.Printf("%s\t%s (fetch)\n", name, url)
+		}
+		for _, url := range remotePushURLs(localDir, name) {
+			fmt.Printf("%s\t%s (push)\n", name, url)
+		}
+	}
+	return nil
+}
+
+// How remote add sets up a remote.
+type remoteAddOptions struct {
+	Fetch    bool     // fetch from it straight away
+	Branches []string // track only these branches rather than all
+	Master   string   // branch refs/remotes/<name>/HEAD points at
+	TagOpt   string   // "--tags" or "--no-tags" to change how tags are fetched
+	Mirror   string   // "fetch" to mirror its refs, "push" to push as a mirror
+}
+
+func remoteAddCmd(args []string) error {
+	var options remoteAddOptions
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "-f", "--fetch":
+			options.Fetch = true
+		case "--tags", "--no-tags":
+			options.TagOpt = arg
+		case "--mirror":
+			options.Mirror = "push"
+		case "-t", "--track", "-m", "--master":
+			if i+1 == len(args) {
+				return fmt.Errorf("switch `%s' requires a value", strings.TrimLeft(arg, "-"))
+			}
+			i++
+			if arg == "-t" || arg == "--track" {
+				options.Branches = append(options.Branches, args[i])
+			} else {
+				options.Master = args[i]
+			}
+		default:
+			if mirror, ok := cutPrefix(arg, "--mirror="); ok {
+				if mirror != "fetch" && mirror != "push" {
+					return fmt.Errorf("unknown mirror argument: %s", mirror)
+				}
+				options.Mirror = mirror
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
+				return fmt.Errorf("unknown option: %s", arg)
+			}
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 {
+		return errors.New("usage: mygit remote add [<options>] <name> <url>")
+	}
+	return AddRemote(".", positional[0], positional[1], options)
+}
+
+// Configure a new remote, fetching all its branches into
+// refs/remotes/<name>/ unless told otherwise.
+func AddRemote(localDir, name, url string, options remoteAddOptions) error {
+	if options.Mirror != "" && (len(options.Branches) > 0 || options.Master != "") {
+		return errors.New("specifying branches to track makes sense only with fetch mirrors")
+	}
+	if remoteExists(localDir, name) {
+		return fmt.Errorf("remote %s already exists.", name)
+	}
+	if !validRemoteName(name) {
+		return fmt.Errorf("'%s' is not a valid remote name", name)
+	}
+	entries := []configEntry{{"url", url}}
+	switch {
+	case options.Mirror == "fetch":
+		entries = append(entries, configEntry{"fetch", "+refs/*:refs/*"})
+	case options.Mirror == "push":
+		entries = append(entries, configEntry{"mirror", "true"})
+	case len(options.Branches) == 0:
+		entries = append(entries, configEntry{"fetch", "+refs/heads/*:refs/remotes/" + name + "/*"})
+	default:
+		for _, branch := range options.Branches {
+			entries = append(entries, configEntry{"fetch", "+refs/heads/" + branch + ":refs/remotes/" + name + "/" + branch})
+		}
+	}
+	if options.TagOpt != "" {
+		entries = append(entries, configEntry{"tagOpt", options.TagOpt})
+	}
+	if err := appendConfigSection(localDir, "remote", name, entries...); err != nil {
+		return err
+	}
+	if options.Fetch {
+		if err := Fetch(localDir, name, nil, fetchOptions{}); err != nil {
+			return err
+		}
+	}
+	if options.Master != "" {
+		return writeSymref(localDir, "refs/remotes/"+name+"/HEAD", "refs/remotes/"+name+"/"+options.Master)
+	}
+	return nil
+}
+
+// Remove a remote with its remote-tracking refs and the configuration of
+// branches tracking it. Refs it fetches outside refs/remotes/ are kept.
+func RemoveRemote(localDir, name string) error {
+	if !remoteExists(localDir, name) {
+		return fmt.Errorf("No such remote: '%s'", name)
+	}
+	specs, err := configuredRefspecs(localDir, name)
+	if err != nil {
+		return err
+	}
+	// Refs another remote also fetches into are left to it.
+	var otherSpecs []refspec
+	for _, other := range remoteNames(localDir) {
+		if other == name {
+			continue
+		}
+		more, err := configuredRefspecs(localDir, other)
+		if err != nil {
+			return err
+		}
+		otherSpecs = append(otherSpecs, more...)
+	}
+	refs, err := localRefs(localDir, "refs/")
+	if err != nil {
+		return err
+	}
+	var removed, skipped []string
+	for ref := range refs {
+		if !fetchedByRefspecs(ref, specs) || fetchedByRefspecs(ref, otherSpecs) {
+			continue
+		}
+		if strings.HasPrefix(ref, "refs/remotes/") {
+			removed = append(removed, ref)
+		} else {
+			skipped = append(skipped, ref)
+		}
+	}
+	// A symbolic ref such as refs/remotes/<name>/HEAD goes too.
+	sort.Strings(removed)
+	for _, ref := range removed {
+		if err := deleteRef(localDir, ref); err != nil {
+			return err
+		}
+		// Directories left empty go with the ref and its reflog.
+		for _, name := range []string{ref, "logs/" + ref} {
+			if err := removeWorkFile(gitDir(localDir), name); err != nil {
+				return err
+			}
+		}
+	}
+
+	err = editConfigFile(repositoryConfigPath(localDir), func(f *configFile) error {
+		for _, v := range f.Vars {
+			if v.Section != "branch" || v.Subsection == "" || v.Value != name {
+				continue
+			}
+			switch v.Key {
+			case "remote":
+				for _, key := range []string{"remote", "merge"} {
+					if _, err := f.unset("branch." + v.Subsection + "." + key); err != nil {
+						return err
+					}
+				}
+			case "pushremote":
+				if _, err := f.unset("branch." + v.Subsection + ".pushremote"); err != nil {
+					return err
+				}
+			}
+		}
+		f.removeSection("remote", name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(skipped) > 0 {
+		sort.Strings(skipped)
+		if len(skipped) == 1 {
+			fmt.Fprintln(os.Stderr, "Note: A branch outside the refs/remotes/ hierarchy was not removed;\nto delete it, use:")
+		} else {
+			fmt.Fprintln(os.Stderr, "Note: Some branches outside the refs/remotes/ hierarchy were not removed;\nto delete them, use:")
+		}
+		for _, ref := range skipped {
+			fmt.Fprintf(os.Stderr, "  git branch -d %s\n", strings.TrimPrefix(ref, "refs/heads/"))
+		}
+	}
+	return nil
+}
+
+// Whether a local ref is where one of the refspecs puts a fetched ref.
+func fetchedByRefspecs(ref string, specs []refspec) bool {
+	for _, spec := range specs {
+		if spec.Dst == "" {
+			continue
+		}
+		if _, ok := (refspec{Src: spec.Dst, Dst: spec.Src}).match(ref); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Rename a remote: its configuration, its default fetch refspecs, the
+// branches tracking it and its remote-tracking refs with their reflogs.
+func RenameRemote(localDir, oldName, newName string) error {
+	if !remoteExists(localDir, oldName) {
+		return fmt.Errorf("No such remote: '%s'", oldName)
+	}
+	if oldName == newName {
+		return nil
+	}
+	if remoteExists(localDir, newName) {
+		return fmt.Errorf("remote %s already exists.", newName)
+	}
+	if !validRemoteName(newName) {
+		return fmt.Errorf("'%s' is not a valid remote name", newName)
+	}
+	oldPrefix, newPrefix := "refs/remotes/"+oldName+"/", "refs/remotes/"+newName+"/"
+
+	err := editConfigFile(repositoryConfigPath(localDir), func(f *configFile) error {
+		f.renameSection("remote", oldName, newName)
+		for i := 0; i < len(f.Vars); i++ {
+			v := f.Vars[i]
+			value := v.Value
+			switch {
+			case v.Section == "remote" && v.Subsection == newName && v.Key == "fetch":
+				if src, dst, ok := strings.Cut(value, ":"); ok && strings.HasPrefix(dst, oldPrefix) {
+					value = src + ":" + newPrefix + strings.TrimPrefix(dst, oldPrefix)
+				}
+			case v.Section == "branch" && (v.Key == "remote" || v.Key == "pushremote") && value == oldName,
+				v.Section == "remote" && v.Subsection == "" && v.Key == "pushdefault" && value == oldName,
+				v.Section == "extensions" && v.Key == "partialclone" && value == oldName:
+				value = newName
+			}
+			if value != v.Value {
+				// The edit keeps the number and order of variables.
+				f.replace(v, v.key, value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	refs, err := localRefs(localDir, oldPrefix)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(refs))
+	for ref := range refs {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+	for _, ref := range names {
+		renamed := newPrefix + strings.TrimPrefix(ref, oldPrefix)
+		if target, ok := readSymref(localDir, ref); ok {
+			if strings.HasPrefix(target, oldPrefix) {
+				target = newPrefix + strings.TrimPrefix(target, oldPrefix)
+			}
+			err = writeSymref(localDir, renamed, target)
+		} else {
+			err = writeRef(localDir, renamed, refs[ref])
+		}
+		if err != nil {
+			return err
+		}
+		if err := deleteRef(localDir, ref); err != nil {
+			return err
+		}
+		if err := renameReflog(localDir, ref, renamed); err != nil {
+			return err
+		}
+		if err := removeWorkFile(gitDir(localDir), ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renameReflog(localDir, oldRef, newRef string) error {
+	newPath := reflogPath(localDir, newRef)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	err := os.Rename(reflogPath(localDir, oldRef), newPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return removeWorkFile(gitDir(localDir), "logs/"+oldRef)
+}
+
+func remoteSetURLCmd(args []string) error {
+	push, add, remove := false, false, false
+	var positional []string
+	for _, arg := range args {
+		switch arg {
+		case "--push":
+			push = true
+		case "--add":
+			add = true
+		case "--delete":
+			remove = true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				return fmt.Errorf("unknown option: %s", arg)
+			}
+			positional = append(positional, arg)
+		}
+	}
+	if add && remove {
+		return errors.New("--add --delete doesn't make sense")
+	}
+	if len(positional) < 2 || len(positional) > 3 || (add || remove) && len(positional) != 2 {
+		return errors.New("usage: mygit remote set-url [--push] [--add | --delete] <name> <newurl> [<oldurl>]")
+	}
+	oldURL := ""
+	if len(positional) == 3 {
+		oldURL = positional[2]
+	}
+	return SetRemoteURL(".", positional[0], positional[1], oldURL, push, add, remove)
+}
+
+// Change the URL of a remote, or its push URL. The URL replaced, or the
+// ones deleted, are those matching a regular expression.
+func SetRemoteURL(localDir, name, newURL, oldURL string, push, add, remove bool) error {
+	if !remoteExists(localDir, name) {
+		return fmt.Errorf("No such remote '%s'", name)
+	}
+	key := "remote." + name + ".url"
+	if push {
+		key = "remote." + name + ".pushurl"
+	}
+	return editConfigFile(repositoryConfigPath(localDir), func(f *configFile) error {
+		if add {
+			return f.add(key, newURL)
+		}
+		if !remove && oldURL == "" {
+			return f.set(key, newURL)
+		}
+		pattern := oldURL
+		if remove {
+			pattern = newURL
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid old URL pattern: %s", pattern)
+		}
+		vars, err := f.matching(key)
+		if err != nil {
+			return err
+		}
+		var matched []configVar
+		for _, v := range vars {
+			if re.MatchString(v.Value) {
+				matched = append(matched, v)
+			}
+		}
+		switch {
+		case len(matched) == 0:
+			return fmt.Errorf("No such URL found: %s", pattern)
+		case remove && !push && len(matched) == len(vars):
+			return errors.New("Will not delete all non-push URLs")
+		case remove:
+			for i := len(matched) - 1; i >= 0; i-- {
+				f.remove(matched[i])
+			}
+			return nil
+		case len(matched) > 1:
+			return fmt.Errorf("warning: %s has multiple values", key)
+		}
+		f.replace(matched[0], matched[0].key, newURL)
+		return nil
+	})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Usage:
+//
+//	mygit reset [--soft | --mixed | --hard] [<rev>]
+//	mygit reset [<rev>] [--] <paths>...
+func resetCmd(args []string) error {
+	mode, explicitMode := "mixed", false
+	var revs, paths []string
+	for i, arg := range args {
+		if arg == "--" {
+			paths = append(paths, args[i+1:]...)
+			break
+		}
+		switch arg {
+		case "--soft", "--mixed", "--hard":
+			mode, explicitMode = strings.TrimPrefix(arg, "--"), true
+		default:
+			if strings.HasPrefix(arg, "-") {
+				return fmt.Errorf("unknown option: %s", arg)
+			}
+			revs = append(revs, arg)
+		}
+	}
+	rev := "HEAD"
+	if len(revs) > 0 {
+		// Without "--", a first argument that is not a revision is a path.
+		if _, err := revParse(".", revs[0]); err == nil || len(paths) > 0 || explicitMode {
+			rev, revs = revs[0], revs[1:]
+		}
+	}
+	paths = append(revs, paths...)
+	if len(paths) > 0 {
+		if explicitMode {
+			return fmt.Errorf("cannot do --%s reset with paths", mode)
+		}
+		return ResetPaths(".", rev, paths)
+	}
+	return Reset(".", mode, rev)
+}
+
+// Move the current branch to rev. Mixed also resets the index to the target
+// tree, and hard additionally rewrites the working tree.
+func Reset(localDir, mode, rev string) error {
+	target, err := revParse(localDir, rev)
+	if err != nil {
+		return err
+	}
+	if target, err = peelToCommit(localDir, target); err != nil {
+		return err
+	}
+	commit, err := readCommit(localDir, target)
+	if err != nil {
+		return err
+	}
+	_, head, err := readHead(localDir)
+	if err != nil {
+		return err
+	}
+
+	if mode == "hard" {
+		if err := hardResetWorkTree(localDir, commit.Tree); err != nil {
+			return err
+		}
+	}
+	if head != "" {
+		if err := writeRef(localDir, "ORIG_HEAD", head); err != nil {
+			return err
+		}
+	}
+	if err := updateHead(localDir, target); err != nil {
+		return err
+	}
+	if mode == "soft" {
+		return nil
+	}
+	if err := writeIndexFromTree(localDir, commit.Tree); err != nil {
+		return err
+	}
+	if mode == "hard" {
+		fmt.Printf("HEAD is now at %s %s\n", shortSha(target), commit.Subject())
+		return nil
+	}
+	return printUnstagedChanges(localDir)
+}
+
+// Rewrite every tracked file, discarding local changes, so the working tree
+// matches treeSha.
+func hardResetWorkTree(localDir, treeSha string) error {
+	index, err := readIndex(localDir)
+	if err != nil {
+		return err
+	}
+	current, err := headTree(localDir)
+	if err != nil {
+		return err
+	}
+	paths, err := treePaths(localDir, current, treeSha)
+	if err != nil {
+		return err
+	}
+	for _, entry := range index.Entries {
+		paths[entry.Name] = true
+	}
+	onDisk, err := snapshotWorkFiles(localDir, paths, false)
+	if err != nil {
+		return err
+	}
+	want, err := flattenTree(localDir, treeSha)
+	if err != nil {
+		return err
+	}
+	return checkoutFiles(localDir, onDisk, want)
+}
+
+// Reset the index entries of the given paths to their state in rev, leaving
+// HEAD and the working tree alone.
+func ResetPaths(localDir, rev string, paths []string) error {
+	treeSha := emptyTreeSha
+	if _, head, _ := readHead(localDir); head != "" || rev != "HEAD" {
+		target, err := revParse(localDir, rev)
+		if err != nil {
+			return err
+		}
+		if target, err = peelToCommit(localDir, target); err != nil {
+			return err
+		}
+		commit, err := readCommit(localDir, target)
+		if err != nil {
+			return err
+		}
+		treeSha = commit.Tree
+	}
+	files, err := flattenTree(localDir, treeSha)
+	if err != nil {
+		return err
+	}
+	index, err := readIndex(localDir)
+	if err != nil {
+		return err
+	}
+
+	matched := make(map[string]bool)
+	for _, name := range paths {
+		prefix := filepath.ToSlash(filepath.Clean(name))
+		if prefix == "." {
+			prefix = ""
+		}
+		for file := range files {
+			if pathMatchesPrefix(file, prefix) {
+				matched[file] = true
+			}
+		}
+		for _, entry := range index.Entries {
+			if pathMatchesPrefix(entry.Name, prefix) {
+				matched[entry.Name] = true
+			}
+		}
+	}
+	for name := range matched {
+		file, ok := files[name]
+		if !ok {
+			index.set(name, nil)
+			continue
+		}
+		if current := index.entry(name); current != nil && current.File() == file {
+			continue
+		}
+		entry, err := newIndexEntry(name, file)
+		if err != nil {
+			return err
+		}
+		entry.updateStat(localDir)
+		index.set(name, entry)
+	}
+	if err := index.write(localDir); err != nil {
+		return err
+	}
+	return printUnstagedChanges(localDir)
+}
+
+// Report whether name is prefix itself or lies inside the directory prefix.
+func pathMatchesPrefix(name, prefix string) bool {
+	return prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// List index entries whose working tree file was modified or deleted.
+func unstagedChanges(localDir string, index *Index) ([]string, error) {
+	var changes []string
+	for _, entry := range index.Entries {
+		if entry.Stage != 0 || entry.TreeMode() == "160000" {
+			continue
+		}
+		current, err := hashWorkFile(localDir, entry.Name)
+		switch {
+		case os.IsNotExist(err):
+			changes = append(changes, "D\t"+entry.Name)
+		case err != nil:
+			return nil, err
+		case current != entry.File():
+			changes = append(changes, "M\t"+entry.Name)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i][2:] < changes[j][2:] })
+	return changes, nil
+}
+
+func printUnstagedChanges(localDir string) error {
+	index, err := readIndex(localDir)
+	if err != nil {
+		return err
+	}
+	changes, err := unstagedChanges(localDir, index)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	fmt.Println("Unstaged changes after reset:")
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	return nil
+}
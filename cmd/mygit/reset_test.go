@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Two commits, the working tree at the second with a local change in "a", an
+// untracked file and a staged new file.
+func resetRepo(t *testing.T) (dir, first, second string) {
+	dir = newTestRepo(t)
+	first = commitFiles(t, dir, "", "first", map[string]string{"a": "a1\n", "b": "b1\n"})
+	second = commitFiles(t, dir, first, "second", map[string]string{"a": "a2\n", "sub/c": "c2\n"})
+	resetHard(t, dir, second)
+	writeTestFile(t, dir, "a", "local\n")
+	writeTestFile(t, dir, "untracked", "u\n")
+	writeTestFile(t, dir, "staged", "s\n")
+	if err := Add(dir, []string{"staged"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	return dir, first, second
+}
+
+func TestResetSoft(t *testing.T) {
+	dir, first, second := resetRepo(t)
+	before := indexFiles(t, dir)
+	if err := Reset(dir, "soft", "HEAD~1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := headSha(t, dir); got != first {
+		t.Errorf("HEAD is %s, want %s", got, first)
+	}
+	if got := mustRevParse(t, dir, "ORIG_HEAD"); got != second {
+		t.Errorf("ORIG_HEAD is %s, want %s", got, second)
+	}
+	if !sameFiles(indexFiles(t, dir), before) {
+		t.Error("a soft reset changed the index")
+	}
+	if got := readTestFile(t, dir, "a"); got != "local\n" {
+		t.Errorf("a soft reset changed a to %q", got)
+	}
+}
+
+func TestResetMixed(t *testing.T) {
+	dir, first, _ := resetRepo(t)
+	if err := Reset(dir, "mixed", first); err != nil {
+		t.Fatal(err)
+	}
+	if got := headSha(t, dir); got != first {
+		t.Errorf("HEAD is %s, want %s", got, first)
+	}
+	if !sameFiles(indexFiles(t, dir), treeFiles(t, dir, first)) {
+		t.Error("the index does not match the target")
+	}
+	for name, want := range map[string]string{"a": "local\n", "sub/c": "c2\n", "staged": "s\n"} {
+		if got := readTestFile(t, dir, name); got != want {
+			t.Errorf("a mixed reset changed %s to %q", name, got)
+		}
+	}
+}
+
+func TestResetHard(t *testing.T) {
+	dir, first, _ := resetRepo(t)
+	if err := Reset(dir, "hard", first); err != nil {
+		t.Fatal(err)
+	}
+	if !sameFiles(indexFiles(t, dir), treeFiles(t, dir, first)) {
+		t.Error("the index does not match the target")
+	}
+	// Tracked and staged files follow the target; untracked ones stay.
+	for name, want := range map[string]string{"a": "a1\n", "b": "b1\n", "sub/c": "", "staged": "", "untracked": "u\n"} {
+		if got := readTestFile(t, dir, name); got != want {
+			t.Errorf("%s is %q after a hard reset, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub")); !os.IsNotExist(err) {
+		t.Error("the emptied directory was left behind")
+	}
+
+	// Back to where it was, through ORIG_HEAD.
+	if err := Reset(dir, "hard", "ORIG_HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, dir, "sub/c"); got != "c2\n" {
+		t.Errorf("sub/c is %q after resetting to ORIG_HEAD", got)
+	}
+}
+
+func TestResetPaths(t *testing.T) {
+	dir, first, second := resetRepo(t)
+	if err := Add(dir, []string{"a"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	head := treeFiles(t, dir, "HEAD")
+
+	// Unstage a, leaving the staged new file alone.
+	if err := ResetPaths(dir, "HEAD", []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	files := indexFiles(t, dir)
+	if files["a"] != head["a"] {
+		t.Error("a is still staged")
+	}
+	if _, ok := files["staged"]; !ok {
+		t.Error("resetting a unstaged another file")
+	}
+	if got := readTestFile(t, dir, "a"); got != "local\n" {
+		t.Errorf("resetting a path changed the file to %q", got)
+	}
+	if got := headSha(t, dir); got != second {
+		t.Errorf("resetting a path moved HEAD to %s", got)
+	}
+
+	// A path missing from the revision leaves the index.
+	if err := ResetPaths(dir, "HEAD", []string{"staged"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := indexFiles(t, dir)["staged"]; ok {
+		t.Error("staged is still in the index")
+	}
+
+	// A directory resets everything under it, from another revision.
+	if err := ResetPaths(dir, first, []string{"sub"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := indexFiles(t, dir)["sub/c"]; ok {
+		t.Error("sub/c is still in the index")
+	}
+}
+
+func TestResetPathsUnbornBranch(t *testing.T) {
+	dir := newTestRepo(t)
+	writeTestFile(t, dir, "new", "n\n")
+	if err := Add(dir, []string{"new"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ResetPaths(dir, "HEAD", []string{"new"}); err != nil {
+		t.Fatal(err)
+	}
+	if files := indexFiles(t, dir); len(files) != 0 {
+		t.Errorf("index still has %d files", len(files))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+// Collect every commit reachable from the given tips.
+func reachableCommits(localDir string, tips ...string) (map[string]bool, error) {
+	return reachableCommitsWithin(localDir, tips, nil)
+}
+
+// Collect the commits reachable from tips without going past the commits
+// in stop, which are collected but not their parents.
+func reachableCommitsWithin(localDir string, tips []string, stop map[string]bool) (map[string]bool, error) {
+	seen := make(map[string]bool)
+	stack := append([]string{}, tips...)
+	for len(stack) > 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if sha == "" || seen[sha] {
+			continue
+		}
+		seen[sha] = true
+		if stop[sha] {
+			continue
+		}
+		commit, err := readCommit(localDir, sha)
+		if err != nil {
+			return nil, err
+		}
+		stack = append(stack, commit.Parents...)
+	}
+	return seen, nil
+}
+
+// Report whether ancestor is reachable from sha.
+func isAncestor(localDir, ancestor, sha string) (bool, error) {
+	reachable, err := reachableCommits(localDir, sha)
+	if err != nil {
+		return false, err
+	}
+	return reachable[ancestor], nil
+}
+
+// List commits reachable from tip but not from any of exclude, parents before
+// children.
+func commitsBetween(localDir string, exclude []string, tip string) ([]string, error) {
+	excluded, err := reachableCommits(localDir, exclude...)
+	if err != nil {
+		return nil, err
+	}
+	type frame struct {
+		sha      string
+		expanded bool
+	}
+	var order []string
+	visited := make(map[string]bool)
+	stack := []frame{{sha: tip}}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if top.expanded {
+			order = append(order, top.sha)
+			continue
+		}
+		if top.sha == "" || visited[top.sha] || excluded[top.sha] {
+			continue
+		}
+		visited[top.sha] = true
+		commit, err := readCommit(localDir, top.sha)
+		if err != nil {
+			return nil, err
+		}
+		stack = append(stack, frame{sha: top.sha, expanded: true})
+		for i := len(commit.Parents) - 1; i >= 0; i-- {
+			stack = append(stack, frame{sha: commit.Parents[i]})
+		}
+	}
+	return order, nil
+}
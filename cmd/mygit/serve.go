@@ -0,0 +1,198 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+func serveCmd(args []string) error {
+	addr := ":8080"
+	users := make(map[string]string)
+	private := false
+	var positional []string
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--listen="):
+			addr = strings.TrimPrefix(arg, "--listen=")
+		case strings.HasPrefix(arg, "--user="):
+			name, password, ok := strings.Cut(strings.TrimPrefix(arg, "--user="), ":")
+			if !ok {
+				return fmt.Errorf("invalid --user '%s', expected <name>:<password>", arg)
+			}
+			users[name] = password
+		case arg == "--private":
+			private = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option: %s", arg)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) > 1 || (private && len(users) == 0) {
+		return errors.New("usage: mygit serve [--listen=<addr>] [--user=<name>:<password>]... [--private] [<root>]")
+	}
+	root := "."
+	if len(positional) == 1 {
+		root = positional[0]
+	}
+	handler := &gitHTTPHandler{Root: root, ErrorLog: os.Stderr}
+	if len(users) > 0 {
+		handler.Authorize = usersAuthorizer(users, private)
+	}
+	fmt.Fprintf(os.Stderr, "Serving %s on http://%s/\n", root, addr)
+	return http.ListenAndServe(addr, handler)
+}
+
+// Let the users in by basic auth, and anyone fetch unless private.
+func usersAuthorizer(users map[string]string, private bool) func(r *http.Request, repo, service string) bool {
+	return func(r *http.Request, repo, service string) bool {
+		if service == "git-upload-pack" && !private {
+			return true
+		}
+		name, password, ok := r.BasicAuth()
+		want, known := users[name]
+		return ok && known && password == want
+	}
+}
+
+// Serves the repositories under Root over the smart HTTP protocol, as
+// git-http-backend does.
+// ref: https://git-scm.com/docs/http-protocol
+// ref: https://git-scm.com/docs/git-http-backend
+type gitHTTPHandler struct {
+	Root string
+	// Decide whether a request may use a service on a repository; a refusal
+	// asks for basic auth. Without a hook anyone may fetch, and pushes need
+	// http.receivepack set in the repository.
+	Authorize func(r *http.Request, repo, service string) bool
+	Realm     string
+	ErrorLog  io.Writer // where failed requests are reported, nil to drop them
+
+	lock sync.Mutex // requests share the object caches
+}
+
+var httpServices = map[string]bool{"git-upload-pack": true, "git-receive-pack": true}
+
+func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	repo, action := path.Split(r.URL.Path)
+	service := action
+	method := http.MethodPost
+	if action == "refs" && strings.HasSuffix(repo, "/info/") {
+		repo, service, method = strings.TrimSuffix(repo, "info/"), r.URL.Query().Get("service"), http.MethodGet
+	}
+	repo = strings.Trim(repo, "/")
+	switch {
+	case !httpServices[service]:
+		// The dumb protocol is not served.
+		http.Error(w, "unsupported service", http.StatusForbidden)
+		return
+	case r.Method != method:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dir, ok := h.repository(repo)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if h.Authorize != nil && !h.Authorize(r, repo, service) {
+		realm := h.Realm
+		if realm == "" {
+			realm = "mygit"
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	if !serviceEnabled(dir, service, h.Authorize != nil) {
+		http.Error(w, "service not enabled", http.StatusForbidden)
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	version := 0
+	if service == "git-upload-pack" && strings.Contains(r.Header.Get("Git-Protocol"), "version=2") {
+		version = 2
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	var err error
+	if method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
+		err = h.advertise(w, dir, service, version)
+	} else {
+		w.Header().Set("Content-Type", "application/x-"+service+"-result")
+		err = h.serve(w, r, dir, service, version)
+	}
+	if err != nil && h.ErrorLog != nil {
+		// Headers are gone by now, so the client sees a truncated response.
+		fmt.Fprintf(h.ErrorLog, "error: %s %s: %v\n", r.Method, r.URL.Path, err)
+	}
+}
+
+// Map a repository path onto a directory under Root, trying "<repo>.git"
+// too as hosting sites do.
+func (h *gitHTTPHandler) repository(repo string) (string, bool) {
+	for _, part := range strings.Split(repo, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	for _, candidate := range []string{repo, repo + ".git"} {
+		dir := filepath.Join(h.Root, filepath.FromSlash(candidate))
+		if isRepository(dir) {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// Like git-http-backend, fetches are on unless http.uploadpack is false and
+// pushes only with http.receivepack set or from authenticated users.
+func serviceEnabled(dir, service string, authenticated bool) bool {
+	key := "http.uploadpack"
+	if service == "git-receive-pack" {
+		key = "http.receivepack"
+	}
+	if _, ok := configValue(dir, key); !ok {
+		return service == "git-upload-pack" || authenticated
+	}
+	return configBool(dir, key)
+}
+
+func (h *gitHTTPHandler) advertise(w io.Writer, dir, service string, version int) error {
+	// A v2 server starts with its capabilities rather than the service line.
+	if version != 2 {
+		if err := writePktLines(w, "# service="+service); err != nil {
+			return err
+		}
+	}
+	if service == "git-receive-pack" {
+		return advertiseReceivePack(dir, w)
+	}
+	return advertiseUploadPack(dir, w, version)
+}
+
+func (h *gitHTTPHandler) serve(w io.Writer, r *http.Request, dir, service string, version int) error {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	if service == "git-receive-pack" {
+		return serveReceivePack(dir, body, w, true)
+	}
+	return serveUploadPack(dir, body, w, version, true)
+}
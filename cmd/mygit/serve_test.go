@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServiceEnabled(t *testing.T) {
+	tests := []struct {
+		config        map[string]string
+		service       string
+		authenticated bool
+		want          bool
+	}{
+		{service: "git-upload-pack", want: true},
+		{service: "git-receive-pack", want: false},
+		{service: "git-receive-pack", authenticated: true, want: true},
+		{config: map[string]string{"http.uploadpack": "false"}, service: "git-upload-pack", want: false},
+		{config: map[string]string{"http.uploadpack": "false"}, service: "git-upload-pack", authenticated: true, want: false},
+		{config: map[string]string{"http.receivepack": "true"}, service: "git-receive-pack", want: true},
+		{config: map[string]string{"http.receivepack": "false"}, service: "git-receive-pack", authenticated: true, want: false},
+	}
+	for _, tt := range tests {
+		_, dir := bareRepo(t)
+		for name, value := range tt.config {
+			if err := setConfigValue(dir, name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := serviceEnabled(dir, tt.service, tt.authenticated); got != tt.want {
+			t.Errorf("%s with %v, authenticated %v: enabled is %v", tt.service, tt.config, tt.authenticated, got)
+		}
+	}
+}
+
+// GET a service's advertisement, as name with password unless name is "",
+// returning the status and the headers.
+func getAdvertisement(t *testing.T, url, service, name, password string) (int, http.Header) {
+	t.Helper()
+	r, err := http.NewRequest(http.MethodGet, url+"/info/refs?service="+service, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "" {
+		r.SetBasicAuth(name, password)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, resp.Header
+}
+
+func TestHTTPHandler(t *testing.T) {
+	root, dir := bareRepo(t)
+	handler := &gitHTTPHandler{Root: root, ErrorLog: testLog{t}}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	url := server.URL + "/upstream"
+
+	// Anonymous: fetches are on, pushes off until the repository enables them.
+	if status, _ := getAdvertisement(t, url, "git-upload-pack", "", ""); status != http.StatusOK {
+		t.Errorf("fetch gave %d", status)
+	}
+	if status, _ := getAdvertisement(t, url, "git-receive-pack", "", ""); status != http.StatusForbidden {
+		t.Errorf("an anonymous push gave %d", status)
+	}
+	if err := setConfigValue(dir, "http.receivepack", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := getAdvertisement(t, url, "git-receive-pack", "", ""); status != http.StatusOK {
+		t.Errorf("http.receivepack=true gave %d", status)
+	}
+	if err := setConfigValue(dir, "http.uploadpack", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := getAdvertisement(t, url, "git-upload-pack", "", ""); status != http.StatusForbidden {
+		t.Errorf("http.uploadpack=false gave %d", status)
+	}
+
+	for path, want := range map[string]int{
+		"/missing/info/refs?service=git-upload-pack":     http.StatusNotFound,
+		"/../upstream/info/refs?service=git-upload-pack": http.StatusNotFound,
+		"/upstream/info/refs":                            http.StatusForbidden,
+		"/upstream/git-upload-pack":                      http.StatusMethodNotAllowed,
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s gave %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestHTTPHandlerAuthorize(t *testing.T) {
+	root, dir := bareRepo(t)
+	users := map[string]string{"alice": "secret", "nobody": ""}
+	public := &gitHTTPHandler{Root: root, Authorize: usersAuthorizer(users, false), Realm: "test", ErrorLog: testLog{t}}
+	private := &gitHTTPHandler{Root: root, Authorize: usersAuthorizer(users, true), ErrorLog: testLog{t}}
+	tests := []struct {
+		handler        *gitHTTPHandler
+		service        string
+		name, password string
+		want           int
+		realm          string // asked for on a 401
+	}{
+		{handler: public, service: "git-upload-pack", want: http.StatusOK},
+		{handler: public, service: "git-receive-pack", want: http.StatusUnauthorized, realm: "test"},
+		{handler: public, service: "git-receive-pack", name: "alice", password: "wrong", want: http.StatusUnauthorized, realm: "test"},
+		{handler: public, service: "git-receive-pack", name: "mallory", want: http.StatusUnauthorized, realm: "test"},
+		// An authenticated user may push without http.receivepack.
+		{handler: public, service: "git-receive-pack", name: "alice", password: "secret", want: http.StatusOK},
+		{handler: public, service: "git-receive-pack", name: "nobody", want: http.StatusOK},
+		{handler: private, service: "git-upload-pack", want: http.StatusUnauthorized, realm: "mygit"},
+		{handler: private, service: "git-upload-pack", name: "alice", password: "secret", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(tt.handler)
+		status, header := getAdvertisement(t, server.URL+"/upstream", tt.service, tt.name, tt.password)
+		server.Close()
+		if status != tt.want {
+			t.Errorf("%s as %q: got %d, want %d", tt.service, tt.name, status, tt.want)
+		}
+		want := ""
+		if tt.realm != "" {
+			want = `Basic realm="` + tt.realm + `"`
+		}
+		if got := header.Get("WWW-Authenticate"); got != want {
+			t.Errorf("%s as %q: WWW-Authenticate is %q, want %q", tt.service, tt.name, got, want)
+		}
+	}
+
+	// http.receivepack=false turns pushes off even for the users.
+	if err := setConfigValue(dir, "http.receivepack", "false"); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(public)
+	defer server.Close()
+	if status, _ := getAdvertisement(t, server.URL+"/upstream", "git-receive-pack", "alice", "secret"); status != http.StatusForbidden {
+		t.Errorf("http.receivepack=false gave %d", status)
+	}
+}
+
+func TestPushRefusedAnonymously(t *testing.T) {
+	upstream, local, _, _ := fetchRepos(t)
+	if err := Fetch(local, "origin", nil, fetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	master := mustRevParse(t, upstream, "master")
+	ahead := commitFiles(t, local, master, "ahead", map[string]string{"a": "ahead\n"})
+	if err := writeRef(local, "refs/heads/master", ahead); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	output := captureOutput(t, func() { err = Push(local, "origin", []string{"master"}, false, false) })
+	if err == nil {
+		t.Fatal("pushed without http.receivepack")
+	}
+	if !strings.Contains(output+err.Error(), "403") {
+		t.Errorf("the refusal does not say why:\n%s%v", output, err)
+	}
+	checkRef(t, upstream, "refs/heads/master", master)
+}
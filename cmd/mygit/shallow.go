@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The commits listed in .git/shallow, whose parents a shallow repository
+// does not have. History walks treat them as roots.
+// ref: https://git-scm.com/docs/gitrepository-layout#Documentation/gitrepository-layout.txt-shallow
+var (
+	shallowFiles     = make(map[string]map[string]bool)
+	shallowFilesLock sync.Mutex
+)
+
+func shallowPath(localDir string) string {
+	return filepath.Join(gitDir(localDir), "shallow")
+}
+
+func shallowCommits(localDir string) map[string]bool {
+	path := shallowPath(localDir)
+	shallowFilesLock.Lock()
+	defer shallowFilesLock.Unlock()
+	if commits, ok := shallowFiles[path]; ok {
+		return commits
+	}
+	commits := make(map[string]bool)
+	if data, err := os.ReadFile(path); err == nil {
+		for _, sha := range strings.Fields(string(data)) {
+			commits[sha] = true
+		}
+	}
+	shallowFiles[path] = commits
+	return commits
+}
+
+func isShallow(localDir, sha string) bool {
+	return shallowCommits(localDir)[sha]
+}
+
+func isShallowRepository(localDir string) bool {
+	return len(shallowCommits(localDir)) > 0
+}
+
+// Record what a fetch said about the boundary: commits now shallow, and
+// formerly shallow ones whose parents arrived. The file goes away once
+// history is complete.
+func updateShallow(localDir string, shallow, unshallow []string) error {
+	if len(shallow) == 0 && len(unshallow) == 0 {
+		return nil
+	}
+	commits := make(map[string]bool)
+	for sha := range shallowCommits(localDir) {
+		commits[sha] = true
+	}
+	for _, sha := range shallow {
+		commits[sha] = true
+	}
+	for _, sha := range unshallow {
+		delete(commits, sha)
+	}
+	shas := sortedKeys(commits)
+	path := shallowPath(localDir)
+	shallowFilesLock.Lock()
+	defer shallowFilesLock.Unlock()
+	shallowFiles[path] = commits
+	if len(shas) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeFile(path, []byte(strings.Join(shas, "\n")+"\n"))
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The depth asked for by --unshallow, which git treats as infinite.
+const infiniteDepth = 0x7fffffff
+
+// How far a fetch deepens history, sent to the server as deepen lines.
+// ref: https://git-scm.com/docs/pack-protocol#_shallow_clients
+type deepenOptions struct {
+	Depth    int      // commits from each tip, or past the current boundary when Relative
+	Relative bool     // --deepen rather than --depth
+	Since    int64    // unix time of the oldest commit to fetch, 0 for none
+	Not      []string // refs whose history is left out
+}
+
+func (d deepenOptions) requested() bool {
+	return d.Depth > 0 || d.Since != 0 || len(d.Not) > 0
+}
+
+// Parse one of the options of fetch and clone that make or deepen a
+// shallow history, reporting false for any other argument.
+func parseDeepenOption(arg string, d *deepenOptions) (bool, error) {
+	switch {
+	case strings.HasPrefix(arg, "--depth="), strings.HasPrefix(arg, "--deepen="):
+		name, value, _ := strings.Cut(arg, "=")
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth <= 0 {
+			return true, fmt.Errorf("depth %s is not a positive number", value)
+		}
+		d.Depth, d.Relative = depth, name == "--deepen"
+	case strings.HasPrefix(arg, "--shallow-since="):
+		value := strings.TrimPrefix(arg, "--shallow-since=")
+		since, err := parseDate(value)
+		if err != nil {
+			return true, err
+		}
+		d.Since = since.Unix()
+	case strings.HasPrefix(arg, "--shallow-exclude="):
+		d.Not = append(d.Not, strings.TrimPrefix(arg, "--shallow-exclude="))
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Parse a date as given to --shallow-since: a Unix timestamp, a date or a
+// relative time like "2.weeks.ago".
+func parseDate(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(strings.TrimPrefix(value, "@"), 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	date, ok, err := parseExpiry(value, time.Now())
+	if err != nil || !ok {
+		return time.Time{}, fmt.Errorf("invalid date '%s'", value)
+	}
+	return date, nil
+}
+
+// Refuse deepen requests the server cannot honour, with git's messages.
+func (r *gitRemote) checkShallowSupport() error {
+	// Protocol v2 servers offer the deepen variants along with shallow.
+	supports := func(capability string) bool {
+		if r.Version == 2 {
+			return r.fetchSupports("shallow")
+		}
+		return r.fetchSupports(capability)
+	}
+	switch {
+	case (len(r.Shallow) > 0 || r.Deepen.requested()) && !supports("shallow"):
+		return errors.New("Server does not support shallow clients")
+	case r.Deepen.Since != 0 && !supports("deepen-since"):
+		return errors.New("Server does not support --shallow-since")
+	case len(r.Deepen.Not) > 0 && !supports("deepen-not"):
+		return errors.New("Server does not support --shallow-exclude")
+	case r.Deepen.Relative && !supports("deepen-relative"):
+		return errors.New("Server does not support --deepen")
+	}
+	return nil
+}
+
+// The shallow and deepen lines of a request. A v0 request asks for
+// deepen-relative as a capability instead.
+func (r *gitRemote) shallowLines() []string {
+	var lines []string
+	for _, sha := range r.Shallow {
+		lines = append(lines, "shallow "+sha)
+	}
+	d := r.Deepen
+	if d.Depth > 0 {
+		lines = append(lines, "deepen "+strconv.Itoa(d.Depth))
+	}
+	if d.Relative && r.Version == 2 {
+		lines = append(lines, "deepen-relative")
+	}
+	if d.Since != 0 {
+		lines = append(lines, "deepen-since "+strconv.FormatInt(d.Since, 10))
+	}
+	for _, ref := range d.Not {
+		lines = append(lines, "deepen-not "+ref)
+	}
+	return lines
+}
+
+// Note a "shallow <sha>" or "unshallow <sha>" line from the server,
+// reporting false for anything else.
+func (r *gitRemote) readShallowLine(line string) bool {
+	if sha, ok := cutPrefix(line, "shallow "); ok {
+		r.NewShallow = append(r.NewShallow, sha)
+		return true
+	}
+	if sha, ok := cutPrefix(line, "unshallow "); ok {
+		r.Unshallow = append(r.Unshallow, sha)
+		return true
+	}
+	return false
+}
+
+// Work out the history boundary of a shallow client after a deepen request,
+// as upload-pack does: the commits the client will lack the parents of and
+// every commit that it will have whole. Walks stop at the shallow commits
+// the client already has when deepening relative to them.
+func deepenBoundary(localDir string, wants []string, clientShallow map[string]bool, d deepenOptions) (shallow, reached map[string]bool, err error) {
+	shallow, reached = make(map[string]bool), make(map[string]bool)
+	var tips []string
+	for _, sha := range wants {
+		commit, err := peelToCommit(localDir, sha)
+		if err != nil {
+			return nil, nil, err
+		}
+		tips = append(tips, commit)
+	}
+	if d.Depth > 0 && (d.Since != 0 || len(d.Not) > 0) {
+		return nil, nil, errors.New("deepen and deepen-since (or deepen-not) cannot be used together")
+	}
+	if d.Depth == 0 {
+		err = deepenByRevisions(localDir, tips, d, shallow, reached)
+		return shallow, reached, err
+	}
+
+	type queued struct {
+		sha   string
+		depth int
+	}
+	var queue []queued
+	if d.Relative {
+		// Everything above the current boundary, which is then deepened.
+		above, err := reachableCommitsWithin(localDir, tips, clientShallow)
+		if err != nil {
+			return nil, nil, err
+		}
+		for sha := range above {
+			reached[sha] = true
+			if clientShallow[sha] {
+				queue = append(queue, queued{sha, 1})
+			}
+		}
+		sort.Slice(queue, func(i, j int) bool { return queue[i].sha < queue[j].sha })
+		d.Depth++
+	} else {
+		for _, sha := range tips {
+			queue = append(queue, queued{sha, 1})
+		}
+	}
+	depths := make(map[string]int)
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if depth, ok := depths[c.sha]; ok && depth <= c.depth {
+			continue
+		}
+		depths[c.sha] = c.depth
+		reached[c.sha] = true
+		commit, err := readCommit(localDir, c.sha)
+		if err != nil {
+			return nil, nil, err
+		}
+		if c.depth >= d.Depth {
+			if len(commit.Parents) > 0 {
+				shallow[c.sha] = true
+			}
+			continue
+		}
+		for _, parent := range commit.Parents {
+			queue = append(queue, queued{parent, c.depth + 1})
+		}
+	}
+	return shallow, reached, nil
+}
+
+// Find the boundary for deepen-since and deepen-not: commits older than
+// Since or reachable from a Not ref are left out, and those that remain
+// but have a parent left out become shallow.
+func deepenByRevisions(localDir string, tips []string, d deepenOptions, shallow, reached map[string]bool) error {
+	var notTips []string
+	for _, name := range d.Not {
+		sha, err := revParse(localDir, name)
+		if err != nil {
+			return fmt.Errorf("git upload-pack: ambiguous argument '%s': unknown revision or path not in the working tree.", name)
+		}
+		if commit, err := peelToCommit(localDir, sha); err == nil {
+			notTips = append(notTips, commit)
+		}
+	}
+	excluded, err := reachableCommits(localDir, notTips...)
+	if err != nil {
+		return err
+	}
+	included := func(sha string) (bool, *GitCommit, error) {
+		if excluded[sha] {
+			return false, nil, nil
+		}
+		commit, err := readCommit(localDir, sha)
+		if err != nil {
+			return false, nil, err
+		}
+		return d.Since == 0 || commit.Committer.When.Unix() >= d.Since, commit, nil
+	}
+	stack := append([]string{}, tips...)
+	for len(stack) > 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if reached[sha] {
+			continue
+		}
+		ok, commit, err := included(sha)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		reached[sha] = true
+		for _, parent := range commit.Parents {
+			if ok, _, err := included(parent); err != nil {
+				return err
+			} else if !ok {
+				shallow[sha] = true
+			} else {
+				stack = append(stack, parent)
+			}
+		}
+	}
+	if len(reached) == 0 {
+		return errors.New("no commits selected for shallow requests")
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A line of n commits a day apart, oldest first, each adding a file.
+func datedHistory(t *testing.T, dir string, n int) (commits []string, times []int64) {
+	t.Helper()
+	files := make(map[string]treeFile)
+	parent := ""
+	for i := 0; i < n; i++ {
+		blob, err := writeGitObject(dir, (&GitBlob{Content: []byte(fmt.Sprintf("%d\n", i))}).Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[fmt.Sprintf("file%d", i)] = treeFile{Mode: "100644", Sha: blob}
+		tree, err := writeTreeFromFiles(dir, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		when := int64(1500000000 + i*86400)
+		content := "tree " + tree + "\n"
+		if parent != "" {
+			content += "parent " + parent + "\n"
+		}
+		ident := fmt.Sprintf("A U Thor <author@example.com> %d +0000", when)
+		content += "author " + ident + "\ncommitter " + ident + "\n\ncommit " + fmt.Sprint(i) + "\n"
+		parent = writeRawObject(t, dir, "commit", content)
+		commits, times = append(commits, parent), append(times, when)
+	}
+	return commits, times
+}
+
+// Serve an upstream with a five-commit master, in the protocol version the
+// clients are configured for.
+func shallowUpstream(t *testing.T, version string) (upstream, url string, commits []string, times []int64) {
+	t.Helper()
+	root, upstream := bareRepo(t)
+	commits, times = datedHistory(t, upstream, 5)
+	if err := writeRef(upstream, "refs/heads/master", commits[4]); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeRef(upstream, "refs/heads/old", commits[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(os.Getenv("HOME"), ".gitconfig"), []byte("[protocol]\n\tversion = "+version+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base, _ := serveRepos(t, root)
+	return upstream, base + "/upstream.git", commits, times
+}
+
+func checkShallow(t *testing.T, dir string, want ...string) {
+	t.Helper()
+	got := strings.Fields(readTestFile(t, dir, ".git/shallow"))
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf(".git/shallow has %v, want %v", got, want)
+	}
+}
+
+func TestShallowCloneAndFetch(t *testing.T) {
+	for _, version := range []string{"2", "0"} {
+		upstream, url, commits, _ := shallowUpstream(t, version)
+		dir := filepath.Join(t.TempDir(), "clone")
+		if err := Clone(url, dir, cloneOptions{Deepen: deepenOptions{Depth: 2}, SingleBranch: true}); err != nil {
+			t.Fatalf("protocol %s: %v", version, err)
+		}
+		checkShallow(t, dir, commits[3])
+		if hasObject(dir, commits[2]) {
+			t.Errorf("protocol %s: --depth=2 fetched a third commit", version)
+		}
+		if got := runGit(t, dir, "rev-list", "--count", "HEAD"); got != "2\n" {
+			t.Errorf("protocol %s: git counts %s commits", version, strings.TrimSpace(got))
+		}
+		runGit(t, dir, "fsck", "--strict")
+
+		// --deepen moves the boundary back from where it is.
+		if err := Fetch(dir, "origin", nil, fetchOptions{Deepen: deepenOptions{Depth: 1, Relative: true}}); err != nil {
+			t.Fatal(err)
+		}
+		checkShallow(t, dir, commits[2])
+		if !hasObject(dir, commits[2]) || hasObject(dir, commits[1]) {
+			t.Errorf("protocol %s: --deepen=1 did not fetch exactly one more commit", version)
+		}
+
+		// A plain fetch keeps the boundary.
+		next := commitFiles(t, upstream, commits[4], "next", map[string]string{"next": "next\n"})
+		if err := writeRef(upstream, "refs/heads/master", next); err != nil {
+			t.Fatal(err)
+		}
+		if err := Fetch(dir, "origin", nil, fetchOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		checkRef(t, dir, "refs/remotes/origin/master", next)
+		checkShallow(t, dir, commits[2])
+
+		// --unshallow completes the history.
+		if err := Fetch(dir, "origin", nil, fetchOptions{Deepen: deepenOptions{Depth: infiniteDepth}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git", "shallow")); !os.IsNotExist(err) {
+			t.Errorf("protocol %s: .git/shallow is left after --unshallow", version)
+		}
+		if isShallowRepository(dir) {
+			t.Errorf("protocol %s: still shallow after --unshallow", version)
+		}
+		if got := runGit(t, dir, "rev-list", "--count", "origin/master"); got != "6\n" {
+			t.Errorf("protocol %s: git counts %s commits after --unshallow", version, strings.TrimSpace(got))
+		}
+		runGit(t, dir, "fsck", "--strict")
+	}
+}
+
+func TestShallowSinceAndExclude(t *testing.T) {
+	for _, version := range []string{"2", "0"} {
+		_, url, commits, times := shallowUpstream(t, version)
+		tests := []struct {
+			name   string
+			deepen deepenOptions
+		}{
+			{"--shallow-since", deepenOptions{Since: times[2]}},
+			{"--shallow-exclude", deepenOptions{Not: []string{"refs/heads/old"}}},
+		}
+		for _, tt := range tests {
+			dir := filepath.Join(t.TempDir(), "clone")
+			if err := Clone(url, dir, cloneOptions{Deepen: tt.deepen, SingleBranch: true}); err != nil {
+				t.Fatalf("protocol %s, %s: %v", version, tt.name, err)
+			}
+			checkShallow(t, dir, commits[2])
+			if hasObject(dir, commits[1]) {
+				t.Errorf("protocol %s, %s: fetched past the boundary", version, tt.name)
+			}
+			runGit(t, dir, "fsck", "--strict")
+		}
+
+		// Depth and dates do not mix.
+		dir := filepath.Join(t.TempDir(), "clone")
+		if err := Clone(url, dir, cloneOptions{Deepen: deepenOptions{Depth: 1, Since: times[2]}, SingleBranch: true}); err == nil {
+			t.Errorf("protocol %s: cloned with both --depth and --shallow-since", version)
+		}
+	}
+}
+
+func TestParseDeepenOption(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want deepenOptions
+	}{
+		{"--depth=3", deepenOptions{Depth: 3}},
+		{"--deepen=2", deepenOptions{Depth: 2, Relative: true}},
+		{"--shallow-since=@1500000000", deepenOptions{Since: 1500000000}},
+		{"--shallow-since=1500000000", deepenOptions{Since: 1500000000}},
+		{"--shallow-exclude=v1", deepenOptions{Not: []string{"v1"}}},
+	}
+	for _, tt := range tests {
+		var got deepenOptions
+		if ok, err := parseDeepenOption(tt.arg, &got); !ok || err != nil {
+			t.Errorf("%s: %v, %v", tt.arg, ok, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s gave %+v, want %+v", tt.arg, got, tt.want)
+		}
+	}
+	for _, bad := range []string{"--depth=0", "--depth=-1", "--deepen=x", "--shallow-since=whenever"} {
+		if _, err := parseDeepenOption(bad, &deepenOptions{}); err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+	if ok, _ := parseDeepenOption("--unshallow", &deepenOptions{}); ok {
+		t.Error("took --unshallow as a deepen option")
+	}
+}
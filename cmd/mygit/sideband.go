@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Demultiplexes a side-band-64k stream: band 1 carries pack data, band 2
+// progress messages and band 3 a fatal error. A flush ends the stream.
+// ref: https://git-scm.com/docs/protocol-capabilities#_side_band_side_band_64k
+type sideBandReader struct {
+	r        io.Reader
+	progress io.Writer // where remote messages go, nil to drop them
+	buf      []byte
+	err      error
+	midLine  bool // the last remote message ended part way through a line
+}
+
+func newSideBandReader(r io.Reader, progress io.Writer) *sideBandReader {
+	return &sideBandReader{r: r, progress: progress}
+}
+
+func (s *sideBandReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		data, flush, err := readPkt(s.r)
+		switch {
+		case err == io.EOF:
+			s.err = io.ErrUnexpectedEOF
+		case err != nil:
+			s.err = err
+		case flush:
+			s.err = io.EOF
+		case len(data) == 0:
+		case data[0] == 1:
+			s.buf = data[1:]
+		case data[0] == 2:
+			if s.progress != nil {
+				s.writeRemoteMessage(data[1:])
+			}
+		case data[0] == 3:
+			s.err = fmt.Errorf("remote error: %s", strings.TrimSpace(string(data[1:])))
+		default:
+			s.err = fmt.Errorf("invalid side-band channel %d", data[0])
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// Print a remote progress message, prefixing every line with "remote: ".
+// Progress lines end in "\r" so they overwrite each other. A line may be
+// split across messages, so the prefix goes only where a line starts.
+func (s *sideBandReader) writeRemoteMessage(msg []byte) {
+	var out strings.Builder
+	for len(msg) > 0 {
+		if !s.midLine {
+			out.WriteString("remote: ")
+		}
+		end := bytes.IndexAny(msg, "\r\n") + 1
+		if end == 0 {
+			end = len(msg)
+		}
+		out.Write(msg[:end])
+		s.midLine = msg[end-1] != '\n' && msg[end-1] != '\r'
+		msg = msg[end:]
+	}
+	io.WriteString(s.progress, out.String())
+}
+
+// Report whether progress should be shown, which like git is only when
+// stderr is a terminal. Commands decide this once and pass it on; code
+// serving a client never shows progress here.
+func progressEnabled() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// A "Title: 42% (21/50)" progress meter on stderr, optionally with the
+// amount of data transferred.
+type progressMeter struct {
+	title      string
+	total      int
+	start      time.Time
+	lastUpdate time.Time
+	lastShown  string
+	enabled    bool
+}
+
+func newProgress(title string, total int, enabled bool) *progressMeter {
+	return &progressMeter{title: title, total: total, start: time.Now(), enabled: enabled}
+}
+
+// Redraw the meter, at most a few times a second unless the percentage moved.
+func (p *progressMeter) update(n int, bytes int64) {
+	if !p.enabled {
+		return
+	}
+	line := p.format(n, bytes)
+	if line == p.lastShown || (time.Since(p.lastUpdate) < 100*time.Millisecond && n < p.total) {
+		return
+	}
+	p.lastShown, p.lastUpdate = line, time.Now()
+	fmt.Fprintf(os.Stderr, "%s\r", line)
+}
+
+func (p *progressMeter) done(n int, bytes int64) {
+	if !p.enabled {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s, done.\n", p.format(n, bytes))
+}
+
+func (p *progressMeter) format(n int, bytes int64) string {
+	percent := 100
+	if p.total > 0 {
+		percent = n * 100 / p.total
+	}
+	line := fmt.Sprintf("%s: %3d%% (%d/%d)", p.title, percent, n, p.total)
+	if bytes > 0 {
+		line += ", " + humanBytes(float64(bytes))
+		if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+			line += " | " + humanBytes(float64(bytes)/elapsed) + "/s"
+		}
+	}
+	return line
+}
+
+func humanBytes(n float64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GiB", n/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2f MiB", n/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2f KiB", n/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", int64(n))
+	}
+}
+
+// Multiplexes data onto one band of a side-band stream, as the sending end
+// of a sideBandReader.
+type sideBandWriter struct {
+	w    io.Writer
+	band byte
+	max  int // data per packet: 65515 for side-band-64k, 995 for side-band
+}
+
+func newSideBandWriter(w io.Writer, band byte, max int) *sideBandWriter {
+	return &sideBandWriter{w: w, band: band, max: max}
+}
+
+func (s *sideBandWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > s.max {
+			n = s.max
+		}
+		if err := writePkt(s.w, append([]byte{s.band}, p[:n]...)); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// A side-band stream of the given packets, each a band byte and its data.
+func sideBandStream(packets ...string) *bytes.Buffer {
+	var b bytes.Buffer
+	for _, packet := range packets {
+		if packet == "0000" {
+			writeFlush(&b)
+		} else {
+			writePkt(&b, []byte(packet))
+		}
+	}
+	return &b
+}
+
+func TestSideBandReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		packets  []string
+		data     string
+		progress string
+		err      string
+	}{
+		{
+			name:     "data and progress",
+			packets:  []string{"\x01PACK", "\x02Counting objects: 1\r", "\x01data", "\x02done.\n", "0000"},
+			data:     "PACKdata",
+			progress: "remote: Counting objects: 1\rremote: done.\n",
+		},
+		{
+			name:     "several lines in a packet",
+			packets:  []string{"\x02one\ntwo\rthree\n", "0000"},
+			progress: "remote: one\nremote: two\rremote: three\n",
+		},
+		{
+			name:     "a line split across packets",
+			packets:  []string{"\x02Compressing obj", "\x02ects:  50% (1/2)\rCompress", "\x02ing objects: 100% (2/2), done.\n", "0000"},
+			progress: "remote: Compressing objects:  50% (1/2)\rremote: Compressing objects: 100% (2/2), done.\n",
+		},
+		{
+			name:     "an error",
+			packets:  []string{"\x01PA", "\x03access denied\n"},
+			data:     "PA",
+			progress: "",
+			err:      "remote error: access denied",
+		},
+		{
+			name:    "an unknown band",
+			packets: []string{"\x01PA", "\x05what"},
+			data:    "PA",
+			err:     "invalid side-band channel 5",
+		},
+		{
+			name:    "the end without a flush",
+			packets: []string{"\x01PACK"},
+			data:    "PACK",
+			err:     io.ErrUnexpectedEOF.Error(),
+		},
+	}
+	for _, tt := range tests {
+		var progress strings.Builder
+		data, err := io.ReadAll(newSideBandReader(sideBandStream(tt.packets...), &progress))
+		if string(data) != tt.data {
+			t.Errorf("%s: read %q, want %q", tt.name, data, tt.data)
+		}
+		if progress.String() != tt.progress {
+			t.Errorf("%s: printed %q, want %q", tt.name, progress.String(), tt.progress)
+		}
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%s: got error %v, want %s", tt.name, err, tt.err)
+		}
+	}
+
+	// Without somewhere to print it, progress is dropped.
+	data, err := io.ReadAll(newSideBandReader(sideBandStream("\x02progress\n", "\x01PACK", "0000"), nil))
+	if err != nil || string(data) != "PACK" {
+		t.Errorf("read %q: %v", data, err)
+	}
+}
+
+func TestSideBandWriter(t *testing.T) {
+	var stream bytes.Buffer
+	content := strings.Repeat("x", 2500)
+	w := newSideBandWriter(&stream, 1, 995)
+	if n, err := w.Write([]byte(content)); n != len(content) || err != nil {
+		t.Fatalf("wrote %d: %v", n, err)
+	}
+	writeFlush(&stream)
+	// 995 bytes of data and a band byte, in three packets.
+	if stream.Len() != 3*5+len(content)+4 {
+		t.Errorf("a %d byte stream", stream.Len())
+	}
+	data, err := io.ReadAll(newSideBandReader(&stream, nil))
+	if err != nil || string(data) != content {
+		t.Errorf("read back %d bytes: %v", len(data), err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Stands in for ssh: runs the requested service on the local repository the
+// path names, over stdin and stdout, and notes its arguments and
+// GIT_PROTOCOL in $MYGIT_TEST_SSH_LOG.
+func sshHelper() int {
+	args := os.Args[1:]
+	if log := os.Getenv("MYGIT_TEST_SSH_LOG"); log != "" {
+		f, err := os.OpenFile(log, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%s|%s\n", strings.Join(args, "|"), os.Getenv("GIT_PROTOCOL"))
+			f.Close()
+		}
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "ssh: no command")
+		return 255
+	}
+	service, path, _ := strings.Cut(args[len(args)-1], " ")
+	path = strings.Trim(path, "'")
+	var err error
+	switch service {
+	case "git-upload-pack":
+		version := 0
+		if strings.Contains(os.Getenv("GIT_PROTOCOL"), "version=2") {
+			version = 2
+		}
+		err = serveUploadPack(path, os.Stdin, os.Stdout, version, false)
+	case "git-receive-pack":
+		err = serveReceivePack(path, os.Stdin, os.Stdout, false)
+	default:
+		err = fmt.Errorf("unknown command %q", service)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ssh:", err)
+		return 1
+	}
+	return 0
+}
+
+func TestIsSSHURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"host:path", true},
+		{"user@host:path/repo.git", true},
+		{"host:/abs/path", true},
+		{"ssh://host/path", true},
+		{"ssh://user@host:2222/path", true},
+		{"git+ssh://host/path", true},
+		{"ssh+git://host/path", true},
+		{"./a:b", false},
+		{"a/b:c", false},
+		{"/abs/a:b", false},
+		{"path", false},
+		{":path", false},
+		{"file:///path", false},
+		{"https://host/path", false},
+	}
+	for _, tt := range tests {
+		if got := isSSHURL(tt.url); got != tt.want {
+			t.Errorf("isSSHURL(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+		if _, local := localRepositoryPath(tt.url); local == tt.want && !strings.Contains(tt.url, "://") {
+			t.Errorf("localRepositoryPath(%q) disagrees with isSSHURL", tt.url)
+		}
+	}
+}
+
+func TestNewSSHTransport(t *testing.T) {
+	isolateConfig(t)
+	t.Setenv("GIT_SSH_VARIANT", "ssh")
+	tests := []struct {
+		url              string
+		host, port, path string
+	}{
+		{"host:repo.git", "host", "", "repo.git"},
+		{"user@host:dir/repo.git", "user@host", "", "dir/repo.git"},
+		{"host:/abs/repo.git", "host", "", "/abs/repo.git"},
+		{"ssh://host/srv/repo.git", "host", "", "/srv/repo.git"},
+		{"ssh://user@host:2222/srv/repo.git", "user@host", "2222", "/srv/repo.git"},
+		{"git+ssh://host/~user/repo.git", "host", "", "~user/repo.git"},
+	}
+	for _, tt := range tests {
+		transport, err := newSSHTransport(t.TempDir(), tt.url)
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if transport.Host != tt.host || transport.Port != tt.port || transport.Path != tt.path {
+			t.Errorf("%s: host %q, port %q, path %q", tt.url, transport.Host, transport.Port, transport.Path)
+		}
+	}
+	for _, bad := range []string{"-oProxyCommand=evil:repo", "ssh://host/", "host:"} {
+		if _, err := newSSHTransport(t.TempDir(), bad); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+	// Only OpenSSH is known to take a port.
+	t.Setenv("GIT_SSH_VARIANT", "simple")
+	if _, err := newSSHTransport(t.TempDir(), "ssh://host:2222/repo"); err == nil {
+		t.Error("a simple ssh was given a port")
+	}
+}
+
+func TestSSHTransport(t *testing.T) {
+	root, upstream := bareRepo(t)
+	master := commitFiles(t, upstream, "", "first", map[string]string{"a": "a\n"})
+	if err := writeRef(upstream, "refs/heads/master", master); err != nil {
+		t.Fatal(err)
+	}
+	local := newTestRepo(t)
+	log := filepath.Join(root, "ssh.log")
+	t.Setenv("MYGIT_TEST_SSH_LOG", log)
+	t.Setenv("GIT_SSH_COMMAND", helperCommand(t, "ssh"))
+	t.Setenv("GIT_SSH_VARIANT", "ssh")
+	readLog := func() string {
+		t.Helper()
+		data, err := os.ReadFile(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(log)
+		return string(data)
+	}
+
+	// scp-like syntax, in protocol v2.
+	if err := AddRemote(local, "origin", "example.com:"+upstream, remoteAddOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Fetch(local, "origin", nil, fetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkRef(t, local, "refs/remotes/origin/master", master)
+	if got, want := readLog(), "-o|SendEnv=GIT_PROTOCOL|example.com|git-upload-pack '"+upstream+"'|version=2\n"; got != want {
+		t.Errorf("ssh was run as %q, want %q", got, want)
+	}
+
+	// ssh:// with a user and port, in protocol v0.
+	if err := setConfigValue(local, "protocol.version", "0"); err != nil {
+		t.Fatal(err)
+	}
+	url := "ssh://git@example.com:2222" + upstream
+	next := commitFiles(t, local, master, "next", map[string]string{"b": "b\n"})
+	if err := writeRef(local, "refs/heads/master", next); err != nil {
+		t.Fatal(err)
+	}
+	if err := Push(local, url, []string{"master"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	checkRef(t, upstream, "refs/heads/master", next)
+	if got, want := readLog(), "-p|2222|git@example.com|git-receive-pack '"+upstream+"'|\n"; got != want {
+		t.Errorf("ssh was run as %q, want %q", got, want)
+	}
+	if err := Fetch(local, url, []string{"master:refs/heads/copy"}, fetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	checkRef(t, local, "refs/heads/copy", next)
+	if got, want := readLog(), "-p|2222|git@example.com|git-upload-pack '"+upstream+"'|\n"; got != want {
+		t.Errorf("ssh was run as %q, want %q", got, want)
+	}
+
+	// A service that fails to start is an error, not a hang.
+	if err := Fetch(local, "example.com:"+filepath.Join(root, "missing.git"), nil, fetchOptions{}); err == nil {
+		t.Error("fetched from a missing repository")
+	}
+}
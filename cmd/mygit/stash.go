@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Stashes are stored like git does: refs/stash points at the newest stash and
+// its reflog holds the whole stack. Each stash is a merge commit W whose tree
+// is the working tree state, with the HEAD commit as first parent and a commit
+// I recording the index as second parent.
+const stashRef = "refs/stash"
+
+// Usage:
+//
+//	mygit stash [push [-m <message>]]
+//	mygit stash list
+//	mygit stash show [-p] [<stash>]
+//	mygit stash apply [--index] [<stash>]
+//	mygit stash pop [--index] [<stash>]
+//	mygit stash drop [<stash>]
+func stashCmd(args []string) error {
+	subcommand := "push"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		subcommand, args = args[0], args[1:]
+	}
+	var message, stash string
+	patch, restoreIndex := false, false
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case (arg == "-m" || arg == "--message") && i+1 < len(args):
+			i++
+			message = args[i]
+		case arg == "-p" || arg == "--patch":
+			patch = true
+		case arg == "--index":
+			restoreIndex = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option: %s", arg)
+		default:
+			stash = arg
+		}
+	}
+	switch subcommand {
+	case "push", "save":
+		return StashPush(".", message)
+	case "list":
+		return StashList(".")
+	case "show":
+		return StashShow(".", stash, patch)
+	case "apply":
+		return StashApply(".", stash, restoreIndex)
+	case "pop":
+		if err := StashApply(".", stash, restoreIndex); err != nil {
+			return err
+		}
+		return StashDrop(".", stash)
+	case "drop":
+		return StashDrop(".", stash)
+	default:
+		return fmt.Errorf("unknown stash subcommand: %s", subcommand)
+	}
+}
+
+// Save the index and the tracked files of the working tree, then reset them
+// to HEAD.
+func StashPush(localDir, message string) error {
+	headRef, head, err := readHead(localDir)
+	if err != nil {
+		return err
+	}
+	if head == "" {
+		return errors.New("you do not have the initial commit yet")
+	}
+	headCommit, err := readCommit(localDir, head)
+	if err != nil {
+		return err
+	}
+	index, err := readIndex(localDir)
+	if err != nil {
+		return err
+	}
+	indexFiles := index.files()
+	indexTree, err := writeTreeFromFiles(localDir, indexFiles)
+	if err != nil {
+		return err
+	}
+	paths := make(map[string]bool)
+	for name := range indexFiles {
+		paths[name] = true
+	}
+	workFiles, err := snapshotWorkFiles(localDir, paths, true)
+	if err != nil {
+		return err
+	}
+	workTree, err := writeTreeFromFiles(localDir, workFiles)
+	if err != nil {
+		return err
+	}
+	if indexTree == headCommit.Tree && workTree == indexTree {
+		fmt.Println("No local changes to save")
+		return nil
+	}
+
+	branch := "(no branch)"
+	if headRef != "" {
+		branch = branchName(headRef)
+	}
+	description := fmt.Sprintf("%s: %s %s", branch, shortSha(head), headCommit.Subject())
+	indexCommit, err := commitTree(localDir, indexTree, []string{head}, "index on "+description)
+	if err != nil {
+		return err
+	}
+	stashMessage := "WIP on " + description
+	if message != "" {
+		stashMessage = fmt.Sprintf("On %s: %s", branch, message)
+	}
+	workCommit, err := commitTree(localDir, workTree, []string{head, indexCommit}, stashMessage)
+	if err != nil {
+		return err
+	}
+	previous, _ := readRef(localDir, stashRef)
+	if err := writeRef(localDir, stashRef, workCommit); err != nil {
+		return err
+	}
+	if err := appendReflog(localDir, stashRef, previous, workCommit, stashMessage); err != nil {
+		return err
+	}
+
+	if err := hardResetWorkTree(localDir, headCommit.Tree); err != nil {
+		return err
+	}
+	if err := writeIndexFromTree(localDir, headCommit.Tree); err != nil {
+		return err
+	}
+	fmt.Printf("Saved working directory and index state %s\n", stashMessage)
+	return nil
+}
+
+func StashList(localDir string) error {
+	entries, err := readReflog(localDir, stashRef)
+	if err != nil {
+		return err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		fmt.Printf("stash@{%d}: %s\n", len(entries)-1-i, entries[i].Message)
+	}
+	return nil
+}
+
+// Show the changes recorded in a stash as a diffstat or a patch.
+func StashShow(localDir, stash string, patch bool) error {
+	_, sha, err := resolveStash(localDir, stash)
+	if err != nil {
+		return err
+	}
+	work, base, _, err := readStash(localDir, sha)
+	if err != nil {
+		return err
+	}
+	changes, err := diffTrees(localDir, base.Tree, work.Tree)
+	if err != nil {
+		return err
+	}
+	if patch {
+		return writePatch(os.Stdout, localDir, changes)
+	}
+	return writeDiffStat(os.Stdout, localDir, changes)
+}
+
+// Merge the changes of a stash into the working tree, and into the index too
+// when restoreIndex is set.
+func StashApply(localDir, stash string, restoreIndex bool) error {
+	_, sha, err := resolveStash(localDir, stash)
+	if err != nil {
+		return err
+	}
+	work, base, indexCommit, err := readStash(localDir, sha)
+	if err != nil {
+		return err
+	}
+	index, err := readIndex(localDir)
+	if err != nil {
+		return err
+	}
+	indexFiles := index.files()
+	indexTree, err := writeTreeFromFiles(localDir, indexFiles)
+	if err != nil {
+		return err
+	}
+
+	// Refuse to touch files that have unstaged modifications.
+	stashed, err := diffTrees(localDir, base.Tree, work.Tree)
+	if err != nil {
+		return err
+	}
+	var blocked []string
+	for _, change := range stashed {
+		current, err := hashWorkFile(localDir, change.Name)
+		if os.IsNotExist(err) {
+			current, err = treeFile{}, nil
+		}
+		if err != nil {
+			return err
+		}
+		if current != indexFiles[change.Name] {
+			blocked = append(blocked, change.Name)
+		}
+	}
+	if len(blocked) > 0 {
+		return fmt.Errorf("your local changes to the following files would be overwritten by merge:\n\t%s\nPlease commit your changes or stash them before you merge.",
+			strings.Join(blocked, "\n\t"))
+	}
+
+	var newIndexFiles map[string]treeFile
+	if restoreIndex && indexCommit.Tree != base.Tree {
+		indexMerge, err := mergeTrees(localDir, base.Tree, indexTree, indexCommit.Tree, "Updated upstream", "Stashed changes")
+		if err != nil {
+			return err
+		}
+		if len(indexMerge.Conflicts) > 0 {
+			return errors.New("conflicts in index. Try without --index.")
+		}
+		newIndexFiles = indexMerge.Files
+	}
+	merge, err := mergeTrees(localDir, base.Tree, indexTree, work.Tree, "Updated upstream", "Stashed changes")
+	if err != nil {
+		return err
+	}
+	if err := checkoutFiles(localDir, indexFiles, merge.Files); err != nil {
+		return err
+	}
+
+	if newIndexFiles == nil {
+		// Without --index only files new in the stash get staged.
+		newIndexFiles = make(map[string]treeFile)
+		for name, file := range indexFiles {
+			newIndexFiles[name] = file
+		}
+		for name, file := range merge.Files {
+			if _, tracked := indexFiles[name]; !tracked {
+				newIndexFiles[name] = file
+			}
+		}
+	}
+	for _, change := range diffFiles(indexFiles, newIndexFiles) {
+		if change.New.Sha == "" {
+			index.set(change.Name, nil)
+			continue
+		}
+		entry, err := newIndexEntry(change.Name, change.New)
+		if err != nil {
+			return err
+		}
+		entry.updateStat(localDir)
+		index.set(change.Name, entry)
+	}
+	if err := index.write(localDir); err != nil {
+		return err
+	}
+	if len(merge.Conflicts) > 0 {
+		return errors.New("the stash entry is kept in case you need it again")
+	}
+	return nil
+}
+
+// Remove a stash from the stack.
+func StashDrop(localDir, stash string) error {
+	n, sha, err := resolveStash(localDir, stash)
+	if err != nil {
+		return err
+	}
+	entries, err := readReflog(localDir, stashRef)
+	if err != nil {
+		return err
+	}
+	position := len(entries) - 1 - n
+	entries = append(entries[:position], entries[position+1:]...)
+	if len(entries) == 0 {
+		if err := deleteRef(localDir, stashRef); err != nil {
+			return err
+		}
+		if err := os.Remove(reflogPath(localDir, stashRef)); err != nil {
+			return err
+		}
+	} else {
+		if err := writeReflog(localDir, stashRef, entries); err != nil {
+			return err
+		}
+		if err := writeRef(localDir, stashRef, entries[len(entries)-1].New); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Dropped stash@{%d} (%s)\n", n, sha)
+	return nil
+}
+
+// Resolve "", "<n>" or "stash@{<n>}" to a stack position and commit.
+func resolveStash(localDir, name string) (int, string, error) {
+	entries, err := readReflog(localDir, stashRef)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(entries) == 0 {
+		return 0, "", errors.New("no stash entries found")
+	}
+	selector := strings.TrimSuffix(strings.TrimPrefix(name, "stash@{"), "}")
+	if selector == "" {
+		selector = "0"
+	}
+	n, err := strconv.Atoi(selector)
+	if err != nil || n < 0 || n >= len(entries) {
+		return 0, "", fmt.Errorf("%s is not a valid reference", name)
+	}
+	return n, entries[len(entries)-1-n].New, nil
+}
+
+// Read a stash commit together with the HEAD and index commits it records.
+func readStash(localDir, sha string) (*GitCommit, *GitCommit, *GitCommit, error) {
+	work, err := readCommit(localDir, sha)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(work.Parents) < 2 {
+		return nil, nil, nil, fmt.Errorf("%s is not a stash-like commit", shortSha(sha))
+	}
+	base, err := readCommit(localDir, work.Parents[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	index, err := readCommit(localDir, work.Parents[1])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return work, base, index, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// A commit with "a" and "b", then a staged change to "a", an unstaged one to
+// "b" and a staged new file.
+func stashRepo(t *testing.T) (dir, head string) {
+	dir = newTestRepo(t)
+	head = commitFiles(t, dir, "", "first", map[string]string{"a": "a\n", "b": "b\n"})
+	resetHard(t, dir, head)
+	writeTestFile(t, dir, "a", "a staged\n")
+	writeTestFile(t, dir, "new", "new\n")
+	if err := Add(dir, []string{"a", "new"}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "b", "b unstaged\n")
+	return dir, head
+}
+
+func TestStashPush(t *testing.T) {
+	dir, head := stashRepo(t)
+	staged := indexFiles(t, dir)
+	if err := StashPush(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	work, base, index, err := readStash(dir, mustRevParse(t, dir, stashRef))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if work.Parents[0] != head {
+		t.Errorf("stash is based on %s, want %s", work.Parents[0], head)
+	}
+	if want := "WIP on master: " + shortSha(head) + " first"; work.Subject() != want {
+		t.Errorf("stash message %q, want %q", work.Subject(), want)
+	}
+	indexTree, err := flattenTree(dir, index.Tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameFiles(indexTree, staged) {
+		t.Error("the index commit does not record the staged files")
+	}
+	if base.Tree == work.Tree {
+		t.Error("the stash records no changes")
+	}
+	want := map[string]string{"a": "a staged\n", "b": "b unstaged\n", "new": "new\n"}
+	if got := commitContents(t, dir, stashRef); !equalContents(got, want) {
+		t.Errorf("stashed files %q, want %q", got, want)
+	}
+
+	// Everything is back at HEAD.
+	if !sameFiles(indexFiles(t, dir), treeFiles(t, dir, head)) {
+		t.Error("the index was not reset")
+	}
+	for name, want := range map[string]string{"a": "a\n", "b": "b\n", "new": ""} {
+		if got := readTestFile(t, dir, name); got != want {
+			t.Errorf("%s is %q after stashing, want %q", name, got, want)
+		}
+	}
+
+	// Nothing more to stash.
+	stash := mustRevParse(t, dir, stashRef)
+	if err := StashPush(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustRevParse(t, dir, stashRef); got != stash {
+		t.Errorf("refs/stash moved to %s", got)
+	}
+	if _, _, err := resolveStash(dir, "stash@{1}"); err == nil {
+		t.Error("stashing no changes made a stash")
+	}
+}
+
+func TestStashApply(t *testing.T) {
+	dir, head := stashRepo(t)
+	if err := StashPush(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := StashApply(dir, "", false); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a": "a staged\n", "b": "b unstaged\n", "new": "new\n"} {
+		if got := readTestFile(t, dir, name); got != want {
+			t.Errorf("%s is %q after applying, want %q", name, got, want)
+		}
+	}
+	// Without --index only the new file is staged.
+	files, headFiles := indexFiles(t, dir), treeFiles(t, dir, head)
+	if files["a"] != headFiles["a"] {
+		t.Error("a was staged without --index")
+	}
+	if _, ok := files["new"]; !ok {
+		t.Error("the new file was not staged")
+	}
+	if _, _, err := resolveStash(dir, ""); err != nil {
+		t.Error("applying dropped the stash")
+	}
+}
+
+func TestStashApplyIndex(t *testing.T) {
+	dir, _ := stashRepo(t)
+	staged := indexFiles(t, dir)
+	if err := StashPush(dir, "keep the index"); err != nil {
+		t.Fatal(err)
+	}
+	if err := StashApply(dir, "stash@{0}", true); err != nil {
+		t.Fatal(err)
+	}
+	if !sameFiles(indexFiles(t, dir), staged) {
+		t.Error("--index did not restore the staged files")
+	}
+	if got := readTestFile(t, dir, "b"); got != "b unstaged\n" {
+		t.Errorf("b is %q", got)
+	}
+}
+
+func TestStashApplyRefusals(t *testing.T) {
+	dir, head := stashRepo(t)
+	if err := StashPush(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// A local change to a stashed file would be lost.
+	writeTestFile(t, dir, "b", "b again\n")
+	if err := StashApply(dir, "", false); err == nil || !strings.Contains(err.Error(), "would be overwritten") {
+		t.Errorf("applied over a local change: %v", err)
+	}
+	if got := readTestFile(t, dir, "b"); got != "b again\n" {
+		t.Errorf("the refused apply changed b to %q", got)
+	}
+
+	// A conflicting commit leaves markers and keeps the stash.
+	resetHard(t, dir, commitFiles(t, dir, head, "second", map[string]string{"b": "b committed\n"}))
+	err := StashApply(dir, "", false)
+	if err == nil || !strings.Contains(err.Error(), "kept") {
+		t.Errorf("applied with a conflict: %v", err)
+	}
+	if got := readTestFile(t, dir, "b"); !strings.Contains(got, "<<<<<<< Updated upstream\nb committed\n=======\nb unstaged\n>>>>>>> Stashed changes\n") {
+		t.Errorf("conflicted b:\n%s", got)
+	}
+}
+
+func TestStashStack(t *testing.T) {
+	dir, _ := stashRepo(t)
+	if err := StashPush(dir, "first"); err != nil {
+		t.Fatal(err)
+	}
+	first := mustRevParse(t, dir, stashRef)
+	writeTestFile(t, dir, "a", "second change\n")
+	if err := StashPush(dir, "second"); err != nil {
+		t.Fatal(err)
+	}
+	second := mustRevParse(t, dir, stashRef)
+
+	if _, sha, err := resolveStash(dir, "stash@{1}"); err != nil || sha != first {
+		t.Errorf("stash@{1} is %s, want %s: %v", sha, first, err)
+	}
+	if _, _, err := resolveStash(dir, "stash@{2}"); err == nil {
+		t.Error("resolved a stash past the end")
+	}
+	if got := runGit(t, dir, "log", "-g", "--format=%gs", stashRef); got != "On master: second\nOn master: first\n" {
+		t.Errorf("git reads the stash reflog as:\n%s", got)
+	}
+
+	if err := StashDrop(dir, "stash@{1}"); err != nil {
+		t.Fatal(err)
+	}
+	if _, sha, err := resolveStash(dir, ""); err != nil || sha != second {
+		t.Errorf("stash@{0} is %s after dropping stash@{1}, want %s", sha, second)
+	}
+	if _, _, err := resolveStash(dir, "1"); err == nil {
+		t.Error("stash@{1} is still there")
+	}
+	if err := StashDrop(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readRef(dir, stashRef); err == nil {
+		t.Error("refs/stash is left after dropping every stash")
+	}
+	if err := StashDrop(dir, ""); err == nil {
+		t.Error("dropped from an empty stack")
+	}
+}
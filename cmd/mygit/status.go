@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Usage: mygit status [-s | --short] [--ignored]
+func statusCmd(args []string) error {
+	short, showIgnored := false, false
+	for _, arg := range args {
+		switch arg {
+		case "-s", "--short":
+			short = true
+		case "--ignored":
+			showIgnored = true
+		default:
+			return fmt.Errorf("unknown option: %s", arg)
+		}
+	}
+	return Status(".", short, showIgnored)
+}
+
+// Working tree status, split like git status reports it.
+type workTreeStatus struct {
+	Staged    []fileChange // HEAD -> index
+	Unstaged  []fileChange // index -> working tree
+	Untracked []string     // directories end with "/"
+	Ignored   []string
+}
+
+func collectStatus(localDir string, showIgnored bool) (*workTreeStatus, error) {
+	tree, err := headTree(localDir)
+	if err != nil {
+		return nil, err
+	}
+	headFiles, err := flattenTree(localDir, tree)
+	if err != nil {
+		return nil, err
+	}
+	index, err := readIndex(localDir)
+	if err != nil {
+		return nil, err
+	}
+	indexFiles := index.files()
+	status := &workTreeStatus{Staged: diffFiles(headFiles, indexFiles)}
+
+	paths := make(map[string]bool)
+	for name := range indexFiles {
+		paths[name] = true
+	}
+	workFiles, err := snapshotWorkFiles(localDir, paths, false)
+	if err != nil {
+		return nil, err
+	}
+	status.Unstaged = diffFiles(indexFiles, workFiles)
+
+	// Untracked directories are reported as a whole, like git does.
+	trackedDirs := make(map[string]bool)
+	for name := range indexFiles {
+		for dir := name; strings.Contains(dir, "/"); {
+			dir = dir[:strings.LastIndex(dir, "/")]
+			trackedDirs[dir] = true
+		}
+	}
+	ignore := newIgnoreMatcher(localDir)
+	err = walkWorkTree(localDir, "", func(name string, isDir bool) (bool, error) {
+		if indexFiles[name].Sha != "" || trackedDirs[name] {
+			return isDir, nil
+		}
+		display := name
+		if isDir {
+			display += "/"
+		}
+		if ignore.ignored(name, isDir) {
+			if showIgnored {
+				status.Ignored = append(status.Ignored, display)
+			}
+			return false, nil
+		}
+		if !isDir {
+			status.Untracked = append(status.Untracked, display)
+			return false, nil
+		}
+		untracked, ignored := scanUntrackedDir(localDir, name, ignore)
+		if untracked {
+			status.Untracked = append(status.Untracked, display)
+		} else if ignored && showIgnored {
+			// A directory holding nothing but ignored files is ignored as a whole.
+			status.Ignored = append(status.Ignored, display)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(status.Untracked)
+	sort.Strings(status.Ignored)
+	return status, nil
+}
+
+// Report whether an untracked directory holds files that are not ignored, and
+// whether it holds ignored ones.
+func scanUntrackedDir(localDir, dir string, ignore *ignoreMatcher) (bool, bool) {
+	untracked, ignored := false, false
+	walkWorkTree(localDir, dir, func(name string, isDir bool) (bool, error) {
+		if untracked {
+			return false, nil
+		}
+		if ignore.ignored(name, isDir) {
+			ignored = true
+			return false, nil
+		}
+		untracked = !isDir
+		return true, nil
+	})
+	return untracked, ignored
+}
+
+func changeKind(change fileChange) string {
+	switch {
+	case change.Old.Sha == "":
+		return "new file"
+	case change.New.Sha == "":
+		return "deleted"
+	default:
+		return "modified"
+	}
+}
+
+func changeCode(change fileChange) byte {
+	switch {
+	case change.Old.Sha == "":
+		return 'A'
+	case change.New.Sha == "":
+		return 'D'
+	default:
+		return 'M'
+	}
+}
+
+func Status(localDir string, short, showIgnored bool) error {
+	status, err := collectStatus(localDir, showIgnored)
+	if err != nil {
+		return err
+	}
+	if short {
+		codes := make(map[string][]byte)
+		for _, change := range status.Staged {
+			codes[change.Name] = []byte{changeCode(change), ' '}
+		}
+		for _, change := range status.Unstaged {
+			code, ok := codes[change.Name]
+			if !ok {
+				code = []byte{' ', ' '}
+			}
+			code[1] = changeCode(change)
+			codes[change.Name] = code
+		}
+		names := make([]string, 0, len(codes))
+		for name := range codes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s %s\n", codes[name], name)
+		}
+		for _, name := range status.Untracked {
+			fmt.Printf("?? %s\n", name)
+		}
+		for _, name := range status.Ignored {
+			fmt.Printf("!! %s\n", name)
+		}
+		return nil
+	}
+
+	headRef, _, err := readHead(localDir)
+	if err != nil {
+		return err
+	}
+	if headRef != "" {
+		fmt.Printf("On branch %s\n", branchName(headRef))
+	} else {
+		fmt.Println("HEAD detached")
+	}
+	if rebaseInProgress(localDir) {
+		fmt.Println("You are currently rebasing.")
+	}
+	if len(status.Staged) > 0 {
+		fmt.Println("Changes to be committed:")
+		for _, change := range status.Staged {
+			fmt.Printf("\t%-12s%s\n", changeKind(change)+":", change.Name)
+		}
+		fmt.Println()
+	}
+	if len(status.Unstaged) > 0 {
+		fmt.Println("Changes not staged for commit:")
+		for _, change := range status.Unstaged {
+			fmt.Printf("\t%-12s%s\n", changeKind(change)+":", change.Name)
+		}
+		fmt.Println()
+	}
+	for _, section := range []struct {
+		title string
+		names []string
+	}{{"Untracked files:", status.Untracked}, {"Ignored files:", status.Ignored}} {
+		if len(section.names) == 0 {
+			continue
+		}
+		fmt.Println(section.title)
+		for _, name := range section.names {
+			fmt.Printf("\t%s\n", name)
+		}
+		fmt.Println()
+	}
+	if len(status.Staged) == 0 && len(status.Unstaged) == 0 {
+		if len(status.Untracked) > 0 {
+			fmt.Println("nothing added to commit but untracked files present")
+		} else {
+			fmt.Println("nothing to commit, working tree clean")
+		}
+	}
+	return nil
+}
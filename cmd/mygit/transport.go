@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How a remote's git-upload-pack or git-receive-pack is reached. The
+// protocol spoken on top is the same for every transport.
+type transport interface {
+	// Start the service and return its ref advertisement, asking for the
+	// given protocol version.
+	advertise(service string, version int) (io.ReadCloser, error)
+	// Send a request to the service, in the protocol version the server
+	// answered with, and return its response.
+	request(service string, version int, body []byte) (io.ReadCloser, error)
+	// Whether every request stands alone, as over HTTP, rather than
+	// continuing one conversation.
+	stateless() bool
+	close() error
+}
+
+// Pick the transport for a URL: ssh:// and scp-like user@host:path URLs go
+// over SSH, paths and file:// URLs to a local repository, and everything
+// else over smart HTTP.
+// ref: https://git-scm.com/docs/git-clone#_git_urls
+func newTransport(localDir, url string) (transport, error) {
+	if isSSHURL(url) {
+		return newSSHTransport(localDir, url)
+	}
+	if path, ok := localRepositoryPath(url); ok {
+		return &localTransport{Dir: path}, nil
+	}
+	return newHTTPTransport(localDir, url)
+}
+
+// Drop the user and any password from a URL before showing it, as git does.
+func anonymizeURL(url string) string {
+	if i := strings.Index(url, "://"); i >= 0 {
+		rest := url[i+3:]
+		host, _, _ := strings.Cut(rest, "/")
+		if at := strings.LastIndexByte(host, '@'); at >= 0 {
+			return url[:i+3] + rest[at+1:]
+		}
+	} else if isSSHURL(url) {
+		host, path, _ := strings.Cut(url, ":")
+		if at := strings.LastIndexByte(host, '@'); at >= 0 {
+			return host[at+1:] + ":" + path
+		}
+	}
+	return url
+}
+
+// Smart HTTP: the advertisement is a GET of info/refs and every request a
+// POST to the service.
+// ref: https://git-scm.com/docs/http-protocol
+type httpTransport struct {
+	URL    string // without any user name and password
+	Client *http.Client
+	Config httpConfig
+
+	localDir   string
+	cred       *credential
+	challenged bool // the server has asked for credentials
+	approved   bool
+}
+
+func newHTTPTransport(localDir, url string) (*httpTransport, error) {
+	cred, err := newCredential(localDir, url)
+	if err != nil {
+		return nil, err
+	}
+	client, config, err := newHTTPClient(localDir, url)
+	if err != nil {
+		return nil, err
+	}
+	return &httpTransport{
+		URL:      strings.TrimSuffix(anonymizeURL(url), "/"),
+		Client:   client,
+		Config:   config,
+		localDir: localDir,
+		cred:     cred,
+	}, nil
+}
+
+func (t *httpTransport) advertise(service string, version int) (io.ReadCloser, error) {
+	resp, err := t.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", t.URL+"/info/refs?service="+service, nil)
+		if err != nil {
+			return nil, err
+		}
+		if version == 2 {
+			req.Header.Set("Git-Protocol", "version=2")
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Get("Content-Type") != "application/x-"+service+"-advertisement" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("repository '%s' does not speak the smart HTTP protocol", t.URL)
+	}
+	return resp.Body, nil
+}
+
+func (t *httpTransport) request(service string, version int, body []byte) (io.ReadCloser, error) {
+	// Like git, only fetch requests are compressed, and only when big enough
+	// for it to pay.
+	encoding := ""
+	if service == "git-upload-pack" && len(body) > 1024 {
+		compressed, err := gzipBody(body)
+		if err != nil {
+			return nil, err
+		}
+		body, encoding = compressed, "gzip"
+	}
+	resp, err := t.do(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", t.URL+"/"+service, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		req.Header.Set("Content-Type", "application/x-"+service+"-request")
+		req.Header.Set("Accept", "application/x-"+service+"-result")
+		if version == 2 {
+			req.Header.Set("Git-Protocol", "version=2")
+		}
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Send a request, made afresh for every try, and answer a 401 by asking for
+// credentials: from the URL, ~/.netrc, the credential helpers or the user.
+// Nothing is sent before the server asks, so its challenge can pick the
+// scheme. Transient failures are retried after a growing delay, for at most
+// http.maxRetries tries and http.maxRetryTime seconds of waiting.
+// Credentials that work are handed to the helpers to store, and ones that
+// are turned down to erase.
+// ref: https://git-scm.com/docs/gitcredentials
+func (t *httpTransport) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	var retries int64
+	var waited time.Duration
+	for {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		t.Config.addHeaders(req)
+		if t.challenged {
+			t.authorize(req)
+		}
+		resp, err := t.send(req)
+		if err != nil {
+			return nil, err
+		}
+		if transientHTTPStatus(resp.StatusCode) && retries < t.Config.MaxRetries {
+			if delay := retryDelay(resp, retries); delay <= t.Config.MaxRetryTime-waited {
+				resp.Body.Close()
+				time.Sleep(delay)
+				retries++
+				waited += delay
+				continue
+			}
+		}
+		if resp.StatusCode == http.StatusOK {
+			if t.cred.complete() && !t.approved {
+				t.cred.approve(t.localDir, t.URL)
+				t.approved = true
+			}
+			return resp, nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			return nil, fmt.Errorf("unable to access '%s/': The requested URL returned error: %d", t.URL, resp.StatusCode)
+		}
+		if t.challenged && t.cred.complete() {
+			// What was sent was turned down; nothing is asked twice.
+			t.cred.reject(t.localDir, t.URL)
+			return nil, fmt.Errorf("Authentication failed for '%s/'", t.URL)
+		}
+		t.challenged = true
+		t.cred.WWWAuth = resp.Header.Values("WWW-Authenticate")
+		if t.cred.Password == "" {
+			if username, password, ok := netrcCredential(req.URL.Hostname(), t.cred.Username); ok {
+				t.cred.Username, t.cred.Password = username, password
+			}
+		}
+		if !t.cred.complete() {
+			if err := t.cred.fill(t.localDir, t.URL); err != nil {
+				return nil, err
+			}
+		}
+		if !t.cred.complete() {
+			return nil, fmt.Errorf("Authentication failed for '%s/'", t.URL)
+		}
+	}
+}
+
+// Send a request, giving up on it if it goes slower than http.lowSpeedLimit
+// bytes a second for http.lowSpeedTime seconds.
+func (t *httpTransport) send(req *http.Request) (*http.Response, error) {
+	if t.Config.LowSpeedLimit <= 0 || t.Config.LowSpeedTime <= 0 {
+		return t.Client.Do(req)
+	}
+	req, monitor := watchSpeed(req, t.Config.LowSpeedLimit, t.Config.LowSpeedTime)
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		if monitor.slow.Load() {
+			err = fmt.Errorf("unable to access '%s/': %v", t.URL, monitor.err())
+		}
+		monitor.stop()
+		return nil, err
+	}
+	resp.Body = &monitoredBody{ReadCloser: resp.Body, m: monitor, response: true}
+	return resp, nil
+}
+
+// Add credentials to a request once there are any: a helper's own authtype
+// and credential, else a bearer token where the server asks only for one,
+// else Basic.
+// ref: https://datatracker.ietf.org/doc/html/rfc7617
+func (t *httpTransport) authorize(req *http.Request) {
+	c := t.cred
+	switch {
+	case c.AuthType != "" && c.Credential != "":
+		req.Header.Set("Authorization", c.AuthType+" "+c.Credential)
+	case c.Password != "" && onlyBearer(c.WWWAuth):
+		req.Header.Set("Authorization", "Bearer "+c.Password)
+	case c.Password != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// Whether a server's WWW-Authenticate challenges are all for Bearer.
+func onlyBearer(challenges []string) bool {
+	for _, challenge := range challenges {
+		scheme, _, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			return false
+		}
+	}
+	return len(challenges) > 0
+}
+
+func (t *httpTransport) stateless() bool {
+	return true
+}
+
+func (t *httpTransport) close() error {
+	return nil
+}
+
+// SSH runs the service on the remote host through an ssh command and speaks
+// pkt-lines over its stdin and stdout for the rest of the conversation.
+// ref: https://git-scm.com/docs/pack-protocol#_ssh_transport
+type sshTransport struct {
+	Host    string // [user@]host
+	Port    string
+	Path    string
+	command []string // the ssh program and its leading arguments
+	variant string   // "ssh" for OpenSSH, "simple" for anything else
+	pipeConn
+}
+
+// A conversation with a service at the other end of a pair of pipes, which
+// stays open from the advertisement until close.
+type pipeConn struct {
+	stdin     io.WriteCloser
+	stdout    *bufio.Reader
+	wait      func() error // until the service has exited
+	requested bool
+}
+
+func isSSHURL(url string) bool {
+	for _, scheme := range []string{"ssh://", "git+ssh://", "ssh+git://"} {
+		if strings.HasPrefix(url, scheme) {
+			return true
+		}
+	}
+	// scp-like syntax has a colon before any slash.
+	colon := strings.IndexByte(url, ':')
+	return colon > 0 && !strings.Contains(url[:colon], "/") && !strings.HasPrefix(url[colon:], "://")
+}
+
+func newSSHTransport(localDir, url string) (*sshTransport, error) {
+	t := &sshTransport{}
+	if rest, ok := cutURLScheme(url); ok {
+		hostPort, path, _ := strings.Cut(rest, "/")
+		t.Host, t.Path = hostPort, "/"+path
+		// ssh://host/~user/path is relative to a home directory.
+		if strings.HasPrefix(path, "~") {
+			t.Path = path
+		}
+		if at := strings.LastIndexByte(hostPort, '@'); strings.LastIndexByte(hostPort, ':') > at {
+			colon := strings.LastIndexByte(hostPort, ':')
+			t.Host, t.Port = hostPort[:colon], hostPort[colon+1:]
+		}
+	} else {
+		t.Host, t.Path, _ = strings.Cut(url, ":")
+	}
+	if t.Host == "" || t.Path == "" || t.Path == "/" {
+		return nil, fmt.Errorf("'%s' does not appear to be a git repository", url)
+	}
+	if strings.HasPrefix(t.Host, "-") {
+		return nil, fmt.Errorf("strange hostname '%s' blocked", t.Host)
+	}
+
+	// Like git, $GIT_SSH_COMMAND and core.sshCommand are run by the shell
+	// while $GIT_SSH names a program.
+	if command, ok := os.LookupEnv("GIT_SSH_COMMAND"); ok && command != "" {
+		t.command = []string{"sh", "-c", command + ` "$@"`, command}
+		t.variant = sshVariant(localDir, strings.Fields(command)[0])
+	} else if command, ok := configValue(localDir, "core.sshCommand"); ok && command != "" {
+		t.command = []string{"sh", "-c", command + ` "$@"`, command}
+		t.variant = sshVariant(localDir, strings.Fields(command)[0])
+	} else if program := os.Getenv("GIT_SSH"); program != "" {
+		t.command = []string{program}
+		t.variant = sshVariant(localDir, program)
+	} else {
+		t.command = []string{"ssh"}
+		t.variant = sshVariant(localDir, "ssh")
+	}
+	if t.Port != "" && t.variant != "ssh" {
+		return nil, fmt.Errorf("ssh variant '%s' does not support setting port", t.variant)
+	}
+	return t, nil
+}
+
+func cutURLScheme(url string) (string, bool) {
+	for _, scheme := range []string{"ssh://", "git+ssh://", "ssh+git://"} {
+		if rest, ok := cutPrefix(url, scheme); ok {
+			return rest, true
+		}
+	}
+	return "", false
+}
+
+// Decide from $GIT_SSH_VARIANT, ssh.variant or the program's name whether
+// OpenSSH options such as -p may be passed.
+func sshVariant(localDir, program string) string {
+	variant := os.Getenv("GIT_SSH_VARIANT")
+	if variant == "" {
+		variant, _ = configValue(localDir, "ssh.variant")
+	}
+	if variant == "" || variant == "auto" {
+		variant = "simple"
+		if name := strings.TrimSuffix(filepath.Base(program), ".exe"); name == "ssh" {
+			variant = "ssh"
+		}
+	}
+	return variant
+}
+
+func (t *sshTransport) advertise(service string, version int) (io.ReadCloser, error) {
+	args := append([]string{}, t.command[1:]...)
+	if t.variant == "ssh" {
+		if version == 2 {
+			args = append(args, "-o", "SendEnv=GIT_PROTOCOL")
+		}
+		if t.Port != "" {
+			args = append(args, "-p", t.Port)
+		}
+	}
+	args = append(args, t.Host, service+" "+shellQuote(t.Path))
+
+	cmd := exec.Command(t.command[0], args...)
+	cmd.Env = os.Environ()
+	if version == 2 {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL=version=2")
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot run %s: %v", t.command[0], err)
+	}
+	t.stdin, t.stdout, t.wait = stdin, bufio.NewReader(stdout), cmd.Wait
+	return io.NopCloser(t.stdout), nil
+}
+
+// Requests are written to the running service and the response read from
+// the same connection.
+func (c *pipeConn) request(service string, version int, body []byte) (io.ReadCloser, error) {
+	if c.wait == nil {
+		return nil, fmt.Errorf("%s is not running", service)
+	}
+	c.requested = true
+	if _, err := c.stdin.Write(body); err != nil {
+		return nil, fmt.Errorf("the remote end hung up unexpectedly: %v", err)
+	}
+	return io.NopCloser(c.stdout), nil
+}
+
+func (c *pipeConn) stateless() bool {
+	return false
+}
+
+// End the conversation. A service that was sent nothing expects a flush to
+// hang up cleanly.
+func (c *pipeConn) close() error {
+	if c.wait == nil {
+		return nil
+	}
+	if !c.requested {
+		writeFlush(c.stdin)
+	}
+	c.stdin.Close()
+	io.Copy(io.Discard, c.stdout)
+	err := c.wait()
+	c.wait = nil
+	return err
+}
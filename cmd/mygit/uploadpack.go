@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Capabilities offered to v0/v1 clients of git-upload-pack. Any object we
+// have may be wanted, as partial clones fetch missing objects by name.
+var uploadPackCapabilities = []string{"multi_ack_detailed", "side-band-64k", "thin-pack", "ofs-delta", "shallow", "deepen-since", "deepen-not", "deepen-relative", "filter", "include-tag", "no-progress", "allow-tip-sha1-in-want", "allow-reachable-sha1-in-want"}
+
+// The sending end of a fetch: answers what a gitRemote asks of
+// git-upload-pack for the repository at localDir.
+// ref: https://git-scm.com/docs/pack-protocol#_packfile_negotiation
+// ref: https://git-scm.com/docs/protocol-v2
+type uploadPackServer struct {
+	localDir  string
+	r         *bufio.Reader
+	w         io.Writer
+	stateless bool // answer a single request, as over HTTP
+}
+
+// Serve git-upload-pack over a connection: the ref advertisement, then
+// either one v0 negotiation and pack, or with protocol v2 any number of
+// commands until the client hangs up. A stateless server skips the
+// advertisement and answers one request.
+func serveUploadPack(localDir string, r io.Reader, w io.Writer, version int, stateless bool) error {
+	s := &uploadPackServer{localDir: localDir, r: bufio.NewReader(r), w: w, stateless: stateless}
+	if !stateless {
+		if err := advertiseUploadPack(localDir, w, version); err != nil {
+			return err
+		}
+	}
+	if version == 2 {
+		for {
+			done, err := s.serveCommand()
+			if done || err != nil || stateless {
+				return err
+			}
+		}
+	}
+	return s.serveV0()
+}
+
+// Write the refs and capabilities a git-upload-pack client starts from.
+func advertiseUploadPack(localDir string, w io.Writer, version int) error {
+	if version == 2 {
+		return writePktLines(w, "version 2", "agent="+agentName, "ls-refs", "fetch=shallow filter", "object-format=sha1")
+	}
+	refs, err := advertisedRefs(localDir)
+	if err != nil {
+		return err
+	}
+	capabilities := append([]string{}, uploadPackCapabilities...)
+	if len(refs) > 0 && refs[0].Symref != "" {
+		capabilities = append(capabilities, "symref=HEAD:"+refs[0].Symref)
+	}
+	return advertiseV0(w, refs, capabilities)
+}
+
+// HEAD and every ref, sorted, with annotated tags peeled.
+func advertisedRefs(localDir string) ([]remoteRef, error) {
+	var refs []remoteRef
+	if headRef, headSha, err := readHead(localDir); err != nil {
+		return nil, err
+	} else if headSha != "" {
+		refs = append(refs, remoteRef{Name: "HEAD", Sha: headSha, Symref: headRef})
+	}
+	shas, err := localRefs(localDir, "refs/")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(shas))
+	for name := range shas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ref := remoteRef{Name: name, Sha: shas[name]}
+		if peeled, err := peelTag(localDir, ref.Sha); err == nil && peeled != ref.Sha {
+			ref.Peeled = peeled
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// Write a v0 ref advertisement, the first ref carrying the capabilities.
+func advertiseV0(w io.Writer, refs []remoteRef, capabilities []string) error {
+	capabilities = append(capabilities, "agent="+agentName, "object-format=sha1")
+	if len(refs) == 0 {
+		// An empty repository still needs somewhere to put capabilities.
+		refs = []remoteRef{{Name: "capabilities^{}", Sha: zeroSha}}
+	}
+	for i, ref := range refs {
+		line := ref.Sha + " " + ref.Name
+		if i == 0 {
+			line += "\x00" + strings.Join(capabilities, " ")
+		}
+		if err := writePkt(w, []byte(line+"\n")); err != nil {
+			return err
+		}
+		if ref.Peeled != "" {
+			if err := writePkt(w, []byte(ref.Peeled+" "+ref.Name+"^{}\n")); err != nil {
+				return err
+			}
+		}
+	}
+	return writeFlush(w)
+}
+
+// Read the want list, negotiate common commits and send the pack.
+func (s *uploadPackServer) serveV0() error {
+	var wants []string
+	capabilities := make(map[string]bool)
+	shallow := newShallowRequest()
+	var filter objectFilter
+	for {
+		data, flush, err := readPkt(s.r)
+		if err != nil {
+			return err
+		}
+		if flush {
+			break
+		}
+		if ok, err := shallow.parse(trimNewline(string(data))); ok || err != nil {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if spec, ok := cutPrefix(trimNewline(string(data)), "filter "); ok {
+			if filter, err = parseFilterSpec(spec); err != nil {
+				return err
+			}
+			continue
+		}
+		fields := strings.Fields(trimNewline(string(data)))
+		if len(fields) < 2 || fields[0] != "want" {
+			return fmt.Errorf("protocol error: expected want, got %q", data)
+		}
+		if len(wants) == 0 {
+			for _, capability := range fields[2:] {
+				capabilities[capability] = true
+			}
+		}
+		wants = append(wants, fields[1])
+	}
+	// A client that wants nothing is done.
+	if len(wants) == 0 {
+		return nil
+	}
+	if err := s.checkWants(wants); err != nil {
+		return err
+	}
+	// In v0 deepen-relative is a capability rather than a line.
+	shallow.Deepen.Relative = shallow.Deepen.Relative || capabilities["deepen-relative"]
+	// The new boundary goes out right after the wants, in every request of
+	// a stateless conversation.
+	lines, err := s.deepen(wants, shallow)
+	if err != nil {
+		return err
+	}
+	if shallow.Deepen.requested() {
+		if err := writePktLines(s.w, lines...); err != nil {
+			return err
+		}
+	}
+
+	multiAck := capabilities["multi_ack_detailed"]
+	var common []string
+	for {
+		data, flush, err := readPkt(s.r)
+		if err == io.EOF && s.stateless && len(common) == 0 {
+			// A deepening client asks for the new boundary on its own.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if flush {
+			if len(common) == 0 || multiAck {
+				if err := writePkt(s.w, []byte("NAK\n")); err != nil {
+					return err
+				}
+			}
+			// A stateless client sends the next round as a new request.
+			if s.stateless {
+				return nil
+			}
+			continue
+		}
+		line := trimNewline(string(data))
+		if line == "done" {
+			break
+		}
+		sha, ok := cutPrefix(line, "have ")
+		if !ok {
+			return fmt.Errorf("protocol error: expected have or done, got %q", line)
+		}
+		if !hasObject(s.localDir, sha) {
+			continue
+		}
+		common = append(common, sha)
+		// Without multi_ack only the first common commit is acknowledged.
+		if multiAck {
+			err = writePkt(s.w, []byte("ACK "+sha+" common\n"))
+		} else if len(common) == 1 {
+			err = writePkt(s.w, []byte("ACK "+sha+"\n"))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	var final string
+	switch {
+	case len(common) == 0:
+		final = "NAK\n"
+	case multiAck:
+		final = "ACK " + common[len(common)-1] + "\n"
+	}
+	if final != "" {
+		if err := writePkt(s.w, []byte(final)); err != nil {
+			return err
+		}
+	}
+	return s.sendPack(wants, common, capabilities, shallow, filter)
+}
+
+// What a client said about the shallow end of its history and how far to
+// deepen it.
+type shallowRequest struct {
+	Shallow map[string]bool // commits the client lacks the parents of
+	Deepen  deepenOptions
+
+	stop  map[string]bool // commits whose parents are not sent
+	wants []string        // parents of commits no longer shallow
+}
+
+func newShallowRequest() *shallowRequest {
+	return &shallowRequest{Shallow: make(map[string]bool)}
+}
+
+// Take a shallow or deepen line of a fetch request, reporting false for any
+// other line.
+func (q *shallowRequest) parse(line string) (bool, error) {
+	name, value, _ := strings.Cut(line, " ")
+	switch name {
+	case "shallow":
+		q.Shallow[value] = true
+	case "deepen":
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth <= 0 {
+			return true, fmt.Errorf("protocol error: invalid deepen: %s", value)
+		}
+		q.Deepen.Depth = depth
+	case "deepen-relative":
+		q.Deepen.Relative = true
+	case "deepen-since":
+		since, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || since == 0 {
+			return true, fmt.Errorf("protocol error: invalid deepen-since: %s", value)
+		}
+		q.Deepen.Since = since
+	case "deepen-not":
+		q.Deepen.Not = append(q.Deepen.Not, value)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Work out the client's new history boundary and return the shallow and
+// unshallow lines telling it so. Commits that stop being shallow have their
+// parents sent.
+// ref: https://git-scm.com/docs/pack-protocol#_shallow_clients
+func (s *uploadPackServer) deepen(wants []string, q *shallowRequest) ([]string, error) {
+	q.stop, q.wants = q.Shallow, nil
+	if !q.Deepen.requested() {
+		return nil, nil
+	}
+	boundary, reached, err := deepenBoundary(s.localDir, wants, q.Shallow, q.Deepen)
+	if err != nil {
+		writePkt(s.w, []byte("ERR "+err.Error()+"\n"))
+		return nil, err
+	}
+	var lines []string
+	q.stop = make(map[string]bool)
+	for _, sha := range sortedKeys(boundary) {
+		q.stop[sha] = true
+		if !q.Shallow[sha] {
+			lines = append(lines, "shallow "+sha)
+		}
+	}
+	for _, sha := range sortedKeys(q.Shallow) {
+		if !reached[sha] || boundary[sha] {
+			q.stop[sha] = true
+			continue
+		}
+		lines = append(lines, "unshallow "+sha)
+		commit, err := readCommit(s.localDir, sha)
+		if err != nil {
+			return nil, err
+		}
+		q.wants = append(q.wants, commit.Parents...)
+	}
+	return lines, nil
+}
+
+// Refuse wants that are not objects we have.
+func (s *uploadPackServer) checkWants(wants []string) error {
+	for _, sha := range wants {
+		if !hasObject(s.localDir, sha) {
+			writePkt(s.w, []byte("ERR upload-pack: not our ref "+sha+"\n"))
+			return fmt.Errorf("upload-pack: not our ref %s", sha)
+		}
+	}
+	return nil
+}
+
+// Send the objects wants need that the common commits do not have and the
+// filter lets through, on band 1 of a side-band stream when the client asked
+// for one.
+func (s *uploadPackServer) sendPack(wants, common []string, capabilities map[string]bool, shallow *shallowRequest, filter objectFilter) error {
+	tips := append(append([]string{}, wants...), shallow.wants...)
+	objects, err := objectsToPackShallow(s.localDir, tips, common, shallow.stop, shallow.Shallow, filter)
+	if err != nil {
+		return err
+	}
+	if capabilities["include-tag"] {
+		if objects, err = includeTags(s.localDir, objects); err != nil {
+			return err
+		}
+	}
+	options := defaultPackOptions
+	options.OfsDelta = capabilities["ofs-delta"]
+	var w io.Writer = s.w
+	sideBand := capabilities["side-band-64k"] || capabilities["side-band"]
+	switch {
+	case capabilities["side-band-64k"]:
+		w = newSideBandWriter(s.w, 1, maxPktPayload-1)
+	case capabilities["side-band"]:
+		w = newSideBandWriter(s.w, 1, 995)
+	}
+	buffered := bufio.NewWriterSize(w, maxPktPayload-1)
+	if _, _, err := writePack(buffered, s.localDir, objects, options); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	if sideBand {
+		return writeFlush(s.w)
+	}
+	return nil
+}
+
+// Add the annotated tags under refs/tags that point, possibly through other
+// tags, at an object being sent.
+// ref: https://git-scm.com/docs/protocol-capabilities#_include_tag
+func includeTags(localDir string, objects []packObject) ([]packObject, error) {
+	sent := make(map[string]bool)
+	for _, object := range objects {
+		sent[object.Sha] = true
+	}
+	refs, err := advertisedRefs(localDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if !strings.HasPrefix(ref.Name, "refs/tags/") || ref.Peeled == "" || sent[ref.Sha] {
+			continue
+		}
+		var chain []string
+		for sha := ref.Sha; !sent[sha]; {
+			objectType, content, err := readGitObject(localDir, sha)
+			if err != nil || objectType != "tag" {
+				chain = nil
+				break
+			}
+			chain = append(chain, sha)
+			target, _, _ := strings.Cut(string(content), "\n")
+			sha = strings.TrimPrefix(target, "object ")
+		}
+		for _, sha := range chain {
+			sent[sha] = true
+			objects = append(objects, packObject{Sha: sha})
+		}
+	}
+	return objects, nil
+}
+
+// Answer one v2 command, reporting done when the client hung up instead.
+func (s *uploadPackServer) serveCommand() (bool, error) {
+	data, flush, err := readPkt(s.r)
+	if err == io.EOF || flush {
+		return true, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	command, ok := cutPrefix(trimNewline(string(data)), "command=")
+	if !ok {
+		return true, fmt.Errorf("protocol error: expected command, got %q", data)
+	}
+	// Capabilities up to a delimiter, then arguments up to a flush.
+	var args []string
+	inArgs := false
+	for {
+		data, flush, err := readPkt(s.r)
+		if err != nil {
+			return true, err
+		}
+		if flush {
+			break
+		}
+		if data == nil {
+			inArgs = true
+		} else if inArgs {
+			args = append(args, trimNewline(string(data)))
+		}
+	}
+	switch command {
+	case "ls-refs":
+		return false, s.lsRefs(args)
+	case "fetch":
+		return false, s.fetch(args)
+	default:
+		writePkt(s.w, []byte("ERR unknown command "+command+"\n"))
+		return true, fmt.Errorf("unknown command %s", command)
+	}
+}
+
+func (s *uploadPackServer) lsRefs(args []string) error {
+	var prefixes []string
+	symrefs, peel := false, false
+	for _, arg := range args {
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peel = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		}
+	}
+	refs, err := advertisedRefs(s.localDir)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, ref := range refs {
+		if !hasAnyPrefix(ref.Name, prefixes) {
+			continue
+		}
+		line := ref.Sha + " " + ref.Name
+		if symrefs && ref.Symref != "" {
+			line += " symref-target:" + ref.Symref
+		}
+		if peel && ref.Peeled != "" {
+			line += " peeled:" + ref.Peeled
+		}
+		lines = append(lines, line)
+	}
+	return writePktLines(s.w, lines...)
+}
+
+// A v2 fetch: acknowledge haves until the client says done, then send the
+// pack in a packfile section.
+func (s *uploadPackServer) fetch(args []string) error {
+	var wants, common []string
+	capabilities := map[string]bool{"side-band-64k": true}
+	shallow := newShallowRequest()
+	var filter objectFilter
+	done := false
+	for _, arg := range args {
+		if ok, err := shallow.parse(arg); ok || err != nil {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(arg, "want "):
+			wants = append(wants, strings.TrimPrefix(arg, "want "))
+		case strings.HasPrefix(arg, "have "):
+			if sha := strings.TrimPrefix(arg, "have "); hasObject(s.localDir, sha) {
+				common = append(common, sha)
+			}
+		case strings.HasPrefix(arg, "filter "):
+			var err error
+			if filter, err = parseFilterSpec(strings.TrimPrefix(arg, "filter ")); err != nil {
+				return err
+			}
+		case arg == "done":
+			done = true
+		default:
+			capabilities[arg] = true
+		}
+	}
+	if err := s.checkWants(wants); err != nil {
+		return err
+	}
+	if !done {
+		lines := []string{"acknowledgments"}
+		for _, sha := range common {
+			lines = append(lines, "ACK "+sha)
+		}
+		if len(common) == 0 {
+			lines = append(lines, "NAK")
+		}
+		return writePktLines(s.w, lines...)
+	}
+	lines, err := s.deepen(wants, shallow)
+	if err != nil {
+		return err
+	}
+	if shallow.Deepen.requested() || len(shallow.Shallow) > 0 {
+		if err := writePkt(s.w, []byte("shallow-info\n")); err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if err := writePkt(s.w, []byte(line+"\n")); err != nil {
+				return err
+			}
+		}
+		if err := writeDelim(s.w); err != nil {
+			return err
+		}
+	}
+	if err := writePkt(s.w, []byte("packfile\n")); err != nil {
+		return err
+	}
+	return s.sendPack(wants, common, capabilities, shallow, filter)
+}